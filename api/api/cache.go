@@ -0,0 +1,354 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"github.com/equinor/oneseismic/api/internal/message"
+)
+
+/*
+ * The result cache maps queries to the pid of a process that computes (or
+ * has computed) the result, so that identical queries can share a process
+ * instead of scheduling new work. Interpretation tools tend to request the
+ * same popular lines over and over, so this saves a lot of planning, fetching
+ * and packing.
+ *
+ * The cache is stored in redis, next to the results, and entries are keyed
+ * by the cube (guid and manifest version), function and arguments, i.e.
+ * everything that determines the result. The fragment shape is picked by the
+ * planner from the manifest, so it is covered by the version. The manifest
+ * version is a hash of the manifest document, so any change to the cube gives
+ * new keys.
+ *
+ * The key is reserved for a process as soon as the query is planned, before
+ * it is scheduled, so that identical queries that arrive while the process is
+ * being scheduled share it too.
+ *
+ * Only the pid is cached - the result itself is the process' result stream,
+ * and the entry is only good as long as the process is. Looking up an entry
+ * for a process that has expired, failed or been cancelled is a miss, and
+ * removes the entry. A hit refreshes the expiration of the result, so that
+ * popular results stay available for as long as the cache entry lives.
+ *
+ * Users only get to look up results for cubes they can read, as resolving the
+ * cube reads the manifest on behalf of the user. Since a process handed out
+ * by the cache is shared between users, it is marked as such, and shared
+ * processes cannot be cancelled - that would kill the query of other users.
+ * This includes a user re-running their own query, as the cache does not know
+ * who owns a process. Enabling the cache therefore means giving up cancelling
+ * popular queries, which is why the query server only enables it on request.
+ *
+ * The cache is limited in two ways:
+ * - maxentries: the number of entries. When exceeded, the oldest entries
+ *   are evicted.
+ * - maxbytes: the size of a single result. Larger results are not cached,
+ *   since they are expensive to keep around and unlikely to be re-requested.
+ *
+ * A nil *ResultCache is a valid, disabled cache.
+ */
+type ResultCache struct {
+	storage    redis.Cmdable
+	ttl        time.Duration
+	maxentries int64
+	maxbytes   int64
+}
+
+/*
+ * The lifetime of the header and result stream of processes, as set by the
+ * scheduler and workers.
+ */
+const resultlifetime = 10 * time.Minute
+
+/*
+ * The lifetime of a reservation, i.e. an entry for a process that is not yet
+ * scheduled. It is short, so that a query server that dies while scheduling
+ * does not make identical queries wait for a process that never comes.
+ */
+const reservelifetime = time.Minute
+
+/*
+ * The prefix of the value of reserved entries, before the pid.
+ */
+const reserveprefix = "reserved/"
+
+/*
+ * The sorted set of cache entries, scored by insertion time, used for
+ * eviction.
+ */
+const cacheindex = "cache/index"
+
+/*
+ * Make a result cache with entries that live for ttl. A zero maxentries or
+ * maxbytes means no limit.
+ */
+func MakeResultCache(
+	storage    redis.Cmdable,
+	ttl        time.Duration,
+	maxentries int64,
+	maxbytes   int64,
+) *ResultCache {
+	return &ResultCache {
+		storage:    storage,
+		ttl:        ttl,
+		maxentries: maxentries,
+		maxbytes:   maxbytes,
+	}
+}
+
+/*
+ * The key of the marker for processes that have been handed out by the
+ * cache, and so may be shared by multiple users.
+ */
+func sharedkey(pid string) string {
+	return fmt.Sprintf("%s/shared", pid)
+}
+
+/*
+ * Make the cache key for a query. The arguments are serialized as json, which
+ * is stable for structs (fields are written in declaration order).
+ */
+func cachekey(
+	guid     string,
+	version  string,
+	function string,
+	args     interface{},
+) (string, error) {
+	doc, err := json.Marshal(struct {
+		Guid     string      `json:"guid"`
+		Version  string      `json:"version"`
+		Function string      `json:"function"`
+		Args     interface{} `json:"args"`
+	} {
+		Guid:     guid,
+		Version:  version,
+		Function: function,
+		Args:     args,
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to make cache key: %w", err)
+	}
+	sum := sha256.Sum256(doc)
+	return fmt.Sprintf("cache/%s", hex.EncodeToString(sum[:])), nil
+}
+
+/*
+ * Get the version of a manifest document, for use in cache keys.
+ */
+func manifestversion(doc []byte) string {
+	sum := sha256.Sum256(doc)
+	return hex.EncodeToString(sum[:])
+}
+
+/*
+ * Look up the pid of the process for key. Returns the empty string on a miss.
+ *
+ * The process is marked as shared before it is checked, so that it cannot be
+ * cancelled after the check, and before the caller gets it.
+ */
+func (rc *ResultCache) lookup(ctx context.Context, key string) (string, error) {
+	if rc == nil {
+		return "", nil
+	}
+
+	val, err := rc.storage.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	pid      := strings.TrimPrefix(val, reserveprefix)
+	reserved := pid != val
+
+	err = rc.storage.Set(ctx, sharedkey(pid), "", resultlifetime).Err()
+	if err != nil {
+		return "", err
+	}
+
+	alive, err := rc.alive(ctx, pid, reserved)
+	if err != nil {
+		return "", err
+	}
+	if !alive {
+		rc.storage.Del(ctx, key)
+		rc.storage.ZRem(ctx, cacheindex, key)
+		return "", nil
+	}
+
+	rc.storage.Expire(ctx, headerkey(pid), resultlifetime)
+	rc.storage.Expire(ctx, pid, resultlifetime)
+	rc.storage.Expire(ctx, message.PartsKey(pid), resultlifetime)
+	return pid, nil
+}
+
+/*
+ * Check that the process can still deliver its result, i.e. that it has not
+ * expired, been cancelled, or failed. A reserved process may not have written
+ * its header yet, so it is alive as long as it has not been stopped.
+ */
+func (rc *ResultCache) alive(
+	ctx      context.Context,
+	pid      string,
+	reserved bool,
+) (bool, error) {
+	n, err := rc.storage.Exists(ctx, headerkey(pid)).Result()
+	if err != nil || (n == 0 && !reserved) {
+		return false, err
+	}
+
+	cancelled, err := processCancelled(ctx, rc.storage, pid)
+	if err != nil || cancelled {
+		return false, err
+	}
+
+	failures, err := processFailures(ctx, rc.storage, pid)
+	if err != nil {
+		return false, err
+	}
+	return len(failures) == 0, nil
+}
+
+/*
+ * Reserve key for the process pid, which is planned but not yet scheduled.
+ * Returns the pid of the process that should serve the query - pid if the
+ * reservation succeeded, or if the result should not be cached, and the pid
+ * of the process that has already reserved or stored key otherwise.
+ */
+func (rc *ResultCache) reserve(
+	ctx  context.Context,
+	key  string,
+	pid  string,
+	plan *QueryPlan,
+) (string, error) {
+	if rc == nil {
+		return pid, nil
+	}
+
+	cacheable, err := rc.cacheable(plan)
+	if err != nil || !cacheable {
+		return pid, err
+	}
+
+	ok, err := rc.storage.SetNX(
+		ctx,
+		key,
+		reserveprefix + pid,
+		reservelifetime,
+	).Result()
+	if err != nil || ok {
+		return pid, err
+	}
+
+	/*
+	 * Some other process got the key first. It is possibly dead, in which
+	 * case the entry is removed, and this process runs uncached.
+	 */
+	owner, err := rc.lookup(ctx, key)
+	if err != nil || owner == "" {
+		return pid, err
+	}
+	return owner, nil
+}
+
+/*
+ * Check if the result of the plan is small enough to be cached.
+ */
+func (rc *ResultCache) cacheable(plan *QueryPlan) (bool, error) {
+	if rc.maxbytes <= 0 {
+		return true, nil
+	}
+	head, err := (&message.ProcessHeader{}).Unpack(plan.header)
+	if err != nil {
+		return false, fmt.Errorf("unable to parse process header: %w", err)
+	}
+	return resultsize(head) <= rc.maxbytes, nil
+}
+
+/*
+ * Store pid as the process for key. This should be called once the process
+ * has been scheduled, and replaces the reservation. Results larger than
+ * maxbytes are not stored.
+ */
+func (rc *ResultCache) store(
+	ctx  context.Context,
+	key  string,
+	pid  string,
+	plan *QueryPlan,
+) error {
+	if rc == nil {
+		return nil
+	}
+
+	cacheable, err := rc.cacheable(plan)
+	if err != nil || !cacheable {
+		return err
+	}
+
+	err = rc.storage.Set(ctx, key, pid, rc.ttl).Err()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	err = rc.storage.ZAdd(ctx, cacheindex, &redis.Z {
+		Score:  float64(now.UnixNano()),
+		Member: key,
+	}).Err()
+	if err != nil {
+		return err
+	}
+	return rc.evict(ctx, now)
+}
+
+/*
+ * Remove expired entries from the index, and evict the oldest entries when
+ * there are more than maxentries.
+ */
+func (rc *ResultCache) evict(ctx context.Context, now time.Time) error {
+	expired := fmt.Sprintf("(%d", now.Add(-rc.ttl).UnixNano())
+	err := rc.storage.ZRemRangeByScore(ctx, cacheindex, "-inf", expired).Err()
+	if err != nil {
+		return err
+	}
+
+	if rc.maxentries <= 0 {
+		return nil
+	}
+	n, err := rc.storage.ZCard(ctx, cacheindex).Result()
+	if err != nil {
+		return err
+	}
+	if n <= rc.maxentries {
+		return nil
+	}
+
+	oldest, err := rc.storage.ZPopMin(ctx, cacheindex, n - rc.maxentries).Result()
+	if err != nil {
+		return err
+	}
+	keys := make([]string, len(oldest))
+	for i, entry := range oldest {
+		keys[i] = entry.Member.(string)
+	}
+	return rc.storage.Del(ctx, keys...).Err()
+}
+
+/*
+ * The (padded) size in bytes of the result of the process, assuming 4-byte
+ * samples.
+ */
+func resultsize(head *message.ProcessHeader) int64 {
+	size := int64(4)
+	for _, dim := range head.Shape {
+		size *= int64(dim)
+	}
+	return size
+}
@@ -0,0 +1,233 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/equinor/oneseismic/api/internal/message"
+)
+
+/*
+ * Make a query plan with just a header for a result of the given shape
+ */
+func headerplan(t *testing.T, pid string, shape []int) *QueryPlan {
+	head := message.ProcessHeader {
+		Pid:      pid,
+		Function: "slice",
+		Ntasks:   1,
+		Shape:    shape,
+		Index:    make([][]float64, len(shape)),
+	}
+	doc, err := head.Pack()
+	assert.Nil(t, err)
+	return &QueryPlan { function: "slice", header: doc }
+}
+
+func TestCacheKeyDependsOnQuery(t *testing.T) {
+	args := sliceargs { Kind: "index", Dim: 0, Val: 1 }
+	key, err := cachekey("guid", "v1", "slice", args)
+	assert.Nil(t, err)
+
+	same, err := cachekey("guid", "v1", "slice", args)
+	assert.Nil(t, err)
+	assert.Equal(t, key, same)
+
+	others := []struct {
+		guid, version, function string
+		args interface{}
+	} {
+		{ "other", "v1", "slice",   args },
+		{ "guid",  "v2", "slice",   args },
+		{ "guid",  "v1", "curtain", args },
+		{ "guid",  "v1", "slice",   sliceargs { Kind: "index", Dim: 0, Val: 2 } },
+	}
+	for _, o := range others {
+		other, err := cachekey(o.guid, o.version, o.function, o.args)
+		assert.Nil(t, err)
+		assert.NotEqual(t, key, other)
+	}
+}
+
+func TestCacheHitForLiveProcess(t *testing.T) {
+	storage := testredis(t)
+	ctx := context.Background()
+	cache := MakeResultCache(storage, time.Minute, 0, 0)
+
+	pid, err := cache.lookup(ctx, "cache/key")
+	assert.Nil(t, err)
+	assert.Equal(t, "", pid)
+
+	putheader(t, storage, "pid", 1)
+	plan := headerplan(t, "pid", []int{ 2, 2 })
+	assert.Nil(t, cache.store(ctx, "cache/key", "pid", plan))
+
+	pid, err = cache.lookup(ctx, "cache/key")
+	assert.Nil(t, err)
+	assert.Equal(t, "pid", pid)
+}
+
+func TestCacheMissForStoppedProcess(t *testing.T) {
+	stop := map[string]func(t *testing.T, storage redis.Cmdable) {
+		"expired": func(t *testing.T, storage redis.Cmdable) {
+			storage.Del(context.Background(), headerkey("pid"))
+		},
+		"cancelled": func(t *testing.T, storage redis.Cmdable) {
+			key := message.CancelKey("pid")
+			storage.Set(context.Background(), key, "", 0)
+		},
+		"failed": func(t *testing.T, storage redis.Cmdable) {
+			putfailure(t, storage, message.Failure {
+				Pid:     "pid",
+				Part:    "0/1",
+				Kind:    "download",
+				Message: "failure",
+			})
+		},
+	}
+
+	for name, fn := range stop {
+		t.Run(name, func(t *testing.T) {
+			storage := testredis(t)
+			ctx := context.Background()
+			cache := MakeResultCache(storage, time.Minute, 0, 0)
+
+			putheader(t, storage, "pid", 1)
+			plan := headerplan(t, "pid", []int{ 2, 2 })
+			assert.Nil(t, cache.store(ctx, "cache/key", "pid", plan))
+			fn(t, storage)
+
+			pid, err := cache.lookup(ctx, "cache/key")
+			assert.Nil(t, err)
+			assert.Equal(t, "", pid)
+
+			n, err := storage.Exists(ctx, "cache/key").Result()
+			assert.Nil(t, err)
+			assert.Equal(t, int64(0), n)
+		})
+	}
+}
+
+func TestCacheReservationSharesPendingProcess(t *testing.T) {
+	storage := testredis(t)
+	ctx := context.Background()
+	cache := MakeResultCache(storage, time.Minute, 0, 0)
+
+	plan := headerplan(t, "pid-0", []int{ 2, 2 })
+	owner, err := cache.reserve(ctx, "cache/key", "pid-0", plan)
+	assert.Nil(t, err)
+	assert.Equal(t, "pid-0", owner)
+
+	// The header is not yet written, but the process is not stopped either
+	owner, err = cache.reserve(ctx, "cache/key", "pid-1", plan)
+	assert.Nil(t, err)
+	assert.Equal(t, "pid-0", owner)
+
+	pid, err := cache.lookup(ctx, "cache/key")
+	assert.Nil(t, err)
+	assert.Equal(t, "pid-0", pid)
+
+	putheader(t, storage, "pid-0", 1)
+	assert.Nil(t, cache.store(ctx, "cache/key", "pid-0", plan))
+	pid, err = cache.lookup(ctx, "cache/key")
+	assert.Nil(t, err)
+	assert.Equal(t, "pid-0", pid)
+}
+
+func TestCacheDoesNotReserveForFailedProcess(t *testing.T) {
+	storage := testredis(t)
+	ctx := context.Background()
+	cache := MakeResultCache(storage, time.Minute, 0, 0)
+
+	plan := headerplan(t, "pid-0", []int{ 2, 2 })
+	_, err := cache.reserve(ctx, "cache/key", "pid-0", plan)
+	assert.Nil(t, err)
+	putfailure(t, storage, message.Failure {
+		Pid:     "pid-0",
+		Part:    "",
+		Kind:    "schedule",
+		Message: "failure",
+	})
+
+	owner, err := cache.reserve(ctx, "cache/key", "pid-1", plan)
+	assert.Nil(t, err)
+	assert.Equal(t, "pid-1", owner)
+}
+
+func TestCachedProcessCannotBeCancelled(t *testing.T) {
+	storage := testredis(t)
+	ctx := context.Background()
+	cache := MakeResultCache(storage, time.Minute, 0, 0)
+	result := Result { Storage: storage }
+
+	putheader(t, storage, "pid", 1)
+	plan := headerplan(t, "pid", []int{ 2, 2 })
+	assert.Nil(t, cache.store(ctx, "cache/key", "pid", plan))
+
+	pid, err := cache.lookup(ctx, "cache/key")
+	assert.Nil(t, err)
+	assert.Equal(t, "pid", pid)
+
+	w := callresult(result.Cancel, "pid")
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	n, err := storage.Exists(ctx, message.CancelKey("pid"), headerkey("pid")).Result()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), n)
+}
+
+func TestCacheDoesNotStoreLargeResults(t *testing.T) {
+	storage := testredis(t)
+	ctx := context.Background()
+	cache := MakeResultCache(storage, time.Minute, 0, 16)
+
+	putheader(t, storage, "small", 1)
+	putheader(t, storage, "large", 1)
+	small := headerplan(t, "small", []int{ 2, 2 })
+	large := headerplan(t, "large", []int{ 2, 3 })
+	assert.Nil(t, cache.store(ctx, "cache/small", "small", small))
+	assert.Nil(t, cache.store(ctx, "cache/large", "large", large))
+
+	pid, err := cache.lookup(ctx, "cache/small")
+	assert.Nil(t, err)
+	assert.Equal(t, "small", pid)
+
+	pid, err = cache.lookup(ctx, "cache/large")
+	assert.Nil(t, err)
+	assert.Equal(t, "", pid)
+}
+
+func TestCacheEvictsOldestEntries(t *testing.T) {
+	storage := testredis(t)
+	ctx := context.Background()
+	cache := MakeResultCache(storage, time.Minute, 2, 0)
+
+	for _, pid := range []string{ "pid-0", "pid-1", "pid-2" } {
+		putheader(t, storage, pid, 1)
+		plan := headerplan(t, pid, []int{ 2, 2 })
+		assert.Nil(t, cache.store(ctx, "cache/" + pid, pid, plan))
+	}
+
+	pid, err := cache.lookup(ctx, "cache/pid-0")
+	assert.Nil(t, err)
+	assert.Equal(t, "", pid)
+
+	for _, want := range []string{ "pid-1", "pid-2" } {
+		pid, err := cache.lookup(ctx, "cache/" + want)
+		assert.Nil(t, err)
+		assert.Equal(t, want, pid)
+	}
+}
+
+func TestDisabledCacheAlwaysMisses(t *testing.T) {
+	var cache *ResultCache
+	ctx := context.Background()
+	assert.Nil(t, cache.store(ctx, "cache/key", "pid", nil))
+	pid, err := cache.lookup(ctx, "cache/key")
+	assert.Nil(t, err)
+	assert.Equal(t, "", pid)
+}
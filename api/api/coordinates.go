@@ -0,0 +1,467 @@
+package api
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/equinor/oneseismic/api/internal/blobstore"
+	"github.com/equinor/oneseismic/api/internal/message"
+	"github.com/equinor/oneseismic/api/internal/util"
+)
+
+/*
+ * Curtains by world coordinates
+ * -----------------------------
+ * The curtain function takes (inline, crossline) pairs, but well planning and
+ * most other tools work in world coordinates (UTM, or the CDP coordinates of
+ * the survey). The world coordinates of every trace are stored as a tiled
+ * attribute of the cube, described by an attribute of type utm (or cdp) in
+ * the manifest:
+ *
+ *     <prefix>/<s0>-<s1>/<i>-<j>.f64
+ *
+ * where every tile holds the (x, y) of s0 * s1 traces, row-major, as little
+ * endian doubles. Tiles at the edges of the survey are padded.
+ *
+ * Seismic surveys are regular grids, so the survey geometry is an affine map
+ * between grid positions and world coordinates, which is fitted to the world
+ * coordinates of a handful of traces spread across the survey. Traces that
+ * are missing from the input are written at (0, 0) by upload, so those are
+ * left out of the fit, and the fit is rejected if the remaining traces do not
+ * agree on a regular grid. The points of the curtain are
+ * mapped to (fractional) grid positions, and resolved to either the nearest
+ * trace, or the (up to) four surrounding traces and their bilinear weights.
+ * The traces are fetched as a regular curtain, and the process header
+ * describes how the points are made from the traces.
+ */
+
+/*
+ * The affine map from the (fractional, 0-based) grid position (i, j) to the
+ * world position (x, y):
+ *
+ *     (x, y) = origin + i * inline + j * crossline
+ */
+type surveygeometry struct {
+	origin    [2]float64
+	inline    [2]float64
+	crossline [2]float64
+}
+
+func (g *surveygeometry) world(i, j float64) [2]float64 {
+	return [2]float64 {
+		g.origin[0] + i * g.inline[0] + j * g.crossline[0],
+		g.origin[1] + i * g.inline[1] + j * g.crossline[1],
+	}
+}
+
+/*
+ * The (fractional) grid position of the world position (x, y)
+ */
+func (g *surveygeometry) grid(x, y float64) (float64, float64, error) {
+	det := g.inline[0] * g.crossline[1] - g.inline[1] * g.crossline[0]
+	if det == 0 {
+		return 0, 0, errors.New("degenerate survey geometry")
+	}
+	dx := x - g.origin[0]
+	dy := y - g.origin[1]
+	i := (dx * g.crossline[1] - dy * g.crossline[0]) / det
+	j := (dy * g.inline[0]    - dx * g.inline[1])    / det
+	return i, j, nil
+}
+
+/*
+ * The attribute description, as stored in the manifest
+ */
+type attributedesc struct {
+	Prefix string     `json:"prefix"`
+	Ext    string     `json:"file-extension"`
+	Type   string     `json:"type"`
+	Layout string     `json:"layout"`
+	Labels []string   `json:"labels"`
+	Shapes [][]int    `json:"shapes"`
+}
+
+/*
+ * The attributes described by the manifest
+ */
+func manifestAttributes(manifest map[string]interface{}) ([]attributedesc, error) {
+	doc, err := json.Marshal(manifest["attributes"])
+	if err != nil {
+		return nil, err
+	}
+	var attrs []attributedesc
+	if err := json.Unmarshal(doc, &attrs); err != nil {
+		return nil, fmt.Errorf("bad attributes in manifest: %w", err)
+	}
+	return attrs, nil
+}
+
+/*
+ * Find the world coordinates attribute in the manifest, preferring utm over
+ * cdp coordinates.
+ */
+func coordinateAttribute(manifest map[string]interface{}) (*attributedesc, error) {
+	attrs, err := manifestAttributes(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, kind := range []string{ "utm", "cdp" } {
+		for _, attr := range attrs {
+			if attr.Type != kind {
+				continue
+			}
+			if attr.Layout != "tiled" || attr.Ext != "f64" {
+				continue
+			}
+			if len(attr.Shapes) == 0 || len(attr.Shapes[0]) != 2 {
+				continue
+			}
+			if len(attr.Labels) != 2 {
+				continue
+			}
+			return &attr, nil
+		}
+	}
+	return nil, errors.New("cube has no world coordinates")
+}
+
+/*
+ * Read the world (x, y) position of the traces at the grid positions. The
+ * fetch function gets a blob from the cube by its name. Every trace has one
+ * value per label, of which (x, y) are the first two.
+ */
+func readCoordinates(
+	ctx       context.Context,
+	attr      *attributedesc,
+	fetch     func(context.Context, string) ([]byte, error),
+	positions [][2]int,
+) ([][2]float64, error) {
+	s0 := attr.Shapes[0][0]
+	s1 := attr.Shapes[0][1]
+	nvalues := len(attr.Labels)
+	if nvalues < 2 {
+		msg := "%s: expected (x, y) labels, was %v"
+		return nil, fmt.Errorf(msg, attr.Prefix, attr.Labels)
+	}
+	tiles := make(map[string][]byte)
+
+	coordinates := make([][2]float64, len(positions))
+	for n, pos := range positions {
+		id := fmt.Sprintf(
+			"%s/%d-%d/%d-%d.%s",
+			attr.Prefix,
+			s0, s1,
+			pos[0] / s0, pos[1] / s1,
+			attr.Ext,
+		)
+		tile, ok := tiles[id]
+		if !ok {
+			var err error
+			tile, err = fetch(ctx, id)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read %s: %w", id, err)
+			}
+			tiles[id] = tile
+		}
+
+		offset := ((pos[0] % s0) * s1 + (pos[1] % s1)) * nvalues * 8
+		if offset + nvalues * 8 > len(tile) {
+			return nil, fmt.Errorf("%s: truncated tile", id)
+		}
+		for k := 0; k < 2; k++ {
+			bits := binary.LittleEndian.Uint64(tile[offset + k * 8:])
+			coordinates[n][k] = math.Float64frombits(bits)
+		}
+	}
+	return coordinates, nil
+}
+
+/*
+ * The number of lines in each direction that are sampled to fit the survey
+ * geometry. The corners, the middle of the edges and the centre of the survey
+ * are enough to fit the geometry when some of them are dead, without reading
+ * too many tiles.
+ */
+const geometrysamples = 3
+
+/*
+ * Make the survey geometry from the world coordinates of a few traces spread
+ * across the survey, which is n0 by n1 traces.
+ */
+func readGeometry(
+	ctx   context.Context,
+	attr  *attributedesc,
+	fetch func(context.Context, string) ([]byte, error),
+	n0    int,
+	n1    int,
+) (*surveygeometry, error) {
+	if n0 < 2 || n1 < 2 {
+		return nil, errors.New("survey geometry needs at least 2 lines")
+	}
+
+	lines := func(n int) []int {
+		xs := make([]int, 0, geometrysamples)
+		for k := 0; k < geometrysamples; k++ {
+			x := k * (n - 1) / (geometrysamples - 1)
+			if len(xs) == 0 || xs[len(xs) - 1] != x {
+				xs = append(xs, x)
+			}
+		}
+		return xs
+	}
+	var positions [][2]int
+	for _, i := range lines(n0) {
+		for _, j := range lines(n1) {
+			positions = append(positions, [2]int{ i, j })
+		}
+	}
+
+	coordinates, err := readCoordinates(ctx, attr, fetch, positions)
+	if err != nil {
+		return nil, err
+	}
+	return fitGeometry(positions, coordinates)
+}
+
+/*
+ * Fit the survey geometry to the world coordinates of the traces at the grid
+ * positions with least squares. Traces at (0, 0) are dead and ignored. The
+ * fit fails unless there are at least three live traces that are not on the
+ * same line, and every live trace is within a quarter line of the fitted
+ * grid.
+ */
+func fitGeometry(
+	positions   [][2]int,
+	coordinates [][2]float64,
+) (*surveygeometry, error) {
+	/*
+	 * The normal equations (A^T A) p = A^T b of the design matrix A with the
+	 * rows (1, i, j), for p = (origin, inline, crossline) of x and y.
+	 */
+	var ata [3][3]float64
+	var atb [3][2]float64
+	live := 0
+	for n, pos := range positions {
+		x := coordinates[n]
+		if x[0] == 0 && x[1] == 0 {
+			continue
+		}
+		live++
+		row := [3]float64{ 1, float64(pos[0]), float64(pos[1]) }
+		for r := 0; r < 3; r++ {
+			for c := 0; c < 3; c++ {
+				ata[r][c] += row[r] * row[c]
+			}
+			atb[r][0] += row[r] * x[0]
+			atb[r][1] += row[r] * x[1]
+		}
+	}
+
+	det := func(m [3][3]float64) float64 {
+		return m[0][0] * (m[1][1] * m[2][2] - m[1][2] * m[2][1]) -
+		       m[0][1] * (m[1][0] * m[2][2] - m[1][2] * m[2][0]) +
+		       m[0][2] * (m[1][0] * m[2][1] - m[1][1] * m[2][0])
+	}
+	/*
+	 * Live traces on a single line give a singular system. The determinant
+	 * is compared to the scale of the system, as it grows with the number
+	 * of lines.
+	 */
+	d     := det(ata)
+	scale := ata[0][0] * ata[1][1] * ata[2][2]
+	if live < 3 || math.Abs(d) <= 1e-9 * scale {
+		msg := "survey geometry: too few live traces (= %d) to fit"
+		return nil, fmt.Errorf(msg, live)
+	}
+
+	/*
+	 * Cramer's rule, one column of the parameters at a time
+	 */
+	var p [3][2]float64
+	for k := 0; k < 2; k++ {
+		for c := 0; c < 3; c++ {
+			m := ata
+			for r := 0; r < 3; r++ {
+				m[r][c] = atb[r][k]
+			}
+			p[c][k] = det(m) / d
+		}
+	}
+	g := &surveygeometry {
+		origin:    [2]float64{ p[0][0], p[0][1] },
+		inline:    [2]float64{ p[1][0], p[1][1] },
+		crossline: [2]float64{ p[2][0], p[2][1] },
+	}
+
+	for n, pos := range positions {
+		x := coordinates[n]
+		if x[0] == 0 && x[1] == 0 {
+			continue
+		}
+		i, j, err := g.grid(x[0], x[1])
+		if err != nil {
+			return nil, fmt.Errorf("survey geometry: %w", err)
+		}
+		off := math.Max(math.Abs(i - float64(pos[0])), math.Abs(j - float64(pos[1])))
+		if off > 0.25 {
+			msg := "survey geometry: trace (%d, %d) at (%v, %v) is not on " +
+				"a regular grid"
+			return nil, fmt.Errorf(msg, pos[0], pos[1], x[0], x[1])
+		}
+	}
+	return g, nil
+}
+
+/*
+ * The curtain query for points in world coordinates. This is a regular
+ * curtain of the traces that make up the points, and the positions, traces
+ * and weights that are added to the process header.
+ */
+type coordinatecurtain struct {
+	curtainargs
+	Interpolation string      `json:"interpolation"`
+	Positions     [][]float64 `json:"positions"`
+	Traces        [][]int     `json:"traces"`
+	Weights       [][]float64 `json:"weights"`
+}
+
+func (q *coordinatecurtain) decorate(head *message.ProcessHeader) {
+	head.Positions = q.Positions
+	head.Traces    = q.Traces
+	head.Weights   = q.Weights
+}
+
+/*
+ * Resolve the points (x, y) to the traces of the survey with line numbers
+ * linenos. The interpolation is either nearest (the nearest trace) or linear
+ * (bilinear interpolation of the surrounding traces). Points more than half a
+ * line outside the survey are not found.
+ */
+func resolveCoordinates(
+	g             *surveygeometry,
+	linenos       [][]int32,
+	points        [][]float64,
+	interpolation string,
+) (*coordinatecurtain, error) {
+	if interpolation != "nearest" && interpolation != "linear" {
+		msg := "interpolation (= %s) not one of nearest, linear"
+		return nil, fmt.Errorf(msg, interpolation)
+	}
+	n0 := len(linenos[0])
+	n1 := len(linenos[1])
+
+	q := &coordinatecurtain { Interpolation: interpolation }
+	traces := make(map[[2]int]int)
+	use := func(i, j int) int {
+		if t, ok := traces[[2]int{ i, j }]; ok {
+			return t
+		}
+		t := len(q.Coords)
+		traces[[2]int{ i, j }] = t
+		q.Coords = append(q.Coords, []int32{ linenos[0][i], linenos[1][j] })
+		return t
+	}
+	/*
+	 * Clamp x to the survey, and snap it to the nearest line if it is
+	 * within rounding error of it, so that points on a line only use the
+	 * traces of that line.
+	 */
+	clamp := func(x float64, n int) float64 {
+		if math.Abs(x - math.Round(x)) < 1e-9 {
+			x = math.Round(x)
+		}
+		return math.Max(0, math.Min(x, float64(n - 1)))
+	}
+
+	for n, point := range points {
+		if len(point) != 2 {
+			return nil, fmt.Errorf("points[%d]: expected (x, y)", n)
+		}
+		fi, fj, err := g.grid(point[0], point[1])
+		if err != nil {
+			return nil, err
+		}
+		outside := fi < -0.5 || fi > float64(n0) - 0.5 ||
+		           fj < -0.5 || fj > float64(n1) - 0.5
+		if outside {
+			msg := "point (= (%v, %v)) is outside the survey"
+			return nil, fmt.Errorf(msg, point[0], point[1])
+		}
+		fi = clamp(fi, n0)
+		fj = clamp(fj, n1)
+
+		var ts []int
+		var ws []float64
+		var pos [2]float64
+		if interpolation == "nearest" {
+			i := math.Round(fi)
+			j := math.Round(fj)
+			ts = []int{ use(int(i), int(j)) }
+			ws = []float64{ 1 }
+			pos = g.world(i, j)
+		} else {
+			i0 := int(math.Min(math.Floor(fi), float64(n0 - 2)))
+			j0 := int(math.Min(math.Floor(fj), float64(n1 - 2)))
+			a := fi - float64(i0)
+			b := fj - float64(j0)
+			corners := []struct { i, j int; w float64 } {
+				{ i0,     j0,     (1 - a) * (1 - b) },
+				{ i0 + 1, j0,     a       * (1 - b) },
+				{ i0,     j0 + 1, (1 - a) * b       },
+				{ i0 + 1, j0 + 1, a       * b       },
+			}
+			for _, c := range corners {
+				if c.w == 0 {
+					continue
+				}
+				ts = append(ts, use(c.i, c.j))
+				ws = append(ws, c.w)
+			}
+			pos = g.world(fi, fj)
+		}
+		q.Positions = append(q.Positions, []float64{ pos[0], pos[1] })
+		q.Traces    = append(q.Traces, ts)
+		q.Weights   = append(q.Weights, ws)
+	}
+	return q, nil
+}
+
+/*
+ * The survey geometry of the cube, made from its world coordinates attribute.
+ */
+func (c *cube) geometry(ctx context.Context) (*surveygeometry, error) {
+	attr, err := coordinateAttribute(c.manifest)
+	if err != nil {
+		return nil, err
+	}
+	linenos, err := c.Linenumbers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := ctx.Value("keys").(map[string]string)
+	auth := keys["Authorization"]
+	fetch := func(ctx context.Context, id string) ([]byte, error) {
+		blob, err := util.WithOnbehalfAndRetry(
+			c.root.tokens,
+			auth,
+			func (tok string) (interface{}, error) {
+				store, err := blobstore.Open(c.root.endpoint, tok)
+				if err != nil {
+					return nil, err
+				}
+				return store.Container(string(c.id)).Fragment(ctx, id)
+			},
+		)
+		if err != nil {
+			return nil, err
+		}
+		return blob.([]byte), nil
+	}
+	return readGeometry(ctx, attr, fetch, len(linenos[0]), len(linenos[1]))
+}
@@ -0,0 +1,279 @@
+package api
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/equinor/oneseismic/api/internal/blobstore"
+)
+
+/*
+ * A rotated survey, where the inlines go north-east and crosslines go
+ * north-west, 25m apart.
+ */
+func rotatedsurvey() *surveygeometry {
+	s := 25 / math.Sqrt2
+	return &surveygeometry {
+		origin:    [2]float64{ 1000, 2000 },
+		inline:    [2]float64{ s,  s },
+		crossline: [2]float64{ -s, s },
+	}
+}
+
+func TestSurveyGeometryRoundTrips(t *testing.T) {
+	g := rotatedsurvey()
+	for _, pos := range [][2]float64{ { 0, 0 }, { 3, 4 }, { 1.5, 0.25 } } {
+		world := g.world(pos[0], pos[1])
+		i, j, err := g.grid(world[0], world[1])
+		assert.Nil(t, err)
+		assert.InDelta(t, pos[0], i, 1e-9)
+		assert.InDelta(t, pos[1], j, 1e-9)
+	}
+}
+
+/*
+ * Make the tiles of a world coordinates attribute for a survey of n0 by n1
+ * traces, in tiles of s0 by s1
+ */
+func coordinatetiles(
+	g      *surveygeometry,
+	prefix string,
+	n0, n1 int,
+	s0, s1 int,
+) map[string][]byte {
+	tiles := make(map[string][]byte)
+	for i := 0; i < n0; i++ {
+		for j := 0; j < n1; j++ {
+			id := fmt.Sprintf("%s/%d-%d/%d-%d.f64", prefix, s0, s1, i/s0, j/s1)
+			if _, ok := tiles[id]; !ok {
+				tiles[id] = make([]byte, s0 * s1 * 2 * 8)
+			}
+			pos := g.world(float64(i), float64(j))
+			off := ((i % s0) * s1 + (j % s1)) * 16
+			binary.LittleEndian.PutUint64(tiles[id][off:],   math.Float64bits(pos[0]))
+			binary.LittleEndian.PutUint64(tiles[id][off+8:], math.Float64bits(pos[1]))
+		}
+	}
+	return tiles
+}
+
+func TestReadGeometryFromAttributeTiles(t *testing.T) {
+	g := rotatedsurvey()
+	tiles := coordinatetiles(g, "attributes/cdp", 5, 7, 2, 3)
+	fetch := func(ctx context.Context, id string) ([]byte, error) {
+		tile, ok := tiles[id]
+		if !ok {
+			return nil, blobstore.ErrNotFound
+		}
+		return tile, nil
+	}
+	attr := &attributedesc {
+		Prefix: "attributes/cdp",
+		Ext:    "f64",
+		Type:   "cdp",
+		Layout: "tiled",
+		Labels: []string{ "cdpx", "cdpy" },
+		Shapes: [][]int{ { 2, 3 } },
+	}
+
+	read, err := readGeometry(context.Background(), attr, fetch, 5, 7)
+	assert.Nil(t, err)
+	for k := 0; k < 2; k++ {
+		assert.InDelta(t, g.origin[k],    read.origin[k],    1e-9)
+		assert.InDelta(t, g.inline[k],    read.inline[k],    1e-9)
+		assert.InDelta(t, g.crossline[k], read.crossline[k], 1e-9)
+	}
+}
+
+func TestReadGeometryIgnoresDeadTraces(t *testing.T) {
+	g := rotatedsurvey()
+	tiles := coordinatetiles(g, "attributes/cdp", 5, 7, 2, 3)
+	/*
+	 * Kill the first trace, which is the origin, like upload does for traces
+	 * that are missing from the input
+	 */
+	tile := tiles["attributes/cdp/2-3/0-0.f64"]
+	for k := 0; k < 16; k++ {
+		tile[k] = 0
+	}
+	fetch := func(ctx context.Context, id string) ([]byte, error) {
+		tile, ok := tiles[id]
+		if !ok {
+			return nil, blobstore.ErrNotFound
+		}
+		return tile, nil
+	}
+	attr := &attributedesc {
+		Prefix: "attributes/cdp",
+		Ext:    "f64",
+		Type:   "cdp",
+		Layout: "tiled",
+		Labels: []string{ "cdpx", "cdpy" },
+		Shapes: [][]int{ { 2, 3 } },
+	}
+
+	read, err := readGeometry(context.Background(), attr, fetch, 5, 7)
+	assert.Nil(t, err)
+	for k := 0; k < 2; k++ {
+		assert.InDelta(t, g.origin[k],    read.origin[k],    1e-9)
+		assert.InDelta(t, g.inline[k],    read.inline[k],    1e-9)
+		assert.InDelta(t, g.crossline[k], read.crossline[k], 1e-9)
+	}
+}
+
+func TestFitGeometryRejectsIrregularTraces(t *testing.T) {
+	g := rotatedsurvey()
+	var positions [][2]int
+	var coordinates [][2]float64
+	for _, pos := range [][2]int{ { 0, 0 }, { 4, 0 }, { 0, 6 }, { 4, 6 } } {
+		positions   = append(positions, pos)
+		coordinates = append(
+			coordinates,
+			g.world(float64(pos[0]), float64(pos[1])),
+		)
+	}
+	coordinates[3] = [2]float64{ 1, 1 }
+	_, err := fitGeometry(positions, coordinates)
+	assert.NotNil(t, err)
+
+	coordinates[1] = [2]float64{ 0, 0 }
+	coordinates[2] = [2]float64{ 0, 0 }
+	coordinates[3] = [2]float64{ 0, 0 }
+	_, err = fitGeometry(positions, coordinates)
+	assert.NotNil(t, err)
+}
+
+func TestCoordinateAttributePrefersUTM(t *testing.T) {
+	manifest := map[string]interface{} {
+		"attributes": []interface{} {
+			map[string]interface{} {
+				"prefix":         "attributes/cdp",
+				"file-extension": "f64",
+				"type":           "cdp",
+				"layout":         "tiled",
+				"labels":         []string{ "cdpx", "cdpy" },
+				"shapes":         [][]int{ { 64, 64 } },
+			},
+			map[string]interface{} {
+				"prefix":         "attributes/utm",
+				"file-extension": "f64",
+				"type":           "utm",
+				"layout":         "tiled",
+				"labels":         []string{ "utmx", "utmy" },
+				"shapes":         [][]int{ { 64, 64 } },
+			},
+		},
+	}
+	attr, err := coordinateAttribute(manifest)
+	assert.Nil(t, err)
+	assert.Equal(t, "attributes/utm", attr.Prefix)
+
+	_, err = coordinateAttribute(map[string]interface{} {
+		"attributes": []interface{}{},
+	})
+	assert.NotNil(t, err)
+
+	_, err = coordinateAttribute(map[string]interface{} {
+		"attributes": []interface{} {
+			map[string]interface{} {
+				"prefix":         "attributes/utm",
+				"file-extension": "f64",
+				"type":           "utm",
+				"layout":         "tiled",
+				"labels":         []string{ "utmx" },
+				"shapes":         [][]int{ { 64, 64 } },
+			},
+		},
+	})
+	assert.NotNil(t, err)
+}
+
+func TestResolveCoordinatesToNearestTrace(t *testing.T) {
+	g := rotatedsurvey()
+	linenos := [][]int32{ { 10, 11, 12, 13 }, { 100, 102, 104 } }
+
+	nearby := g.world(1.2, 1.9)
+	again  := g.world(0.8, 2.1)
+	points := [][]float64{
+		{ nearby[0], nearby[1] },
+		{ again[0],  again[1] },
+	}
+	q, err := resolveCoordinates(g, linenos, points, "nearest")
+	assert.Nil(t, err)
+	assert.Equal(t, [][]int32{ { 11, 104 } }, q.Coords)
+	assert.Equal(t, [][]int{ { 0 }, { 0 } }, q.Traces)
+	assert.Equal(t, [][]float64{ { 1 }, { 1 } }, q.Weights)
+
+	used := g.world(1, 2)
+	assert.InDelta(t, used[0], q.Positions[0][0], 1e-9)
+	assert.InDelta(t, used[1], q.Positions[0][1], 1e-9)
+}
+
+func TestResolveCoordinatesInterpolatesLinearly(t *testing.T) {
+	g := rotatedsurvey()
+	linenos := [][]int32{ { 10, 11, 12, 13 }, { 100, 102, 104 } }
+
+	point := g.world(1.25, 0.5)
+	q, err := resolveCoordinates(
+		g,
+		linenos,
+		[][]float64{ { point[0], point[1] } },
+		"linear",
+	)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]int32{
+		{ 11, 100 },
+		{ 12, 100 },
+		{ 11, 102 },
+		{ 12, 102 },
+	}, q.Coords)
+	assert.Equal(t, [][]int{ { 0, 1, 2, 3 } }, q.Traces)
+	expected := []float64{ 0.375, 0.125, 0.375, 0.125 }
+	for k, w := range expected {
+		assert.InDelta(t, w, q.Weights[0][k], 1e-9)
+	}
+	assert.InDelta(t, point[0], q.Positions[0][0], 1e-9)
+	assert.InDelta(t, point[1], q.Positions[0][1], 1e-9)
+
+	/*
+	 * Points on a trace only use that trace
+	 */
+	edge := g.world(3, 2)
+	q, err = resolveCoordinates(
+		g,
+		linenos,
+		[][]float64{ { edge[0], edge[1] } },
+		"linear",
+	)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]int32{ { 13, 104 } }, q.Coords)
+	assert.Equal(t, 1.0, q.Weights[0][0])
+}
+
+func TestResolveCoordinatesOutsideSurveyFails(t *testing.T) {
+	g := rotatedsurvey()
+	linenos := [][]int32{ { 10, 11, 12, 13 }, { 100, 102, 104 } }
+
+	outside := g.world(-1, 1)
+	_, err := resolveCoordinates(
+		g,
+		linenos,
+		[][]float64{ { outside[0], outside[1] } },
+		"nearest",
+	)
+	assert.NotNil(t, err)
+
+	_, err = resolveCoordinates(g, linenos, [][]float64{ { 1000, 2000 } }, "cubic")
+	assert.NotNil(t, err)
+}
+
+func TestGraphQLSchemaMatchesResolvers(t *testing.T) {
+	assert.NotPanics(t, func() {
+		MakeGraphQL(nil, "", nil, nil, nil, TaskSize { Size: 10 })
+	})
+}
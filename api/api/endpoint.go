@@ -11,6 +11,7 @@ type BasicEndpoint struct {
 	keyring  *auth.Keyring
 	tokens   auth.Tokens
 	sched    scheduler
+	cache    *ResultCache
 }
 
 func MakeBasicEndpoint(
@@ -18,6 +19,8 @@ func MakeBasicEndpoint(
 	endpoint string,
 	storage  redis.Cmdable,
 	tokens   auth.Tokens,
+	cache    *ResultCache,
+	tasksize TaskSize,
 ) BasicEndpoint {
 	return BasicEndpoint {
 		endpoint: endpoint,
@@ -27,6 +30,7 @@ func MakeBasicEndpoint(
 		 * Scheduler should probably be exported (and in internal/?) and be
 		 * constructed directly by the caller.
 		 */
-		sched:   newScheduler(storage),
+		sched:   newScheduler(storage, tasksize),
+		cache:   cache,
 	}
 }
@@ -2,20 +2,26 @@ package api
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"net/http"
-	"net/url"
+	"regexp"
 
 	"github.com/gin-gonic/gin"
 	graphql "github.com/graph-gophers/graphql-go"
 	"github.com/go-redis/redis/v8"
-	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
 
 	"github.com/equinor/oneseismic/api/internal/auth"
+	"github.com/equinor/oneseismic/api/internal/blobstore"
+	"github.com/equinor/oneseismic/api/internal/logging"
 	"github.com/equinor/oneseismic/api/internal/message"
+	"github.com/equinor/oneseismic/api/internal/tracing"
 	"github.com/equinor/oneseismic/api/internal/util"
 )
 
@@ -30,32 +36,36 @@ type cube struct {
 	id       graphql.ID
 	root     *resolver
 	manifest map[string]interface{}
+	/*
+	 * The version of the manifest, for keying the result cache
+	 */
+	version  string
 }
 type promise struct {
 	url string
 	key string
 }
+type attr struct {
+	desc attributedesc
+}
 
 func (r *resolver) Cubes(ctx context.Context) ([]graphql.ID, error) {
 	keys := ctx.Value("keys").(map[string]string)
-	pid  := keys["pid"]
 	auth := keys["Authorization"]
 
-	endpoint, err := url.Parse(r.endpoint)
-	if err != nil {
-		log.Printf("pid=%s %v", pid, err)
-		return nil, err
-	}
-
 	cubes, err := util.WithOnbehalfAndRetry(
 		r.tokens,
 		auth,
 		func (tok string) (interface{}, error) {
-			return util.ListCubes(ctx, endpoint, tok)
+			store, err := blobstore.Open(r.endpoint, tok)
+			if err != nil {
+				return nil, err
+			}
+			return store.ListCubes(ctx)
 		},
 	)
 	if err != nil {
-		log.Printf("pid=%s, %v", pid, err)
+		logging.FromContext(ctx).Error().Err(err).Msg("unable to list cubes")
 		return nil, err
 	}
 
@@ -70,10 +80,19 @@ func (r *resolver) Cubes(ctx context.Context) ([]graphql.ID, error) {
 func (r *resolver) Cube(
 	ctx context.Context,
 	args struct { Id graphql.ID },
-) (*cube, error) {
+) (c *cube, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "resolver.Cube")
+	span.SetAttributes(attribute.String(logging.Guid, string(args.Id)))
+	defer func() {
+		tracing.Fail(span, err)
+		span.End()
+	}()
+
 	keys := ctx.Value("keys").(map[string]string)
-	pid  := keys["pid"]
 	auth := keys["Authorization"]
+	logger := logging.FromContext(ctx).With().
+		Str(logging.Guid, string(args.Id)).
+		Logger()
 
 	doc, err := getManifest(
 		ctx,
@@ -83,13 +102,13 @@ func (r *resolver) Cube(
 		auth,
 	)
 	if err != nil {
-		log.Printf("pid=%s %v", pid, err)
+		logger.Warn().Err(err).Msg("unable to get manifest")
 		return nil, err
 	}
 
 	manifest, err := manifestAsMap(doc)
 	if err != nil {
-		log.Printf("pid=%s %v", pid, err)
+		logger.Error().Err(err).Msg("bad manifest")
 		return nil, err
 	}
 
@@ -97,6 +116,7 @@ func (r *resolver) Cube(
 		id:       args.Id,
 		root:     r,
 		manifest: manifest,
+		version:  manifestversion(doc),
 	}, nil
 }
 
@@ -139,13 +159,9 @@ func asSliceSliceInt32(root interface{}) ([][]int32, error) {
 func (c *cube) Linenumbers(ctx context.Context) ([][]int32, error) {
 	doc, ok := c.manifest["line-numbers"]
 	if !ok {
-		keys := ctx.Value("keys").(map[string]string)
-		pid  := keys["pid"]
-		log.Printf(
-			"pid=%s %s/manifest.json broken; no dimensions",
-			pid,
-			string(c.id),
-		)
+		logging.FromContext(ctx).Error().
+			Str(logging.Guid, string(c.id)).
+			Msg("manifest.json broken; no dimensions")
 		return nil, errors.New("internal error; bad document")
 	}
 	linenos, err := asSliceSliceInt32(doc)
@@ -168,70 +184,185 @@ func getManifest(
 	guid     string,
 	auth     string,
 ) ([]byte, error) {
-	container, err := url.Parse(fmt.Sprintf("%s/%s", endpoint, guid))
-	if err != nil {
-		return nil, err
-	}
-
 	manifest, err := util.WithOnbehalfAndRetry(
 		tokens,
 		auth,
 		func (tok string) (interface{}, error) {
-			return util.FetchManifest(ctx, tok, container)
+			store, err := blobstore.Open(endpoint, tok)
+			if err != nil {
+				return nil, err
+			}
+			return store.Container(guid).Manifest(ctx)
 		},
 	)
 	if err != nil {
-		switch e := err.(type) {
-		case azblob.StorageError:
-			sc := e.Response()
-			if sc.StatusCode == http.StatusNotFound {
-				// TODO: add guid as a part of the error message?
-				return nil, errors.New("Not found")
-			}
-			return nil, errors.New("Internal error")
+		if errors.Is(err, blobstore.ErrNotFound) {
+			// TODO: add guid as a part of the error message?
+			return nil, errors.New("Not found")
 		}
-		return nil, err
+		logging.FromContext(ctx).Error().
+			Err(err).
+			Str(logging.Guid, guid).
+			Msg("unable to get manifest.json")
+		return nil, errors.New("Internal error")
 	}
 
 	return manifest.([]byte), nil
 }
 
+/*
+ * The sample values (time or depth) of the vertical axis, in milliseconds (or
+ * metres). Older manifests do not have the sample-interval and sample-start,
+ * and the line numbers of the vertical axis, which are in microseconds, are
+ * used instead, like the planner does.
+ */
+func (c *cube) Samples(ctx context.Context) ([]float64, error) {
+	linenos, err := c.Linenumbers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(linenos) == 0 {
+		return nil, errors.New("internal error; bad document")
+	}
+	vertical := linenos[len(linenos) - 1]
+
+	samples := make([]float64, len(vertical))
+	interval, hasinterval := c.manifest["sample-interval"].(float64)
+	start,    hasstart    := c.manifest["sample-start"].(float64)
+	for i, x := range vertical {
+		if hasinterval && hasstart {
+			samples[i] = start + float64(i) * interval
+		} else {
+			samples[i] = float64(x) / 1000
+		}
+	}
+	return samples, nil
+}
+
 func manifestAsMap(doc []byte) (m map[string]interface{}, err error) {
 	err = json.Unmarshal(doc, &m)
 	return
 }
 
+/*
+ * The val is a line number or index for lineno and index slices, and a
+ * sample value (time or depth) for time slices.
+ *
+ * The optional ranges limit the slice to a window, with an inclusive [first,
+ * last] range for every dimension of the slice, i.e. all dimensions except
+ * dim. Like for sub-volumes, the ranges are line numbers for the lateral
+ * dimensions and sample values for the vertical dimension.
+ *
+ * The optional stride decimates the slice (or its window) by only taking
+ * every stride'th sample of every dimension of the slice, which makes for
+ * smaller results when the full resolution is not needed.
+ *
+ * The optional resolution is the coarsest acceptable resolution, as the
+ * number of source lines (or samples) per line (or sample) of the result, for
+ * every dimension of the cube. The slice is read from the coarsest level of
+ * detail (pyramid) in the manifest within the resolution that has the line
+ * of the slice, and the level is in the result header. The ranges and stride
+ * are applied to the chosen level.
+ */
 type sliceargs struct {
-	Kind string `json:"kind"`
-	Dim  int32  `json:"dim"`
-	Val  int32  `json:"val"`
+	Kind       string      `json:"kind"`
+	Dim        int32       `json:"dim"`
+	Val        float64     `json:"val"`
+	Ranges     [][]float64 `json:"ranges,omitempty"`
+	Stride     []int32     `json:"stride,omitempty"`
+	Resolution []int32     `json:"resolution,omitempty"`
+}
+
+/*
+ * Get the optional window arguments, which are nil when not set.
+ */
+func window(ranges *[][]float64) [][]float64 {
+	if ranges == nil {
+		return nil
+	}
+	return *ranges
+}
+
+/*
+ * Get the optional stride argument, which is nil when not set.
+ */
+func stride(strides *[]int32) []int32 {
+	if strides == nil {
+		return nil
+	}
+	return *strides
+}
+
+/*
+ * Get the optional resolution argument, which is nil when not set.
+ */
+func resolution(resolutions *[]int32) []int32 {
+	if resolutions == nil {
+		return nil
+	}
+	return *resolutions
 }
 
 func (c *cube) SliceByLineno(
 	ctx  context.Context,
 	args struct {
-		Dim    int32
-		Lineno int32
+		Dim        int32
+		Lineno     int32
+		Ranges     *[][]float64
+		Stride     *[]int32
+		Resolution *[]int32
 	},
 ) (*promise, error) {
 	return c.basicSlice(ctx, sliceargs {
-		Kind: "lineno",
-		Dim: args.Dim,
-		Val: args.Lineno,
+		Kind:       "lineno",
+		Dim:        args.Dim,
+		Val:        float64(args.Lineno),
+		Ranges:     window(args.Ranges),
+		Stride:     stride(args.Stride),
+		Resolution: resolution(args.Resolution),
 	})
 }
 
 func (c *cube) SliceByIndex(
 	ctx  context.Context,
 	args struct {
-		Dim   int32
-		Index int32
+		Dim        int32
+		Index      int32
+		Ranges     *[][]float64
+		Stride     *[]int32
+		Resolution *[]int32
+	},
+) (*promise, error) {
+	return c.basicSlice(ctx, sliceargs {
+		Kind:       "index",
+		Dim:        args.Dim,
+		Val:        float64(args.Index),
+		Ranges:     window(args.Ranges),
+		Stride:     stride(args.Stride),
+		Resolution: resolution(args.Resolution),
+	})
+}
+
+/*
+ * A horizontal slice at the sample nearest to time (or depth, for depth
+ * cubes). The vertical axis is always the last dimension.
+ */
+func (c *cube) SliceByTime(
+	ctx  context.Context,
+	args struct {
+		Time       float64
+		Ranges     *[][]float64
+		Stride     *[]int32
+		Resolution *[]int32
 	},
 ) (*promise, error) {
 	return c.basicSlice(ctx, sliceargs {
-		Kind: "index",
-		Dim: args.Dim,
-		Val: args.Index,
+		Kind:       "time",
+		Dim:        2,
+		Val:        args.Time,
+		Ranges:     window(args.Ranges),
+		Stride:     stride(args.Stride),
+		Resolution: resolution(args.Resolution),
 	})
 }
 
@@ -239,9 +370,312 @@ func (c *cube) basicSlice(
 	ctx  context.Context,
 	args sliceargs,
 ) (*promise, error) {
+	return c.query(ctx, "slice", args)
+}
+
+/*
+ * The optional samples limit the curtain to the inclusive [first, last]
+ * range of sample values (time or depth).
+ */
+type curtainargs struct {
+	Coords  [][]int32 `json:"coords"`
+	Samples []float64 `json:"samples,omitempty"`
+}
+
+func (c *cube) Curtain(
+	ctx    context.Context,
+	args   struct {
+		Coords  [][]int32
+		Samples *[]float64
+	},
+) (*promise, error) {
+	query := curtainargs { Coords: args.Coords }
+	if args.Samples != nil {
+		query.Samples = *args.Samples
+	}
+	return c.query(ctx, "curtain", query)
+}
+
+/*
+ * A curtain through points (x, y) in world coordinates, resolved to the
+ * nearest traces, or interpolated from the surrounding traces. See
+ * coordinates.go.
+ */
+func (c *cube) CurtainByCoordinates(
+	ctx  context.Context,
+	args struct {
+		Points        [][]float64
+		Interpolation *string
+		Samples       *[]float64
+	},
+) (*promise, error) {
+	logger := logging.FromContext(ctx).With().
+		Str(logging.Guid, string(c.id)).
+		Str(logging.Function, "curtain").
+		Logger()
+
+	interpolation := "nearest"
+	if args.Interpolation != nil {
+		interpolation = *args.Interpolation
+	}
+
+	geometry, err := c.geometry(ctx)
+	if err != nil {
+		logger.Warn().Err(err).Msg("unable to get survey geometry")
+		return nil, err
+	}
+	linenos, err := c.Linenumbers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	query, err := resolveCoordinates(
+		geometry,
+		linenos,
+		args.Points,
+		interpolation,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if args.Samples != nil {
+		query.Samples = *args.Samples
+	}
+	return c.query(ctx, "curtain", query)
+}
+
+/*
+ * A curtain along the polyline through vertices, given as (inline, crossline)
+ * line numbers. See polyline.go.
+ */
+func (c *cube) CurtainAlongPolyline(
+	ctx  context.Context,
+	args struct {
+		Vertices [][]int32
+		Spacing  *float64
+		Samples  *[]float64
+	},
+) (*promise, error) {
+	linenos, err := c.Linenumbers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	query, err := densify(linenos, args.Vertices, args.Spacing)
+	if err != nil {
+		return nil, err
+	}
+	if args.Samples != nil {
+		query.Samples = *args.Samples
+	}
+	return c.query(ctx, "curtain", *query)
+}
+
+/*
+ * The horizon is the time (or depth) of every trace, as a grid of inlines by
+ * crosslines, where null means the horizon is not defined for that trace. The
+ * optional window is the [above, below] time (or depth) around the horizon to
+ * sample, which by default is only the sample nearest the horizon.
+ *
+ * The grid is as large as the survey, so clients should pass it as a
+ * variable, e.g. query($values: [[Float]!]!) { ... horizon(values: $values)
+ * }, rather than write it into the query text. The query text of horizon
+ * queries is not written to the audit log either way.
+ */
+type horizonargs struct {
+	Values [][]*float64 `json:"values"`
+	Window []float64    `json:"window,omitempty"`
+}
+
+func (c *cube) Horizon(
+	ctx  context.Context,
+	args struct {
+		Values [][]*float64
+		Window *[]float64
+	},
+) (*promise, error) {
+	query := horizonargs { Values: args.Values }
+	if args.Window != nil {
+		query.Window = *args.Window
+	}
+	return c.query(ctx, "horizon", query)
+}
+
+/*
+ * The attribute is computed from the window around every point of the
+ * horizon, and is one of rms, mean, min, max, or sum-of-magnitudes.
+ */
+type horizonattributeargs struct {
+	horizonargs
+	Attribute string `json:"attribute"`
+}
+
+func (c *cube) HorizonAttribute(
+	ctx  context.Context,
+	args struct {
+		Values    [][]*float64
+		Window    *[]float64
+		Attribute string
+	},
+) (*promise, error) {
+	query := horizonattributeargs {
+		horizonargs: horizonargs { Values: args.Values },
+		Attribute:   args.Attribute,
+	}
+	if args.Window != nil {
+		query.Window = *args.Window
+	}
+	return c.query(ctx, "horizon-attribute", query)
+}
+
+/*
+ * The attributes of the cube, e.g. the world coordinates of the traces
+ */
+func (c *cube) Attributes() ([]*attr, error) {
+	attrs, err := manifestAttributes(c.manifest)
+	if err != nil {
+		return nil, err
+	}
+	xs := make([]*attr, len(attrs))
+	for i, a := range attrs {
+		xs[i] = &attr { desc: a }
+	}
+	return xs, nil
+}
+
+func (a *attr) Type() string {
+	return a.desc.Type
+}
+
+func (a *attr) Labels() []string {
+	return a.desc.Labels
+}
+
+func (a *attr) Layout() string {
+	return a.desc.Layout
+}
+
+/*
+ * The attribute is queried for the traces of a slice or curtain, so that it
+ * can be matched with the amplitudes:
+ *   - dim and lineno: the traces of an inline or crossline
+ *   - coords: the traces of a curtain
+ *   - neither: all traces, i.e. those of a time or depth slice
+ */
+type attributeargs struct {
+	Kind   string    `json:"kind"`
+	Dim    *int32    `json:"dim,omitempty"`
+	Lineno *int32    `json:"lineno,omitempty"`
+	Coords [][]int32 `json:"coords,omitempty"`
+}
+
+/*
+ * Catch the mismatched arguments here, so that the client gets a bad request
+ * rather than waiting for the planner to reject them. The attributes are
+ * stored per trace, so dims 0 and 1 are the lateral ones.
+ */
+func (args attributeargs) validate(coords bool) error {
+	badrequest := func(msg string) error {
+		return &QueryError { msg: msg, status: http.StatusBadRequest }
+	}
+	lateral  := args.Dim != nil && 0 <= *args.Dim && *args.Dim < 2
+	vertical := args.Dim != nil && *args.Dim == 2
+	switch {
+	case coords && (args.Dim != nil || args.Lineno != nil):
+		return badrequest("attribute: coords and dim are exclusive")
+	case args.Lineno != nil && args.Dim == nil:
+		return badrequest("attribute: dim required when lineno is given")
+	case args.Lineno != nil && vertical:
+		return badrequest("attribute: lineno not allowed when dim is vertical")
+	case args.Lineno == nil && lateral:
+		return badrequest("attribute: lineno required when dim is lateral")
+	}
+	return nil
+}
+
+func (c *cube) Attribute(
+	ctx  context.Context,
+	args struct {
+		Kind   string
+		Dim    *int32
+		Lineno *int32
+		Coords *[][]int32
+	},
+) (*promise, error) {
+	query := attributeargs {
+		Kind:   args.Kind,
+		Dim:    args.Dim,
+		Lineno: args.Lineno,
+	}
+	if err := query.validate(args.Coords != nil); err != nil {
+		return nil, err
+	}
+	if args.Coords != nil {
+		query.Coords = *args.Coords
+	}
+	return c.query(ctx, "attribute", query)
+}
+
+/*
+ * Queries that add to the process header made by the planner, e.g. to tell
+ * the client how to assemble the result.
+ */
+type headerdecorator interface {
+	decorate(*message.ProcessHeader)
+}
+
+/*
+ * The ranges are inclusive [first, last] pairs, one per dimension, of line
+ * numbers for the lateral dimensions and sample values (time or depth) for
+ * the vertical dimension.
+ *
+ * The optional resolution picks the level of detail like for slices, see
+ * sliceargs, and the ranges are clipped to the lines of that level.
+ */
+type subvolumeargs struct {
+	Ranges     [][]float64 `json:"ranges"`
+	Resolution *[]int32    `json:"resolution,omitempty"`
+}
+
+/*
+ * The box of the cube bounded by ranges. Ranges that reach outside the cube
+ * are clipped.
+ */
+func (c *cube) Subvolume(
+	ctx  context.Context,
+	args subvolumeargs,
+) (*promise, error) {
+	return c.query(ctx, "subvolume", args)
+}
+
+/*
+ * Plan and schedule the query for function with args, and make a promise for
+ * its result. The query is served from the result cache if an identical query
+ * has already been scheduled.
+ */
+func (c *cube) query(
+	ctx      context.Context,
+	function string,
+	args     interface{},
+) (p *promise, err error) {
+	defer func() {
+		queriesTotal.WithLabelValues(function, outcome(err)).Inc()
+	}()
+
 	keys := ctx.Value("keys").(map[string]string)
 	pid  := keys["pid"]
 	auth := keys["Authorization"]
+	logger := logging.FromContext(ctx).With().
+		Str(logging.Guid, string(c.id)).
+		Str(logging.Function, function).
+		Logger()
+
+	ckey, err := cachekey(string(c.id), c.version, function, args)
+	if err != nil {
+		logger.Error().Err(err).Send()
+		return nil, err
+	}
+	if p, err := c.cached(ctx, ckey, function, logger); p != nil || err != nil {
+		return p, err
+	}
 	/*
 	 * Embedding a json doc as a string works (surprisingly) well, since the
 	 * Pack()/encoding escapes all nested quotes. It might be reasonable at
@@ -259,7 +693,7 @@ func (c *cube) basicSlice(
 		// a broken token, so this should be readily cached. If it is
 		// just-about to expire then the process will fail pretty soon anyway,
 		// so just give up.
-		log.Printf("pid=%s, %v", pid, err)
+		logger.Error().Err(err).Msg("unable to get on-behalf token")
 		return nil, err
 	}
 
@@ -269,31 +703,67 @@ func (c *cube) basicSlice(
 		Guid:            string(c.id),
 		Manifest:        c.manifest,
 		StorageEndpoint: c.root.endpoint,
-		Shape:           []int32{ 64, 64, 64 },
-		Function:        "slice",
+		Function:        function,
 		Args:            args,
+		TraceContext:    tracing.Inject(ctx),
 	}
-	query, err := c.root.sched.MakeQuery(&msg)
+	query, err := c.root.sched.MakeQuery(ctx, &msg)
 	if err != nil {
-		log.Printf("pid=%s, %v", pid, err)
+		logger.Warn().Err(err).Msg("unable to make query plan")
 		return nil, err
 	}
+	if decorator, ok := args.(headerdecorator); ok {
+		head, err := (&message.ProcessHeader{}).Unpack(query.header)
+		if err != nil {
+			logger.Error().Err(err).Msg("unable to parse process header")
+			return nil, err
+		}
+		decorator.decorate(head)
+		query.header, err = head.Pack()
+		if err != nil {
+			logger.Error().Err(err).Msg("unable to pack process header")
+			return nil, err
+		}
+	}
+
+	/*
+	 * An identical query may have been planned at the same time, in which
+	 * case its process is shared, and this plan is dropped.
+	 */
+	owner, err := c.root.cache.reserve(ctx, ckey, pid, query)
+	if err != nil {
+		logger.Warn().Err(err).Msg("unable to reserve in result cache")
+	}
+	if owner != pid {
+		cacheLookupsTotal.WithLabelValues(function, "hit").Inc()
+		return c.hit(owner, logger)
+	}
 
 	key, err := c.root.keyring.Sign(pid)
 	if err != nil {
-		log.Printf("pid=%s, %v", pid, err)
+		logger.Error().Err(err).Msg("unable to sign result key")
 		return nil, err
 	}
 
+	/*
+	 * Scheduling outlives the request, so it must not be cancelled with it,
+	 * but its span should still be part of the query trace.
+	 */
+	sctx := tracing.Detach(ctx)
 	go func () {
-		err := c.root.sched.Schedule(context.Background(), pid, query)
+		err := c.root.sched.Schedule(sctx, pid, query)
 		if err != nil {
 			/*
-			 * Make scheduling errors fatal to detect them for debugging.
-			 * Eventually this should log, maybe cancel the process, and
-			 * continue.
+			 * The scheduler reports the process as failed, so the client
+			 * is told through the result endpoints. Only this process is
+			 * affected, so just log and carry on.
 			 */
-			log.Fatalf("pid=%s, %v", pid, err)
+			logger.Error().Err(err).Msg("unable to schedule")
+			return
+		}
+		err = c.root.cache.store(sctx, ckey, pid, query)
+		if err != nil {
+			logger.Warn().Err(err).Msg("unable to store in result cache")
 		}
 	}()
 
@@ -303,58 +773,43 @@ func (c *cube) basicSlice(
 	}, nil
 }
 
-func (c *cube) Curtain(
-	ctx    context.Context,
-	args   struct { Coords [][]int32 `json:"coords"` },
+/*
+ * Look up the query in the result cache, and make a promise for the process
+ * of the cached query on a hit. Returns nil on a miss.
+ *
+ * Failing to read the cache is not an error, but a miss, so that queries can
+ * still be served when the cache is broken.
+ */
+func (c *cube) cached(
+	ctx      context.Context,
+	key      string,
+	function string,
+	logger   zerolog.Logger,
 ) (*promise, error) {
-	keys := ctx.Value("keys").(map[string]string)
-	pid  := keys["pid"]
-	auth := keys["Authorization"]
-
-	token, err := c.root.tokens.GetOnbehalf(auth)
+	pid, err := c.root.cache.lookup(ctx, key)
 	if err != nil {
-		// No further recovery is tried - GetManifest should already have fixed
-		// a broken token, so this should be readily cached. If it is
-		// just-about to expire then the process will fail pretty soon anyway,
-		// so just give up.
-		log.Printf("pid=%s, %v", pid, err)
-		return nil, err
+		logger.Warn().Err(err).Msg("unable to read result cache")
+		cacheLookupsTotal.WithLabelValues(function, "failed").Inc()
+		return nil, nil
 	}
-
-	msg := message.Query {
-		Pid:             pid,
-		Token:           token,
-		Guid:            string(c.id),
-		Manifest:        c.manifest,
-		StorageEndpoint: c.root.endpoint,
-		Shape:           []int32{ 64, 64, 64 },
-		Function:        "curtain",
-		Args:            args,
-	}
-	query, err := c.root.sched.MakeQuery(&msg)
-	if err != nil {
-		log.Printf("pid=%s, %v", pid, err)
-		return nil, err
+	if pid == "" {
+		cacheLookupsTotal.WithLabelValues(function, "miss").Inc()
+		return nil, nil
 	}
+	cacheLookupsTotal.WithLabelValues(function, "hit").Inc()
+	return c.hit(pid, logger)
+}
 
+/*
+ * Make a promise for the (shared) process pid, found in the result cache.
+ */
+func (c *cube) hit(pid string, logger zerolog.Logger) (*promise, error) {
 	key, err := c.root.keyring.Sign(pid)
 	if err != nil {
-		log.Printf("pid=%s, %v", pid, err)
+		logger.Error().Err(err).Msg("unable to sign result key")
 		return nil, err
 	}
-
-	go func () {
-		err := c.root.sched.Schedule(context.Background(), pid, query)
-		if err != nil {
-			/*
-			 * Make scheduling errors fatal to detect them for debugging.
-			 * Eventually this should log, maybe cancel the process, and
-			 * continue.
-			 */
-			log.Fatalf("pid=%s, %v", pid, err)
-		}
-	}()
-
+	logger.Info().Str("cached-pid", pid).Msg("result cache hit")
 	return &promise {
 		url: fmt.Sprintf("result/%s", pid),
 		key: key,
@@ -374,6 +829,8 @@ func MakeGraphQL(
 	endpoint string,
 	storage  redis.Cmdable,
 	tokens   auth.Tokens,
+	cache    *ResultCache,
+	tasksize TaskSize,
 ) *gql {
 	schema := `
 type Query {
@@ -385,10 +842,26 @@ type Cube {
     id: ID!
 
     linenumbers: [[Int!]!]!
+    samples: [Float!]!
+
+    sliceByLineno(dim: Int!, lineno: Int!, ranges: [[Float!]!], stride: [Int!], resolution: [Int!]): Promise!
+    sliceByIndex(dim: Int!, index: Int!, ranges: [[Float!]!], stride: [Int!], resolution: [Int!]): Promise!
+    sliceByTime(time: Float!, ranges: [[Float!]!], stride: [Int!], resolution: [Int!]): Promise!
+    curtain(coords: [[Int!]!]!, samples: [Float!]): Promise!
+    curtainByCoordinates(points: [[Float!]!]!, interpolation: String, samples: [Float!]): Promise!
+    curtainAlongPolyline(vertices: [[Int!]!]!, spacing: Float, samples: [Float!]): Promise!
+    subvolume(ranges: [[Float!]!]!, resolution: [Int!]): Promise!
+    horizon(values: [[Float]!]!, window: [Float!]): Promise!
+    horizonAttribute(values: [[Float]!]!, window: [Float!], attribute: String!): Promise!
+
+    attributes: [Attribute!]!
+    attribute(kind: String!, dim: Int, lineno: Int, coords: [[Int!]!]): Promise!
+}
 
-    sliceByLineno(dim: Int!, lineno: Int!): Promise!
-    sliceByIndex(dim: Int!, index: Int!): Promise!
-    curtain(coords: [[Int!]!]!): Promise!
+type Attribute {
+    type: String!
+    labels: [String!]!
+    layout: String!
 }
 
 type Promise {
@@ -402,6 +875,8 @@ type Promise {
 			endpoint,
 			storage,
 			tokens,
+			cache,
+			tasksize,
 		),
 	}
 
@@ -416,9 +891,18 @@ func (g *gql) Get(ctx *gin.Context) {
 	query  := ctx.Query("query")
 	opName := ctx.Query("operationName")
 
-	// TODO: parse the ?variables=... to this map
-	//variables := ctx.Query("variables")
 	variables := make(map[string]interface{})
+	if vars := ctx.Query("variables"); vars != "" {
+		err := json.Unmarshal([]byte(vars), &variables)
+		if err != nil {
+			log.Warn().
+				Err(err).
+				Str(logging.Pid, ctx.GetString("pid")).
+				Msg("bad graphql variables")
+			ctx.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+	}
 	ctx.JSON(200, g.execQuery(ctx, query, opName, variables))
 }
 
@@ -431,7 +915,10 @@ func (g *gql) Post(ctx *gin.Context) {
 	b := body {}
 	err := ctx.BindJSON(&b)
 	if err != nil {
-		log.Printf("pid=%s %v", ctx.GetString("pid"), err)
+		log.Warn().
+			Err(err).
+			Str(logging.Pid, ctx.GetString("pid")).
+			Msg("bad graphql request")
 		return
 	}
 
@@ -443,6 +930,30 @@ func (g *gql) Post(ctx *gin.Context) {
 	))
 }
 
+/*
+ * Queries for horizons can carry the whole horizon inline, which is far too
+ * much for the audit log, as is any other very large query.
+ */
+var horizonfield = regexp.MustCompile(`\bhorizon(Attribute)?\s*\(`)
+
+const maxauditquery = 4096
+
+/*
+ * The query text as written to the audit log. Queries for horizons and
+ * queries larger than maxauditquery are replaced by their size and sha256.
+ */
+func auditquery(query string) string {
+	if len(query) <= maxauditquery && !horizonfield.MatchString(query) {
+		return query
+	}
+	sum := sha256.Sum256([]byte(query))
+	return fmt.Sprintf(
+		"<omitted; %d bytes, sha256:%s>",
+		len(query),
+		hex.EncodeToString(sum[:]),
+	)
+}
+
 func (g *gql) execQuery(
 	ctx    *gin.Context,
 	query  string,
@@ -453,6 +964,35 @@ func (g *gql) execQuery(
 		"pid": ctx.GetString("pid"),
 		"Authorization": ctx.GetHeader("Authorization"),
 	}
-	c := context.WithValue(ctx, "keys", keys)
-	return g.schema.Exec(c, query, opName, variables)
+	/*
+	 * The audit record of the query. Every record written while resolving
+	 * the query carries the pid and user through the context logger.
+	 */
+	c, span := tracing.Tracer().Start(
+		tracing.ExtractHTTP(ctx, ctx.Request.Header),
+		"graphql",
+	)
+	span.SetAttributes(
+		attribute.String(logging.Pid, keys["pid"]),
+		attribute.String("operation", opName),
+	)
+	defer span.End()
+
+	logger := log.With().
+		Str(logging.Pid, keys["pid"]).
+		Str(logging.User, logging.UserOID(keys["Authorization"])).
+		Logger()
+	logger.Info().
+		Bool("audit", true).
+		Str("operation", opName).
+		Str("query", auditquery(query)).
+		Msg("graphql query")
+
+	c  = context.WithValue(c, "keys", keys)
+	c  = logging.WithLogger(c, logger)
+	response := g.schema.Exec(c, query, opName, variables)
+	if len(response.Errors) > 0 {
+		tracing.Fail(span, response.Errors[0])
+	}
+	return response
 }
@@ -0,0 +1,50 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditQueryOmitsHorizons(t *testing.T) {
+	query := `{ cube(id: "guid") { sliceByLineno(dim: 0, lineno: 1) { url } } }`
+	assert.Equal(t, query, auditquery(query))
+
+	for _, query := range []string {
+		`{ cube(id: "guid") { horizon(values: [[1.0]]) { url } } }`,
+		`{ cube(id: "guid") { horizonAttribute (values: $v) { url } } }`,
+		`{ cube(id: "guid") { linenumbers } }` + strings.Repeat(" ", 4096),
+	} {
+		audited := auditquery(query)
+		assert.True(t, strings.HasPrefix(audited, "<omitted;"), audited)
+	}
+}
+
+func TestAttributeRejectsMismatchedDimAndLineno(t *testing.T) {
+	dim    := func(x int32) *int32 { return &x }
+	lineno := dim
+
+	for _, args := range []attributeargs {
+		attributeargs { Dim: dim(0) },
+		attributeargs { Lineno: lineno(3) },
+		attributeargs { Dim: dim(2), Lineno: lineno(4) },
+	} {
+		err := args.validate(false)
+		qe, ok := err.(*QueryError)
+		assert.True(t, ok, "expected *QueryError, was %T", err)
+		assert.Equal(t, http.StatusBadRequest, qe.Status())
+	}
+
+	err := attributeargs { Dim: dim(0) }.validate(true)
+	assert.Error(t, err)
+
+	for _, args := range []attributeargs {
+		attributeargs {},
+		attributeargs { Dim: dim(2) },
+		attributeargs { Dim: dim(1), Lineno: lineno(12) },
+	} {
+		assert.NoError(t, args.validate(false))
+	}
+}
@@ -0,0 +1,75 @@
+package api
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+/*
+ * Prometheus metrics for the query server. The metrics are registered with the
+ * default registry, which is exposed on /metrics by cmd/query.
+ *
+ * Metrics are labelled by function (slice, curtain, ...) and, when it makes
+ * sense, by outcome. The outcome is a short, fixed string (e.g. ok, failed)
+ * and never an error message, to keep the number of series bounded.
+ */
+var (
+	queriesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts {
+			Namespace: "oneseismic",
+			Name:      "queries_total",
+			Help:      "Number of queries made, by function and outcome",
+		},
+		[]string{ "function", "outcome" },
+	)
+
+	planTasks = promauto.NewHistogramVec(
+		prometheus.HistogramOpts {
+			Namespace: "oneseismic",
+			Name:      "plan_tasks",
+			Help:      "Number of tasks in the query plans made by MakeQuery",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+		},
+		[]string{ "function" },
+	)
+
+	scheduleXAddSeconds = promauto.NewHistogramVec(
+		prometheus.HistogramOpts {
+			Namespace: "oneseismic",
+			Name:      "schedule_xadd_seconds",
+			Help:      "Latency of putting a batch of tasks on the job " +
+				"queue",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 12),
+		},
+		[]string{ "function", "outcome" },
+	)
+
+	resultBytesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts {
+			Namespace: "oneseismic",
+			Name:      "result_bytes_total",
+			Help:      "Number of result bytes streamed to clients",
+		},
+		[]string{ "function", "outcome" },
+	)
+
+	cacheLookupsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts {
+			Namespace: "oneseismic",
+			Name:      "result_cache_lookups_total",
+			Help:      "Number of result cache lookups, by function and " +
+				"outcome (hit, miss, failed)",
+		},
+		[]string{ "function", "outcome" },
+	)
+)
+
+/*
+ * Automation for the common ok/failed outcome label
+ */
+func outcome(err error) string {
+	if err != nil {
+		return "failed"
+	}
+	return "ok"
+}
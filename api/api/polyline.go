@@ -0,0 +1,208 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+/*
+ * Arbitrary lines
+ * ---------------
+ * Arbitrary (random) lines through the survey are curtains along a polyline,
+ * which is usually drawn with a handful of control points. The curtain
+ * function needs every trace of the line, so the polyline is densified to the
+ * trace path server-side and scheduled as a regular curtain.
+ *
+ * The vertices are (inline, crossline) line numbers, and the path is traced
+ * in the index space of the survey, i.e. one step is one trace. Without a
+ * spacing the path is the Bresenham line between consecutive vertices, which
+ * visits every trace the line crosses. With a spacing the path is sampled at
+ * fixed distance (in traces) along the polyline, and every sample is snapped
+ * to the nearest trace.
+ *
+ * A curtain cannot have the same trace twice, so traces visited more than once
+ * (a polyline that crosses itself) are only in the curtain at their first
+ * visit.
+ */
+
+/*
+ * The index of every line number in linenos
+ */
+func lineindex(linenos []int32) map[int32]int {
+	index := make(map[int32]int, len(linenos))
+	for i, lineno := range linenos {
+		index[lineno] = i
+	}
+	return index
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+/*
+ * The number of steps of the Bresenham line between a and b
+ */
+func steps(a, b [2]int) int {
+	dx := abs(b[0] - a[0])
+	dy := abs(b[1] - a[1])
+	if dx > dy {
+		return dx
+	}
+	return dy
+}
+
+/*
+ * The traces on the line between a and b (inclusive), by Bresenham's
+ * algorithm.
+ */
+func bresenham(a, b [2]int) [][2]int {
+	sign := func(x int) int {
+		if x < 0 {
+			return -1
+		}
+		return 1
+	}
+
+	dx := abs(b[0] - a[0])
+	dy := -abs(b[1] - a[1])
+	sx := sign(b[0] - a[0])
+	sy := sign(b[1] - a[1])
+	e  := dx + dy
+
+	line := [][2]int{}
+	x, y := a[0], a[1]
+	for {
+		line = append(line, [2]int{ x, y })
+		if x == b[0] && y == b[1] {
+			return line
+		}
+		e2 := 2 * e
+		if e2 >= dy {
+			e += dy
+			x += sx
+		}
+		if e2 <= dx {
+			e += dx
+			y += sy
+		}
+	}
+}
+
+/*
+ * The traces at every spacing along the polyline through vertices, snapped
+ * to the nearest trace. The last vertex is always included.
+ */
+func sampled(vertices [][2]int, spacing float64) [][2]int {
+	path := [][2]int{ vertices[0] }
+	/*
+	 * The distance to walk past the start of the current segment until the
+	 * next sample, carried over from the previous segment.
+	 */
+	next := spacing
+	for k := 1; k < len(vertices); k++ {
+		a := vertices[k - 1]
+		b := vertices[k]
+		dx := float64(b[0] - a[0])
+		dy := float64(b[1] - a[1])
+		length := math.Hypot(dx, dy)
+
+		t := next
+		for ; t <= length; t += spacing {
+			path = append(path, [2]int{
+				int(math.Round(float64(a[0]) + dx * t / length)),
+				int(math.Round(float64(a[1]) + dy * t / length)),
+			})
+		}
+		next = t - length
+	}
+	return append(path, vertices[len(vertices) - 1])
+}
+
+/*
+ * Densify the polyline through vertices, given as (inline, crossline) line
+ * numbers, to the curtain of the traces along it. The spacing is in traces,
+ * and nil means every trace the polyline crosses.
+ */
+func densify(
+	linenos  [][]int32,
+	vertices [][]int32,
+	spacing  *float64,
+) (*curtainargs, error) {
+	if len(vertices) == 0 {
+		return nil, errors.New("polyline must have at least one vertex")
+	}
+	if spacing != nil && !(*spacing >= 1) {
+		msg := "spacing (= %v) must be at least 1 trace"
+		return nil, fmt.Errorf(msg, *spacing)
+	}
+
+	index0 := lineindex(linenos[0])
+	index1 := lineindex(linenos[1])
+	points := make([][2]int, 0, len(vertices))
+	for n, vertex := range vertices {
+		if len(vertex) != 2 {
+			msg := "vertices[%d]: expected (inline, crossline)"
+			return nil, fmt.Errorf(msg, n)
+		}
+		i, ok := index0[vertex[0]]
+		if !ok {
+			return nil, fmt.Errorf("vertices[%d]: no line %d", n, vertex[0])
+		}
+		j, ok := index1[vertex[1]]
+		if !ok {
+			return nil, fmt.Errorf("vertices[%d]: no line %d", n, vertex[1])
+		}
+		points = append(points, [2]int{ i, j })
+	}
+
+	/*
+	 * The path can visit a trace more than once, but a path that is longer
+	 * than the survey has traces is almost certainly a mistake, and is
+	 * rejected before it is made, as it could be arbitrarily large.
+	 */
+	ntraces := len(points)
+	for k := 1; k < len(points); k++ {
+		a := points[k - 1]
+		b := points[k]
+		if spacing == nil {
+			ntraces += steps(a, b)
+		} else {
+			dx := float64(b[0] - a[0])
+			dy := float64(b[1] - a[1])
+			ntraces += int(math.Hypot(dx, dy) / *spacing) + 1
+		}
+	}
+	if maxtraces := len(linenos[0]) * len(linenos[1]); ntraces > maxtraces {
+		msg := "polyline has too many traces (= %d), max is %d"
+		return nil, fmt.Errorf(msg, ntraces, maxtraces)
+	}
+
+	var path [][2]int
+	if spacing == nil {
+		path = [][2]int{ points[0] }
+		for k := 1; k < len(points); k++ {
+			path = append(path, bresenham(points[k - 1], points[k])[1:]...)
+		}
+	} else {
+		path = sampled(points, *spacing)
+	}
+
+	query := &curtainargs {}
+	seen  := make(map[[2]int]bool, len(path))
+	for _, trace := range path {
+		if seen[trace] {
+			continue
+		}
+		seen[trace] = true
+		query.Coords = append(query.Coords, []int32{
+			linenos[0][trace[0]],
+			linenos[1][trace[1]],
+		})
+	}
+	return query, nil
+}
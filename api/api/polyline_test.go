@@ -0,0 +1,110 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBresenhamVisitsEveryTraceOnTheLine(t *testing.T) {
+	assert.Equal(t, [][2]int{
+		{ 0, 0 }, { 1, 1 }, { 2, 1 }, { 3, 2 }, { 4, 2 },
+	}, bresenham([2]int{ 0, 0 }, [2]int{ 4, 2 }))
+
+	assert.Equal(t, [][2]int{
+		{ 2, 3 }, { 2, 2 }, { 1, 1 }, { 1, 0 },
+	}, bresenham([2]int{ 2, 3 }, [2]int{ 1, 0 }))
+
+	assert.Equal(t, [][2]int{ { 1, 1 } }, bresenham([2]int{ 1, 1 }, [2]int{ 1, 1 }))
+}
+
+func TestDensifyPolylineToLineNumbers(t *testing.T) {
+	linenos := [][]int32{ { 10, 11, 12, 13, 14 }, { 100, 102, 104, 106 } }
+	vertices := [][]int32{ { 10, 100 }, { 12, 100 }, { 12, 104 } }
+
+	q, err := densify(linenos, vertices, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]int32{
+		{ 10, 100 },
+		{ 11, 100 },
+		{ 12, 100 },
+		{ 12, 102 },
+		{ 12, 104 },
+	}, q.Coords)
+}
+
+func TestDensifyPolylineWithSpacing(t *testing.T) {
+	linenos := [][]int32{ { 10, 11, 12, 13, 14 }, { 100, 102, 104, 106 } }
+	vertices := [][]int32{ { 10, 100 }, { 13, 100 }, { 13, 106 } }
+
+	/*
+	 * The spacing carries over the corner, so the sample after (13, 100) is
+	 * one trace into the next segment
+	 */
+	spacing := 2.0
+	q, err := densify(linenos, vertices, &spacing)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]int32{
+		{ 10, 100 },
+		{ 12, 100 },
+		{ 13, 102 },
+		{ 13, 106 },
+	}, q.Coords)
+}
+
+func TestDensifyPolylineVisitsTracesOnce(t *testing.T) {
+	linenos := [][]int32{ { 10, 11, 12 }, { 100, 101, 102 } }
+	vertices := [][]int32{ { 10, 101 }, { 12, 101 }, { 11, 102 }, { 11, 100 } }
+
+	q, err := densify(linenos, vertices, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]int32{
+		{ 10, 101 },
+		{ 11, 101 },
+		{ 12, 101 },
+		{ 11, 102 },
+		{ 11, 100 },
+	}, q.Coords)
+}
+
+func TestDensifyPolylineBadInputFails(t *testing.T) {
+	linenos := [][]int32{ { 10, 11, 12 }, { 100, 101, 102 } }
+
+	_, err := densify(linenos, [][]int32{}, nil)
+	assert.NotNil(t, err)
+
+	_, err = densify(linenos, [][]int32{ { 10, 100 }, { 9, 100 } }, nil)
+	assert.NotNil(t, err)
+
+	_, err = densify(linenos, [][]int32{ { 10, 100, 1 } }, nil)
+	assert.NotNil(t, err)
+
+	spacing := 0.0
+	_, err = densify(linenos, [][]int32{ { 10, 100 } }, &spacing)
+	assert.NotNil(t, err)
+
+	spacing = 0.5
+	_, err = densify(linenos, [][]int32{ { 10, 100 } }, &spacing)
+	assert.NotNil(t, err)
+}
+
+func TestDensifyPolylineLongerThanSurveyFails(t *testing.T) {
+	linenos := [][]int32{ { 10, 11, 12 }, { 100, 101, 102 } }
+
+	/*
+	 * Back and forth along the diagonal, which is more traces than the 9 in
+	 * the survey
+	 */
+	vertices := [][]int32{
+		{ 10, 100 }, { 12, 102 }, { 10, 100 }, { 12, 102 }, { 10, 100 },
+	}
+	_, err := densify(linenos, vertices, nil)
+	assert.NotNil(t, err)
+
+	spacing := 1.0
+	_, err = densify(linenos, vertices, &spacing)
+	assert.NotNil(t, err)
+
+	_, err = densify(linenos, vertices[:2], nil)
+	assert.Nil(t, err)
+}
@@ -4,14 +4,17 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"time"
 
 	"github.com/equinor/oneseismic/api/internal/auth"
+	"github.com/equinor/oneseismic/api/internal/logging"
 	"github.com/equinor/oneseismic/api/internal/message"
+	"github.com/equinor/oneseismic/api/internal/tracing"
 	"github.com/go-redis/redis/v8"
 	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type Result struct {
@@ -33,24 +36,109 @@ func headerkey(pid string) string {
 func parseProcessHeader(doc []byte) (*message.ProcessHeader, error) {
 	ph, err := (&message.ProcessHeader{}).Unpack(doc)
 	if err != nil {
-		log.Printf("bad process header: %s", string(doc))
+		log.Error().Str("header", string(doc)).Msg("bad process header")
 		return ph, fmt.Errorf("unable to parse process header: %w", err)
 	}
 
 	if ph.Ntasks <= 0 {
-		log.Printf("bad process header: %s", string(doc))
+		log.Error().Str("header", string(doc)).Msg("bad process header")
 		return ph, fmt.Errorf("processheader.parts = %d; want >= 1", ph.Ntasks)
 	}
 	return ph, nil
 }
 
+/*
+ * Get the failure records for the process. An empty list means that no part
+ * of the process has failed (yet).
+ */
+func processFailures(
+	ctx     context.Context,
+	storage redis.Cmdable,
+	pid     string,
+) ([]message.Failure, error) {
+	key := message.FailureKey(pid)
+	docs, err := storage.LRange(ctx, key, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	failures := make([]message.Failure, len(docs))
+	for i, doc := range docs {
+		_, err := failures[i].Unpack([]byte(doc))
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse failure record: %w", err)
+		}
+	}
+	return failures, nil
+}
+
+/*
+ * Check if the process has been cancelled by the client.
+ */
+func processCancelled(
+	ctx     context.Context,
+	storage redis.Cmdable,
+	pid     string,
+) (bool, error) {
+	n, err := storage.Exists(ctx, message.CancelKey(pid)).Result()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+/*
+ * Abort the request if the process has been cancelled or has failed, and
+ * respond with the reason. A stopped process will never complete, so all the
+ * result endpoints should check this before waiting for (more) partial
+ * results.
+ *
+ * Returns true if the request was aborted.
+ */
+func (r *Result) abortIfStopped(ctx *gin.Context, pid string) bool {
+	cancelled, err := processCancelled(ctx, r.Storage, pid)
+	if err != nil {
+		log.Error().Err(err).Str(logging.Pid, pid).Msg("unable to check for cancel")
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return true
+	}
+	if cancelled {
+		ctx.AbortWithStatusJSON(http.StatusGone, gin.H {
+			"location": fmt.Sprintf("result/%s/status", pid),
+			"status":   "cancelled",
+		})
+		return true
+	}
+
+	failures, err := processFailures(ctx, r.Storage, pid)
+	if err != nil {
+		log.Error().Err(err).Str(logging.Pid, pid).Msg("unable to get failures")
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return true
+	}
+	if len(failures) == 0 {
+		return false
+	}
+
+	ctx.AbortWithStatusJSON(http.StatusInternalServerError, gin.H {
+		"location": fmt.Sprintf("result/%s/status", pid),
+		"status":   "failed",
+		"errors":   failures,
+	})
+	return true
+}
+
 func resultFromProcessHeader(
 	head *message.ProcessHeader,
 ) *message.ResultHeader {
 	return &message.ResultHeader {
-		Bundles: head.Ntasks,
-		Shape:   head.Shape,
-		Index:   head.Index,
+		Bundles:   head.Ntasks,
+		Level:     head.Level,
+		Shape:     head.Shape,
+		Index:     head.Index,
+		Positions: head.Positions,
+		Traces:    head.Traces,
+		Weights:   head.Weights,
 	}
 }
 
@@ -75,22 +163,67 @@ func collectResult(
 	}
 	tiles <- rhpacked
 
+	/*
+	 * With at-least-once delivery of tasks, the same part can be written more
+	 * than once to the stream, when a slow task is assumed dead and re-run.
+	 * Only the first copy of every part is sent.
+	 */
+	seen := make(map[string]bool)
 	streamCursor := "0"
 	count := 0
 	for count < head.Ntasks {
 		xreadArgs := redis.XReadArgs{
 			Streams: []string{pid, streamCursor},
-			Block:   0,
+			Block:   time.Second,
 		}
 		reply, err := storage.XRead(ctx, &xreadArgs).Result()
 
+		if err == redis.Nil {
+			/*
+			 * No new partial results within the block timeout. If the process
+			 * has been cancelled or failed then the remaining parts will never
+			 * arrive, and the transfer must be stopped, otherwise keep
+			 * waiting.
+			 */
+			cancelled, err := processCancelled(ctx, storage, pid)
+			if err != nil {
+				failure <- err
+				return
+			}
+			if cancelled {
+				failure <- errors.New("process cancelled")
+				return
+			}
+
+			failures, err := processFailures(ctx, storage, pid)
+			if err != nil {
+				failure <- err
+				return
+			}
+			if len(failures) > 0 {
+				f := failures[0]
+				failure <- fmt.Errorf("part=%s failed: %s", f.Part, f.Message)
+				return
+			}
+			continue
+		}
+
 		if err != nil {
 			failure <- err
 			return
 		}
 
 		for _, message := range reply[0].Messages {
-			for _, tile := range message.Values {
+			for part, tile := range message.Values {
+				if seen[part] {
+					log.Info().
+						Str(logging.Pid, pid).
+						Str(logging.Part, part).
+						Msg("duplicate part; dropped")
+					continue
+				}
+				seen[part] = true
+
 				chunk, ok := tile.(string)
 				if !ok {
 					msg := fmt.Sprintf("tile.type = %T; expected []byte]", tile)
@@ -108,19 +241,39 @@ func collectResult(
 
 func (r *Result) Stream(ctx *gin.Context) {
 	pid := ctx.Param("pid")
+	if r.abortIfStopped(ctx, pid) {
+		return
+	}
+
+	logger := log.With().Str(logging.Pid, pid).Logger()
 	body, err := r.Storage.Get(ctx, headerkey(pid)).Bytes()
 	if err != nil {
-		log.Printf("Unable to get process header: %v", err)
+		logger.Warn().Err(err).Msg("unable to get process header")
 		ctx.AbortWithStatus(http.StatusNotFound)
 		return
 	}
 
 	head, err := parseProcessHeader(body)
 	if err != nil {
-		log.Printf("pid=%s, %v", pid, err)
+		logger.Error().Err(err).Send()
 		ctx.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
+	logger = logger.With().Str(logging.Function, head.Function).Logger()
+
+	/*
+	 * The result is fetched in a separate request, so the span is joined to
+	 * the trace of the query through the trace context in the header.
+	 */
+	_, span := tracing.Tracer().Start(
+		tracing.Extract(ctx.Request.Context(), head.TraceContext),
+		"result.Stream",
+	)
+	span.SetAttributes(
+		attribute.String(logging.Pid,      pid),
+		attribute.String(logging.Function, head.Function),
+	)
+	defer span.End()
 
 	tiles := make(chan []byte)
 	failure := make(chan error)
@@ -132,17 +285,35 @@ func (r *Result) Stream(ctx *gin.Context) {
 	header.Set("Content-Type", "text/html")
 	w.WriteHeader(http.StatusOK)
 
+	nbytes := 0
 	for {
 		select {
 		case output, ok := <-tiles:
 			if !ok {
 				w.(http.Flusher).Flush()
+				span.SetAttributes(attribute.Int("bytes", nbytes))
+				logger.Info().
+					Bool("audit", true).
+					Int("bytes", nbytes).
+					Msg("result streamed")
+				resultBytesTotal.WithLabelValues(head.Function, "ok").Add(
+					float64(nbytes),
+				)
 				return
 			}
-			w.Write(output)
+			n, _ := w.Write(output)
+			nbytes += n
 
 		case err := <-failure:
-			log.Printf("pid=%s, %s", pid, err)
+			tracing.Fail(span, err)
+			logger.Warn().
+				Err(err).
+				Bool("audit", true).
+				Int("bytes", nbytes).
+				Msg("result stream failed")
+			resultBytesTotal.WithLabelValues(head.Function, "failed").Add(
+				float64(nbytes),
+			)
 			return
 		}
 	}
@@ -150,29 +321,45 @@ func (r *Result) Stream(ctx *gin.Context) {
 
 func (r *Result) Get(ctx *gin.Context) {
 	pid := ctx.Param("pid")
+	if r.abortIfStopped(ctx, pid) {
+		return
+	}
+
+	logger := log.With().Str(logging.Pid, pid).Logger()
 	body, err := r.Storage.Get(ctx, headerkey(pid)).Bytes()
 	if err != nil {
-		log.Printf("Unable to get process header: %v", err)
+		logger.Warn().Err(err).Msg("unable to get process header")
 		ctx.AbortWithStatus(http.StatusNotFound)
 		return
 	}
 
 	head, err := parseProcessHeader(body)
 	if err != nil {
-		log.Printf("pid=%s, %v", pid, err)
+		logger.Error().Err(err).Send()
 		ctx.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
+	logger = logger.With().Str(logging.Function, head.Function).Logger()
 
-	count, err := r.Storage.XLen(ctx, pid).Result()
+	count, err := r.Storage.SCard(ctx, message.PartsKey(pid)).Result()
+	if err != nil {
+		logger.Error().Err(err).Send()
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
 
 	if count < int64(head.Ntasks) {
 		ctx.AbortWithStatus(http.StatusAccepted)
 		return
 	}
 
+	/*
+	 * The failure channel is buffered so that collectResult can post its error
+	 * and close the tiles channel without waiting for this function to read
+	 * it.
+	 */
 	tiles := make(chan []byte, 1000)
-	failure := make(chan error)
+	failure := make(chan error, 1)
 	go collectResult(ctx, r.Storage, pid, head, tiles, failure)
 
 	result := make([]byte, 0)
@@ -181,13 +368,21 @@ func (r *Result) Get(ctx *gin.Context) {
 		result = append(result, tile...)
 	}
 
-	err, ok := <-failure
-
-	if ok {
-		log.Printf("pid=%s, %s", pid, err)
+	select {
+	case err := <-failure:
+		logger.Warn().Err(err).Msg("unable to collect result")
 		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	default:
 	}
 
+	logger.Info().
+		Bool("audit", true).
+		Int("bytes", len(result)).
+		Msg("result fetched")
+	resultBytesTotal.WithLabelValues(head.Function, "ok").Add(
+		float64(len(result)),
+	)
 	ctx.Data(http.StatusOK, "application/octet-stream", result)
 }
 
@@ -208,6 +403,10 @@ func (r *Result) Status(ctx *gin.Context) {
 	 *
 	 * [1] the header-write step not completed, to be precise
 	 */
+	if r.abortIfStopped(ctx, pid) {
+		return
+	}
+
 	body, err := r.Storage.Get(ctx, headerkey(pid)).Bytes()
 	if err == redis.Nil {
 		/* request sucessful, but key does not exist */
@@ -218,21 +417,25 @@ func (r *Result) Status(ctx *gin.Context) {
 		return
 	}
 	if err != nil {
-		log.Printf("%s %v", pid, err)
+		log.Error().Err(err).Str(logging.Pid, pid).Send()
 		ctx.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
 	proc, err := parseProcessHeader(body)
 	if err != nil {
-		log.Printf("%s %v", pid, err)
+		log.Error().Err(err).Str(logging.Pid, pid).Send()
 		ctx.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
-	count, err := r.Storage.XLen(ctx, pid).Result()
+	/*
+	 * The stream can hold duplicates of a part when tasks are re-run, so
+	 * count the distinct parts that are done.
+	 */
+	count, err := r.Storage.SCard(ctx, message.PartsKey(pid)).Result()
 	if err != nil {
-		log.Printf("%s %v", pid, err)
+		log.Error().Err(err).Str(logging.Pid, pid).Send()
 		ctx.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
@@ -240,7 +443,6 @@ func (r *Result) Status(ctx *gin.Context) {
 	done := count == int64(proc.Ntasks)
 	completed := fmt.Sprintf("%d/%d", count, proc.Ntasks)
 
-	// TODO: add (and detect) failed status
 	if done {
 		ctx.JSON(http.StatusOK, gin.H {
 			"location": fmt.Sprintf("result/%s", pid),
@@ -255,3 +457,75 @@ func (r *Result) Status(ctx *gin.Context) {
 		})
 	}
 }
+
+/*
+ * Set the cancellation marker KEYS[1] of a process, unless it is shared, i.e.
+ * the shared marker KEYS[2] exists. This must be atomic, as the result cache
+ * may hand out the process at any time. Returns 1 if the process is
+ * cancelled.
+ */
+var cancelscript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[2]) == 1 then
+    return 0
+end
+redis.call('SET', KEYS[1], '', 'PX', ARGV[1])
+return 1
+`)
+
+/*
+ * Cancel a process. The process is marked as cancelled, which stops the
+ * scheduler from sending more tasks and makes workers skip (or abort) the
+ * tasks of this process. The partial results and the process header are
+ * removed immediately.
+ *
+ * The cancellation marker itself expires like the rest of the process, and
+ * until then the status of the process is reported as cancelled. Cancelling
+ * an already-cancelled or completed process is not an error.
+ *
+ * Processes that have been handed out by the result cache may be shared with
+ * other users, and cannot be cancelled.
+ */
+func (r *Result) Cancel(ctx *gin.Context) {
+	pid := ctx.Param("pid")
+	ok, err := cancelscript.Run(
+		ctx,
+		r.Storage,
+		[]string{ message.CancelKey(pid), sharedkey(pid) },
+		(10 * time.Minute).Milliseconds(),
+	).Bool()
+	if err != nil {
+		log.Error().Err(err).Str(logging.Pid, pid).Msg("unable to cancel")
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		log.Info().Str(logging.Pid, pid).Msg("shared; not cancelled")
+		ctx.AbortWithStatusJSON(http.StatusConflict, gin.H {
+			"location": fmt.Sprintf("result/%s/status", pid),
+			"status":   "shared",
+		})
+		return
+	}
+
+	err = r.Storage.Del(
+		ctx,
+		headerkey(pid),
+		pid,
+		message.PartsKey(pid),
+		message.FailureKey(pid),
+	).Err()
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str(logging.Pid, pid).
+			Msg("unable to clean up cancelled process")
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	log.Info().Str(logging.Pid, pid).Msg("cancelled")
+	ctx.JSON(http.StatusOK, gin.H {
+		"location": fmt.Sprintf("result/%s/status", pid),
+		"status":   "cancelled",
+	})
+}
@@ -0,0 +1,264 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/equinor/oneseismic/api/internal/message"
+)
+
+func testredis(t *testing.T) redis.Cmdable {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("unable to start miniredis: %v", err)
+	}
+	t.Cleanup(mr.Close)
+	return redis.NewClient(&redis.Options { Addr: mr.Addr() })
+}
+
+/*
+ * Write a process header for pid with ntasks parts, like the scheduler does.
+ */
+func putheader(t *testing.T, storage redis.Cmdable, pid string, ntasks int) {
+	head := message.ProcessHeader {
+		Pid:      pid,
+		Function: "slice",
+		Ntasks:   ntasks,
+		Shape:  []int{ 2, 2 },
+		Index:  [][]float64{ { 1, 2 }, { 1, 2 } },
+	}
+	doc, err := head.Pack()
+	assert.Nil(t, err)
+	err = storage.Set(context.Background(), headerkey(pid), doc, 0).Err()
+	assert.Nil(t, err)
+}
+
+func putfailure(t *testing.T, storage redis.Cmdable, f message.Failure) {
+	doc, err := f.Pack()
+	assert.Nil(t, err)
+	key := message.FailureKey(f.Pid)
+	err = storage.RPush(context.Background(), key, doc).Err()
+	assert.Nil(t, err)
+}
+
+/*
+ * Call a result endpoint for pid, and return the response
+ */
+func callresult(
+	fn  func(*gin.Context),
+	pid string,
+) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodGet, "/result/" + pid, nil)
+	ctx.Params = gin.Params { { Key: "pid", Value: pid } }
+	fn(ctx)
+	return w
+}
+
+func TestStatusWorkingWithoutFailures(t *testing.T) {
+	storage := testredis(t)
+	putheader(t, storage, "pid", 2)
+	result := Result { Storage: storage }
+
+	w := callresult(result.Status, "pid")
+	assert.Equal(t, http.StatusAccepted, w.Code)
+
+	var body map[string]interface{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, "working", body["status"])
+}
+
+func TestStatusReportsFailed(t *testing.T) {
+	storage := testredis(t)
+	putheader(t, storage, "pid", 2)
+	putfailure(t, storage, message.Failure {
+		Pid:     "pid",
+		Part:    "1/2",
+		Kind:    "download",
+		Message: "fragment not found",
+	})
+	result := Result { Storage: storage }
+
+	w := callresult(result.Status, "pid")
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+	var body struct {
+		Status string            `json:"status"`
+		Errors []message.Failure `json:"errors"`
+	}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, "failed", body.Status)
+	assert.Equal(t, 1, len(body.Errors))
+	assert.Equal(t, "1/2", body.Errors[0].Part)
+	assert.Equal(t, "download", body.Errors[0].Kind)
+}
+
+func TestGetAndStreamReportFailed(t *testing.T) {
+	storage := testredis(t)
+	putheader(t, storage, "pid", 2)
+	putfailure(t, storage, message.Failure {
+		Pid:     "pid",
+		Part:    "0/2",
+		Kind:    "download",
+		Message: "fragment not found",
+	})
+	result := Result { Storage: storage }
+
+	w := callresult(result.Get, "pid")
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+	w = callresult(result.Stream, "pid")
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+}
+
+func TestCollectResultStopsOnFailure(t *testing.T) {
+	storage := testredis(t)
+	ctx := context.Background()
+	head := &message.ProcessHeader { Pid: "pid", Ntasks: 2 }
+
+	args := redis.XAddArgs {
+		Stream: "pid",
+		Values: map[string]interface{} { "0/2": "part" },
+	}
+	assert.Nil(t, storage.XAdd(ctx, &args).Err())
+	putfailure(t, storage, message.Failure {
+		Pid:     "pid",
+		Part:    "1/2",
+		Kind:    "download",
+		Message: "fragment not found",
+	})
+
+	tiles   := make(chan []byte, 10)
+	failure := make(chan error, 1)
+	collectResult(ctx, storage, "pid", head, tiles, failure)
+
+	select {
+	case err := <-failure:
+		assert.Contains(t, err.Error(), "part=1/2")
+	default:
+		t.Errorf("expected failure from collectResult")
+	}
+
+	// the header and the one completed part should still be sent
+	assert.Equal(t, 2, len(tiles))
+}
+
+func TestCancelRemovesProcess(t *testing.T) {
+	storage := testredis(t)
+	ctx := context.Background()
+	putheader(t, storage, "pid", 2)
+	args := redis.XAddArgs {
+		Stream: "pid",
+		Values: map[string]interface{} { "0/2": "part" },
+	}
+	assert.Nil(t, storage.XAdd(ctx, &args).Err())
+	result := Result { Storage: storage }
+
+	w := callresult(result.Cancel, "pid")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	n, err := storage.Exists(ctx, headerkey("pid"), "pid").Result()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), n)
+
+	n, err = storage.Exists(ctx, message.CancelKey("pid")).Result()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), n)
+}
+
+func TestCancelledProcessReportsCancelled(t *testing.T) {
+	storage := testredis(t)
+	putheader(t, storage, "pid", 2)
+	result := Result { Storage: storage }
+	callresult(result.Cancel, "pid")
+
+	for _, fn := range []func(*gin.Context) {
+		result.Status,
+		result.Get,
+		result.Stream,
+	} {
+		w := callresult(fn, "pid")
+		assert.Equal(t, http.StatusGone, w.Code)
+
+		var body map[string]interface{}
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &body))
+		assert.Equal(t, "cancelled", body["status"])
+	}
+}
+
+func TestCollectResultDropsDuplicateParts(t *testing.T) {
+	storage := testredis(t)
+	ctx := context.Background()
+	head := &message.ProcessHeader { Pid: "pid", Ntasks: 2 }
+
+	for _, part := range []string{ "0/2", "0/2", "1/2" } {
+		args := redis.XAddArgs {
+			Stream: "pid",
+			Values: map[string]interface{} { part: part },
+		}
+		assert.Nil(t, storage.XAdd(ctx, &args).Err())
+	}
+
+	tiles   := make(chan []byte, 10)
+	failure := make(chan error, 1)
+	collectResult(ctx, storage, "pid", head, tiles, failure)
+
+	<-tiles // header
+	parts := []string{}
+	for tile := range tiles {
+		parts = append(parts, string(tile))
+	}
+	assert.Equal(t, []string{ "0/2", "1/2" }, parts)
+}
+
+func TestStatusCountsDistinctParts(t *testing.T) {
+	storage := testredis(t)
+	ctx := context.Background()
+	putheader(t, storage, "pid", 2)
+	for _, part := range []string{ "0/2", "0/2" } {
+		args := redis.XAddArgs {
+			Stream: "pid",
+			Values: map[string]interface{} { part: part },
+		}
+		assert.Nil(t, storage.XAdd(ctx, &args).Err())
+		assert.Nil(t, storage.SAdd(ctx, message.PartsKey("pid"), part).Err())
+	}
+	result := Result { Storage: storage }
+
+	w := callresult(result.Status, "pid")
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	var body map[string]interface{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, "working", body["status"])
+	assert.Equal(t, "1/2", body["progress"])
+}
+
+func TestStreamCountsResultBytes(t *testing.T) {
+	storage := testredis(t)
+	ctx := context.Background()
+	putheader(t, storage, "pid", 2)
+	for _, part := range []string{ "0/2", "1/2" } {
+		args := redis.XAddArgs {
+			Stream: "pid",
+			Values: map[string]interface{} { part: part },
+		}
+		assert.Nil(t, storage.XAdd(ctx, &args).Err())
+	}
+	result := Result { Storage: storage }
+
+	counter := resultBytesTotal.WithLabelValues("slice", "ok")
+	before := testutil.ToFloat64(counter)
+	w := callresult(result.Stream, "pid")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, float64(w.Body.Len()), testutil.ToFloat64(counter) - before)
+}
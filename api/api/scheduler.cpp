@@ -17,17 +17,28 @@ char* copy(char* dst, const T& x) noexcept (true) {
 
 }
 
-plan mkschedule(const char* doc, int len, int task_size) {
+plan mkschedule(const char* doc, int len, tasksize size) {
     plan p {};
     std::vector< std::string > packed;
     try {
-        packed = one::mkschedule(doc, len, task_size);
+        const auto sizing = one::task_sizing {
+            size.size,
+            size.max,
+            size.workers,
+        };
+        packed = one::mkschedule(doc, len, sizing);
     } catch (one::not_found& e) {
         p.status_code = 404;
         auto* err = new char[std::strlen(e.what()) + 1];
         std::strcpy(err, e.what());
         p.err = err;
         return p;
+    } catch (one::bad_value& e) {
+        p.status_code = 400;
+        auto* err = new char[std::strlen(e.what()) + 1];
+        std::strcpy(err, e.what());
+        p.err = err;
+        return p;
     } catch (std::exception& e) {
         p.status_code = 500;
         auto* err = new char[std::strlen(e.what()) + 1];
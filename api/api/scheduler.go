@@ -19,21 +19,90 @@ import "unsafe"
 import(
 	"context"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/go-redis/redis/v8"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
 
+	"github.com/equinor/oneseismic/api/internal/logging"
 	"github.com/equinor/oneseismic/api/internal/message"
+	"github.com/equinor/oneseismic/api/internal/tracing"
 )
 
+/*
+ * The task size is the number of fragments in a task. A fixed task size (Size
+ * > 0) is used for all queries. Otherwise the task size is adaptive, and
+ * picked for every query from the number of fragments it needs, the number of
+ * fetch workers, and the target latency of a task:
+ *
+ *   Latency:  the target time for a worker to complete a task
+ *   Fragment: the estimated time a worker spends on a single fragment
+ *   Group:    the consumer group of the fetch workers
+ *   Stream:   the job stream of the fetch workers, which defaults to jobs
+ *
+ * Small queries are kept in a single task, to not pay the overhead of tasks
+ * for nothing, while larger queries are spread across the workers in tasks
+ * that complete within the target latency, to cut the tail latency.
+ */
+type TaskSize struct {
+	Size     int
+	Latency  time.Duration
+	Fragment time.Duration
+	Group    string
+	Stream   string
+}
+
+/*
+ * The job stream the tasks are put on, and the fetch workers read from
+ */
+func (ts TaskSize) stream() string {
+	if ts.Stream == "" {
+		return "jobs"
+	}
+	return ts.Stream
+}
+
+/*
+ * Consumers in the fetch group that have not read from the job stream for
+ * this long are assumed to be dead. Workers block for at most a second when
+ * reading, so live workers are well below it, but workers that die without
+ * leaving the group stay in it.
+ */
+const workeridle = 30 * time.Second
+
+/*
+ * The number of live workers is cached for this long, so that planning a
+ * query does not need a round-trip to redis.
+ */
+const workerttl = 5 * time.Second
+
+/*
+ * The cached number of live workers.
+ */
+type workercount struct {
+	sync.Mutex
+	n       int
+	expires time.Time
+}
+
+/*
+ * The number of tasks put on the job queue in a single round-trip. The
+ * process is checked for cancellation before every batch.
+ */
+const schedulebatch = 100
+
 type cppscheduler struct {
-	tasksize int
+	tasksize TaskSize
 	storage  redis.Cmdable
+	workers  workercount
 }
 
 type QueryPlan struct {
-	header []byte
-	plan   [][]byte
+	function string
+	header   []byte
+	plan     [][]byte
 }
 
 type QueryError struct {
@@ -49,6 +118,14 @@ func (qe *QueryError) Status() int {
 	return qe.status
 }
 
+/*
+ * The status is forwarded to the client in the error's extensions, as the
+ * graphql response itself is always 200 OK.
+ */
+func (qe *QueryError) Extensions() map[string]interface{} {
+	return map[string]interface{} { "status": qe.status }
+}
+
 /*
  * This interface does feel superfluous, and should probably not need to be
  * exported. Using an interface makes testing a lot easier though, and unless
@@ -56,18 +133,99 @@ func (qe *QueryError) Status() int {
  * for now.
  */
 type scheduler interface {
-	MakeQuery(*message.Query) (*QueryPlan, error)
+	MakeQuery(context.Context, *message.Query) (*QueryPlan, error)
 	Schedule(context.Context, string, *QueryPlan) error
 }
 
-func newScheduler(storage redis.Cmdable) scheduler {
+func newScheduler(storage redis.Cmdable, tasksize TaskSize) scheduler {
 	return &cppscheduler{
 		storage:  storage,
-		tasksize: 10,
+		tasksize: tasksize,
+	}
+}
+
+/*
+ * The task sizing of a query. With adaptive task sizes the workers are the
+ * live consumers in the fetch group, which is looked up regularly since
+ * workers come and go.
+ */
+func (sched *cppscheduler) sizing(ctx context.Context) C.struct_tasksize {
+	ts := sched.tasksize
+	if ts.Size > 0 {
+		return C.struct_tasksize { size: C.int(ts.Size) }
+	}
+
+	max := 1
+	if ts.Fragment > 0 && ts.Latency > ts.Fragment {
+		max = int(ts.Latency / ts.Fragment)
+	}
+
+	return C.struct_tasksize {
+		max:     C.int(max),
+		workers: C.int(sched.countworkers(ctx)),
+	}
+}
+
+/*
+ * Count the live consumers in the fetch group, i.e. the ones that have
+ * recently read from the job stream. When they can not be counted, or there
+ * are none, the query is planned as if there is a single worker.
+ */
+func (sched *cppscheduler) countworkers(ctx context.Context) int {
+	sched.workers.Lock()
+	n, expires := sched.workers.n, sched.workers.expires
+	sched.workers.Unlock()
+	now := time.Now()
+	if now.Before(expires) {
+		return n
+	}
+
+	/*
+	 * Count the workers without holding the lock, so that concurrent queries
+	 * are not serialized behind the round-trip. Queries that race on an
+	 * expired count all ask redis, which is harmless.
+	 */
+	group  := sched.tasksize.Group
+	stream := sched.tasksize.stream()
+	consumers, err := sched.storage.XInfoConsumers(ctx, stream, group).Result()
+	if err != nil {
+		logging.FromContext(ctx).Warn().
+			Err(err).
+			Str("group", group).
+			Msg("unable to count workers; assuming 1")
+		return 1
+	}
+
+	n = 0
+	for _, consumer := range consumers {
+		if time.Duration(consumer.Idle) * time.Millisecond < workeridle {
+			n++
+		}
+	}
+	if n == 0 {
+		n = 1
 	}
+	sched.workers.Lock()
+	sched.workers.n       = n
+	sched.workers.expires = now.Add(workerttl)
+	sched.workers.Unlock()
+	return n
 }
 
-func (sched *cppscheduler) MakeQuery(msg *message.Query) (*QueryPlan, error) {
+func (sched *cppscheduler) MakeQuery(
+	ctx context.Context,
+	msg *message.Query,
+) (plan *QueryPlan, err error) {
+	_, span := tracing.Tracer().Start(ctx, "scheduler.MakeQuery")
+	span.SetAttributes(
+		attribute.String(logging.Pid,      msg.Pid),
+		attribute.String(logging.Function, msg.Function),
+	)
+	defer func() {
+		tracing.Fail(span, err)
+		span.End()
+	}()
+
 	task, err := msg.Pack()
 	if err != nil {
 		return nil, fmt.Errorf("pack error: %w", err)
@@ -76,7 +234,7 @@ func (sched *cppscheduler) MakeQuery(msg *message.Query) (*QueryPlan, error) {
 	csched := C.mkschedule(
 		(*C.char)(unsafe.Pointer(&task[0])),
 		C.int(len(task)),
-		C.int(sched.tasksize),
+		sched.sizing(ctx),
 	)
 	defer C.cleanup(&csched)
 	if csched.err != nil {
@@ -96,9 +254,12 @@ func (sched *cppscheduler) MakeQuery(msg *message.Query) (*QueryPlan, error) {
 		this += uintptr(size)
 	}
 
+	planTasks.WithLabelValues(msg.Function).Observe(float64(ntasks - 1))
+	span.SetAttributes(attribute.Int("tasks", ntasks - 1))
 	return &QueryPlan {
-		header: result[0],
-		plan:   result[1:],
+		function: msg.Function,
+		header:   result[0],
+		plan:     result[1:],
 	}, nil
 }
 
@@ -106,36 +267,170 @@ func (sched *cppscheduler) Schedule(
 	ctx  context.Context,
 	pid  string,
 	plan *QueryPlan,
-) error {
+) (err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "scheduler.Schedule")
+	span.SetAttributes(
+		attribute.String(logging.Pid,      pid),
+		attribute.String(logging.Function, plan.function),
+		attribute.Int("tasks", len(plan.plan)),
+	)
+	defer func() {
+		tracing.Fail(span, err)
+		span.End()
+	}()
+
 	/*
 	 * TODO: This mixes I/O with parsing and building the plan. This could very
 	 * well be split up into sub structs and functions which can then be
 	 * dependency-injected for some customisation and easier testing.
 	 */
-	sched.storage.Set(
+	cancelled, err := sched.cancelled(ctx, pid)
+	if err != nil {
+		sched.fail(pid, "", err)
+		return err
+	}
+	if cancelled {
+		return nil
+	}
+
+	err = sched.storage.Set(
 		ctx,
-		fmt.Sprintf("%s/header.json", pid),
+		headerkey(pid),
 		plan.header,
 		10 * time.Minute,
-	)
+	).Err()
+	if err != nil {
+		err = fmt.Errorf("unable to put header in storage; %w", err)
+		sched.fail(pid, "", err)
+		return err
+	}
 	ntasks := len(plan.plan)
-	for i, task := range plan.plan {
+	for i := 0; i < ntasks; i += schedulebatch {
+		/*
+		 * The request was cancelled or timed out, which leaves the process
+		 * with only some of its tasks. Report it as failed and remove the
+		 * header, with a context of their own since ctx is done.
+		 */
 		if ctx.Err() != nil {
+			sched.fail(pid, "", ctx.Err())
+			sched.storage.Del(context.Background(), headerkey(pid))
 			return ctx.Err()
 		}
 
-		part := fmt.Sprintf("%d/%d", i, ntasks)
-		values := []interface{} {
-			"pid",  pid,
-			"part", part,
-			"task", task,
+		/*
+		 * The process can be cancelled by the client while it is being
+		 * scheduled, in which case the remaining tasks are dropped. This is
+		 * not an error from the scheduler's point of view. The cancel may
+		 * have removed the header before it was written, so remove it
+		 * (again), or it would outlive the process.
+		 */
+		cancelled, err := sched.cancelled(ctx, pid)
+		if err != nil {
+			sched.fail(pid, "", err)
+			return err
+		}
+		if cancelled {
+			log.Info().
+				Str(logging.Pid, pid).
+				Str(logging.Function, plan.function).
+				Msgf("cancelled after %d/%d parts", i, ntasks)
+			sched.storage.Del(ctx, headerkey(pid))
+			return nil
 		}
-		args := redis.XAddArgs{Stream: "jobs", Values: values}
-		_, err := sched.storage.XAdd(ctx, &args).Result()
+
+		end := i + schedulebatch
+		if end > ntasks {
+			end = ntasks
+		}
+		err = sched.enqueue(ctx, pid, plan, i, end)
 		if err != nil {
-			msg := "part=%v unable to put in storage; %w"
-			return fmt.Errorf(msg, part, err)
+			return err
 		}
 	}
 	return nil
 }
+
+/*
+ * Put the tasks [begin, end) of the plan on the job queue, in a single
+ * round-trip.
+ */
+func (sched *cppscheduler) enqueue(
+	ctx   context.Context,
+	pid   string,
+	plan  *QueryPlan,
+	begin int,
+	end   int,
+) error {
+	ntasks := len(plan.plan)
+	stream := sched.tasksize.stream()
+	start := time.Now()
+	cmds, err := sched.storage.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i := begin; i < end; i++ {
+			values := []interface{} {
+				"pid",  pid,
+				"part", fmt.Sprintf("%d/%d", i, ntasks),
+				"task", plan.plan[i],
+			}
+			pipe.XAdd(ctx, &redis.XAddArgs{Stream: stream, Values: values})
+		}
+		return nil
+	})
+	scheduleXAddSeconds.WithLabelValues(
+		plan.function,
+		outcome(err),
+	).Observe(time.Since(start).Seconds())
+	if err == nil {
+		return nil
+	}
+
+	part := fmt.Sprintf("%d/%d", begin, ntasks)
+	for i, cmd := range cmds {
+		if cmd.Err() != nil {
+			part = fmt.Sprintf("%d/%d", begin + i, ntasks)
+			break
+		}
+	}
+	msg := "part=%v unable to put in storage; %w"
+	err = fmt.Errorf(msg, part, err)
+	sched.fail(pid, part, err)
+	return err
+}
+
+func (sched *cppscheduler) cancelled(
+	ctx context.Context,
+	pid string,
+) (bool, error) {
+	n, err := sched.storage.Exists(ctx, message.CancelKey(pid)).Result()
+	if err != nil {
+		return false, fmt.Errorf("pid=%s unable to check cancellation; %w", pid, err)
+	}
+	return n > 0, nil
+}
+
+/*
+ * Report the process as failed, so that clients waiting for the result are
+ * told that it will never complete. This is best-effort, since the failure
+ * to schedule is likely caused by storage being unavailable.
+ */
+func (sched *cppscheduler) fail(pid string, part string, err error) {
+	failure := message.Failure {
+		Pid:     pid,
+		Part:    part,
+		Kind:    "schedule",
+		Message: err.Error(),
+	}
+	packed, e := failure.Pack()
+	if e != nil {
+		log.Error().Err(e).Str(logging.Pid, pid).Msg("unable to pack failure")
+		return
+	}
+
+	ctx := context.Background()
+	key := message.FailureKey(pid)
+	e = sched.storage.RPush(ctx, key, packed).Err()
+	if e != nil {
+		log.Error().Err(e).Str(logging.Pid, pid).Msg("unable to report failure")
+		return
+	}
+	sched.storage.Expire(ctx, key, 10 * time.Minute)
+}
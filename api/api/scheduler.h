@@ -50,7 +50,17 @@ struct plan {
     char* tasks;
 };
 
-struct plan mkschedule(const char* doc, int len, int task_size);
+/*
+ * The number of fragments per task, see one::task_sizing. A size of zero
+ * means adaptive sizing from max and workers.
+ */
+struct tasksize {
+    int size;
+    int max;
+    int workers;
+};
+
+struct plan mkschedule(const char* doc, int len, struct tasksize);
 void cleanup(struct plan*);
 
 #ifdef __cplusplus
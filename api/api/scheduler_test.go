@@ -0,0 +1,640 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/equinor/oneseismic/api/internal/message"
+)
+
+func TestScheduleCancelledProcessWritesNoTasks(t *testing.T) {
+	storage := testredis(t)
+	ctx := context.Background()
+	key := message.CancelKey("pid")
+	assert.Nil(t, storage.Set(ctx, key, "", 0).Err())
+
+	sched := newScheduler(storage, TaskSize { Size: 10 })
+	plan := &QueryPlan {
+		header: []byte("header"),
+		plan:   [][]byte{ []byte("task-0"), []byte("task-1") },
+	}
+	assert.Nil(t, sched.Schedule(ctx, "pid", plan))
+
+	n, err := storage.Exists(ctx, "jobs", headerkey("pid")).Result()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), n)
+}
+
+func TestScheduleWritesHeaderAndTasks(t *testing.T) {
+	storage := testredis(t)
+	ctx := context.Background()
+
+	sched := newScheduler(storage, TaskSize { Size: 10 })
+	plan := &QueryPlan {
+		header: []byte("header"),
+		plan:   [][]byte{ []byte("task-0"), []byte("task-1") },
+	}
+	assert.Nil(t, sched.Schedule(ctx, "pid", plan))
+
+	header, err := storage.Get(ctx, headerkey("pid")).Result()
+	assert.Nil(t, err)
+	assert.Equal(t, "header", header)
+
+	n, err := storage.XLen(ctx, "jobs").Result()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), n)
+}
+
+/*
+ * A storage where the process is cancelled by the client as soon as the first
+ * batch of tasks is scheduled. Only the cancellation marker is set, like when
+ * the cancel removed the header before the scheduler wrote it.
+ */
+type cancelAfterBatch struct {
+	redis.Cmdable
+	pid string
+}
+
+func (c cancelAfterBatch) Pipelined(
+	ctx context.Context,
+	fn  func(redis.Pipeliner) error,
+) ([]redis.Cmder, error) {
+	cmds, err := c.Cmdable.Pipelined(ctx, fn)
+	c.Cmdable.Set(ctx, message.CancelKey(c.pid), "", 0)
+	return cmds, err
+}
+
+func TestScheduleStopsAndRemovesHeaderOnCancel(t *testing.T) {
+	storage := testredis(t)
+	ctx := context.Background()
+
+	sched := newScheduler(
+		cancelAfterBatch { Cmdable: storage, pid: "pid" },
+		TaskSize { Size: 10 },
+	)
+	plan := &QueryPlan { header: []byte("header") }
+	for i := 0; i < schedulebatch + 1; i++ {
+		plan.plan = append(plan.plan, []byte(fmt.Sprintf("task-%d", i)))
+	}
+	assert.Nil(t, sched.Schedule(ctx, "pid", plan))
+
+	n, err := storage.XLen(ctx, "jobs").Result()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(schedulebatch), n)
+
+	n, err = storage.Exists(ctx, headerkey("pid")).Result()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), n)
+}
+
+/*
+ * A storage where the context of the request is cancelled as soon as the
+ * first batch of tasks is scheduled.
+ */
+type cancelContextAfterBatch struct {
+	redis.Cmdable
+	cancel context.CancelFunc
+}
+
+func (c cancelContextAfterBatch) Pipelined(
+	ctx context.Context,
+	fn  func(redis.Pipeliner) error,
+) ([]redis.Cmder, error) {
+	cmds, err := c.Cmdable.Pipelined(ctx, fn)
+	c.cancel()
+	return cmds, err
+}
+
+func TestScheduleFailsProcessAndRemovesHeaderWhenContextIsDone(t *testing.T) {
+	storage := testredis(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sched := newScheduler(
+		cancelContextAfterBatch { Cmdable: storage, cancel: cancel },
+		TaskSize { Size: 10 },
+	)
+	plan := &QueryPlan { header: []byte("header") }
+	for i := 0; i < schedulebatch + 1; i++ {
+		plan.plan = append(plan.plan, []byte(fmt.Sprintf("task-%d", i)))
+	}
+	assert.NotNil(t, sched.Schedule(ctx, "pid", plan))
+
+	bg := context.Background()
+	failures, err := processFailures(bg, storage, "pid")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(failures))
+
+	n, err := storage.Exists(bg, headerkey("pid")).Result()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), n)
+}
+
+/*
+ * A storage where the cancellation check fails from the nth check, like when
+ * the connection to redis is lost while scheduling.
+ */
+type failCancelCheck struct {
+	redis.Cmdable
+	n      int
+	checks *int
+}
+
+func (f failCancelCheck) Exists(
+	ctx  context.Context,
+	keys ...string,
+) *redis.IntCmd {
+	*f.checks++
+	if *f.checks < f.n {
+		return f.Cmdable.Exists(ctx, keys...)
+	}
+	cmd := redis.NewIntCmd(ctx)
+	cmd.SetErr(errors.New("connection lost"))
+	return cmd
+}
+
+func TestScheduleFailsProcessWhenCancelCheckFails(t *testing.T) {
+	ctx := context.Background()
+	plan := &QueryPlan { header: []byte("header") }
+	for i := 0; i < schedulebatch + 1; i++ {
+		plan.plan = append(plan.plan, []byte(fmt.Sprintf("task-%d", i)))
+	}
+
+	/*
+	 * Before the header is written, and before the second batch
+	 */
+	for _, n := range []int{ 1, 3 } {
+		storage := testredis(t)
+		checks := 0
+		sched := newScheduler(
+			failCancelCheck { Cmdable: storage, n: n, checks: &checks },
+			TaskSize { Size: 10 },
+		)
+		assert.NotNil(t, sched.Schedule(ctx, "pid", plan))
+
+		failures, err := processFailures(ctx, storage, "pid")
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(failures), "check %d", n)
+	}
+}
+
+/*
+ * A manifest for a small 2x2x2 cube
+ */
+func testmanifest() map[string]interface{} {
+	return map[string]interface{} {
+		"format-version": 1,
+		"data": []interface{} {
+			map[string]interface{} {
+				"file-extension": "f32",
+				"shapes":         [][]int{ { 64, 64, 64 } },
+				"prefix":         "src",
+				"resolution":     "source",
+			},
+		},
+		"attributes":   []interface{}{},
+		"line-numbers": [][]int{ { 1, 2 }, { 10, 11 }, { 0, 4 } },
+		"line-labels":  []string{ "inline", "crossline", "time" },
+	}
+}
+
+func TestMakeQueryCarriesTraceContext(t *testing.T) {
+	tracecontext := map[string]string {
+		"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+	}
+	query := message.Query {
+		Pid:             "pid",
+		Token:           "token",
+		Guid:            "guid",
+		StorageEndpoint: "https://storage.com",
+		Shape:           []int32{ 64, 64, 64 },
+		Function:        "slice",
+		Args:            sliceargs { Kind: "index", Dim: 0, Val: 0 },
+		TraceContext:    tracecontext,
+		Manifest:        testmanifest(),
+	}
+
+	sched := newScheduler(nil, TaskSize { Size: 10 })
+	plan, err := sched.MakeQuery(context.Background(), &query)
+	assert.Nil(t, err)
+
+	head, err := (&message.ProcessHeader{}).Unpack(plan.header)
+	assert.Nil(t, err)
+	assert.Equal(t, tracecontext, head.TraceContext)
+
+	assert.NotEmpty(t, plan.plan)
+	for _, packed := range plan.plan {
+		task, err := (&message.Task{}).Unpack(packed)
+		assert.Nil(t, err)
+		assert.Equal(t, tracecontext, task.TraceContext)
+	}
+}
+
+/*
+ * Make the query of function and args against the manifest, and unpack the
+ * process header of the plan. The fragment shape is picked by the planner.
+ */
+func makequery(
+	t        *testing.T,
+	sched    scheduler,
+	manifest map[string]interface{},
+	function string,
+	args     interface{},
+) (*QueryPlan, *message.ProcessHeader, error) {
+	query := message.Query {
+		Pid:             "pid",
+		Token:           "token",
+		Guid:            "guid",
+		StorageEndpoint: "https://storage.com",
+		Function:        function,
+		Args:            args,
+		Manifest:        manifest,
+	}
+	plan, err := sched.MakeQuery(context.Background(), &query)
+	if err != nil {
+		return nil, nil, err
+	}
+	head, err := (&message.ProcessHeader{}).Unpack(plan.header)
+	assert.Nil(t, err)
+	return plan, head, nil
+}
+
+/*
+ * The planning of time slices is tested in core/tests/plan.cpp. This checks
+ * that the arguments make it to the planner, and that times outside the cube
+ * are reported as not found.
+ */
+func TestTimeSliceArgumentsReachThePlanner(t *testing.T) {
+	manifest := testmanifest()
+	manifest["sample-interval"] = 4.0
+	manifest["sample-start"]    = 0.0
+	sched := newScheduler(nil, TaskSize { Size: 10 })
+
+	plan, head, err := makequery(
+		t,
+		sched,
+		manifest,
+		"slice",
+		sliceargs { Kind: "time", Dim: 2, Val: 4 },
+	)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]float64{ { 1, 2 }, { 10, 11 } }, head.Index)
+	task, err := (&message.Task{}).Unpack(plan.plan[0])
+	assert.Nil(t, err)
+	assert.Equal(t, "slice", task.Function)
+
+	_, _, err = makequery(
+		t,
+		sched,
+		manifest,
+		"slice",
+		sliceargs { Kind: "time", Dim: 2, Val: 200 },
+	)
+	qe, ok := err.(*QueryError)
+	assert.True(t, ok)
+	assert.Equal(t, 404, qe.Status())
+}
+
+/*
+ * The planning of sub-volumes is tested in core/tests/plan.cpp. This checks
+ * that the ranges make it to the planner.
+ */
+func TestSubvolumeArgumentsReachThePlanner(t *testing.T) {
+	manifest := testmanifest()
+	manifest["line-numbers"] = [][]int{ { 1, 2, 3 }, { 10, 11 }, { 0, 4, 8 } }
+	manifest["sample-interval"] = 4.0
+	manifest["sample-start"]    = 0.0
+	sched := newScheduler(nil, TaskSize { Size: 10 })
+
+	plan, head, err := makequery(t, sched, manifest, "subvolume", subvolumeargs {
+		Ranges: [][]float64{ { 2, 3 }, { 0, 100 }, { 3, 5 } },
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []int{ 2, 2, 1 }, head.Shape)
+	task, err := (&message.Task{}).Unpack(plan.plan[0])
+	assert.Nil(t, err)
+	assert.Equal(t, "subvolume", task.Function)
+}
+
+/*
+ * The planning of windows is tested in core/tests/plan.cpp. This checks that
+ * the windows of slices and curtains make it to the planner.
+ */
+func TestWindowArgumentsReachThePlanner(t *testing.T) {
+	manifest := testmanifest()
+	manifest["line-numbers"] = [][]int{ { 1, 2, 3 }, { 10, 11 }, { 0, 4, 8 } }
+	manifest["sample-interval"] = 4.0
+	manifest["sample-start"]    = 0.0
+	sched := newScheduler(nil, TaskSize { Size: 10 })
+
+	_, head, err := makequery(t, sched, manifest, "slice", sliceargs {
+		Kind:   "lineno",
+		Dim:    0,
+		Val:    2,
+		Ranges: [][]float64{ { 10, 10 }, { 0, 4 } },
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []int{ 1, 2 }, head.Shape)
+
+	_, head, err = makequery(t, sched, manifest, "curtain", curtainargs {
+		Coords:  [][]int32{ { 1, 10 }, { 3, 11 } },
+		Samples: []float64{ 4, 8 },
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []int{ 2, 2 }, head.Shape)
+}
+
+/*
+ * The planning of attributes is tested in core/tests/plan.cpp. This checks
+ * that the arguments make it to the planner, and that missing attributes are
+ * reported as not found.
+ */
+func TestAttributeArgumentsReachThePlanner(t *testing.T) {
+	manifest := testmanifest()
+	manifest["line-numbers"] = [][]int{ { 1, 2, 3 }, { 10, 11 }, { 0, 4, 8 } }
+	manifest["attributes"] = []interface{} {
+		map[string]interface{} {
+			"prefix":         "attributes/cdp",
+			"file-extension": "f64",
+			"type":           "cdp",
+			"layout":         "tiled",
+			"labels":         []string{ "cdpx", "cdpy" },
+			"shapes":         [][]int{ { 2, 2 } },
+		},
+	}
+	sched := newScheduler(nil, TaskSize { Size: 10 })
+
+	dim, lineno := int32(0), int32(3)
+	_, head, err := makequery(t, sched, manifest, "attribute", attributeargs {
+		Kind:   "cdp",
+		Dim:    &dim,
+		Lineno: &lineno,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []int{ 2, 2 }, head.Shape)
+
+	_, head, err = makequery(t, sched, manifest, "attribute", attributeargs {
+		Kind:   "cdp",
+		Coords: [][]int32{ { 2, 11 } },
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []int{ 1, 2 }, head.Shape)
+
+	_, _, err = makequery(
+		t,
+		sched,
+		manifest,
+		"attribute",
+		attributeargs { Kind: "utm" },
+	)
+	qe, ok := err.(*QueryError)
+	assert.True(t, ok)
+	assert.Equal(t, 404, qe.Status())
+}
+
+/*
+ * The planning of horizons is tested in core/tests/plan.cpp. This checks
+ * that the values and window make it to the planner.
+ */
+func TestHorizonArgumentsReachThePlanner(t *testing.T) {
+	manifest := testmanifest()
+	manifest["line-numbers"] = [][]int{ { 1, 2 }, { 10, 11 }, { 0, 4, 8 } }
+	manifest["sample-interval"] = 4.0
+	manifest["sample-start"]    = 0.0
+	sched := newScheduler(nil, TaskSize { Size: 10 })
+
+	z := 4.0
+	plan, head, err := makequery(t, sched, manifest, "horizon", horizonargs {
+		Values: [][]*float64{ { &z, nil }, { &z, &z } },
+		Window: []float64{ 4, 4 },
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []int{ 2, 2, 3 }, head.Shape)
+	task, err := (&message.Task{}).Unpack(plan.plan[0])
+	assert.Nil(t, err)
+	assert.Equal(t, "horizon", task.Function)
+}
+
+/*
+ * The partitioning of horizon attributes is tested in core/tests/plan.cpp.
+ * This checks that the attribute makes it to the planner.
+ */
+func TestHorizonAttributeArgumentsReachThePlanner(t *testing.T) {
+	manifest := testmanifest()
+	manifest["line-numbers"] = [][]int{ { 1, 2 }, { 10, 11 }, { 0, 4, 8 } }
+	manifest["sample-interval"] = 4.0
+	manifest["sample-start"]    = 0.0
+	sched := newScheduler(nil, TaskSize { Size: 10 })
+
+	z := 4.0
+	row := []*float64{ &z, &z }
+	args := horizonattributeargs {
+		horizonargs: horizonargs { Values: [][]*float64{ row, row } },
+		Attribute:   "rms",
+	}
+	plan, head, err := makequery(t, sched, manifest, "horizon-attribute", args)
+	assert.Nil(t, err)
+	assert.Equal(t, []int{ 2, 2 }, head.Shape)
+	task, err := (&message.Task{}).Unpack(plan.plan[0])
+	assert.Nil(t, err)
+	assert.Equal(t, "horizon-attribute", task.Function)
+
+	args.Attribute = "median"
+	_, _, err = makequery(t, sched, manifest, "horizon-attribute", args)
+	assert.NotNil(t, err)
+}
+
+/*
+ * The planning of decimated slices is tested in core/tests/plan.cpp. This
+ * checks that the stride makes it to the planner.
+ */
+func TestStrideArgumentsReachThePlanner(t *testing.T) {
+	manifest := testmanifest()
+	manifest["line-numbers"] = [][]int{ { 1, 2, 3 }, { 10, 11 }, { 0, 4, 8 } }
+	manifest["sample-interval"] = 4.0
+	manifest["sample-start"]    = 0.0
+	sched := newScheduler(nil, TaskSize { Size: 10 })
+
+	_, head, err := makequery(t, sched, manifest, "slice", sliceargs {
+		Kind:   "index",
+		Dim:    2,
+		Val:    0,
+		Stride: []int32{ 2, 1 },
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []int{ 2, 2 }, head.Shape)
+	assert.Equal(t, [][]float64{ { 1, 3 }, { 10, 11 } }, head.Index)
+}
+
+/*
+ * The planning of coarse slices is tested in core/tests/plan.cpp. This checks
+ * that the resolution makes it to the planner.
+ */
+func TestResolutionArgumentsReachThePlanner(t *testing.T) {
+	manifest := testmanifest()
+	manifest["data"] = append(manifest["data"].([]interface{}),
+		map[string]interface{} {
+			"file-extension": "f32",
+			"shapes":         [][]int{ { 64, 64, 64 } },
+			"prefix":         "src/lod1",
+			"resolution":     "lod1",
+			"level":          1,
+			"decimation":     []int{ 2, 2, 2 },
+		},
+	)
+	manifest["line-numbers"] = [][]int{ { 1, 2, 3 }, { 10, 11, 12 }, { 0, 4, 8 } }
+	manifest["sample-interval"] = 4.0
+	manifest["sample-start"]    = 0.0
+	sched := newScheduler(nil, TaskSize { Size: 10 })
+
+	_, head, err := makequery(t, sched, manifest, "slice", sliceargs {
+		Kind:       "lineno",
+		Dim:        0,
+		Val:        3,
+		Resolution: []int32{ 2, 2, 2 },
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, head.Level)
+}
+
+/*
+ * The choice of fragment shape is tested in core/tests/plan.cpp. This checks
+ * that the shape picked by the planner is in the process header.
+ */
+func TestProcessHeaderHasTheFragmentShape(t *testing.T) {
+	manifest := testmanifest()
+	manifest["data"] = []interface{} {
+		map[string]interface{} {
+			"file-extension": "f32",
+			"shapes":         [][]int{ { 1, 1, 2 } },
+			"prefix":         "src",
+			"resolution":     "source",
+		},
+	}
+	sched := newScheduler(nil, TaskSize { Size: 10 })
+
+	_, head, err := makequery(
+		t,
+		sched,
+		manifest,
+		"slice",
+		sliceargs { Kind: "index", Dim: 0, Val: 0 },
+	)
+	assert.Nil(t, err)
+	assert.Equal(t, []int{ 1, 1, 2 }, head.FragmentShape)
+}
+
+/*
+ * A storage with n live and idle dead consumers in every group. Miniredis does
+ * not reply to XINFO CONSUMERS like redis does, so it is faked. The stream of
+ * the last XINFO CONSUMERS is recorded.
+ */
+type workers struct {
+	redis.Cmdable
+	n      int
+	idle   int
+	stream string
+}
+
+func (w *workers) XInfoConsumers(
+	ctx   context.Context,
+	key   string,
+	group string,
+) *redis.XInfoConsumersCmd {
+	w.stream = key
+	consumers := make([]redis.XInfoConsumer, w.n + w.idle)
+	for i := range consumers {
+		consumers[i].Name = fmt.Sprintf("worker-%d", i)
+		if i >= w.n {
+			consumers[i].Idle = workeridle.Milliseconds()
+		}
+	}
+	cmd := redis.NewXInfoConsumersCmd(ctx, key, group)
+	cmd.SetVal(consumers)
+	return cmd
+}
+
+func TestAdaptiveTaskSizeSpreadsLargeQueriesAcrossWorkers(t *testing.T) {
+	storage := &workers { Cmdable: testredis(t), n: 8, idle: 8 }
+
+	linenos := make([]int, 200)
+	for i := range linenos {
+		linenos[i] = i
+	}
+	manifest := testmanifest()
+	manifest["line-numbers"] = [][]int{ linenos, linenos, linenos }
+	manifest["sample-interval"] = 4.0
+	manifest["sample-start"]    = 0.0
+
+	/*
+	 * A task can have at most 4 fragments to complete within the latency
+	 */
+	sched := newScheduler(storage, TaskSize {
+		Latency:  200 * time.Millisecond,
+		Fragment: 50 * time.Millisecond,
+		Group:    "fetch",
+	})
+	plan := func(args sliceargs) *QueryPlan {
+		qp, _, err := makequery(t, sched, manifest, "slice", args)
+		assert.Nil(t, err)
+		return qp
+	}
+
+	/*
+	 * The 16 fragments of the time slice are spread across the 8 live
+	 * workers
+	 */
+	large := plan(sliceargs { Kind: "index", Dim: 2, Val: 0 })
+	assert.Equal(t, 8, len(large.plan))
+
+	/*
+	 * The number of workers is cached, so workers that just joined are not
+	 * counted yet
+	 */
+	storage.n = 16
+	large = plan(sliceargs { Kind: "index", Dim: 2, Val: 0 })
+	assert.Equal(t, 8, len(large.plan))
+
+	/*
+	 * The 4 fragments of the small window fit in a single task
+	 */
+	small := plan(sliceargs {
+		Kind:   "index",
+		Dim:    2,
+		Val:    0,
+		Ranges: [][]float64{ { 0, 100 }, { 0, 100 } },
+	})
+	assert.Equal(t, 1, len(small.plan))
+}
+
+func TestSchedulerUsesTheConfiguredStream(t *testing.T) {
+	ctx := context.Background()
+	storage := &workers { Cmdable: testredis(t), n: 1 }
+	sched := newScheduler(storage, TaskSize {
+		Latency:  time.Second,
+		Fragment: 50 * time.Millisecond,
+		Group:    "fetch",
+		Stream:   "tasks",
+	})
+
+	plan, _, err := makequery(
+		t,
+		sched,
+		testmanifest(),
+		"slice",
+		sliceargs { Kind: "index", Dim: 0, Val: 0 },
+	)
+	assert.Nil(t, err)
+	assert.Equal(t, "tasks", storage.stream)
+
+	assert.Nil(t, sched.Schedule(ctx, "pid", plan))
+	n, err := storage.XLen(ctx, "tasks").Result()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(plan.plan)), n)
+}
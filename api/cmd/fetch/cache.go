@@ -0,0 +1,381 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/equinor/oneseismic/api/internal/blobstore"
+)
+
+/*
+ * The fragment cache keeps recently downloaded fragments in the worker, so
+ * that popular fragments, e.g. the ones around a much-viewed line, are not
+ * downloaded over and over again.
+ *
+ * Fragments are keyed by the storage endpoint, the cube (container) guid and
+ * the fragment id, and stored together with the ETag they were downloaded
+ * with, which is taken from the download itself. Fragments are immutable in
+ * practice, so by default cached fragments are served as-is. With a
+ * revalidate interval, fragments that have not been checked for that long
+ * have their ETag checked with a HEAD request before they are served, which
+ * makes sure a re-uploaded cube is not served from stale fragments. The HEAD
+ * request is much cheaper than downloading the fragment, but is still a round
+ * trip, so this is opt-in.
+ *
+ * The cache has two tiers:
+ * - memory: an LRU of fragments, limited by a byte budget
+ * - disk (optional): fragments evicted from memory spill to files in a
+ *   directory, also an LRU limited by a byte budget. A disk hit moves the
+ *   fragment back into memory.
+ *
+ * The cache is shared by all processes in the worker and is safe for
+ * concurrent use. The mutex only guards the LRUs, and files are read and
+ * written without holding it, so that downloads are not serialized behind
+ * disk I/O. A file belongs to whoever took it out of (or is about to put it
+ * in) the disk LRU, and every spill gets a new file, so a file is never read
+ * and written at the same time. A nil *fragmentcache is a valid, disabled
+ * cache.
+ */
+type fragmentcache struct {
+	mutex sync.Mutex
+	/*
+	 * The memory tier. The value of entries is a *cachedfragment
+	 */
+	memory *lru
+	/*
+	 * The disk tier, nil if disabled. The value of entries is a *spilled
+	 */
+	disk *lru
+	dir  string
+	/*
+	 * For how long to trust a cached fragment before checking its ETag
+	 * again. 0 means cached fragments are never revalidated.
+	 */
+	revalidate time.Duration
+}
+
+/*
+ * A fragment in memory, with the ETag it was downloaded with, and when that
+ * ETag was last known to be current.
+ */
+type cachedfragment struct {
+	chunk   []byte
+	etag    string
+	checked time.Time
+}
+
+/*
+ * A fragment spilled to disk. The chunk is in the file name.
+ */
+type spilled struct {
+	name    string
+	etag    string
+	checked time.Time
+}
+
+/*
+ * The cache used by process.container(). This is nil (disabled) unless configured with
+ * --fragment-cache-bytes.
+ */
+var cache *fragmentcache
+
+/*
+ * Make a fragment cache that holds at most membytes in memory, and at most
+ * diskbytes in dir. The disk tier is disabled if dir is empty. Any files
+ * already in dir are removed, since they can not be trusted to be complete.
+ */
+func newFragmentCache(
+	membytes   int64,
+	dir        string,
+	diskbytes  int64,
+	revalidate time.Duration,
+) (*fragmentcache, error) {
+	fc := &fragmentcache {
+		memory:     newLRU(membytes),
+		revalidate: revalidate,
+	}
+	if dir == "" {
+		return fc, nil
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, fmt.Errorf("unable to clear cache dir: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("unable to create cache dir: %w", err)
+	}
+	fc.dir  = dir
+	fc.disk = newLRU(diskbytes)
+	return fc, nil
+}
+
+/*
+ * Get the fragment for key, from memory or disk, or nil on a miss. The tier
+ * the fragment was found in (memory, disk) is returned for metrics.
+ */
+func (fc *fragmentcache) get(key string) (*cachedfragment, string) {
+	fc.mutex.Lock()
+	if frag, ok := fc.memory.get(key); ok {
+		fc.mutex.Unlock()
+		return frag.(*cachedfragment), "memory"
+	}
+	if fc.disk == nil {
+		fc.mutex.Unlock()
+		return nil, ""
+	}
+	value, ok := fc.disk.remove(key)
+	fragmentCacheBytes.WithLabelValues("disk").Set(float64(fc.disk.bytes))
+	fc.mutex.Unlock()
+	if !ok {
+		return nil, ""
+	}
+
+	file := value.(*spilled)
+	chunk, err := ioutil.ReadFile(file.name)
+	os.Remove(file.name)
+	if err != nil {
+		return nil, ""
+	}
+	frag := &cachedfragment {
+		chunk:   chunk,
+		etag:    file.etag,
+		checked: file.checked,
+	}
+	fc.put(key, frag)
+	return frag, "disk"
+}
+
+/*
+ * Put a fragment in the cache. Fragments larger than the memory budget are
+ * not cached, and fragments evicted from memory are spilled to disk.
+ */
+func (fc *fragmentcache) put(key string, frag *cachedfragment) {
+	fc.mutex.Lock()
+	size    := int64(len(frag.chunk))
+	evicted := fc.memory.put(key, size, frag)
+	fragmentCacheBytes.WithLabelValues("memory").Set(float64(fc.memory.bytes))
+	fc.mutex.Unlock()
+
+	for _, entry := range evicted {
+		fc.spill(entry.key, entry.value.(*cachedfragment))
+	}
+}
+
+/*
+ * Write a fragment to the disk tier, if enabled. Failing to write is not an
+ * error, the fragment is just not cached.
+ */
+func (fc *fragmentcache) spill(key string, frag *cachedfragment) {
+	size := int64(len(frag.chunk))
+	if fc.disk == nil || size > fc.disk.budget {
+		return
+	}
+
+	sum := sha256.Sum256([]byte(key))
+	f, err := ioutil.TempFile(fc.dir, hex.EncodeToString(sum[:]) + "-")
+	if err != nil {
+		return
+	}
+	_, err = f.Write(frag.chunk)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return
+	}
+
+	file := &spilled {
+		name:    f.Name(),
+		etag:    frag.etag,
+		checked: frag.checked,
+	}
+	fc.mutex.Lock()
+	/*
+	 * The fragment could have been spilled by someone else in the meantime,
+	 * and the replaced file is not reported as evicted.
+	 */
+	replaced, _ := fc.disk.remove(key)
+	evicted     := fc.disk.put(key, size, file)
+	fragmentCacheBytes.WithLabelValues("disk").Set(float64(fc.disk.bytes))
+	fc.mutex.Unlock()
+
+	if replaced != nil {
+		os.Remove(replaced.(*spilled).name)
+	}
+	for _, entry := range evicted {
+		os.Remove(entry.value.(*spilled).name)
+	}
+}
+
+/*
+ * Check if the ETag of a cached fragment should be checked before the
+ * fragment is served.
+ */
+func (fc *fragmentcache) stale(frag *cachedfragment) bool {
+	if fc.revalidate <= 0 {
+		return false
+	}
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	return time.Since(frag.checked) > fc.revalidate
+}
+
+/*
+ * Record that the ETag of a cached fragment was found to be current.
+ */
+func (fc *fragmentcache) revalidated(frag *cachedfragment) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	frag.checked = time.Now()
+}
+
+/*
+ * A container that serves fragments from the fragment cache. The manifest is
+ * always read from the underlying container.
+ */
+type cachedContainer struct {
+	blobstore.Container
+	cache  *fragmentcache
+	prefix string
+}
+
+/*
+ * Wrap container with the fragment cache. The prefix identifies the container,
+ * i.e. the storage endpoint and guid. If the cache is disabled, container is
+ * returned unchanged.
+ */
+func (fc *fragmentcache) wrap(
+	container blobstore.Container,
+	prefix    string,
+) blobstore.Container {
+	if fc == nil {
+		return container
+	}
+	return &cachedContainer {
+		Container: container,
+		cache:     fc,
+		prefix:    prefix,
+	}
+}
+
+func (c *cachedContainer) Fragment(
+	ctx context.Context,
+	id  string,
+) ([]byte, error) {
+	key := c.prefix + "/" + id
+	frag, tier := c.cache.get(key)
+	if frag != nil && c.cache.stale(frag) {
+		tag, err := c.Container.ETag(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if tag == frag.etag {
+			c.cache.revalidated(frag)
+		} else {
+			frag = nil
+		}
+	}
+
+	if frag != nil {
+		fragmentCacheLookupsTotal.WithLabelValues(tier).Inc()
+		return frag.chunk, nil
+	}
+	fragmentCacheLookupsTotal.WithLabelValues("miss").Inc()
+
+	chunk, tag, err := c.Container.FragmentETag(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	c.cache.put(key, &cachedfragment {
+		chunk:   chunk,
+		etag:    tag,
+		checked: time.Now(),
+	})
+	return chunk, nil
+}
+
+/*
+ * A least-recently-used set of values, limited by the sum of their sizes.
+ * This is not safe for concurrent use.
+ */
+type lru struct {
+	budget  int64
+	bytes   int64
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type lruentry struct {
+	key   string
+	size  int64
+	value interface{}
+}
+
+func newLRU(budget int64) *lru {
+	return &lru {
+		budget:  budget,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+/*
+ * Get the value for key, and mark it as recently used.
+ */
+func (l *lru) get(key string) (interface{}, bool) {
+	elem, ok := l.entries[key]
+	if !ok {
+		return nil, false
+	}
+	l.order.MoveToFront(elem)
+	return elem.Value.(*lruentry).value, true
+}
+
+/*
+ * Remove key, and return its value.
+ */
+func (l *lru) remove(key string) (interface{}, bool) {
+	elem, ok := l.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := l.order.Remove(elem).(*lruentry)
+	delete(l.entries, key)
+	l.bytes -= entry.size
+	return entry.value, true
+}
+
+/*
+ * Put a value of size bytes, and evict the least recently used values until
+ * the set is within budget. The evicted values are returned. A value larger
+ * than the budget is not put at all.
+ */
+func (l *lru) put(key string, size int64, value interface{}) []*lruentry {
+	if size > l.budget {
+		return nil
+	}
+	if _, ok := l.entries[key]; ok {
+		l.remove(key)
+	}
+	entry := &lruentry { key: key, size: size, value: value }
+	l.entries[key] = l.order.PushFront(entry)
+	l.bytes += size
+
+	var evicted []*lruentry
+	for l.bytes > l.budget {
+		oldest := l.order.Back()
+		entry  := l.order.Remove(oldest).(*lruentry)
+		delete(l.entries, entry.key)
+		l.bytes -= entry.size
+		evicted = append(evicted, entry)
+	}
+	return evicted
+}
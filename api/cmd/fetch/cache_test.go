@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/equinor/oneseismic/api/internal/blobstore"
+)
+
+func TestLRUEvictsLeastRecentlyUsed(t *testing.T) {
+	l := newLRU(10)
+	assert.Empty(t, l.put("a", 4, "a"))
+	assert.Empty(t, l.put("b", 4, "b"))
+	_, ok := l.get("a")
+	assert.True(t, ok)
+
+	evicted := l.put("c", 4, "c")
+	assert.Equal(t, 1, len(evicted))
+	assert.Equal(t, "b", evicted[0].key)
+	assert.Equal(t, int64(8), l.bytes)
+
+	assert.Empty(t, l.put("d", 11, "d"))
+	_, ok = l.get("d")
+	assert.False(t, ok)
+}
+
+func TestFragmentCacheSpillsToDisk(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "cache")
+	fc, err := newFragmentCache(4, dir, 8, 0)
+	assert.Nil(t, err)
+
+	fc.put("a", &cachedfragment { chunk: []byte("aaaa") })
+	fc.put("b", &cachedfragment { chunk: []byte("bbbb") })
+
+	frag, tier := fc.get("b")
+	assert.Equal(t, "bbbb", string(frag.chunk))
+	assert.Equal(t, "memory", tier)
+
+	frag, tier = fc.get("a")
+	assert.Equal(t, "aaaa", string(frag.chunk))
+	assert.Equal(t, "disk", tier)
+
+	/* a moved back into memory, which spilled b */
+	frag, tier = fc.get("b")
+	assert.Equal(t, "bbbb", string(frag.chunk))
+	assert.Equal(t, "disk", tier)
+
+	frag, _ = fc.get("c")
+	assert.Nil(t, frag)
+
+	/* only the spilled a is left on disk */
+	files, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(files))
+}
+
+func TestFragmentCacheClearsDirOnStart(t *testing.T) {
+	dir   := t.TempDir()
+	stale := filepath.Join(dir, "stale")
+	assert.Nil(t, ioutil.WriteFile(stale, []byte("stale"), 0600))
+
+	_, err := newFragmentCache(4, dir, 8, 0)
+	assert.Nil(t, err)
+	_, err = os.Stat(stale)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestCachedContainerMissesOnChangedFragment(t *testing.T) {
+	ctx  := context.Background()
+	root := t.TempDir()
+	id   := "src/64-64-64/0-0-0.f32"
+	path := filepath.Join(root, "guid", filepath.FromSlash(id))
+	assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+	assert.Nil(t, ioutil.WriteFile(path, []byte("old"), 0644))
+
+	fc, err := newFragmentCache(1024, "", 0, time.Nanosecond)
+	assert.Nil(t, err)
+	store := blobstore.NewLocalStore(root)
+	container := fc.wrap(store.Container("guid"), "file://" + root + "/guid")
+
+	chunk, err := container.Fragment(ctx, id)
+	assert.Nil(t, err)
+	assert.Equal(t, "old", string(chunk))
+
+	/*
+	 * Make sure the modification time changes too, even on file systems with
+	 * coarse timestamps.
+	 */
+	assert.Nil(t, ioutil.WriteFile(path, []byte("new"), 0644))
+	later := time.Now().Add(time.Hour)
+	assert.Nil(t, os.Chtimes(path, later, later))
+
+	chunk, err = container.Fragment(ctx, id)
+	assert.Nil(t, err)
+	assert.Equal(t, "new", string(chunk))
+}
+
+/*
+ * A container that counts the ETag (HEAD) requests
+ */
+type headcountContainer struct {
+	blobstore.Container
+	heads int
+}
+
+func (c *headcountContainer) ETag(
+	ctx context.Context,
+	id  string,
+) (string, error) {
+	c.heads++
+	return c.Container.ETag(ctx, id)
+}
+
+func TestCachedContainerOnlyRevalidatesOnRequest(t *testing.T) {
+	ctx  := context.Background()
+	root := t.TempDir()
+	id   := "src/64-64-64/0-0-0.f32"
+	path := filepath.Join(root, "guid", filepath.FromSlash(id))
+	assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+	assert.Nil(t, ioutil.WriteFile(path, []byte("chunk"), 0644))
+
+	store := blobstore.NewLocalStore(root)
+	counted := &headcountContainer { Container: store.Container("guid") }
+	fc, err := newFragmentCache(1024, "", 0, 0)
+	assert.Nil(t, err)
+	container := fc.wrap(counted, "file://" + root + "/guid")
+
+	for i := 0; i < 3; i++ {
+		chunk, err := container.Fragment(ctx, id)
+		assert.Nil(t, err)
+		assert.Equal(t, "chunk", string(chunk))
+	}
+	assert.Equal(t, 0, counted.heads)
+
+	fc.revalidate = time.Nanosecond
+	_, err = container.Fragment(ctx, id)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, counted.heads)
+}
+
+func TestDisabledFragmentCacheIsNoop(t *testing.T) {
+	var fc *fragmentcache
+	container := testcontainer()
+	assert.Equal(t, container, fc.wrap(container, "prefix"))
+}
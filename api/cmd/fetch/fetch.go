@@ -9,16 +9,20 @@ import "unsafe"
 import (
 	"context"
 	"fmt"
-	"io/ioutil"
-	"log"
-	"net/url"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/equinor/oneseismic/api/internal/blobstore"
+	"github.com/equinor/oneseismic/api/internal/logging"
 	"github.com/equinor/oneseismic/api/internal/message"
+	"github.com/equinor/oneseismic/api/internal/tracing"
 
-	"github.com/Azure/azure-storage-blob-go/azblob"
 	"github.com/go-redis/redis/v8"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 /*
@@ -38,6 +42,14 @@ type process struct {
 	 */
 	pid  string
 	part string
+	/*
+	 * The logger for this process, which tags every record with the pid and
+	 * part, and the guid and function once the task is parsed.
+	 *
+	 * This and fail() are the only members allowed to be used on a process if
+	 * exec() returns an error.
+	 */
+	logger zerolog.Logger
 	/*
 	 * The parsed and raw task specification, as read from the input message
 	 * queue.
@@ -45,12 +57,28 @@ type process struct {
 	task    message.Task
 	rawtask []byte
 	/*
-	 * The azblob API uses a context to communicate status to the caller, which
-	 * in turn can be shared between multiple concurrent downloads. Useful for
-	 * signalling failures to cancel pending downloads.
+	 * The blobstore API uses a context to communicate status to the caller,
+	 * which in turn can be shared between multiple concurrent downloads.
+	 * Useful for signalling failures to cancel pending downloads.
 	 */
 	ctx    context.Context
 	cancel context.CancelFunc
+	/*
+	 * The span of the process, which is part of the trace of the query that
+	 * started it. It is started by run(), and ended by cleanup(). May be nil.
+	 */
+	span trace.Span
+	/*
+	 * Set (atomically) to non-zero by watch() when the client has cancelled
+	 * the process. A cancelled process should stop as soon as possible, and
+	 * must not write results or report failures.
+	 */
+	cancelled int32
+	/*
+	 * Called by cleanup() when the process is done with, to acknowledge the
+	 * task in the job queue. May be nil.
+	 */
+	ack func()
 	/*
 	 * A pointer to the corresponding C++ object. The go part of this program
 	 * handles sessions and I/O (tokens, requests, http requests and redis
@@ -68,17 +96,6 @@ type process struct {
 	cpp *C.struct_proc
 }
 
-/*
- * Automation - return the pid=, proc= log line prefix to make log formatting
- * less noisy.
- *
- * This is the only function allowed to call on a process if exec() returns an
- * error.
- */
-func (p *process) logpid() string {
-	return fmt.Sprintf("pid=%s, part=%s", p.pid, p.part)
-}
-
 /*
  * Convert the last-set error from C++ into a go error.
  */
@@ -103,35 +120,70 @@ func exec(msg [][]byte) (*process, error) {
 		ctx:     ctx,
 		cancel:  cancel,
 	}
+	proc.logger = log.With().
+		Str(logging.Pid,  proc.pid).
+		Str(logging.Part, proc.part).
+		Logger()
 	_, err := proc.task.Unpack(proc.rawtask)
 	if err != nil {
-		return nil, err
+		proc.cancel()
+		return proc, fmt.Errorf("unable to parse task: %w", err)
 	}
+	proc.logger = proc.logger.With().
+		Str(logging.Guid,     proc.task.Guid).
+		Str(logging.Function, proc.task.Function).
+		Logger()
+	proc.ctx = tracing.Extract(proc.ctx, proc.task.TraceContext)
 
 	kind := C.CString(proc.task.Function)
 	defer C.free(unsafe.Pointer(kind))
 	proc.cpp = C.newproc(kind);
 	if proc.cpp == nil {
-		msg := "%s unable to new() proc of kind %s"
-		return proc, fmt.Errorf(msg, proc.logpid(), proc.task.Function)
+		proc.cancel()
+		msg := "unable to new() proc of kind %s"
+		return proc, fmt.Errorf(msg, proc.task.Function)
 	}
 	buffer := unsafe.Pointer(&proc.rawtask[0])
 	length := C.int(len(proc.rawtask))
 	ok := C.init(proc.cpp, buffer, length)
 	if !ok {
-		return proc, proc.c_error()
+		err := proc.c_error()
+		proc.cleanup()
+		return proc, err
 	}
 	return proc, nil
 }
 
+/*
+ * Start the span of the process, as a child of the span in the trace context
+ * of the task.
+ */
+func (p *process) trace() {
+	p.ctx, p.span = tracing.Tracer().Start(p.ctx, "fetch.run")
+	p.span.SetAttributes(
+		attribute.String(logging.Pid,      p.pid),
+		attribute.String(logging.Part,     p.part),
+		attribute.String(logging.Guid,     p.task.Guid),
+		attribute.String(logging.Function, p.task.Function),
+	)
+}
+
 /*
  * Clean up a process, i.e. call the cleanup functions for the (unmanaged) C++
- * objects and cancel the context.
+ * objects, cancel the context, end the span, and acknowledge the task.
  */
 func (p *process) cleanup() {
 	C.cleanup(p.cpp)
 	p.cpp = nil
 	p.cancel()
+	if p.span != nil {
+		p.span.End()
+		p.span = nil
+	}
+	if p.ack != nil {
+		p.ack()
+		p.ack = nil
+	}
 }
 
 /*
@@ -143,11 +195,10 @@ func (p *process) cleanup() {
  *
  * [1] e.g. ['src/64-64-64/0-0-1.f32', 'src/64-64-64/4-1-2.f32' ...]
  */
-func (p *process) fragments() []string {
+func (p *process) fragments() ([]string, error) {
 	cfrags := C.fragments(p.cpp)
 	if cfrags == nil {
-		msg := "%s unable to get fragment IDs: %w"
-		log.Fatalf(msg, p.logpid(), p.c_error())
+		return nil, fmt.Errorf("unable to get fragment IDs: %v", p.c_error())
 	}
 
 	/*
@@ -167,7 +218,7 @@ func (p *process) fragments() []string {
 	 * (!!) at the end, which in turn would build invalid URLs.
 	 */
 	gofrags := C.GoString(cfrags)
-	return strings.Split(gofrags, ";")
+	return strings.Split(gofrags, ";"), nil
 }
 
 /*
@@ -188,6 +239,9 @@ type fragment struct {
  * [2] the list of IDs given by fragments()
  */
 func (p *process) add(f fragment) error {
+	if len(f.chunk) == 0 {
+		return fmt.Errorf("fragment %d is empty", f.index)
+	}
 	buffer := unsafe.Pointer(&f.chunk[0])
 	length := C.int(len(f.chunk))
 	index  := C.int(f.index)
@@ -208,40 +262,143 @@ func (p *process) add(f fragment) error {
  * This function is *not* thread safe, and should not be invoked from multiple
  * goroutines.
  *
- * For now this function raises a fatal error if it is not able to pack the
- * result - this is in order to immediately catch errors in the pack() logic.
- * Eventually this should be a softer error (e.g. log & continue), but for now
- * is a hard crash so that errors do not pass in silence.
- *
  * [1] really exactly once, although nothing bad *should* happen if it is
  * called multiple times for the same object.
  */
-func (p *process) pack() []byte {
+func (p *process) pack() ([]byte, error) {
 	packed := C.pack(p.cpp)
 	if packed.err {
-		msg := "%s unable to pack result: %v"
-		log.Fatalf(msg, p.logpid(), p.c_error())
+		return nil, fmt.Errorf("unable to pack result: %v", p.c_error())
 	}
-	return C.GoBytes(packed.body, packed.size)
+	return C.GoBytes(packed.body, packed.size), nil
 }
 
 /*
- * Make a container URL. This is just a stupid helper to make calling prettier,
- * and it is somewhat inflexible by reading endpoint + guid from the input
- * task.
+ * Open the container for the cube of this process. This is just a stupid
+ * helper to make calling prettier, and it is somewhat inflexible by reading
+ * endpoint + guid + token from the input task. The backend is selected by the
+ * scheme of the storage endpoint. Fragments are served from the fragment
+ * cache, if enabled.
  */
-func (p *process) container() (azblob.ContainerURL, error) {
-	endpoint := p.task.StorageEndpoint
-	guid     := p.task.Guid
-	container, err := url.Parse(fmt.Sprintf("%s/%s", endpoint, guid))
+func (p *process) container() (blobstore.Container, error) {
+	store, err := blobstore.Open(p.task.StorageEndpoint, p.task.Token)
 	if err != nil {
-		err = fmt.Errorf("Container URL would be malformed: %w", err)
-		return azblob.ContainerURL{}, err
+		return nil, fmt.Errorf("unable to open storage: %w", err)
 	}
+	container := store.Container(p.task.Guid)
+	return cache.wrap(container, p.prefix()), nil
+}
+
+/*
+ * The prefix that, together with a fragment id, identifies the fragment blob
+ * across storage accounts and cubes, for caching and coalescing downloads.
+ */
+func (p *process) prefix() string {
+	return p.task.StorageEndpoint + "/" + p.task.Guid
+}
+
+/*
+ * Check if the process pid has been cancelled by the client. Errors are
+ * logged and otherwise ignored, as a process that is wrongly assumed to still
+ * be live only wastes some work.
+ */
+func cancelled(storage redis.Cmdable, pid string) bool {
+	ctx := context.Background()
+	n, err := storage.Exists(ctx, message.CancelKey(pid)).Result()
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Str(logging.Pid, pid).
+			Msg("unable to check cancellation")
+		return false
+	}
+	return n > 0
+}
 
-	credentials := azblob.NewTokenCredential(p.task.Token, nil)
-	pipeline    := azblob.NewPipeline(credentials, azblob.PipelineOptions{})
-	return azblob.NewContainerURL(*container, pipeline), nil
+/*
+ * Watch for cancellation of the process, polling storage every interval. When
+ * the process is cancelled its context is cancelled too, which aborts pending
+ * downloads and in turn makes gather() stop. The watch stops when the process
+ * context is done, i.e. when the process is cleaned up.
+ */
+func (p *process) watch(storage redis.Cmdable, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+			if cancelled(storage, p.pid) {
+				p.logger.Info().Msg("cancelled")
+				atomic.StoreInt32(&p.cancelled, 1)
+				p.cancel()
+				return
+			}
+		}
+	}
+}
+
+func (p *process) isCancelled() bool {
+	return atomic.LoadInt32(&p.cancelled) != 0
+}
+
+/*
+ * Report the process as failed, by writing a failure record to storage. The
+ * failure is picked up by the result endpoints, so that clients are told that
+ * the process failed instead of waiting for a result that never comes.
+ */
+func (p *process) fail(storage redis.Cmdable, kind string, err error) {
+	if p.span != nil {
+		tracing.Fail(p.span, err)
+	}
+	reportfailure(storage, p.pid, p.part, kind, err)
+}
+
+/*
+ * Write a failure record for the part of the process pid. Reporting is
+ * best-effort - if the failure record itself cannot be written there is not
+ * much more to do than log it.
+ */
+func reportfailure(
+	storage redis.Cmdable,
+	pid     string,
+	part    string,
+	kind    string,
+	err     error,
+) {
+	failure := message.Failure {
+		Pid:     pid,
+		Part:    part,
+		Kind:    kind,
+		Message: err.Error(),
+	}
+	packed, err := failure.Pack()
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str(logging.Pid,  pid).
+			Str(logging.Part, part).
+			Msg("unable to pack failure")
+		return
+	}
+
+	/*
+	 * The process context is likely to be cancelled when something has
+	 * failed, and the failure should be reported regardless.
+	 */
+	ctx := context.Background()
+	key := message.FailureKey(pid)
+	err = storage.RPush(ctx, key, packed).Err()
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str(logging.Pid,  pid).
+			Str(logging.Part, part).
+			Msg("unable to report failure")
+		return
+	}
+	storage.Expire(ctx, key, 10 * time.Minute)
 }
 
 /*
@@ -254,6 +411,11 @@ func (p *process) container() (azblob.ContainerURL, error) {
  * doesn't have to without introducing deadlocks if the channels are
  * sufficiently buffered.
  *
+ * Should a download, add(), pack() or the final write fail, the process is
+ * reported as failed with fail(). If the process is cancelled, it is dropped
+ * silently, without waiting for the remaining fragments, which may never
+ * arrive.
+ *
  * This function finalizes the process.
  */
 func (p *process) gather(
@@ -263,83 +425,120 @@ func (p *process) gather(
 	errors     chan error,
 ) {
 	defer p.cleanup()
+	_, span := tracing.Tracer().Start(p.ctx, "fetch.gather")
+	span.SetAttributes(attribute.Int("fragments", nfragments))
+	defer span.End()
+
+	function := p.task.Function
+	start := time.Now()
 	for i := 0; i < nfragments; i++ {
 		select {
 		case f := <-fragments:
+			fragmentsTotal.WithLabelValues(function, "ok").Inc()
+			fetchedBytesTotal.WithLabelValues(function).Add(float64(len(f.chunk)))
 			err := p.add(f)
 			if err != nil {
-				log.Fatalf("%s add failed: %v", p.logpid(), err)
+				p.logger.Error().Err(err).Msg("add failed")
+				p.fail(storage, "add", err)
+				fetchSeconds.WithLabelValues(function, "failed").Observe(
+					time.Since(start).Seconds(),
+				)
+				return
 			}
 		case e := <-errors:
-			log.Printf("%s download failed: %v", p.logpid(), e)
+			if p.isCancelled() {
+				p.logger.Info().Msg("dropped; process cancelled")
+				fetchSeconds.WithLabelValues(function, "cancelled").Observe(
+					time.Since(start).Seconds(),
+				)
+				return
+			}
+			p.logger.Warn().Err(e).Msg("download failed")
+			p.fail(storage, "download", e)
+			fragmentsTotal.WithLabelValues(function, "failed").Inc()
+			fetchSeconds.WithLabelValues(function, "failed").Observe(
+				time.Since(start).Seconds(),
+			)
 			for {
 				// Grab the remaining available errors to log them, but don't
 				// wait around for any new ones to come in
 				select {
 				case e := <-errors:
-					log.Printf("%s download failed: %v", p.logpid(), e)
+					p.logger.Warn().Err(e).Msg("download failed")
+					fragmentsTotal.WithLabelValues(function, "failed").Inc()
 				default:
 					return
 				}
 			}
+		case <-p.ctx.Done():
+			p.logger.Info().Err(p.ctx.Err()).Msg("dropped; process cancelled")
+			fetchSeconds.WithLabelValues(function, "cancelled").Observe(
+				time.Since(start).Seconds(),
+			)
+			return
 		}
 	}
+	fetchSeconds.WithLabelValues(function, "ok").Observe(
+		time.Since(start).Seconds(),
+	)
 
-	packed := p.pack()
-	log.Printf("%s ready", p.logpid())
+	start = time.Now()
+	packed, err := p.pack()
+	packSeconds.WithLabelValues(function, outcome(err)).Observe(
+		time.Since(start).Seconds(),
+	)
+	if err != nil {
+		p.logger.Error().Err(err).Msg("pack failed")
+		p.fail(storage, "pack", err)
+		return
+	}
+	/*
+	 * The result stream is removed when the process is cancelled, and writing
+	 * the result would just recreate it.
+	 */
+	if p.isCancelled() || cancelled(storage, p.pid) {
+		p.logger.Info().Msg("dropped; process cancelled")
+		return
+	}
+	p.logger.Debug().Msg("ready")
 	args := redis.XAddArgs{
 		Stream: p.pid,
 		Values: map[string]interface{}{p.part: packed},
 	}
-	err := storage.XAdd(p.ctx, &args).Err()
+	/*
+	 * The part is recorded in the set of completed parts together with the
+	 * write, so that re-runs of the same task are only counted once.
+	 */
+	parts := message.PartsKey(p.pid)
+	_, err = storage.TxPipelined(p.ctx, func(pipe redis.Pipeliner) error {
+		pipe.XAdd(p.ctx, &args)
+		pipe.SAdd(p.ctx, parts, p.part)
+		pipe.Expire(p.ctx, p.pid, 10 * time.Minute)
+		pipe.Expire(p.ctx, parts, 10 * time.Minute)
+		return nil
+	})
 	if err != nil {
-		log.Printf("%s write to storage failed: %v", p.logpid(), err)
+		p.logger.Error().Err(err).Msg("write to storage failed")
+		p.fail(storage, "write", err)
+		return
 	}
-	storage.Expire(p.ctx, p.pid, 10 * time.Minute)
-	log.Printf("%s written to storage", p.logpid())
+	p.logger.Info().Int("bytes", len(packed)).Msg("written to storage")
 }
 
 /*
  * Synchronously fetch a blob from the blob store.
  */
-func fetchblob(ctx context.Context, blob azblob.BlobURL) ([]byte, error) {
-	dl, err := blob.Download(
-		ctx,
-		0,
-		azblob.CountToEnd,
-		azblob.BlobAccessConditions{},
-		false,
-		azblob.ClientProvidedKeyOptions {},
-	)
-	if err != nil {
-		return nil, err
-	}
-
-	body := dl.Body(azblob.RetryReaderOptions{})
-	defer body.Close()
-	return ioutil.ReadAll(body)
-}
-
-/*
- * Fetch fragments from the blob store, and write them to the fragments
- * channel. This is a simple worker loop, which will grab tasks until the input
- * channel is closed.
- */
-func fetch(
+func fetchblob(
 	ctx       context.Context,
-	tasks     chan task,
-	fragments chan fragment,
-	errors    chan error,
-) {
-	for task := range tasks {
-		chunk, err := fetchblob(ctx, task.blob)
-		if err != nil {
-			errors <- err
-			return
-		}
-		fragments <- fragment {
-			index: task.index,
-			chunk: chunk,
-		}
-	}
+	container blobstore.Container,
+	id        string,
+) ([]byte, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "fetch.fetchblob")
+	span.SetAttributes(attribute.String("fragment", id))
+	defer span.End()
+
+	chunk, err := container.Fragment(ctx, id)
+	tracing.Fail(span, err)
+	span.SetAttributes(attribute.Int("bytes", len(chunk)))
+	return chunk, err
 }
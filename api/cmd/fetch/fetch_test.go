@@ -3,69 +3,49 @@ package main
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"net/url"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
-	"github.com/Azure/azure-pipeline-go/pipeline"
-	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/equinor/oneseismic/api/internal/blobstore"
+	"github.com/equinor/oneseismic/api/internal/message"
 )
 
-func testpipeline() pipeline.Pipeline {
-	return azblob.NewPipeline(
-		azblob.NewAnonymousCredential(),
-		azblob.PipelineOptions{},
-	)
+/*
+ * Make a redis client backed by an in-memory redis (miniredis), which is
+ * closed when the test is over.
+ */
+func testredis(t *testing.T) redis.Cmdable {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("unable to start miniredis: %v", err)
+	}
+	t.Cleanup(mr.Close)
+	return redis.NewClient(&redis.Options { Addr: mr.Addr() })
 }
 
-func testurl() url.URL {
+func testcontainer() blobstore.Container {
 	addr, _ := url.Parse("https://example.com")
-	return *addr
+	return blobstore.NewAzureStore(addr, "").Container("guid")
 }
 
 func TestCancelledDownloadErrors(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	cancel()
-	blob := azblob.NewBlobURL(testurl(), testpipeline())
-	_, err := fetchblob(ctx, blob)
+	_, err := fetchblob(ctx, testcontainer(), "src/64-64-64/0-0-0.f32")
 	if err == nil {
 		t.Errorf("expected fetchblob() to fail; err was nil")
 	}
 }
 
-func TestCancelledDownloadPostsOnErrorChannel(t *testing.T) {
-	/* 
-	 * Cancel the context immediately, to emulating a failure from the process
-	 * controller. This tests that the messages flow onto the right channel in
-	 * the presence of cancelled sibling fetches, not the actual fetch being
-	 * processed by this thread.
-	 */
-	ctx, cancel := context.WithCancel(context.Background())
-	cancel()
-
-	tasks     := make(chan task, 1)
-	fragments := make(chan fragment, 1)
-	errors    := make(chan error, 1)
-	tasks <- task {
-		index: 0,
-		blob: azblob.NewBlobURL(testurl(), testpipeline()),
-	}
-	// *don't* close the tasks channel - the fetch() loop should terminate with
-	// the message posted on the error channel, so keeping it open from the
-	// producer side means another layer covered in test.
-	// close(tasks)
-	fetch(ctx, tasks, fragments, errors)
-
-	select {
-	case <-tasks:
-		t.Errorf("Pending message on tasks; should be drained by fetch()")
-	case <-fragments:
-		t.Errorf("Pending message on fragments; should be error")
-	case <-errors:
-	default:
-		t.Errorf("No pending messages; should be error")
-	}
-}
-
 func TestMessageOnErrorCancelsGather(t *testing.T) {
 	fragments := make(chan fragment, 1)
 	errors    := make(chan error, 1)
@@ -77,6 +57,8 @@ func TestMessageOnErrorCancelsGather(t *testing.T) {
 	// in the struct layout, but such changes should probably be detected
 	// compile time anyway, and this test is then easily updated.
 	proc := process {
+		pid: "pid",
+		part: "0/1",
 		ctx: ctx,
 		cancel: cancel,
 		cpp: nil,
@@ -86,10 +68,253 @@ func TestMessageOnErrorCancelsGather(t *testing.T) {
 	// Pretend that there are 2 fragments to be fetched. None will be sent, but
 	// it increases the confidence that the worker loop is aborted immediately
 	// rather than waiting for more data.
-	proc.gather(nil, 2, fragments, errors)
+	proc.gather(testredis(t), 2, fragments, errors)
+	select {
+	case <-ctx.Done():
+	default:
+		t.Errorf("Expected context to be cancelled, but it is not")
+	}
+}
+
+func TestCancelWhileQueuedEndsGather(t *testing.T) {
+	container := &gatedContainer { release: make(chan struct{}) }
+	downloads := newPool(1)
+	fragments := make(chan fragment, 2)
+	errors    := make(chan error, 2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	acked := make(chan struct{})
+	proc := process {
+		pid: "pid",
+		part: "0/1",
+		ctx: ctx,
+		cancel: cancel,
+		cpp: nil,
+		ack: func() { close(acked) },
+	}
+	go proc.gather(testredis(t), 2, fragments, errors)
+
+	// Like in run(), deliver drops results when the process is cancelled, and
+	// in this test nothing ever completes before the cancel
+	deliver := func([]byte, error) {}
+	// The first download holds the only slot, so the second is queued
+	err := downloads.fetch(ctx, container, "first", "first", deliver)
+	assert.Nil(t, err)
+	queued := make(chan error, 1)
+	go func() {
+		queued <- downloads.fetch(ctx, container, "second", "second", deliver)
+	}()
+
+	cancel()
+	select {
+	case err := <-queued:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(time.Second):
+		t.Fatalf("queued download not cancelled")
+	}
+	select {
+	case <-acked:
+	case <-time.After(time.Second):
+		t.Fatalf("gather did not end and ack the task after cancel")
+	}
+}
+
+func TestDownloadErrorReportsFailure(t *testing.T) {
+	fragments := make(chan fragment, 1)
+	errors    := make(chan error, 1)
+	storage   := testredis(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	proc := process {
+		pid: "pid",
+		part: "1/3",
+		ctx: ctx,
+		cancel: cancel,
+		cpp: nil,
+	}
+
+	errors <- fmt.Errorf("Test error")
+	proc.gather(storage, 2, fragments, errors)
+
+	key := message.FailureKey("pid")
+	docs, err := storage.LRange(context.Background(), key, 0, -1).Result()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(docs), "want exactly one failure record")
+
+	failure, err := (&message.Failure{}).Unpack([]byte(docs[0]))
+	assert.Nil(t, err)
+	expected := message.Failure {
+		Pid:     "pid",
+		Part:    "1/3",
+		Kind:    "download",
+		Message: "Test error",
+	}
+	assert.Equal(t, expected, *failure)
+}
+
+func TestWatchCancelsProcess(t *testing.T) {
+	storage := testredis(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	proc := process {
+		pid: "pid",
+		part: "0/1",
+		ctx: ctx,
+		cancel: cancel,
+		cpp: nil,
+	}
+
+	key := message.CancelKey("pid")
+	assert.Nil(t, storage.Set(context.Background(), key, "", 0).Err())
+	proc.watch(storage, time.Millisecond)
+
+	assert.True(t, proc.isCancelled())
 	select {
 	case <-ctx.Done():
 	default:
 		t.Errorf("Expected context to be cancelled, but it is not")
 	}
 }
+
+func TestCancelledProcessDoesNotReportFailure(t *testing.T) {
+	fragments := make(chan fragment, 1)
+	errors    := make(chan error, 1)
+	storage   := testredis(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	proc := process {
+		pid: "pid",
+		part: "0/2",
+		ctx: ctx,
+		cancel: cancel,
+		cpp: nil,
+		cancelled: 1,
+	}
+
+	errors <- ctx.Err()
+	proc.gather(storage, 2, fragments, errors)
+
+	key := message.FailureKey("pid")
+	n, err := storage.Exists(context.Background(), key).Result()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), n)
+}
+
+/*
+ * Make a slice task for a 2x2x2 cube made up of a single 2x2x2 fragment,
+ * stored in a local blobstore at root.
+ */
+func slicetask(root string, guid string) string {
+	return fmt.Sprintf(`{
+		"pid": "%[2]s",
+		"token": "",
+		"guid": "%[2]s",
+		"storage_endpoint": "file://%[1]s",
+		"shape": [2, 2, 2],
+		"shape-cube": [2, 2, 2],
+		"function": "slice",
+		"dim": 0,
+		"idx": 0,
+		"ids": [[0, 0, 0]]
+	}`, root, guid)
+}
+
+func putfragment(t *testing.T, root string, guid string, chunk []byte) {
+	path := filepath.Join(root, guid, "src", "2-2-2", "0-0-0.f32")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("unable to mkdir: %v", err)
+	}
+	if err := ioutil.WriteFile(path, chunk, 0644); err != nil {
+		t.Fatalf("unable to write fragment: %v", err)
+	}
+}
+
+func failures(t *testing.T, storage redis.Cmdable, pid string) []message.Failure {
+	key := message.FailureKey(pid)
+	docs, err := storage.LRange(context.Background(), key, 0, -1).Result()
+	assert.Nil(t, err)
+
+	out := make([]message.Failure, len(docs))
+	for i, doc := range docs {
+		_, err := out[i].Unpack([]byte(doc))
+		assert.Nil(t, err)
+	}
+	return out
+}
+
+/*
+ * Wait for the (asynchronous) gather of a process to either write a result or
+ * report a failure.
+ */
+func waitfordone(t *testing.T, storage redis.Cmdable, pid string) {
+	ctx := context.Background()
+	for i := 0; i < 100; i++ {
+		n, err := storage.Exists(ctx, pid, message.FailureKey(pid)).Result()
+		assert.Nil(t, err)
+		if n > 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("pid=%s neither completed nor failed", pid)
+}
+
+func TestBadTasksAreReportedAsFailed(t *testing.T) {
+	storage := testredis(t)
+	tasks := map[string]string {
+		"not-json":    "not a task",
+		"no-function": `{"pid": "no-function", "function": "no-such-function"}`,
+		"bad-slice":   `{"pid": "bad-slice", "function": "slice"}`,
+	}
+	for pid, body := range tasks {
+		run(storage, newPool(2), map[string]interface{} {
+			"pid":  pid,
+			"part": "0/1",
+			"task": body,
+		}, nil)
+
+		failed := failures(t, storage, pid)
+		assert.Equal(t, 1, len(failed), "pid = %s", pid)
+		assert.Equal(t, "bad-task", failed[0].Kind, "pid = %s", pid)
+	}
+}
+
+func TestBadFragmentFailsOnlyItsProcess(t *testing.T) {
+	storage := testredis(t)
+	root, err := ioutil.TempDir("", "oneseismic-fetch")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	t.Cleanup(func () { os.RemoveAll(root) })
+
+	// A truncated fragment, and one that is the full 2x2x2 floats
+	putfragment(t, root, "truncated", make([]byte, 4))
+	putfragment(t, root, "good", make([]byte, 2 * 2 * 2 * 4))
+
+	run(storage, newPool(2), map[string]interface{} {
+		"pid":  "truncated",
+		"part": "0/1",
+		"task": slicetask(root, "truncated"),
+	}, nil)
+	waitfordone(t, storage, "truncated")
+	failed := failures(t, storage, "truncated")
+	assert.Equal(t, 1, len(failed))
+	assert.Equal(t, "add", failed[0].Kind)
+
+	// The worker should keep on processing after a failed process
+	downloaded := fragmentsTotal.WithLabelValues("slice", "ok")
+	before := testutil.ToFloat64(downloaded)
+	run(storage, newPool(2), map[string]interface{} {
+		"pid":  "good",
+		"part": "0/1",
+		"task": slicetask(root, "good"),
+	}, nil)
+	waitfordone(t, storage, "good")
+	assert.Equal(t, 0, len(failures(t, storage, "good")))
+	n, err := storage.XLen(context.Background(), "good").Result()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), n)
+	n, err = storage.SCard(context.Background(), message.PartsKey("good")).Result()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), n)
+	assert.Equal(t, float64(1), testutil.ToFloat64(downloaded) - before)
+}
@@ -3,14 +3,19 @@ package main
 import (
 	"context"
 	"fmt"
-	"log"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/equinor/oneseismic/api/internal/logging"
+	"github.com/equinor/oneseismic/api/internal/tracing"
 	"github.com/equinor/oneseismic/api/internal/util"
 
-	"github.com/Azure/azure-storage-blob-go/azblob"
 	"github.com/go-redis/redis/v8"
 	"github.com/pborman/getopt/v2"
+	"github.com/rs/zerolog/log"
 )
 
 type opts struct {
@@ -19,6 +24,42 @@ type opts struct {
 	stream     string
 	consumerid string
 	jobs       int
+	/*
+	 * Reliable (at-least-once) task delivery. Tasks are acknowledged when
+	 * done, and tasks pending for longer than reclaimafter, e.g. because the
+	 * worker crashed, are claimed and re-run by other workers.
+	 */
+	reliable      bool
+	reclaimafter  time.Duration
+	maxdeliveries int64
+	/*
+	 * The time given to in-flight processes to complete on shutdown.
+	 */
+	shutdowntimeout time.Duration
+	/*
+	 * Address to serve prometheus metrics on. Metrics are not served if this
+	 * is empty.
+	 */
+	metrics string
+	/*
+	 * Address of the OTLP/http collector to export trace spans to. Spans are
+	 * not exported if this is empty.
+	 */
+	otlpendpoint string
+	/*
+	 * Log format (text or json) and level
+	 */
+	logformat string
+	loglevel  string
+	/*
+	 * The fragment cache: the memory budget (0 disables the cache), the
+	 * optional disk directory and budget, and for how long cached fragments
+	 * are trusted without checking their ETag with the blob store.
+	 */
+	fragmentcachebytes      int64
+	fragmentcachedir        string
+	fragmentcachedirbytes   int64
+	fragmentcacherevalidate time.Duration
 }
 
 func parseopts() opts {
@@ -26,6 +67,12 @@ func parseopts() opts {
 	opts := opts {
 		group:  "fetch",
 		stream: "jobs",
+		reclaimafter:  5 * time.Minute,
+		maxdeliveries: 3,
+		shutdowntimeout: 30 * time.Second,
+		logformat: "text",
+		loglevel:  "info",
+		fragmentcachedirbytes: 1 << 30,
 	}
 	getopt.FlagLong(
 		&opts.redis,
@@ -66,9 +113,110 @@ func parseopts() opts {
 		"jobs",
 		'j',
 		10,
-		"Allow N concurrent connections at once. Defaults to 10",
+		"Allow N concurrent downloads at once, shared by all tasks. " +
+			"Defaults to 10",
 		"N",
 	)
+	getopt.FlagLong(
+		&opts.reliable,
+		"reliable",
+		0,
+		"Acknowledge tasks when they are done, and re-run tasks that are " +
+			"not acknowledged in time, e.g. because a worker crashed. " +
+			"All workers in the group should agree on this.",
+	).SetFlag()
+	getopt.FlagLong(
+		&opts.reclaimafter,
+		"reclaim-after",
+		0,
+		"In reliable mode, re-run tasks that have been pending for this " +
+			"long. This should be well above the time it takes to " +
+			"complete a task. Defaults to 5m",
+		"duration",
+	)
+	getopt.FlagLong(
+		&opts.maxdeliveries,
+		"max-deliveries",
+		0,
+		"In reliable mode, give up on and fail tasks that have been " +
+			"delivered N times without completing. Defaults to 3",
+		"N",
+	)
+	getopt.FlagLong(
+		&opts.shutdowntimeout,
+		"shutdown-timeout",
+		0,
+		"On SIGTERM or SIGINT, stop reading new tasks and wait this long " +
+			"for the in-flight tasks to complete before exiting. " +
+			"Defaults to 30s",
+		"duration",
+	)
+	getopt.FlagLong(
+		&opts.metrics,
+		"metrics",
+		0,
+		"Serve prometheus metrics on /metrics on this address, e.g. :9090. " +
+			"Metrics are not served unless this is set",
+		"addr",
+	)
+	getopt.FlagLong(
+		&opts.otlpendpoint,
+		"otlp-endpoint",
+		0,
+		"Export trace spans with OTLP/http to the collector on this " +
+			"address, e.g. localhost:4318. " +
+			"Spans are not exported unless this is set",
+		"addr",
+	)
+	getopt.FlagLong(
+		&opts.logformat,
+		"log-format",
+		0,
+		"Log format, text or json. Defaults to text",
+		"format",
+	)
+	getopt.FlagLong(
+		&opts.loglevel,
+		"log-level",
+		0,
+		"Log level, one of debug, info, warn, error. Defaults to info",
+		"level",
+	)
+	getopt.FlagLong(
+		&opts.fragmentcachebytes,
+		"fragment-cache-bytes",
+		0,
+		"Keep up to N bytes of recently downloaded fragments in memory. " +
+			"The fragment cache is disabled unless this is set",
+		"N",
+	)
+	getopt.FlagLong(
+		&opts.fragmentcachedir,
+		"fragment-cache-dir",
+		0,
+		"Spill fragments evicted from memory to this directory. " +
+			"Anything already in the directory is removed on start",
+		"dir",
+	)
+	getopt.FlagLong(
+		&opts.fragmentcachedirbytes,
+		"fragment-cache-dir-bytes",
+		0,
+		"Keep up to N bytes of fragments in --fragment-cache-dir. " +
+			"Defaults to 1GiB",
+		"N",
+	)
+	getopt.FlagLong(
+		&opts.fragmentcacherevalidate,
+		"fragment-cache-revalidate",
+		0,
+		"Check the ETag of cached fragments that have not been checked for " +
+			"this long with the blob store before serving them, so that " +
+			"re-uploaded cubes are not served from stale fragments. This " +
+			"costs a HEAD request per revalidation. When 0 (the default), " +
+			"cached fragments are never revalidated",
+		"duration",
+	)
 	getopt.Parse()
 
 	if *help {
@@ -83,15 +231,17 @@ func parseopts() opts {
 	return opts
 }
 
-type task struct {
-	index int
-	blob  azblob.BlobURL
-}
-
+/*
+ * Run a process, i.e. the task read from the job queue. The ack function is
+ * called when the process is done with, regardless of it being successful,
+ * and may be nil. Running a process is asynchronous, so ack is usually called
+ * after run returns.
+ */
 func run(
-	storage redis.Cmdable,
-	njobs   int,
-	process map[string]interface{},
+	storage   redis.Cmdable,
+	downloads *pool,
+	process   map[string]interface{},
+	ack       func(),
 ) {
 	/*
 	 * Curiously, the XReadGroup/XStream values end up being map[string]string
@@ -106,54 +256,101 @@ func run(
 	pid  := process["pid" ].(string)
 	part := process["part"].(string)
 	body := process["task"].(string)
+	if ack == nil {
+		ack = func() {}
+	}
+	if cancelled(storage, pid) {
+		log.Info().
+			Str(logging.Pid,  pid).
+			Str(logging.Part, part).
+			Msg("skipping cancelled process")
+		ack()
+		return
+	}
+
 	msg  := [][]byte{ []byte(pid), []byte(part), []byte(body) }
 	proc, err := exec(msg)
 	if err != nil {
-		log.Printf("%s dropping bad process %v", proc.logpid(), err)
+		proc.logger.Error().Err(err).Msg("dropping bad process")
+		proc.fail(storage, "bad-task", err)
+		ack()
 		return
 	}
+	proc.ack = ack
+	proc.trace()
 	/*
-	 * Build the container-URL early, in case it should be broken,
-	 * so that no goroutines are scheduled before any sanity
+	 * Open the container early, in case the storage endpoint should be
+	 * broken, so that no goroutines are scheduled before any sanity
 	 * checking of input.
 	 */
 	container, err := proc.container()
 	if err != nil {
-		log.Printf("%s dropping bad process %v", proc.logpid(), err)
+		proc.logger.Error().Err(err).Msg("dropping bad process")
+		proc.fail(storage, "bad-task", err)
+		proc.cleanup()
 		return
 	}
+	fragments, err := proc.fragments()
+	if err != nil {
+		proc.logger.Error().Err(err).Msg("dropping bad process")
+		proc.fail(storage, "bad-task", err)
+		proc.cleanup()
+		return
+	}
+	go proc.watch(storage, time.Second)
 
-	// TODO: share job queue between processes, but use private
-	// output/error queue? Then buffered-elements would control
-	// number of pending jobs Rather than it now continuing once
-	// the last task has been scheduled and possibly spawning N
-	// more goroutines.
-	frags  := make(chan fragment, njobs)
-	tasks  := make(chan task, njobs)
-	errors := make(chan error)
 	/*
-	 * The goroutines must be signalled that there are no more data, or
-	 * they will leak.
+	 * The downloads are shared by all processes, but the results go to
+	 * channels private to the process. Scheduling blocks while the pool is
+	 * busy, which keeps the worker from reading more tasks than it can do.
 	 */
-	defer close(tasks)
-	for i := 0; i < njobs; i++ {
-		go fetch(proc.ctx, tasks, frags, errors)
-	}
-	fragments := proc.fragments()
+	frags  := make(chan fragment, len(fragments))
+	errors := make(chan error, len(fragments))
 	go proc.gather(storage, len(fragments), frags, errors)
 	for i, id := range fragments {
-		select {
-		case tasks <- task { index: i, blob: container.NewBlobURL(id) }:
-		case <-proc.ctx.Done():
-			msg := "%s cancelled after %d scheduling fragments; %v"
-			log.Printf(msg, proc.logpid(), i, proc.ctx.Err())
-			break
+		index := i
+		deliver := func(chunk []byte, err error) {
+			if err != nil {
+				select {
+				case errors <- err:
+				case <-proc.ctx.Done():
+				}
+				return
+			}
+			select {
+			case frags <- fragment { index: index, chunk: chunk }:
+			case <-proc.ctx.Done():
+			}
+		}
+		err := downloads.fetch(
+			proc.ctx,
+			container,
+			proc.prefix() + "/" + id,
+			id,
+			deliver,
+		)
+		if err != nil {
+			/*
+			 * The errors channel has room for every fragment, and this one
+			 * never got to post, so this does not block. It makes sure gather
+			 * stops and cleans up the process.
+			 */
+			proc.logger.Info().
+				Err(err).
+				Msgf("cancelled after scheduling %d fragments", i)
+			errors <- err
+			return
 		}
 	}
 }
 
 func main() {
 	opts := parseopts()
+	err := logging.Configure(opts.logformat, opts.loglevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 
 	storage := redis.NewClient(&redis.Options {
 		Addr: opts.redis,
@@ -162,6 +359,36 @@ func main() {
 	// TODO: err?
 	defer storage.Close()
 
+	if opts.metrics != "" {
+		go servemetrics(opts.metrics)
+	}
+
+	if opts.fragmentcachebytes > 0 {
+		cache, err = newFragmentCache(
+			opts.fragmentcachebytes,
+			opts.fragmentcachedir,
+			opts.fragmentcachedirbytes,
+			opts.fragmentcacherevalidate,
+		)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Unable to create fragment cache")
+		}
+		log.Info().
+			Int64("bytes", opts.fragmentcachebytes).
+			Str("dir", opts.fragmentcachedir).
+			Msg("fragment cache enabled")
+	}
+
+	flush, err := tracing.Configure(
+		context.Background(),
+		"oneseismic-fetch",
+		opts.otlpendpoint,
+	)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Unable to configure tracing")
+	}
+	defer flush(context.Background())
+
 	ctx := context.Background()
 	/*
 	 * Always try to create the group and stream on start-up. The stream may
@@ -174,72 +401,112 @@ func main() {
 	 * program can immediately go into the work loop assuming that the stream
 	 * and group exists, without having to do any chatter or sync.
 	 */
-	err := storage.XGroupCreateMkStream(ctx, opts.stream, opts.group, "0").Err()
+	err = storage.XGroupCreateMkStream(ctx, opts.stream, opts.group, "0").Err()
 	if err != nil {
 		 // Check if the response is a redis error (= BUSYGROUP), which just
 		 // means the group already exists and nothing happens, or if it is a
 		 // network error or something
 		_, busygroup := err.(interface{RedisError()});
 		if !busygroup {
-			log.Fatalf(
-				"Unable to create group %s for stream %s: %v",
-				opts.group,
-				opts.stream,
-				err,
-			)
+			log.Fatal().
+				Err(err).
+				Str("group", opts.group).
+				Str("stream", opts.stream).
+				Msg("Unable to create group")
 		}
 	}
-	log.Printf(
-		"consumer %s in group %s connecting to stream %s",
-		opts.consumerid,
-		opts.group,
-		opts.stream,
-	)
+	log.Info().
+		Str("consumer", opts.consumerid).
+		Str("group", opts.group).
+		Str("stream", opts.stream).
+		Msg("connecting")
+
+	/*
+	 * Stop reading new tasks on SIGTERM (e.g. from kubernetes on scale-down)
+	 * or SIGINT, and drain the worker before exiting.
+	 */
+	ctx, stop := context.WithCancel(ctx)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-signals
+		log.Info().Stringer("signal", sig).Msg("stopping")
+		stop()
+	}()
+	procs := newInflight()
+	downloads := newPool(opts.jobs)
 
-	// TODO: destroy consumers on shutdown
 	// All reads can re-use the same group-args
-	// NoAck is turned on - we can afford to fail requests and lose messages
-	// should a node crash.
+	// Unless in reliable mode NoAck is turned on - we can afford to fail
+	// requests and lose messages should a node crash.
+	//
+	// Reads block for a limited time only, so that the loop can check for
+	// shutdown.
 	args := redis.XReadGroupArgs {
 		Group:    opts.group,
 		Consumer: opts.consumerid,
 		Streams:  []string { opts.stream, ">", },
 		Count:    1,
-		NoAck:    true,
+		Block:    time.Second,
+		NoAck:    !opts.reliable,
+	}
+
+	var reclaiming sync.WaitGroup
+	if opts.reliable {
+		log.Info().
+			Dur("reclaim-after", opts.reclaimafter).
+			Msg("reliable mode; reclaiming pending tasks")
+		reclaiming.Add(1)
+		go func() {
+			defer reclaiming.Done()
+			reclaim(ctx, storage, opts, procs, downloads)
+		}()
 	}
 
-	for {
-		msgs, err := storage.XReadGroup(ctx, &args).Result()
+	for ctx.Err() == nil {
+		/*
+		 * Read with a fresh context, as a read cancelled half-way could
+		 * lose the task read.
+		 */
+		msgs, err := storage.XReadGroup(context.Background(), &args).Result()
+		if err == redis.Nil {
+			continue
+		}
 		if err != nil {
-			log.Fatalf("Unable to read from redis: %v", err)
+			log.Fatal().Err(err).Msg("Unable to read from redis")
 		}
 
-		go func() {
-			/*
-			 * Send a request-for-delete once the message has been read, in
-			 * order to stop the infinite growth of the job queue.
-			 *
-			 * This is the simplest solution that is correct [1] - the node
-			 * that gets a job also deletes it, which emulates a
-			 * fire-and-forget job queue. Unfortunately it also means more
-			 * traffic back to the central job queue node. In redis6.2 the
-			 * XTRIM MINID strategy is introduced, which opens up some
-			 * interesting strategies for cleaning up the job queue. This is
-			 * work for later though.
-			 *
-			 * [1] except in some crashing scenarios
-			 */
-			ids := make([]string, 0, 3)
-			for _, xmsg := range msgs {
-				for _, msg := range xmsg.Messages {
-					ids = append(ids, msg.ID)
+		if !opts.reliable {
+			go func() {
+				/*
+				 * Send a request-for-delete once the message has been read, in
+				 * order to stop the infinite growth of the job queue.
+				 *
+				 * This is the simplest solution that is correct [1] - the node
+				 * that gets a job also deletes it, which emulates a
+				 * fire-and-forget job queue. Unfortunately it also means more
+				 * traffic back to the central job queue node. In redis6.2 the
+				 * XTRIM MINID strategy is introduced, which opens up some
+				 * interesting strategies for cleaning up the job queue. This
+				 * is work for later though.
+				 *
+				 * In reliable mode the message is deleted when it is
+				 * acknowledged instead.
+				 *
+				 * [1] except in some crashing scenarios
+				 */
+				ids := make([]string, 0, 3)
+				for _, xmsg := range msgs {
+					for _, msg := range xmsg.Messages {
+						ids = append(ids, msg.ID)
+					}
 				}
-			}
-			err := storage.XDel(ctx, opts.stream, ids...).Err()
-			if err != nil {
-				log.Fatalf("Unable to XDEL: %v", err)
-			}
-		}()
+				err := storage.XDel(context.Background(), opts.stream, ids...).Err()
+				if err != nil {
+					log.Fatal().Err(err).Msg("Unable to XDEL")
+				}
+			}()
+		}
 
 		/*
 		 * The redis interface is designed for asking for a set of messages per
@@ -257,9 +524,20 @@ func main() {
 		 */
 		for _, xmsg := range msgs {
 			for _, message := range xmsg.Messages {
-				// TODO: graceful shutdown and/or cancellation
-				run(storage, opts.jobs, message.Values)
+				var ack func()
+				if opts.reliable {
+					ack = acknowledge(storage, opts, message.ID)
+				}
+				ack, ok := procs.track(message.ID, message.Values, ack)
+				if !ok {
+					refuse(storage, opts, message.Values)
+					continue
+				}
+				run(storage, downloads, message.Values, ack)
 			}
 		}
 	}
+
+	reclaiming.Wait()
+	shutdown(storage, opts, procs)
 }
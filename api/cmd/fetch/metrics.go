@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+)
+
+/*
+ * Prometheus metrics for the fetch worker. The metrics are registered with the
+ * default registry, and exposed on /metrics when the worker is started with
+ * --metrics.
+ *
+ * Metrics are labelled by the function of the task (slice, curtain, ...) and,
+ * when it makes sense, by outcome (ok, failed, cancelled).
+ */
+var (
+	fragmentsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts {
+			Namespace: "oneseismic",
+			Subsystem: "fetch",
+			Name:      "fragments_total",
+			Help:      "Number of fragments downloaded, by function and outcome",
+		},
+		[]string{ "function", "outcome" },
+	)
+
+	fetchedBytesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts {
+			Namespace: "oneseismic",
+			Subsystem: "fetch",
+			Name:      "bytes_total",
+			Help:      "Number of fragment bytes downloaded",
+		},
+		[]string{ "function" },
+	)
+
+	fetchSeconds = promauto.NewHistogramVec(
+		prometheus.HistogramOpts {
+			Namespace: "oneseismic",
+			Subsystem: "fetch",
+			Name:      "duration_seconds",
+			Help:      "Time spent fetching and adding all fragments of a task",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+		},
+		[]string{ "function", "outcome" },
+	)
+
+	packSeconds = promauto.NewHistogramVec(
+		prometheus.HistogramOpts {
+			Namespace: "oneseismic",
+			Subsystem: "fetch",
+			Name:      "pack_duration_seconds",
+			Help:      "Time spent packing the result of a task",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 12),
+		},
+		[]string{ "function", "outcome" },
+	)
+
+	fragmentCacheLookupsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts {
+			Namespace: "oneseismic",
+			Subsystem: "fetch",
+			Name:      "fragment_cache_lookups_total",
+			Help:      "Fragment cache lookups, by outcome (memory, disk, miss)",
+		},
+		[]string{ "outcome" },
+	)
+
+	coalescedTotal = promauto.NewCounter(
+		prometheus.CounterOpts {
+			Namespace: "oneseismic",
+			Subsystem: "fetch",
+			Name:      "coalesced_downloads_total",
+			Help:      "Number of fragments that joined an in-flight download",
+		},
+	)
+
+	fragmentCacheBytes = promauto.NewGaugeVec(
+		prometheus.GaugeOpts {
+			Namespace: "oneseismic",
+			Subsystem: "fetch",
+			Name:      "fragment_cache_bytes",
+			Help:      "Size of the cached fragments, by tier (memory, disk)",
+		},
+		[]string{ "tier" },
+	)
+)
+
+/*
+ * Automation for the common ok/failed outcome label
+ */
+func outcome(err error) string {
+	if err != nil {
+		return "failed"
+	}
+	return "ok"
+}
+
+/*
+ * Serve the metrics on addr, e.g. :9090. This blocks, so it should usually be
+ * called as a goroutine. Failing to serve metrics is logged, but does not
+ * stop the worker.
+ */
+func servemetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	log.Info().Msgf("serving metrics on %s/metrics", addr)
+	err := http.ListenAndServe(addr, mux)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to serve metrics")
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/equinor/oneseismic/api/internal/blobstore"
+)
+
+/*
+ * The download pool is shared by all the processes in a worker, and limits
+ * the number of concurrent downloads for the worker as a whole, rather than
+ * per process.
+ *
+ * Downloads are coalesced, so when several processes need the same fragment
+ * at the same time, e.g. when many users look at the same line, it is only
+ * downloaded once, and every process gets the same chunk. Chunks are only
+ * read after download, so sharing them is safe. The processes are already
+ * authorized by the query server, which reads the manifest on behalf of the
+ * user, so it does not matter whose token the download is made with.
+ *
+ * The pool is safe for concurrent use.
+ */
+type pool struct {
+	/*
+	 * A semaphore for the concurrent downloads
+	 */
+	slots chan struct{}
+	/*
+	 * The in-flight downloads, by blob
+	 */
+	mutex    sync.Mutex
+	inflight map[string]*download
+}
+
+/*
+ * A single download, which may be waited on by multiple processes. The chunk
+ * and err are only valid after done is closed.
+ */
+type download struct {
+	done  chan struct{}
+	chunk []byte
+	err   error
+}
+
+/*
+ * Make a pool that allows up to jobs concurrent downloads.
+ */
+func newPool(jobs int) *pool {
+	return &pool {
+		slots:    make(chan struct{}, jobs),
+		inflight: make(map[string]*download),
+	}
+}
+
+/*
+ * Schedule the download of fragment id from container. The key identifies
+ * the blob, i.e. the container and id, and downloads of the same key are
+ * coalesced. The done function is called with the result from some other
+ * goroutine when the download completes, or the context is cancelled.
+ *
+ * This blocks until there is room for another download, so that the worker
+ * does not take on more work than it can do. If ctx is cancelled while
+ * waiting, the download is not scheduled, done is not called, and the context
+ * error is returned.
+ */
+func (p *pool) fetch(
+	ctx       context.Context,
+	container blobstore.Container,
+	key       string,
+	id        string,
+	done      func([]byte, error),
+) error {
+	p.mutex.Lock()
+	d, ok := p.inflight[key]
+	p.mutex.Unlock()
+	if ok {
+		p.follow(ctx, d, container, key, id, done)
+		return nil
+	}
+
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	/*
+	 * Someone else could have started the download while waiting for a slot
+	 */
+	p.mutex.Lock()
+	d, ok = p.inflight[key]
+	if ok {
+		p.mutex.Unlock()
+		<-p.slots
+		p.follow(ctx, d, container, key, id, done)
+		return nil
+	}
+	d = &download { done: make(chan struct{}) }
+	p.inflight[key] = d
+	p.mutex.Unlock()
+
+	go func() {
+		d.chunk, d.err = fetchblob(ctx, container, id)
+		p.mutex.Lock()
+		delete(p.inflight, key)
+		p.mutex.Unlock()
+		<-p.slots
+		close(d.done)
+		done(d.chunk, d.err)
+	}()
+	return nil
+}
+
+/*
+ * Wait for the in-flight download d, started by another process.
+ */
+func (p *pool) follow(
+	ctx       context.Context,
+	d         *download,
+	container blobstore.Container,
+	key       string,
+	id        string,
+	done      func([]byte, error),
+) {
+	coalescedTotal.Inc()
+	go p.wait(ctx, d, container, key, id, done)
+}
+
+func (p *pool) wait(
+	ctx       context.Context,
+	d         *download,
+	container blobstore.Container,
+	key       string,
+	id        string,
+	done      func([]byte, error),
+) {
+	select {
+	case <-d.done:
+	case <-ctx.Done():
+		done(nil, ctx.Err())
+		return
+	}
+
+	/*
+	 * The download is made with the context of the process that started it,
+	 * and fails if that process is cancelled. This process is still alive,
+	 * so start over.
+	 */
+	cancelled := errors.Is(d.err, context.Canceled) ||
+		errors.Is(d.err, context.DeadlineExceeded)
+	if cancelled && ctx.Err() == nil {
+		err := p.fetch(ctx, container, key, id, done)
+		if err != nil {
+			done(nil, err)
+		}
+		return
+	}
+	done(d.chunk, d.err)
+}
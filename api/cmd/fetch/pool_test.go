@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/equinor/oneseismic/api/internal/blobstore"
+)
+
+/*
+ * A container where downloads block until released, and which counts the
+ * number of downloads, and the most that are running at the same time.
+ */
+type gatedContainer struct {
+	blobstore.Container
+	release    chan struct{}
+	downloads  int32
+	running    int32
+	maxrunning int32
+}
+
+func (c *gatedContainer) Fragment(
+	ctx context.Context,
+	id  string,
+) ([]byte, error) {
+	atomic.AddInt32(&c.downloads, 1)
+	n := atomic.AddInt32(&c.running, 1)
+	defer atomic.AddInt32(&c.running, -1)
+	for {
+		max := atomic.LoadInt32(&c.maxrunning)
+		if n <= max || atomic.CompareAndSwapInt32(&c.maxrunning, max, n) {
+			break
+		}
+	}
+
+	select {
+	case <-c.release:
+		return []byte(id), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+type result struct {
+	chunk []byte
+	err   error
+}
+
+func collect(results chan result) func([]byte, error) {
+	return func(chunk []byte, err error) {
+		results <- result { chunk: chunk, err: err }
+	}
+}
+
+func TestPoolCoalescesDownloads(t *testing.T) {
+	ctx := context.Background()
+	container := &gatedContainer { release: make(chan struct{}) }
+	downloads := newPool(4)
+	results := make(chan result, 3)
+
+	for i := 0; i < 3; i++ {
+		err := downloads.fetch(ctx, container, "key", "id", collect(results))
+		assert.Nil(t, err)
+	}
+	close(container.release)
+
+	for i := 0; i < 3; i++ {
+		r := <-results
+		assert.Nil(t, r.err)
+		assert.Equal(t, "id", string(r.chunk))
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&container.downloads))
+}
+
+func TestPoolLimitsConcurrentDownloads(t *testing.T) {
+	ctx := context.Background()
+	container := &gatedContainer { release: make(chan struct{}) }
+	downloads := newPool(2)
+	results := make(chan result, 6)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for _, key := range []string{ "a", "b", "c", "d", "e", "f" } {
+			err := downloads.fetch(ctx, container, key, key, collect(results))
+			assert.Nil(t, err)
+		}
+	}()
+
+	/*
+	 * Wait for the pool to fill up, and check that the next download is held
+	 * back
+	 */
+	for atomic.LoadInt32(&container.running) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&container.downloads))
+
+	for i := 0; i < 6; i++ {
+		container.release <- struct{}{}
+		assert.Nil(t, (<-results).err)
+	}
+	wg.Wait()
+	assert.Equal(t, int32(6), atomic.LoadInt32(&container.downloads))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&container.maxrunning))
+}
+
+func TestPoolRetriesWhenLeaderIsCancelled(t *testing.T) {
+	container := &gatedContainer { release: make(chan struct{}) }
+	downloads := newPool(2)
+	results := make(chan result, 2)
+
+	leader, cancel := context.WithCancel(context.Background())
+	err := downloads.fetch(leader, container, "key", "id", collect(results))
+	assert.Nil(t, err)
+	err = downloads.fetch(
+		context.Background(),
+		container,
+		"key",
+		"id",
+		collect(results),
+	)
+	assert.Nil(t, err)
+
+	cancel()
+	assert.NotNil(t, (<-results).err)
+
+	container.release <- struct{}{}
+	select {
+	case r := <-results:
+		assert.Nil(t, r.err)
+		assert.Equal(t, "id", string(r.chunk))
+	case <-time.After(time.Second):
+		t.Fatalf("follower was not retried")
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&container.downloads))
+}
+
+func TestPoolDoesNotScheduleWhenCancelled(t *testing.T) {
+	container := &gatedContainer { release: make(chan struct{}) }
+	downloads := newPool(1)
+	results := make(chan result, 1)
+
+	ctx := context.Background()
+	assert.Nil(t, downloads.fetch(ctx, container, "a", "a", collect(results)))
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	err := downloads.fetch(cancelled, container, "b", "b", collect(results))
+	assert.NotNil(t, err)
+
+	container.release <- struct{}{}
+	assert.Nil(t, (<-results).err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&container.downloads))
+}
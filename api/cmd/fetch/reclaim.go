@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/rs/zerolog/log"
+
+	"github.com/equinor/oneseismic/api/internal/logging"
+)
+
+/*
+ * In reliable mode tasks are read from the job queue without NoAck, which
+ * means redis keeps track of every delivered-but-not-acknowledged task in the
+ * pending entries list (PEL) of the consumer group. A task is acknowledged
+ * (and deleted) when the process is done with, successfully or not. Should a
+ * worker crash, its tasks are left pending, and are eventually claimed and
+ * re-run by some other worker.
+ *
+ * A task that is pending for a long time is not necessarily abandoned - it
+ * could just be slow. Re-running a slow task means the same part may be
+ * written more than once to the result stream, which the result endpoints
+ * must (and do) tolerate.
+ */
+
+/*
+ * Make the ack function for the task id, which acknowledges and deletes the
+ * task from the job queue.
+ */
+func acknowledge(storage redis.Cmdable, opts opts, id string) func() {
+	return func() {
+		ctx := context.Background()
+		err := storage.XAck(ctx, opts.stream, opts.group, id).Err()
+		if err != nil {
+			log.Error().Err(err).Str("id", id).Msg("Unable to XACK")
+			return
+		}
+		err = storage.XDel(ctx, opts.stream, id).Err()
+		if err != nil {
+			log.Error().Err(err).Str("id", id).Msg("Unable to XDEL")
+		}
+	}
+}
+
+/*
+ * Periodically claim and re-run tasks that have been pending for longer than
+ * opts.reclaimafter. This runs until the context is cancelled, and must have
+ * returned before the worker is shut down, or a reclaimed process could be
+ * tracked while (or after) the in-flight processes are drained.
+ */
+func reclaim(
+	ctx       context.Context,
+	storage   redis.Cmdable,
+	opts      opts,
+	procs     *inflight,
+	downloads *pool,
+) {
+	ticker := time.NewTicker(opts.reclaimafter / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := reclaimpending(ctx, storage, opts, procs, downloads)
+			if err != nil {
+				log.Error().Err(err).Msg("Unable to reclaim pending tasks")
+			}
+		}
+	}
+}
+
+/*
+ * Claim the pending tasks that have been idle for longer than
+ * opts.reclaimafter and run them. Tasks that have already been delivered
+ * opts.maxdeliveries times are assumed to be poisonous (i.e. they crash the
+ * worker) and are failed instead of run.
+ *
+ * Multiple workers can race to reclaim the same tasks, but XCLAIM only hands
+ * a task to one of them since claiming resets the idle time.
+ *
+ * The re-run processes are tracked as in-flight in procs.
+ */
+func reclaimpending(
+	ctx       context.Context,
+	storage   redis.Cmdable,
+	opts      opts,
+	procs     *inflight,
+	downloads *pool,
+) error {
+	pending, err := storage.XPendingExt(ctx, &redis.XPendingExtArgs {
+		Stream: opts.stream,
+		Group:  opts.group,
+		Start:  "-",
+		End:    "+",
+		Count:  100,
+	}).Result()
+	if err != nil {
+		return err
+	}
+
+	deliveries := make(map[string]int64)
+	ids := make([]string, 0, len(pending))
+	for _, entry := range pending {
+		if entry.Idle < opts.reclaimafter {
+			continue
+		}
+		deliveries[entry.ID] = entry.RetryCount
+		ids = append(ids, entry.ID)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	msgs, err := storage.XClaim(ctx, &redis.XClaimArgs {
+		Stream:   opts.stream,
+		Group:    opts.group,
+		Consumer: opts.consumerid,
+		MinIdle:  opts.reclaimafter,
+		Messages: ids,
+	}).Result()
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range msgs {
+		ack := acknowledge(storage, opts, msg.ID)
+		pid,  _ := msg.Values["pid" ].(string)
+		part, _ := msg.Values["part"].(string)
+		if pid == "" {
+			// The task has been deleted, but not acknowledged
+			ack()
+			continue
+		}
+
+		n := deliveries[msg.ID]
+		if n >= opts.maxdeliveries {
+			log.Warn().
+				Str(logging.Pid,  pid).
+				Str(logging.Part, part).
+				Msgf("abandoned after %d deliveries", n)
+			err := fmt.Errorf("abandoned after %d deliveries", n)
+			reportfailure(storage, pid, part, "abandoned", err)
+			ack()
+			continue
+		}
+
+		/*
+		 * The worker is shutting down, so leave the remaining tasks pending
+		 * for other workers to reclaim.
+		 */
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		log.Info().
+			Str(logging.Pid,  pid).
+			Str(logging.Part, part).
+			Msgf("reclaimed after %d deliveries", n)
+		ack, ok := procs.track(msg.ID, msg.Values, ack)
+		if !ok {
+			refuse(storage, opts, msg.Values)
+			return nil
+		}
+		run(storage, downloads, msg.Values, ack)
+	}
+	return nil
+}
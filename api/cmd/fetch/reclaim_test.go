@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+)
+
+func reliableopts(consumer string) opts {
+	return opts {
+		stream:        "jobs",
+		group:         "fetch",
+		consumerid:    consumer,
+		jobs:          2,
+		reliable:      true,
+		reclaimafter:  time.Millisecond,
+		maxdeliveries: 3,
+	}
+}
+
+/*
+ * Put a task on the job queue and have the (crashed) consumer read it without
+ * acknowledging it, so that it is left pending.
+ */
+func putpending(t *testing.T, storage redis.Cmdable, pid string, task string) {
+	ctx := context.Background()
+	err := storage.XGroupCreateMkStream(ctx, "jobs", "fetch", "0").Err()
+	if err != nil && err.Error() != "BUSYGROUP Consumer Group name already exists" {
+		t.Fatalf("unable to create group: %v", err)
+	}
+
+	args := redis.XAddArgs {
+		Stream: "jobs",
+		Values: []interface{} { "pid", pid, "part", "0/1", "task", task },
+	}
+	assert.Nil(t, storage.XAdd(ctx, &args).Err())
+	read := redis.XReadGroupArgs {
+		Group:    "fetch",
+		Consumer: "crashed",
+		Streams:  []string { "jobs", ">" },
+		Count:    1,
+	}
+	assert.Nil(t, storage.XReadGroup(ctx, &read).Err())
+}
+
+func npending(t *testing.T, storage redis.Cmdable) int64 {
+	pending, err := storage.XPending(context.Background(), "jobs", "fetch").Result()
+	assert.Nil(t, err)
+	return pending.Count
+}
+
+func TestReclaimRunsAndAcknowledgesPendingTasks(t *testing.T) {
+	storage := testredis(t)
+	putpending(t, storage, "pid", "not a task")
+	assert.Equal(t, int64(1), npending(t, storage))
+
+	time.Sleep(5 * time.Millisecond)
+	opts := reliableopts("alive")
+	err := reclaimpending(context.Background(), storage, opts, newInflight(), newPool(2))
+	assert.Nil(t, err)
+
+	// The task was run (and failed, being garbage), and acknowledged
+	failed := failures(t, storage, "pid")
+	assert.Equal(t, 1, len(failed))
+	assert.Equal(t, "bad-task", failed[0].Kind)
+	assert.Equal(t, int64(0), npending(t, storage))
+
+	n, err := storage.XLen(context.Background(), "jobs").Result()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), n)
+}
+
+func TestReclaimSkipsRecentlyDeliveredTasks(t *testing.T) {
+	storage := testredis(t)
+	putpending(t, storage, "pid", "not a task")
+
+	opts := reliableopts("alive")
+	opts.reclaimafter = time.Hour
+	assert.Nil(t, reclaimpending(context.Background(), storage, opts, newInflight(), newPool(2)))
+
+	assert.Equal(t, 0, len(failures(t, storage, "pid")))
+	assert.Equal(t, int64(1), npending(t, storage))
+}
+
+func TestReclaimAbandonsRepeatedlyDeliveredTasks(t *testing.T) {
+	storage := testredis(t)
+	putpending(t, storage, "pid", "not a task")
+
+	opts := reliableopts("alive")
+	opts.maxdeliveries = 1
+	time.Sleep(5 * time.Millisecond)
+	assert.Nil(t, reclaimpending(context.Background(), storage, opts, newInflight(), newPool(2)))
+
+	failed := failures(t, storage, "pid")
+	assert.Equal(t, 1, len(failed))
+	assert.Equal(t, "abandoned", failed[0].Kind)
+	assert.Equal(t, int64(0), npending(t, storage))
+}
+
+/*
+ * A storage where the worker is told to shut down as soon as it has claimed
+ * the pending tasks.
+ */
+type shutdownAfterClaim struct {
+	redis.Cmdable
+	cancel context.CancelFunc
+}
+
+func (s shutdownAfterClaim) XClaim(
+	ctx  context.Context,
+	args *redis.XClaimArgs,
+) *redis.XMessageSliceCmd {
+	cmd := s.Cmdable.XClaim(ctx, args)
+	s.cancel()
+	return cmd
+}
+
+func TestReclaimLeavesClaimedTasksPendingOnShutdown(t *testing.T) {
+	storage := testredis(t)
+	putpending(t, storage, "pid", "not a task")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	opts := reliableopts("alive")
+	time.Sleep(5 * time.Millisecond)
+	procs := newInflight()
+	err := reclaimpending(
+		ctx,
+		shutdownAfterClaim { Cmdable: storage, cancel: cancel },
+		opts,
+		procs,
+		newPool(2),
+	)
+	assert.Nil(t, err)
+
+	assert.Equal(t, 0, len(failures(t, storage, "pid")))
+	assert.Equal(t, int64(1), npending(t, storage))
+	assert.Empty(t, procs.remaining())
+}
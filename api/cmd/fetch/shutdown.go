@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/rs/zerolog/log"
+
+	"github.com/equinor/oneseismic/api/internal/logging"
+)
+
+/*
+ * The set of in-flight processes, i.e. processes that have been read from the
+ * job queue but not yet completed. This is used to drain the worker on
+ * shutdown.
+ */
+type inflight struct {
+	wg    sync.WaitGroup
+	mutex sync.Mutex
+	/*
+	 * Set when the worker starts shutting down, after which no more
+	 * processes are tracked
+	 */
+	closed bool
+	/*
+	 * The pid and part of the in-flight processes, keyed by the job queue
+	 * message ID
+	 */
+	procs map[string][2]string
+}
+
+func newInflight() *inflight {
+	return &inflight {
+		procs: make(map[string][2]string),
+	}
+}
+
+/*
+ * Track the process read from the job queue message id. The returned ack
+ * function marks the process as completed, and in turn calls the ack given as
+ * argument, if any. It should be passed to run().
+ *
+ * Once the worker is shutting down no new processes are tracked, and track
+ * returns false. The process must then not be run, but be refuse()d.
+ */
+func (f *inflight) track(
+	id      string,
+	process map[string]interface{},
+	ack     func(),
+) (func(), bool) {
+	pid,  _ := process["pid" ].(string)
+	part, _ := process["part"].(string)
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.closed {
+		return nil, false
+	}
+	f.procs[id] = [2]string{ pid, part }
+	f.wg.Add(1)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			if ack != nil {
+				ack()
+			}
+			f.mutex.Lock()
+			delete(f.procs, id)
+			f.mutex.Unlock()
+			f.wg.Done()
+		})
+	}, true
+}
+
+/*
+ * Stop tracking new processes. The processes already in flight can still
+ * complete.
+ */
+func (f *inflight) close() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.closed = true
+}
+
+/*
+ * Wait for all in-flight processes to complete, or for the timeout to pass.
+ * Returns false on timeout.
+ */
+func (f *inflight) wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		f.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+/*
+ * The pid and part of the processes that are still in flight.
+ */
+func (f *inflight) remaining() [][2]string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	procs := make([][2]string, 0, len(f.procs))
+	for _, proc := range f.procs {
+		procs = append(procs, proc)
+	}
+	return procs
+}
+
+/*
+ * Give up the process pid/part because the worker is shutting down. In
+ * reliable mode it is left pending for other workers to reclaim, and
+ * otherwise reported as failed, since it will never complete.
+ */
+func abandon(
+	storage redis.Cmdable,
+	opts    opts,
+	pid     string,
+	part    string,
+	reason  string,
+) {
+	logger := log.With().
+		Str(logging.Pid,  pid).
+		Str(logging.Part, part).
+		Logger()
+	if opts.reliable {
+		logger.Warn().Msgf("%s; left for reclaiming", reason)
+		return
+	}
+
+	logger.Warn().Msgf("%s; failing", reason)
+	err := fmt.Errorf("worker %s shut down", opts.consumerid)
+	reportfailure(storage, pid, part, "shutdown", err)
+}
+
+/*
+ * Refuse the process that could not be tracked because the worker is
+ * shutting down, see abandon().
+ */
+func refuse(storage redis.Cmdable, opts opts, process map[string]interface{}) {
+	pid,  _ := process["pid" ].(string)
+	part, _ := process["part"].(string)
+	abandon(storage, opts, pid, part, "refused")
+}
+
+/*
+ * Drain and shut down the worker. The worker must already have stopped
+ * reading new jobs.
+ *
+ * The in-flight processes are given until opts.shutdowntimeout to complete.
+ * Processes that do not complete in time are handed back in reliable mode, by
+ * leaving them pending for other workers to reclaim, and otherwise reported
+ * as failed, since they will never complete.
+ *
+ * Finally the consumer is removed from the group, unless it has pending
+ * messages that must be left for reclaiming.
+ */
+func shutdown(storage redis.Cmdable, opts opts, procs *inflight) {
+	procs.close()
+	log.Info().
+		Str("consumer", opts.consumerid).
+		Msgf(
+			"shutting down; waiting up to %v for %d processes",
+			opts.shutdowntimeout,
+			len(procs.remaining()),
+		)
+
+	if !procs.wait(opts.shutdowntimeout) {
+		for _, proc := range procs.remaining() {
+			abandon(storage, opts, proc[0], proc[1], "not completed")
+		}
+	}
+
+	ctx := context.Background()
+	if opts.reliable {
+		pending, err := storage.XPendingExt(ctx, &redis.XPendingExtArgs {
+			Stream:   opts.stream,
+			Group:    opts.group,
+			Start:    "-",
+			End:      "+",
+			Count:    1,
+			Consumer: opts.consumerid,
+		}).Result()
+		if err != nil {
+			log.Error().Err(err).Msg("Unable to read pending tasks")
+			return
+		}
+		if len(pending) > 0 {
+			/*
+			 * Removing the consumer would also drop its pending tasks. Leave
+			 * it for cmd/gc to remove once the tasks have been reclaimed.
+			 */
+			log.Info().
+				Str("consumer", opts.consumerid).
+				Msg("pending tasks; consumer not removed")
+			return
+		}
+	}
+
+	err := storage.XGroupDelConsumer(
+		ctx,
+		opts.stream,
+		opts.group,
+		opts.consumerid,
+	).Err()
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("consumer", opts.consumerid).
+			Msg("Unable to remove consumer")
+		return
+	}
+	log.Info().
+		Str("consumer", opts.consumerid).
+		Str("group", opts.group).
+		Msg("consumer removed")
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+)
+
+/*
+ * The consumers with pending messages. Deleting a consumer also drops its
+ * pending messages.
+ */
+func consumers(t *testing.T, storage redis.Cmdable) []string {
+	ctx := context.Background()
+	pending, err := storage.XPending(ctx, "jobs", "fetch").Result()
+	assert.Nil(t, err)
+
+	names := []string{}
+	for name := range pending.Consumers {
+		names = append(names, name)
+	}
+	return names
+}
+
+func TestInflightWaitsForAck(t *testing.T) {
+	acked := 0
+	procs := newInflight()
+	ack, ok := procs.track("1-0", map[string]interface{} {
+		"pid":  "pid",
+		"part": "0/1",
+	}, func() { acked++ })
+	assert.True(t, ok)
+
+	assert.False(t, procs.wait(time.Millisecond))
+	assert.Equal(t, [][2]string{ { "pid", "0/1" } }, procs.remaining())
+
+	ack()
+	ack()
+	assert.True(t, procs.wait(time.Second))
+	assert.Equal(t, 0, len(procs.remaining()))
+	assert.Equal(t, 1, acked)
+}
+
+func TestShutdownFailsUnfinishedAndRemovesConsumer(t *testing.T) {
+	storage := testredis(t)
+	putpending(t, storage, "pid", "not a task")
+	assert.Equal(t, []string{ "crashed" }, consumers(t, storage))
+
+	opts := reliableopts("crashed")
+	opts.reliable = false
+	opts.shutdowntimeout = time.Millisecond
+	procs := newInflight()
+	procs.track("1-0", map[string]interface{} {
+		"pid":  "pid",
+		"part": "0/1",
+	}, nil)
+
+	shutdown(storage, opts, procs)
+	failed := failures(t, storage, "pid")
+	assert.Equal(t, 1, len(failed))
+	assert.Equal(t, "shutdown", failed[0].Kind)
+	assert.Equal(t, 0, len(consumers(t, storage)))
+}
+
+func TestReliableShutdownLeavesPendingForReclaim(t *testing.T) {
+	storage := testredis(t)
+	putpending(t, storage, "pid", "not a task")
+
+	opts := reliableopts("crashed")
+	opts.shutdowntimeout = time.Millisecond
+	procs := newInflight()
+	procs.track("1-0", map[string]interface{} {
+		"pid":  "pid",
+		"part": "0/1",
+	}, nil)
+
+	shutdown(storage, opts, procs)
+	assert.Equal(t, 0, len(failures(t, storage, "pid")))
+	assert.Equal(t, []string{ "crashed" }, consumers(t, storage))
+	assert.Equal(t, int64(1), npending(t, storage))
+}
+
+func TestShutdownRefusesNewProcesses(t *testing.T) {
+	storage := testredis(t)
+	opts := reliableopts("worker")
+	opts.reliable = false
+	opts.shutdowntimeout = time.Millisecond
+	procs := newInflight()
+
+	shutdown(storage, opts, procs)
+	process := map[string]interface{} {
+		"pid":  "pid",
+		"part": "0/1",
+	}
+	_, ok := procs.track("1-0", process, nil)
+	assert.False(t, ok)
+	assert.True(t, procs.wait(time.Millisecond))
+	assert.Empty(t, procs.remaining())
+
+	refuse(storage, opts, process)
+	failed := failures(t, storage, "pid")
+	assert.Equal(t, 1, len(failed))
+	assert.Equal(t, "shutdown", failed[0].Kind)
+}
@@ -44,7 +44,12 @@ bool init(proc* p, const void* msg, int len) {
 }
 
 const char* fragments(proc* p) {
-    return p->p->fragments().c_str();
+    try {
+        return p->p->fragments().c_str();
+    } catch (std::exception& e) {
+        p->errmsg = e.what();
+        return nullptr;
+    }
 }
 
 bool add(proc* p, int index, const void* chunk, int len) {
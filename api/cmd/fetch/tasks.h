@@ -57,6 +57,7 @@ bool add(struct proc*, int index, const void* chunk, int len);
  * Get the list of fragments from proc. This function is not thread safe. The
  * list of fragments is returned as a single string, with list elements
  * separated by ';'. The char array is owned by C++ and *must not* be free'd.
+ * Returns NULL on error, in which case errmsg() describes the error.
  *
  * Returning the list-of-fragments as a single string means only a single round
  * trip go <-> C++, at the cost of parsing a string in go.
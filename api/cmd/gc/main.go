@@ -100,6 +100,15 @@ func main() {
 
 	garbage := []string{}
 	for _, consumer := range consumers {
+		/*
+		 * Deleting a consumer also drops its pending messages, which in
+		 * reliable mode are the tasks that have not been completed yet. Those
+		 * are eventually claimed by other workers, after which the consumer
+		 * has no pending messages and can be removed.
+		 */
+		if consumer.Pending > 0 {
+			continue
+		}
 		if consumer.Idle > opts.threshold.Milliseconds() {
 			garbage = append(garbage, consumer.Name)
 		}
@@ -120,10 +129,10 @@ func main() {
 		 * scaled down or restarted) and there just not being any work, but if
 		 * the node is still alive then the consumer will be re-iniated on the
 		 * next available job and nothing will be lost. This is ok because jobs
-		 * are fetched with NoAck so there are no pending-but-not-acked
-		 * messages. This has been tested manually to work well, but I have not
-		 * found a good reference with guarantees from redis, so this *might*
-		 * come to bite us later.
+		 * are either fetched with NoAck so there are no pending-but-not-acked
+		 * messages, or the consumer is skipped if it has any. This has been
+		 * tested manually to work well, but I have not found a good reference
+		 * with guarantees from redis, so this *might* come to bite us later.
 		 */
 		err := storage.XGroupDelConsumer(ctx, opts.stream, opts.group, id).Err()
 		if err != nil {
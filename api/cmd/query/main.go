@@ -1,18 +1,23 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"time"
 
 	"github.com/equinor/oneseismic/api/api"
 	"github.com/equinor/oneseismic/api/internal/auth"
+	"github.com/equinor/oneseismic/api/internal/logging"
+	"github.com/equinor/oneseismic/api/internal/tracing"
 	"github.com/equinor/oneseismic/api/internal/util"
 	"github.com/gin-gonic/gin"
 	"github.com/go-redis/redis/v8"
 	"github.com/pborman/getopt/v2"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
 )
 
 type opts struct {
@@ -21,9 +26,22 @@ type opts struct {
 	clientID     string
 	clientSecret string
 	storageURL   string
+	s3shared     bool
 	redisURL     string
 	bind         string
 	signkey      string
+	otlpendpoint string
+	metrics      string
+	cachettl     time.Duration
+	cacheentries int64
+	cachebytes   int64
+	tasksize     int
+	tasklatency  time.Duration
+	fraglatency  time.Duration
+	fetchgroup   string
+	jobstream    string
+	logformat    string
+	loglevel     string
 }
 
 func parseopts() opts {
@@ -36,6 +54,16 @@ func parseopts() opts {
 		storageURL:   os.Getenv("STORAGE_URL"),
 		redisURL:     os.Getenv("REDIS_URL"),
 		signkey:      os.Getenv("SIGN_KEY"),
+		otlpendpoint: os.Getenv("OTLP_ENDPOINT"),
+		cacheentries: 10000,
+		cachebytes:   64 * 1024 * 1024,
+		tasksize:     10,
+		tasklatency:  time.Second,
+		fraglatency:  50 * time.Millisecond,
+		fetchgroup:   "fetch",
+		jobstream:    "jobs",
+		logformat:    "text",
+		loglevel:     "info",
 	}
 
 	getopt.FlagLong(
@@ -70,9 +98,20 @@ func parseopts() opts {
 		&opts.storageURL,
 		"storage-url",
 		0,
-		"Storage URL, e.g. https://<account>.blob.core.windows.net",
+		"Storage URL, e.g. https://<account>.blob.core.windows.net. " +
+			"Use s3://<host[:port]> for S3-compatible storage, with " +
+			"credentials from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, " +
+			"or file:///path/to/cubes to serve cubes from a local directory",
 		"url",
 	)
+	getopt.FlagLong(
+		&opts.s3shared,
+		"s3-shared-credentials",
+		0,
+		"Allow an s3:// storage URL. S3 is read with the credentials of " +
+			"the server, not the user, so every user that can log in can " +
+			"read every cube in the store",
+	)
 	getopt.FlagLong(
 		&opts.redisURL,
 		"redis-url",
@@ -94,12 +133,130 @@ func parseopts() opts {
 		"Signing key used for response authorization tokens",
 		"key",
 	)
+	getopt.FlagLong(
+		&opts.otlpendpoint,
+		"otlp-endpoint",
+		0,
+		"Export trace spans with OTLP/http to the collector on this " +
+			"address, e.g. localhost:4318",
+		"addr",
+	)
+	getopt.FlagLong(
+		&opts.metrics,
+		"metrics",
+		0,
+		"Serve prometheus metrics on /metrics on this address, e.g. :9090. " +
+			"Metrics are not served unless this is set, and never on the " +
+			"public :8080",
+		"addr",
+	)
+	getopt.FlagLong(
+		&opts.cachettl,
+		"cache-ttl",
+		0,
+		"Serve identical queries from the same process for this long. " +
+			"Processes served from the result cache are shared between " +
+			"users, and cannot be cancelled. Defaults to 0, which disables " +
+			"the result cache",
+		"duration",
+	)
+	getopt.FlagLong(
+		&opts.cacheentries,
+		"cache-max-entries",
+		0,
+		"Max number of queries in the result cache, 0 for no limit. " +
+			"Defaults to 10000",
+		"N",
+	)
+	getopt.FlagLong(
+		&opts.cachebytes,
+		"cache-max-bytes",
+		0,
+		"Do not cache results larger than this, 0 for no limit. " +
+			"Defaults to 64MiB",
+		"bytes",
+	)
+	getopt.FlagLong(
+		&opts.tasksize,
+		"task-size",
+		0,
+		"Number of fragments per task. 0 picks the task size for every " +
+			"query from the number of fragments, the number of fetch " +
+			"workers, and --task-latency. Defaults to 10",
+		"N",
+	)
+	getopt.FlagLong(
+		&opts.tasklatency,
+		"task-latency",
+		0,
+		"Target time for a worker to complete a task, with --task-size 0. " +
+			"Defaults to 1s",
+		"duration",
+	)
+	getopt.FlagLong(
+		&opts.fraglatency,
+		"fragment-latency",
+		0,
+		"Estimated time for a worker to fetch and process a fragment, " +
+			"with --task-size 0. Defaults to 50ms",
+		"duration",
+	)
+	getopt.FlagLong(
+		&opts.fetchgroup,
+		"fetch-group",
+		0,
+		"Consumer group of the fetch workers, with --task-size 0. " +
+			"Defaults to fetch",
+		"group",
+	)
+	getopt.FlagLong(
+		&opts.jobstream,
+		"stream",
+		0,
+		"Stream ID to put tasks on. Must be consistent with the fetch " +
+			"workers. You should normally not need to change this.",
+		"name",
+	)
+	getopt.FlagLong(
+		&opts.logformat,
+		"log-format",
+		0,
+		"Log format, text or json",
+		"format",
+	)
+	getopt.FlagLong(
+		&opts.loglevel,
+		"log-level",
+		0,
+		"Log level, one of debug, info, warn, error",
+		"level",
+	)
 
 	getopt.Parse()
 	if *help {
 		getopt.Usage()
 		os.Exit(0)
 	}
+	storage, err := url.Parse(opts.storageURL)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "bad --storage-url: %v\n", err)
+		os.Exit(1)
+	}
+	s3 := storage.Scheme == "s3" || storage.Scheme == "s3+http"
+	if s3 && !opts.s3shared {
+		msg := "--storage-url %s: s3 performs no per-user authorization, " +
+			"use --s3-shared-credentials to allow it\n"
+		fmt.Fprintf(os.Stderr, msg, opts.storageURL)
+		os.Exit(1)
+	}
+	if opts.tasksize < 0 {
+		fmt.Fprintf(os.Stderr, "--task-size (= %d) must be >= 0\n", opts.tasksize)
+		os.Exit(1)
+	}
+	if opts.tasksize == 0 && !(opts.fraglatency > 0) {
+		fmt.Fprintln(os.Stderr, "--fragment-latency must be positive")
+		os.Exit(1)
+	}
 
 	return opts
 }
@@ -165,8 +322,38 @@ func (c *clientconfig) Get(ctx *gin.Context) {
 	})
 }
 
+/*
+ * Serve the prometheus metrics on a separate listener, so that they are not
+ * exposed unauthenticated next to the public endpoints.
+ */
+func servemetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	log.Info().Msgf("serving metrics on %s/metrics", addr)
+	err := http.ListenAndServe(addr, mux)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to serve metrics")
+	}
+}
+
 func main() {
 	opts := parseopts()
+	err := logging.Configure(opts.logformat, opts.loglevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	flush, err := tracing.Configure(
+		context.Background(),
+		"oneseismic-query",
+		opts.otlpendpoint,
+	)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Unable to configure tracing")
+	}
+	defer flush(context.Background())
+
 	httpclient := http.Client {
 		Timeout: 10 * time.Second,
 	}
@@ -175,7 +362,7 @@ func main() {
 		opts.authserver + "/v2.0/.well-known/openid-configuration",
 	)
 	if err != nil {
-		log.Fatalf("Unable to get OpenID keyset: %v", err)
+		log.Fatal().Err(err).Msg("Unable to get OpenID keyset")
 	}
 
 	keyring := auth.MakeKeyring([]byte(opts.signkey))
@@ -190,7 +377,30 @@ func main() {
 			DB: 0,
 		},
 	)
-	gql := api.MakeGraphQL(&keyring, opts.storageURL, cmdable, tokens)
+	var cache *api.ResultCache
+	if opts.cachettl > 0 {
+		cache = api.MakeResultCache(
+			cmdable,
+			opts.cachettl,
+			opts.cacheentries,
+			opts.cachebytes,
+		)
+	}
+	tasksize := api.TaskSize {
+		Size:     opts.tasksize,
+		Latency:  opts.tasklatency,
+		Fragment: opts.fraglatency,
+		Group:    opts.fetchgroup,
+		Stream:   opts.jobstream,
+	}
+	gql := api.MakeGraphQL(
+		&keyring,
+		opts.storageURL,
+		cmdable,
+		tokens,
+		cache,
+		tasksize,
+	)
 	result := api.Result {
 		Timeout: time.Second * 15,
 		StorageURL: opts.storageURL,
@@ -209,8 +419,10 @@ func main() {
 		},
 	}
 
-	app := gin.Default()
-	
+	app := gin.New()
+	app.Use(logging.Access())
+	app.Use(gin.Recovery())
+
 	graphql := app.Group("/graphql")
 	graphql.Use(util.GeneratePID)
 	graphql.GET( "", gql.Get)
@@ -222,7 +434,12 @@ func main() {
 	results.GET("/:pid", result.Get)
 	results.GET("/:pid/stream", result.Stream)
 	results.GET("/:pid/status", result.Status)
+	results.DELETE("/:pid", result.Cancel)
 
 	app.GET("/config", cfg.Get)
+
+	if opts.metrics != "" {
+		go servemetrics(opts.metrics)
+	}
 	app.Run(":8080")
 }
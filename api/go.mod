@@ -5,13 +5,26 @@ go 1.14
 require (
 	github.com/Azure/azure-pipeline-go v0.2.3
 	github.com/Azure/azure-storage-blob-go v0.13.0
+	github.com/alicebob/miniredis/v2 v2.30.0
 	github.com/auth0/go-jwt-middleware v1.0.0
 	github.com/form3tech-oss/jwt-go v3.2.2+incompatible
 	github.com/gin-gonic/gin v1.6.3
-	github.com/go-redis/redis/v8 v8.6.0
+	github.com/go-redis/redis/v8 v8.11.5
 	github.com/google/uuid v1.2.0
 	github.com/graph-gophers/graphql-go v1.1.0
+	github.com/minio/minio-go/v6 v6.0.55
 	github.com/pborman/getopt/v2 v2.1.0
-	github.com/stretchr/testify v1.7.0
+	github.com/prometheus/client_golang v1.12.2
+	github.com/rs/zerolog v1.20.0
+	github.com/stretchr/testify v1.7.1
 	github.com/vmihailenco/msgpack/v5 v5.2.3
+	go.opentelemetry.io/otel v1.7.0
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace v1.7.0 // indirect
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.7.0
+	go.opentelemetry.io/otel/sdk v1.7.0
+	go.opentelemetry.io/otel/trace v1.7.0
+	golang.org/x/net v0.11.0 // indirect
+	golang.org/x/sys v0.9.0 // indirect
+	golang.org/x/text v0.13.0 // indirect
+	gopkg.in/ini.v1 v1.51.0 // indirect
 )
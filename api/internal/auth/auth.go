@@ -5,7 +5,6 @@ import (
 	"crypto/rsa"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"strings"
 	"time"
@@ -14,6 +13,9 @@ import (
 	"github.com/auth0/go-jwt-middleware"
 	"github.com/form3tech-oss/jwt-go"
 	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+
+	"github.com/equinor/oneseismic/api/internal/logging"
 )
 
 /*
@@ -191,12 +193,12 @@ func ValidateJWT(
 		ValidationKeyGetter: func(token *jwt.Token) (interface{}, error) {
 			err := verifyIssuerAudience(issuer, audience, token)
 			if err != nil {
-				log.Printf("%v", err)
+				log.Warn().Err(err).Msg("bad issuer or audience")
 				return nil, err
 			}
 			key, err := validateKey(keys, token)
 			if err != nil {
-				log.Printf("%v", err)
+				log.Warn().Err(err).Msg("bad signing key")
 			}
 			return key, err
 		},
@@ -204,7 +206,7 @@ func ValidateJWT(
 
 	return func (ctx *gin.Context) {
 		if err := auth.CheckJWT(ctx.Writer, ctx.Request); err != nil {
-			log.Printf("checkJWT() failed: %v", err)
+			log.Warn().Err(err).Msg("checkJWT() failed")
 			ctx.AbortWithStatus(http.StatusUnauthorized)
 		}
 	}
@@ -414,7 +416,7 @@ func ResultAuth(keyring *Keyring) gin.HandlerFunc {
 		pid := ctx.Param("pid")
 		authorization := ctx.GetHeader("Authorization")
 		if authorization == "" {
-			log.Printf("%s No Authorization header", pid)
+			log.Warn().Str(logging.Pid, pid).Msg("no Authorization header")
 			/*
 			 * MDN docs
 			 * --------
@@ -431,11 +433,10 @@ func ResultAuth(keyring *Keyring) gin.HandlerFunc {
 		token := ""
 		_, err := fmt.Sscanf(authorization, "Bearer %s", &token)
 		if err != nil {
-			log.Printf(
-				"%s malformed header Authorization; was %s",
-				pid,
-				authorization,
-			)
+			log.Warn().
+				Str(logging.Pid, pid).
+				Str("authorization", authorization).
+				Msg("malformed header Authorization")
 			/*
 			 * Malformed authorization header - not quite sure if this is
 			 * Unauthorized, BadRequest or some other status code. Unauthorized
@@ -448,7 +449,7 @@ func ResultAuth(keyring *Keyring) gin.HandlerFunc {
 
 		err = keyring.Validate(token, pid)
 		if err != nil {
-			log.Printf("%s %v", pid, err)
+			log.Warn().Err(err).Str(logging.Pid, pid).Msg("bad result key")
 			ctx.AbortWithStatus(http.StatusForbidden)
 		}
 	}
@@ -5,9 +5,10 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"log"
 	"math/big"
 	"net/http"
+
+	"github.com/rs/zerolog/log"
 )
 
 /*
@@ -220,21 +221,21 @@ func GetOpenIDConfig(c HttpClient, authserver string) (*OpenIDConfig, error) {
 			 * so skip it and look for other viable keys.
 			 */
 	                if key.E == "" {
-				log.Printf("missing field 'e'")
+				log.Warn().Str("kid", key.Kid).Msg("missing field 'e'")
 				continue
 	                }
 	                if key.N == "" {
-				log.Printf("missing field 'n'")
+				log.Warn().Str("kid", key.Kid).Msg("missing field 'n'")
 				continue
 	                }
 			e, err := fromB64(key.E)
 			if err != nil {
-				log.Printf("Key.E (id = %s): %v", key.Kid, err)
+				log.Warn().Err(err).Str("kid", key.Kid).Msg("bad Key.E")
 				continue
 			}
 			n, err := fromB64(key.N)
 			if err != nil {
-				log.Printf("Key.N (id = %s): %v", key.Kid, err)
+				log.Warn().Err(err).Str("kid", key.Kid).Msg("bad Key.N")
 				continue
 			}
 
@@ -248,7 +249,7 @@ func GetOpenIDConfig(c HttpClient, authserver string) (*OpenIDConfig, error) {
 	err = nil
 	if len(keys) == 0 {
 		err = &noRSAKeys{}
-		log.Printf("Keyset: %v", keyset)
+		log.Error().Interface("keyset", keyset).Msg("no RSA keys")
 	}
 
 	return &OpenIDConfig {
@@ -0,0 +1,148 @@
+package blobstore
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+type azureStore struct {
+	service azblob.ServiceURL
+}
+
+type azureContainer struct {
+	container azblob.ContainerURL
+}
+
+/*
+ * Make a store backed by an azure storage account, where requests are
+ * authorized with token.
+ */
+func NewAzureStore(
+	endpoint *url.URL, // typically https://<account>.blob.core.windows.net
+	token    string,
+) Store {
+	credentials := azblob.NewTokenCredential(token, nil)
+	pipeline    := azblob.NewPipeline(credentials, azblob.PipelineOptions{})
+	return &azureStore {
+		service: azblob.NewServiceURL(*endpoint, pipeline),
+	}
+}
+
+/*
+ * List the cubes in a storage account
+ *
+ * Please note that while its phrased as something particular, "list cubes"
+ * really boils down to getting the names of the containers in a particular
+ * account. It is assumed that a storage account is used for oneseismic, and
+ * oneseismic only, in which case every container should correspond to a cube.
+ *
+ * It is untested, but likely, that containers with permissions set to
+ * non-readable for the caller will not show up in this list, which is the
+ * intention.
+ */
+func (s *azureStore) ListCubes(ctx context.Context) ([]string, error) {
+	cubes := make([]string, 0)
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		xs, err := s.service.ListContainersSegment(
+			ctx,
+			marker,
+			azblob.ListContainersSegmentOptions{},
+		)
+		if err != nil {
+			return nil, err
+		}
+		for _, cube := range xs.ContainerItems {
+			cubes = append(cubes, cube.Name)
+		}
+		marker = xs.NextMarker
+	}
+	return cubes, nil
+}
+
+func (s *azureStore) Container(guid string) Container {
+	return &azureContainer {
+		container: s.service.NewContainerURL(guid),
+	}
+}
+
+func (c *azureContainer) Manifest(ctx context.Context) ([]byte, error) {
+	body, _, err := c.download(ctx, "manifest.json")
+	return body, err
+}
+
+func (c *azureContainer) Fragment(
+	ctx context.Context,
+	id  string,
+) ([]byte, error) {
+	body, _, err := c.download(ctx, id)
+	return body, err
+}
+
+func (c *azureContainer) FragmentETag(
+	ctx context.Context,
+	id  string,
+) ([]byte, string, error) {
+	return c.download(ctx, id)
+}
+
+func (c *azureContainer) ETag(
+	ctx context.Context,
+	id  string,
+) (string, error) {
+	blob := c.container.NewBlobURL(id)
+	props, err := blob.GetProperties(
+		ctx,
+		azblob.BlobAccessConditions {},
+		azblob.ClientProvidedKeyOptions {},
+	)
+	if err != nil {
+		if e, ok := err.(azblob.StorageError); ok {
+			if e.Response().StatusCode == http.StatusNotFound {
+				return "", fmt.Errorf("%s: %w", blob.String(), ErrNotFound)
+			}
+		}
+		return "", err
+	}
+	return string(props.ETag()), nil
+}
+
+/*
+ * Synchronously download a blob, and get its ETag. A 404 from azure is
+ * translated to ErrNotFound, all other errors are passed through as-is.
+ */
+func (c *azureContainer) download(
+	ctx  context.Context,
+	name string,
+) ([]byte, string, error) {
+	blob := c.container.NewBlobURL(name)
+	dl, err := blob.Download(
+		ctx,
+		0, /* offset */
+		azblob.CountToEnd,
+		azblob.BlobAccessConditions {},
+		false, /* content-get-md5 */
+		azblob.ClientProvidedKeyOptions {},
+	)
+	if err != nil {
+		if e, ok := err.(azblob.StorageError); ok {
+			if e.Response().StatusCode == http.StatusNotFound {
+				msg := "%s: %w"
+				return nil, "", fmt.Errorf(msg, blob.String(), ErrNotFound)
+			}
+		}
+		return nil, "", err
+	}
+
+	body := dl.Body(azblob.RetryReaderOptions{})
+	defer body.Close()
+	chunk, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, "", err
+	}
+	return chunk, string(dl.ETag()), nil
+}
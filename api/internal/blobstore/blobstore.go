@@ -0,0 +1,100 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+/*
+ * The blobstore package hides the storage backend from the rest of
+ * oneseismic. Cubes are laid out the same way regardless of the backend:
+ *
+ *     <endpoint>/<guid>/manifest.json
+ *     <endpoint>/<guid>/src/64-64-64/0-0-0.f32
+ *     <endpoint>/<guid>/src/64-64-64/0-0-1.f32
+ *     ...
+ *
+ * i.e. every cube is a container (or directory) named by its guid, and the
+ * names of the fragments are relative to the container. The fragment names
+ * are generated by the C++ core, and taken at face value here.
+ */
+
+/*
+ * Returned (possibly wrapped) by all backends when the requested cube,
+ * manifest or fragment does not exist. Use errors.Is() to check for it.
+ */
+var ErrNotFound = errors.New("not found")
+
+/*
+ * A Store is a handle to a set of cubes, e.g. an azure storage account or a
+ * directory on a local file system.
+ */
+type Store interface {
+	/*
+	 * List the cubes (guids) in the store. Callers should assume that cubes
+	 * the caller does not have read access to are not listed.
+	 */
+	ListCubes(ctx context.Context) ([]string, error)
+	/*
+	 * Get a handle to the container for a specific cube. This does not
+	 * perform any I/O, and succeeds even if the cube does not exist.
+	 */
+	Container(guid string) Container
+}
+
+/*
+ * A Container is a handle to a single cube.
+ */
+type Container interface {
+	/*
+	 * Get the manifest.json document for the cube.
+	 */
+	Manifest(ctx context.Context) ([]byte, error)
+	/*
+	 * Get a fragment by its ID, e.g. src/64-64-64/0-0-1.f32
+	 */
+	Fragment(ctx context.Context, id string) ([]byte, error)
+	/*
+	 * Get a fragment and its ETag, in a single request. The ETag changes
+	 * whenever the fragment does, so it can be used for caching fragments.
+	 */
+	FragmentETag(ctx context.Context, id string) ([]byte, string, error)
+	/*
+	 * Get the ETag of a fragment, without downloading it.
+	 */
+	ETag(ctx context.Context, id string) (string, error)
+}
+
+/*
+ * Open a store from an endpoint URL. The backend is selected by the scheme of
+ * the endpoint:
+ *
+ *     https://<account>.blob.core.windows.net  azure blob storage
+ *     s3://<host[:port]>                       S3-compatible object storage
+ *     s3+http://<host[:port]>                  S3, without TLS
+ *     file:///path/to/cubes                    local file system
+ *
+ * The token is the (on-behalf-of) token used to authorize requests, and is
+ * ignored by backends that do not need it. The s3 and file stores ignore it,
+ * and so do not authorize users at all.
+ */
+func Open(endpoint string, token string) (Store, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("bad storage endpoint: %w", err)
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return NewAzureStore(u, token), nil
+	case "s3", "s3+http":
+		return NewS3Store(u)
+	case "file":
+		return NewLocalStore(u.Path), nil
+	default:
+		msg := "storage endpoint %s: unsupported scheme '%s'"
+		return nil, fmt.Errorf(msg, endpoint, u.Scheme)
+	}
+}
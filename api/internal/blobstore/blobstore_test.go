@@ -0,0 +1,177 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+/*
+ * Make a directory with a couple of cubes in it, laid out like blob storage:
+ *
+ *     root/cube-1/manifest.json
+ *     root/cube-1/src/64-64-64/0-0-0.f32
+ *     root/cube-2/manifest.json
+ *     root/not-a-cube
+ */
+func mklocalstore(t *testing.T) string {
+	root, err := ioutil.TempDir("", "oneseismic-blobstore")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	t.Cleanup(func () { os.RemoveAll(root) })
+
+	files := map[string]string {
+		"cube-1/manifest.json":           `{"guid": "cube-1"}`,
+		"cube-1/src/64-64-64/0-0-0.f32": "fragment",
+		"cube-2/manifest.json":           `{"guid": "cube-2"}`,
+		"not-a-cube":                     "",
+	}
+	for name, body := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("unable to mkdir: %v", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(body), 0644); err != nil {
+			t.Fatalf("unable to write %s: %v", name, err)
+		}
+	}
+	return root
+}
+
+func TestOpenSelectsBackendFromScheme(t *testing.T) {
+	store, err := Open("https://account.blob.core.windows.net", "token")
+	assert.Nil(t, err)
+	assert.IsType(t, &azureStore{}, store)
+
+	store, err = Open("file:///tmp/cubes", "")
+	assert.Nil(t, err)
+	assert.IsType(t, &localStore{}, store)
+	assert.Equal(t, "/tmp/cubes", store.(*localStore).root)
+
+	store, err = Open("s3://minio.example.com:9000", "")
+	assert.Nil(t, err)
+	assert.IsType(t, &s3Store{}, store)
+
+	_, err = Open("ftp://example.com", "")
+	assert.NotNil(t, err)
+}
+
+func TestS3EndpointMustNotHavePath(t *testing.T) {
+	_, err := Open("s3://minio.example.com:9000/bucket", "")
+	assert.NotNil(t, err)
+}
+
+func TestS3StoresShareClientPerEndpoint(t *testing.T) {
+	a, err := Open("s3://minio.example.com:9000", "")
+	assert.Nil(t, err)
+	b, err := Open("s3://minio.example.com:9000", "")
+	assert.Nil(t, err)
+	assert.Same(t, a.(*s3Store).client, b.(*s3Store).client)
+
+	c, err := Open("s3+http://minio.example.com:9000", "")
+	assert.Nil(t, err)
+	assert.NotSame(t, a.(*s3Store).client, c.(*s3Store).client)
+
+	d, err := Open("s3://minio.example.com:9000?region=eu-north-1", "")
+	assert.Nil(t, err)
+	assert.NotSame(t, a.(*s3Store).client, d.(*s3Store).client)
+}
+
+func TestS3CancelledDownloadErrors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	store, err := Open("s3+http://minio.example.com:9000", "")
+	assert.Nil(t, err)
+	_, err = store.Container("guid").Manifest(ctx)
+	assert.NotNil(t, err)
+	assert.False(t, errors.Is(err, ErrNotFound))
+}
+
+func TestLocalListCubes(t *testing.T) {
+	store := NewLocalStore(mklocalstore(t))
+	cubes, err := store.ListCubes(context.Background())
+	assert.Nil(t, err)
+
+	sort.Strings(cubes)
+	assert.Equal(t, []string{ "cube-1", "cube-2" }, cubes)
+}
+
+func TestLocalManifestAndFragment(t *testing.T) {
+	ctx := context.Background()
+	container := NewLocalStore(mklocalstore(t)).Container("cube-1")
+
+	manifest, err := container.Manifest(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"guid": "cube-1"}`, string(manifest))
+
+	fragment, err := container.Fragment(ctx, "src/64-64-64/0-0-0.f32")
+	assert.Nil(t, err)
+	assert.Equal(t, "fragment", string(fragment))
+}
+
+func TestLocalETagChangesWithFragment(t *testing.T) {
+	ctx := context.Background()
+	root := mklocalstore(t)
+	container := NewLocalStore(root).Container("cube-1")
+	id := "src/64-64-64/0-0-0.f32"
+
+	etag, err := container.ETag(ctx, id)
+	assert.Nil(t, err)
+	assert.NotEqual(t, "", etag)
+
+	same, err := container.ETag(ctx, id)
+	assert.Nil(t, err)
+	assert.Equal(t, etag, same)
+
+	path := filepath.Join(root, "cube-1", filepath.FromSlash(id))
+	err = ioutil.WriteFile(path, []byte("new fragment"), 0644)
+	assert.Nil(t, err)
+
+	changed, err := container.ETag(ctx, id)
+	assert.Nil(t, err)
+	assert.NotEqual(t, etag, changed)
+
+	_, err = container.ETag(ctx, "src/64-64-64/1-0-0.f32")
+	assert.True(t, errors.Is(err, ErrNotFound), "err = %v", err)
+}
+
+func TestLocalMissingIsNotFound(t *testing.T) {
+	ctx := context.Background()
+	store := NewLocalStore(mklocalstore(t))
+
+	_, err := store.Container("no-such-cube").Manifest(ctx)
+	assert.True(t, errors.Is(err, ErrNotFound), "err = %v", err)
+
+	_, err = store.Container("cube-2").Fragment(ctx, "src/64-64-64/0-0-0.f32")
+	assert.True(t, errors.Is(err, ErrNotFound), "err = %v", err)
+}
+
+func TestLocalCannotEscapeRoot(t *testing.T) {
+	ctx := context.Background()
+	store := NewLocalStore(filepath.Join(mklocalstore(t), "cube-1"))
+
+	_, err := store.Container("..").Manifest(ctx)
+	assert.NotNil(t, err)
+	assert.False(t, errors.Is(err, ErrNotFound))
+
+	_, err = store.Container("src").Fragment(ctx, "../../cube-2/manifest.json")
+	assert.NotNil(t, err)
+	assert.False(t, errors.Is(err, ErrNotFound))
+}
+
+func TestLocalCancelledReadErrors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	container := NewLocalStore(mklocalstore(t)).Container("cube-1")
+	_, err := container.Manifest(ctx)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,163 @@
+package blobstore
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+ * The local store mirrors the blob layout on a local file system, which makes
+ * it possible to run the full query/fetch pipeline against a directory of
+ * uploaded cubes, e.g. on a laptop or in CI. A cube is a directory:
+ *
+ *     <root>/<guid>/manifest.json
+ *     <root>/<guid>/src/64-64-64/0-0-0.f32
+ *
+ * The local store does no authorization, so it should only be used for
+ * testing and development.
+ */
+type localStore struct {
+	root string
+}
+
+type localContainer struct {
+	root string
+	guid string
+}
+
+func NewLocalStore(root string) Store {
+	return &localStore { root: root }
+}
+
+/*
+ * List the cubes, i.e. all the directories in root.
+ */
+func (s *localStore) ListCubes(ctx context.Context) ([]string, error) {
+	entries, err := ioutil.ReadDir(s.root)
+	if err != nil {
+		return nil, err
+	}
+
+	cubes := make([]string, 0)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			cubes = append(cubes, entry.Name())
+		}
+	}
+	return cubes, nil
+}
+
+func (s *localStore) Container(guid string) Container {
+	return &localContainer {
+		root: s.root,
+		guid: guid,
+	}
+}
+
+func (c *localContainer) Manifest(ctx context.Context) ([]byte, error) {
+	return c.read(ctx, "manifest.json")
+}
+
+func (c *localContainer) Fragment(
+	ctx context.Context,
+	id  string,
+) ([]byte, error) {
+	return c.read(ctx, id)
+}
+
+func (c *localContainer) FragmentETag(
+	ctx context.Context,
+	id  string,
+) ([]byte, string, error) {
+	/*
+	 * Stat before reading, so that a fragment that is rewritten during the
+	 * read gets an outdated ETag, and is read again on next revalidation,
+	 * rather than the other way around.
+	 */
+	tag, err := c.ETag(ctx, id)
+	if err != nil {
+		return nil, "", err
+	}
+	body, err := c.read(ctx, id)
+	if err != nil {
+		return nil, "", err
+	}
+	return body, tag, nil
+}
+
+/*
+ * Files have no ETag, so make one from the size and modification time, which
+ * changes whenever the file is rewritten.
+ */
+func (c *localContainer) ETag(
+	ctx context.Context,
+	id  string,
+) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	path, err := c.path(id)
+	if err != nil {
+		return "", err
+	}
+
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("%s: %w", path, ErrNotFound)
+	}
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x-%x", info.Size(), info.ModTime().UnixNano()), nil
+}
+
+/*
+ * Resolve the name relative to the container directory. Both the guid and
+ * name come from the outside, so they must be checked to not escape the
+ * root, e.g. guid = '..' or name = '../../etc/passwd'.
+ */
+func (c *localContainer) path(name string) (string, error) {
+	guid := c.guid
+	if guid == "" || guid == "." || guid == ".." ||
+	   strings.ContainsAny(guid, `/\`) {
+		return "", fmt.Errorf("bad cube id '%s'", guid)
+	}
+
+	clean := filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(clean) || clean == ".." ||
+	   strings.HasPrefix(clean, ".." + string(filepath.Separator)) {
+		return "", fmt.Errorf("bad blob name '%s'", name)
+	}
+
+	return filepath.Join(c.root, guid, clean), nil
+}
+
+func (c *localContainer) read(
+	ctx  context.Context,
+	name string,
+) ([]byte, error) {
+	/*
+	 * File reads are not interruptible, but respecting a cancelled context
+	 * keeps the backends consistent, and stops processes from doing more I/O
+	 * than necessary after they have failed.
+	 */
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	path, err := c.path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s: %w", path, ErrNotFound)
+	}
+	return body, err
+}
@@ -0,0 +1,214 @@
+package blobstore
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/minio/minio-go/v6"
+	"github.com/minio/minio-go/v6/pkg/credentials"
+)
+
+/*
+ * The S3 store serves cubes from S3-compatible object storage, e.g. MinIO.
+ * It uses the same layout as the azure store, with buckets in place of
+ * containers:
+ *
+ *     s3://<host[:port]>/<guid>/manifest.json
+ *
+ * The on-behalf-of token is meaningless to S3, so credentials are read from
+ * the environment of the process, first AWS_ACCESS_KEY_ID and
+ * AWS_SECRET_ACCESS_KEY, then MINIO_ACCESS_KEY and MINIO_SECRET_KEY. This
+ * means both the query server and the fetch workers must be configured with
+ * credentials.
+ *
+ * This store performs NO per-user authorization. Every authenticated user
+ * can read every cube the service credentials can read, which is why the
+ * query server refuses s3 endpoints unless started with
+ * --s3-shared-credentials. Only use it where that is acceptable, e.g. for a
+ * single team or for local development.
+ */
+type s3Store struct {
+	client *minio.Client
+}
+
+type s3Container struct {
+	client *minio.Client
+	bucket string
+}
+
+/*
+ * The minio clients, one per endpoint. A client owns its own http transport
+ * and connection pool, and the credentials are the same for every request
+ * anyway, so the clients are shared by all stores opened for the same
+ * endpoint, rather than built for every manifest read and fetch process.
+ */
+var s3clients = struct {
+	sync.Mutex
+	clients map[string]*minio.Client
+} {
+	clients: make(map[string]*minio.Client),
+}
+
+/*
+ * Make a store backed by S3-compatible object storage. The scheme selects
+ * transport security - s3:// uses https, s3+http:// uses plain http and
+ * should only be used for local development. The region can be set with the
+ * region query parameter, e.g. s3://host?region=eu-north-1
+ */
+func NewS3Store(endpoint *url.URL) (Store, error) {
+	if strings.Trim(endpoint.Path, "/") != "" {
+		msg := "s3 endpoint %s: must not have a path; buckets are cubes"
+		return nil, fmt.Errorf(msg, endpoint.String())
+	}
+
+	client, err := s3client(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Store { client: client }, nil
+}
+
+/*
+ * Get the client for an endpoint, and make it if this is the first time the
+ * endpoint is used.
+ */
+func s3client(endpoint *url.URL) (*minio.Client, error) {
+	secure := endpoint.Scheme != "s3+http"
+	region := endpoint.Query().Get("region")
+	key    := fmt.Sprintf("%s/%t/%s", endpoint.Host, secure, region)
+
+	s3clients.Lock()
+	defer s3clients.Unlock()
+	if client, ok := s3clients.clients[key]; ok {
+		return client, nil
+	}
+
+	creds := credentials.NewChainCredentials([]credentials.Provider {
+		&credentials.EnvAWS{},
+		&credentials.EnvMinio{},
+	})
+	client, err := minio.NewWithOptions(endpoint.Host, &minio.Options {
+		Creds:  creds,
+		Secure: secure,
+		Region: region,
+	})
+	if err != nil {
+		return nil, err
+	}
+	s3clients.clients[key] = client
+	return client, nil
+}
+
+/*
+ * List the cubes, i.e. the buckets visible with the configured credentials.
+ */
+func (s *s3Store) ListCubes(ctx context.Context) ([]string, error) {
+	buckets, err := s.client.ListBucketsWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	cubes := make([]string, 0, len(buckets))
+	for _, bucket := range buckets {
+		cubes = append(cubes, bucket.Name)
+	}
+	return cubes, nil
+}
+
+func (s *s3Store) Container(guid string) Container {
+	return &s3Container {
+		client: s.client,
+		bucket: guid,
+	}
+}
+
+func (c *s3Container) Manifest(ctx context.Context) ([]byte, error) {
+	body, _, err := c.download(ctx, "manifest.json")
+	return body, err
+}
+
+func (c *s3Container) Fragment(
+	ctx context.Context,
+	id  string,
+) ([]byte, error) {
+	body, _, err := c.download(ctx, id)
+	return body, err
+}
+
+func (c *s3Container) FragmentETag(
+	ctx context.Context,
+	id  string,
+) ([]byte, string, error) {
+	return c.download(ctx, id)
+}
+
+func (c *s3Container) ETag(
+	ctx context.Context,
+	id  string,
+) (string, error) {
+	info, err := c.client.StatObjectWithContext(
+		ctx,
+		c.bucket,
+		id,
+		minio.StatObjectOptions{},
+	)
+	if err != nil {
+		return "", c.translate(id, err)
+	}
+	return info.ETag, nil
+}
+
+/*
+ * Synchronously download an object, and get its ETag. Missing buckets and
+ * keys are translated to ErrNotFound, all other errors are passed through
+ * as-is.
+ */
+func (c *s3Container) download(
+	ctx  context.Context,
+	name string,
+) ([]byte, string, error) {
+	obj, err := c.client.GetObjectWithContext(
+		ctx,
+		c.bucket,
+		name,
+		minio.GetObjectOptions{},
+	)
+	if err != nil {
+		return nil, "", c.translate(name, err)
+	}
+	defer obj.Close()
+
+	/*
+	 * GetObject is lazy, and does not make a request until the object is
+	 * read, so errors from the service show up here.
+	 */
+	body, err := ioutil.ReadAll(obj)
+	if err != nil {
+		return nil, "", c.translate(name, err)
+	}
+	/*
+	 * The object info is recorded from the response of the read, so this
+	 * does not make another request.
+	 */
+	info, err := obj.Stat()
+	if err != nil {
+		return nil, "", c.translate(name, err)
+	}
+	return body, info.ETag, nil
+}
+
+func (c *s3Container) translate(name string, err error) error {
+	e := minio.ToErrorResponse(err)
+	notfound := e.StatusCode == http.StatusNotFound ||
+		e.Code == "NoSuchBucket" ||
+		e.Code == "NoSuchKey"
+	if notfound {
+		return fmt.Errorf("%s/%s: %w", c.bucket, name, ErrNotFound)
+	}
+	return err
+}
@@ -0,0 +1,151 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	stdlog "log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/form3tech-oss/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+/*
+ * Structured, leveled logging for oneseismic.
+ *
+ * All services log through the global zerolog logger (github.com/rs/zerolog/log)
+ * which is configured once on start-up with Configure(). Records are either
+ * human readable text, or one JSON document per line, suitable for log
+ * aggregators.
+ *
+ * Records that concern a process carry the correlation fields below, so that
+ * a single query can be tracked through the query server, the scheduler and
+ * the workers by filtering on the pid. The field names are shared by all
+ * services and should not be spelled out by hand.
+ */
+const (
+	Pid      = "pid"
+	Part     = "part"
+	Guid     = "guid"
+	Function = "function"
+	User     = "user-oid"
+)
+
+/*
+ * Configure the global logger. The format is either text or json, and the
+ * level is one of the zerolog levels (trace, debug, info, warn, error).
+ *
+ * Output from the standard library log package, e.g. from third-party
+ * libraries, is redirected to the structured logger.
+ */
+func Configure(format string, level string) error {
+	lvl, err := zerolog.ParseLevel(strings.ToLower(level))
+	if err != nil {
+		return fmt.Errorf("bad log level '%s': %w", level, err)
+	}
+	zerolog.SetGlobalLevel(lvl)
+
+	switch format {
+	case "json":
+		log.Logger = zerolog.New(os.Stderr).With().Timestamp().Logger()
+	case "text":
+		out := zerolog.ConsoleWriter {
+			Out:        os.Stderr,
+			NoColor:    true,
+			TimeFormat: time.RFC3339,
+		}
+		log.Logger = zerolog.New(out).With().Timestamp().Logger()
+	default:
+		return fmt.Errorf("bad log format '%s'; must be text or json", format)
+	}
+
+	stdlog.SetFlags(0)
+	stdlog.SetOutput(log.Logger)
+	return nil
+}
+
+type ctxkey struct{}
+
+/*
+ * Make a context that carries the logger, e.g. a logger with the pid and user
+ * fields set, for functions further down the call chain.
+ */
+func WithLogger(ctx context.Context, logger zerolog.Logger) context.Context {
+	return context.WithValue(ctx, ctxkey{}, logger)
+}
+
+/*
+ * Get the logger carried by the context, or the global logger if the context
+ * does not carry one.
+ */
+func FromContext(ctx context.Context) *zerolog.Logger {
+	if logger, ok := ctx.Value(ctxkey{}).(zerolog.Logger); ok {
+		return &logger
+	}
+	return &log.Logger
+}
+
+/*
+ * Get the object id (oid) of the user from the Authorization header, or the
+ * empty string if it is not available.
+ *
+ * The token is *not* verified - this is only meant for labelling log records
+ * and must never be used for making access decisions.
+ */
+func UserOID(authorization string) string {
+	token := strings.TrimPrefix(authorization, "Bearer ")
+	if token == "" || token == authorization {
+		return ""
+	}
+
+	claims := jwt.MapClaims{}
+	_, _, err := new(jwt.Parser).ParseUnverified(token, claims)
+	if err != nil {
+		return ""
+	}
+	oid, _ := claims["oid"].(string)
+	return oid
+}
+
+/*
+ * Middleware that writes a structured access log record for every request,
+ * after the request has been handled. This replaces the text access log of
+ * gin.Logger(), so that all records share the same format.
+ *
+ * The access log is not the audit log - the audit records, which carry the
+ * query and the user, are written by the handlers themselves. The pid is read
+ * from the gin context key pid (set by util.GeneratePID) or from the :pid path
+ * parameter, which ties access records to the audit records of the process.
+ */
+func Access() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		start := time.Now()
+		ctx.Next()
+
+		pid := ctx.GetString("pid")
+		if pid == "" {
+			pid = ctx.Param("pid")
+		}
+
+		status := ctx.Writer.Status()
+		level := zerolog.InfoLevel
+		if status >= 500 {
+			level = zerolog.ErrorLevel
+		} else if status >= 400 {
+			level = zerolog.WarnLevel
+		}
+
+		log.WithLevel(level).
+			Str(Pid, pid).
+			Str("method", ctx.Request.Method).
+			Str("path", ctx.Request.URL.Path).
+			Str("client", ctx.ClientIP()).
+			Int("status", status).
+			Dur("latency", time.Since(start)).
+			Msg("request")
+	}
+}
@@ -0,0 +1,56 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/form3tech-oss/jwt-go"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserOIDFromBearerToken(t *testing.T) {
+	claims := jwt.MapClaims{ "oid": "some-user" }
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).
+		SignedString([]byte("key"))
+	assert.Nil(t, err)
+
+	assert.Equal(t, "some-user", UserOID("Bearer " + token))
+}
+
+func TestUserOIDMissingOrBadToken(t *testing.T) {
+	assert.Equal(t, "", UserOID(""))
+	assert.Equal(t, "", UserOID("Bearer "))
+	assert.Equal(t, "", UserOID("Bearer not-a-token"))
+	assert.Equal(t, "", UserOID("Basic dXNlcjpwYXNz"))
+}
+
+func TestConfigureRejectsBadFormatAndLevel(t *testing.T) {
+	assert.NotNil(t, Configure("xml",  "info"))
+	assert.NotNil(t, Configure("json", "verbose"))
+}
+
+func TestContextLoggerCarriesFields(t *testing.T) {
+	global := log.Logger
+	defer func() { log.Logger = global }()
+
+	var buf bytes.Buffer
+	log.Logger = zerolog.New(&buf)
+
+	ctx := context.Background()
+	assert.Equal(t, &log.Logger, FromContext(ctx))
+
+	logger := log.With().Str(Pid, "pid").Str(User, "user").Logger()
+	ctx = WithLogger(ctx, logger)
+	FromContext(ctx).Info().Msg("record")
+
+	var record map[string]interface{}
+	err := json.Unmarshal(buf.Bytes(), &record)
+	assert.Nil(t, err)
+	assert.Equal(t, "pid",    record[Pid])
+	assert.Equal(t, "user",   record[User])
+	assert.Equal(t, "record", record["message"])
+}
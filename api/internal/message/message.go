@@ -3,6 +3,7 @@ package message
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 
 	"github.com/vmihailenco/msgpack/v5"
 )
@@ -22,9 +23,19 @@ type Query struct {
 	Guid            string       `json:"guid"`
 	Manifest        interface {} `json:"manifest"`
 	StorageEndpoint string       `json:"storage_endpoint"`
-	Shape           []int32      `json:"shape"`
+	/*
+	 * The fragment shape to read, which is optional. When it is not set the
+	 * planner picks the cheapest of the shapes in the manifest for the query.
+	 */
+	Shape           []int32      `json:"shape,omitempty"`
 	Function        string       `json:"function"`
 	Args            interface {} `json:"args"`
+	/*
+	 * The trace context of the request, e.g. the W3C traceparent, which is
+	 * carried to the tasks and process header so that the spans of the
+	 * process join the trace of the request.
+	 */
+	TraceContext    map[string]string `json:"tracecontext,omitempty"`
 }
 
 func (msg *Query) Pack() ([]byte, error) {
@@ -48,6 +59,7 @@ type Task struct {
 	Shape           []int32      `json:"shape"`
 	ShapeCube       []int32      `json:"shape-cube"`
 	Function        string       `json:"function"`
+	TraceContext    map[string]string `json:"tracecontext,omitempty"`
 }
 
 func (msg *Task) Pack() ([]byte, error) {
@@ -106,12 +118,30 @@ type ProcessHeader struct {
 	 * and request parameters.
 	 */
 	Pid string    `json:"pid"`
+	/*
+	 * The function (e.g. slice, curtain) of the query that started this
+	 * process.
+	 */
+	Function string `json:"function"`
+	/*
+	 * The trace context of the query that started this process.
+	 */
+	TraceContext map[string]string `json:"tracecontext,omitempty"`
 	/*
 	 * The number of separate parts this is broken into, where each part can be
 	 * handled by a separate worker. This is the number of "bundles"
 	 * (parts-of-results) the client will receive.
 	 */
 	Ntasks int    `json:"ntasks"`
+	/*
+	 * The level of detail the result is read from, where 0 is the source
+	 * volume and higher levels are increasingly downsampled pyramid levels.
+	 */
+	Level int     `json:"level"`
+	/*
+	 * The shape of the fragments the process reads, as picked by the planner.
+	 */
+	FragmentShape []int `json:"fragment-shape,omitempty"`
 	/*
 	 * The shape of the result *with padding*. It shall always hold that
 	 * shape[n] >= len(index[n]) and len(shape) == len(index). This is an
@@ -128,8 +158,23 @@ type ProcessHeader struct {
 	 * having a "map" (in the treasure map sense) of what shape and keys to
 	 * expect is quite useful for pre-allocation, and stuff like building a
 	 * language-specific index like in xarray in python.
+	 *
+	 * The vertical axis is indexed by its sample values (time or depth), which
+	 * are not necessarily integers.
+	 */
+	Index [][]float64 `json:"index"`
+	/*
+	 * Curtains by world coordinates are made up of the traces in the index,
+	 * and these describe how. For every point in the curtain:
+	 *   positions: the world (x, y) position of the point
+	 *   traces:    the traces (positions in the index) that make up the point
+	 *   weights:   the weight of each of those traces
+	 *
+	 * They are absent for all other queries.
 	 */
-	Index [][]int `json:"index"`
+	Positions [][]float64 `json:"positions,omitempty"`
+	Traces    [][]int     `json:"traces,omitempty"`
+	Weights   [][]float64 `json:"weights,omitempty"`
 }
 
 func (m *ProcessHeader) Pack() ([]byte, error) {
@@ -140,6 +185,64 @@ func (m *ProcessHeader) Unpack(doc []byte) (*ProcessHeader, error) {
 	return m, json.Unmarshal(doc, m)
 }
 
+/*
+ * A failure record, written by a worker when it is unable to complete its
+ * task. A process with one or more failure records is considered failed, as
+ * it will never be completed.
+ *
+ * Failure records are stored as a list, in a sibling key of the process
+ * header (see FailureKey), so that they do not interfere with the partial
+ * results in the process stream.
+ */
+type Failure struct {
+	Pid  string `json:"pid"`
+	/*
+	 * The part (task) that failed, formatted as n/m
+	 */
+	Part string `json:"part"`
+	/*
+	 * The kind of failure, for clients to act on without parsing the message,
+	 * e.g. download (fragments could not be read from storage) or write
+	 * (the result could not be stored).
+	 */
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+func (f *Failure) Pack() ([]byte, error) {
+	return json.Marshal(f)
+}
+
+func (f *Failure) Unpack(doc []byte) (*Failure, error) {
+	return f, json.Unmarshal(doc, f)
+}
+
+/*
+ * The key of the list of failure records for the process pid.
+ */
+func FailureKey(pid string) string {
+	return fmt.Sprintf("%s/failures", pid)
+}
+
+/*
+ * The key of the set of parts that are written to the result stream of the
+ * process pid. With at-least-once delivery the same part can be written to
+ * the stream more than once, so the length of the stream is not the number of
+ * completed parts, but the size of this set is.
+ */
+func PartsKey(pid string) string {
+	return fmt.Sprintf("%s/parts", pid)
+}
+
+/*
+ * The key of the cancellation marker for the process pid. If this key exists
+ * then the process has been cancelled by the client, and no more work should
+ * be scheduled or done for it.
+ */
+func CancelKey(pid string) string {
+	return fmt.Sprintf("%s/cancelled", pid)
+}
+
 /*
  * The header written as the first part of the end-user result, and meant to be
  * decoded by the clients. Since this is client-facing it has much higher
@@ -147,8 +250,15 @@ func (m *ProcessHeader) Unpack(doc []byte) (*ProcessHeader, error) {
  */
 type ResultHeader struct {
 	Bundles int
+	Level   int
 	Shape   []int
-	Index   [][]int
+	Index   [][]float64
+	/*
+	 * Optional, and only included when set. See ProcessHeader.
+	 */
+	Positions [][]float64
+	Traces    [][]int
+	Weights   [][]float64
 }
 
 /*
@@ -159,19 +269,33 @@ type ResultHeader struct {
 func (rh *ResultHeader) Pack() ([]byte, error) {
 	var b bytes.Buffer
 	enc := msgpack.NewEncoder(&b)
+	/*
+	 * The index is mostly line numbers, which are integers, and clients
+	 * should keep getting them as integers.
+	 */
+	enc.UseCompactFloats(true)
 
 	if err := enc.EncodeArrayLen(2); err != nil {
 		return nil, err
 	}
-	if err := enc.EncodeMapLen(3); err != nil {
-		return nil, err
-	}
-	err := enc.EncodeMulti(
+	fields := []interface{} {
 		"bundles", rh.Bundles,
+		"level",   rh.Level,
 		"shape",   rh.Shape,
 		"index",   rh.Index,
-	)
-	if err != nil {
+	}
+	if rh.Positions != nil {
+		fields = append(fields,
+			"positions", rh.Positions,
+			"traces",    rh.Traces,
+			"weights",   rh.Weights,
+		)
+	}
+
+	if err := enc.EncodeMapLen(len(fields) / 2); err != nil {
+		return nil, err
+	}
+	if err := enc.EncodeMulti(fields...); err != nil {
 		return nil, err
 	}
 	if err := enc.EncodeArrayLen(rh.Bundles); err != nil {
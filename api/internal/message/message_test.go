@@ -0,0 +1,69 @@
+package message
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestResultHeaderKeepsIntegerIndexAsIntegers(t *testing.T) {
+	head := ResultHeader {
+		Bundles: 0,
+		Shape:   []int{ 2, 2 },
+		Index:   [][]float64{ { 1, 2 }, { 0.5, 1 } },
+	}
+	packed, err := head.Pack()
+	assert.Nil(t, err)
+
+	var unpacked []interface{}
+	err = msgpack.Unmarshal(packed, &unpacked)
+	assert.Nil(t, err)
+
+	header := unpacked[0].(map[string]interface{})
+	index  := header["index"].([]interface{})
+	assert.IsType(t, int8(0), index[0].([]interface{})[0])
+	assert.Equal(t, 0.5, index[1].([]interface{})[0])
+}
+
+func TestResultHeaderOnlyHasPositionsWhenSet(t *testing.T) {
+	unpack := func(head ResultHeader) map[string]interface{} {
+		packed, err := head.Pack()
+		assert.Nil(t, err)
+		var unpacked []interface{}
+		err = msgpack.Unmarshal(packed, &unpacked)
+		assert.Nil(t, err)
+		return unpacked[0].(map[string]interface{})
+	}
+
+	head := ResultHeader {
+		Shape: []int{ 1, 2 },
+		Index: [][]float64{ { 1 }, { 2 }, { 0, 4 } },
+	}
+	assert.NotContains(t, unpack(head), "positions")
+
+	head.Positions = [][]float64{ { 10.5, 20.5 } }
+	head.Traces    = [][]int{ { 0 } }
+	head.Weights   = [][]float64{ { 1 } }
+	header := unpack(head)
+	assert.Contains(t, header, "positions")
+	assert.Contains(t, header, "traces")
+	assert.Contains(t, header, "weights")
+}
+
+func TestResultHeaderHasTheLevelOfDetail(t *testing.T) {
+	head := ResultHeader {
+		Level: 2,
+		Shape: []int{ 1, 2 },
+		Index: [][]float64{ { 1 }, { 2, 6 } },
+	}
+	packed, err := head.Pack()
+	assert.Nil(t, err)
+
+	var unpacked []interface{}
+	err = msgpack.Unmarshal(packed, &unpacked)
+	assert.Nil(t, err)
+
+	header := unpacked[0].(map[string]interface{})
+	assert.EqualValues(t, 2, header["level"])
+}
@@ -0,0 +1,135 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+/*
+ * Distributed tracing for oneseismic with OpenTelemetry.
+ *
+ * A query crosses several services - the graphql resolver and the scheduler
+ * in the query server, the job queue, the fetch workers and finally the result
+ * endpoints. The trace context (W3C traceparent) of the query is carried in
+ * message.Query, and from there to the tasks and the process header, so that
+ * all the spans of a process join a single trace.
+ *
+ * Spans are exported with OTLP over http to a collector, e.g. the
+ * opentelemetry-collector or jaeger. When no collector is configured, spans
+ * are not recorded, but trace contexts are still passed along.
+ */
+
+const instrumentation = "github.com/equinor/oneseismic/api"
+
+func init() {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+}
+
+/*
+ * Configure exporting of spans with OTLP/http to the collector at endpoint,
+ * e.g. localhost:4318. Tracing is disabled if endpoint is empty.
+ *
+ * The returned shutdown function flushes the pending spans, and should be
+ * called before the program exits.
+ */
+func Configure(
+	ctx      context.Context,
+	service  string,
+	endpoint string,
+) (func(context.Context) error, error) {
+	if endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(
+		ctx,
+		otlptracehttp.WithEndpoint(endpoint),
+		otlptracehttp.WithInsecure(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", service),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+/*
+ * The tracer used for all oneseismic spans.
+ */
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentation)
+}
+
+/*
+ * Get the trace context of the span in ctx, to be put in a message. Returns
+ * nil if there is no span in ctx, so that messages without a trace stay
+ * unchanged.
+ */
+func Inject(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
+
+/*
+ * Make a context with the trace context from a message, so that new spans
+ * become children of the span that sent the message. A nil or empty trace
+ * context gives ctx unchanged.
+ */
+func Extract(ctx context.Context, tracecontext map[string]string) context.Context {
+	if len(tracecontext) == 0 {
+		return ctx
+	}
+	carrier := propagation.MapCarrier(tracecontext)
+	return otel.GetTextMapPropagator().Extract(ctx, carrier)
+}
+
+/*
+ * Make a context with the trace context from the (incoming) http headers, so
+ * that clients can make the query part of their own traces.
+ */
+func ExtractHTTP(ctx context.Context, header http.Header) context.Context {
+	carrier := propagation.HeaderCarrier(header)
+	return otel.GetTextMapPropagator().Extract(ctx, carrier)
+}
+
+/*
+ * Make a context that carries the span of ctx, but not its values, deadline
+ * or cancellation, for work that outlives the request, e.g. scheduling.
+ */
+func Detach(ctx context.Context) context.Context {
+	return trace.ContextWithSpanContext(
+		context.Background(),
+		trace.SpanContextFromContext(ctx),
+	)
+}
+
+/*
+ * Record err on the span and mark it as failed. This is a no-op if err is nil.
+ */
+func Fail(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
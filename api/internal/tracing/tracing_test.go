@@ -0,0 +1,80 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestInjectWithoutSpanIsNil(t *testing.T) {
+	assert.Nil(t, Inject(context.Background()))
+}
+
+func TestExtractEmptyIsUnchanged(t *testing.T) {
+	ctx := context.Background()
+	assert.Equal(t, ctx, Extract(ctx, nil))
+}
+
+func TestSpansJoinTraceThroughMessage(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	tracer   := provider.Tracer("test")
+
+	ctx, parent := tracer.Start(context.Background(), "parent")
+	tracecontext := Inject(ctx)
+	parent.End()
+	assert.Contains(t, tracecontext, "traceparent")
+
+	/*
+	 * The child is started from a fresh context, as it would be on the other
+	 * side of the job queue.
+	 */
+	ctx = Extract(context.Background(), tracecontext)
+	_, child := tracer.Start(ctx, "child")
+	child.End()
+
+	spans := recorder.Ended()
+	assert.Equal(t, 2, len(spans))
+	assert.Equal(t, spans[0].SpanContext().TraceID(), spans[1].SpanContext().TraceID())
+	assert.Equal(t, spans[0].SpanContext().SpanID(), spans[1].Parent().SpanID())
+}
+
+func TestDetachKeepsSpanButNotCancellation(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx, span := provider.Tracer("test").Start(ctx, "span")
+	defer span.End()
+	detached := Detach(ctx)
+	cancel()
+
+	assert.Nil(t, detached.Err())
+	assert.Equal(
+		t,
+		span.SpanContext(),
+		trace.SpanContextFromContext(detached),
+	)
+}
+
+func TestFailMarksSpanAsFailed(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	_, ok := provider.Tracer("test").Start(context.Background(), "ok")
+	Fail(ok, nil)
+	ok.End()
+	_, failed := provider.Tracer("test").Start(context.Background(), "failed")
+	Fail(failed, errors.New("failure"))
+	failed.End()
+
+	spans := recorder.Ended()
+	assert.Equal(t, codes.Unset, spans[0].Status().Code)
+	assert.Equal(t, codes.Error, spans[1].Status().Code)
+}
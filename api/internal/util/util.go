@@ -2,13 +2,10 @@ package util
 
 import (
 	"compress/gzip"
-	"context"
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"net/url"
 	"sync"
-	"time"
 
 	"github.com/equinor/oneseismic/api/internal/auth"
 	"github.com/equinor/oneseismic/api/internal/message"
@@ -96,42 +93,6 @@ func Compression() gin.HandlerFunc {
 	}
 }
 
-/*
- * Get the manifest for the cube from the blob store.
- *
- * It's important that this is a blocking read, since this is the first
- * authorization mechanism in oneseismic. If the user (through the
- * on-behalf-token) does not have permissions to read the manifest, it
- * shouldn't be able to read the cube either. If so, no more processing should
- * be done, and the request discarded.
- */
-func FetchManifest(
-	ctx context.Context,
-	token string,
-	containerURL *url.URL,
-) ([]byte, error) {
-	credentials := azblob.NewTokenCredential(token, nil)
-	pipeline    := azblob.NewPipeline(credentials, azblob.PipelineOptions{})
-	container   := azblob.NewContainerURL(*containerURL, pipeline)
-	blob        := container.NewBlobURL("manifest.json")
-
-	dl, err := blob.Download(
-		ctx,
-		0, /* offset */
-		azblob.CountToEnd,
-		azblob.BlobAccessConditions {},
-		false, /* content-get-md5 */
-		azblob.ClientProvidedKeyOptions {},
-	)
-	if err != nil {
-		return nil, err
-	}
-
-	body := dl.Body(azblob.RetryReaderOptions{})
-	defer body.Close()
-	return ioutil.ReadAll(body)
-}
-
 /*
  * Centralize the understanding of error conditions of azblob.download.
  *
@@ -142,10 +103,10 @@ func FetchManifest(
  *    sufficient permissions, wrong syntax or similar. azblob probably handles
  *    this by parsing the status code and maybe the response body.
  *
- * Most calls to FetchManifest() should probably immediately call this function
- * on error and exit, but it's moved into its own function so that error paths
+ * Most failed manifest downloads should probably immediately call this
+ * function and exit, but it's moved into its own function so that error paths
  * can be emulated and tested independently. An added benefit is that should a
- * function, for some reason, need FetchManifest() but want custom error+abort
+ * function, for some reason, need the manifest but want custom error+abort
  * handling, it is sufficient to implement bespoke error handling and simply
  * not call this.
  */
@@ -240,62 +201,3 @@ func WithOnbehalfAndRetry(
 	}
 	return fn(token)
 }
-
-/*
- * Custom logger for the /query family of endpoints, that logs the id of the
- * process to be generated by the request (pid).
- */
-func QueryLogger(ctx *gin.Context) {
-	gin.LoggerWithFormatter(func(param gin.LogFormatterParams) string {
-		return fmt.Sprintf("%s - [%s] \"pid=%s, %s %s %s %d %s %s\"\n",
-			param.ClientIP,
-			param.TimeStamp.Format(time.RFC1123),
-			param.Keys["pid"],
-			param.Method,
-			param.Path,
-			param.Request.Proto,
-			param.StatusCode,
-			param.Latency,
-			param.ErrorMessage,
-		)
-	})(ctx)
-}
-
-/*
- * List the cubes in a storage account
- *
- * Please note that while its phrased as something particular, "list cubes"
- * really boils down to getting the names of the containers in a particular
- * account. It is assumed that a storage account is used for oneseismic, and
- * oneseismic only, in which case every container should correspond to a cube.
- *
- * It is untested, but likely, that containers with permissions set to
- * non-readable for the caller will not show up in this list, which is the
- * intention.
- */
-func ListCubes(
-	ctx      context.Context,
-	endpoint *url.URL, // typically https://<account>.blob.core.windows.net
-	token    string,
-) ([]string, error) {
-	credentials := azblob.NewTokenCredential(token, nil)
-	pipeline    := azblob.NewPipeline(credentials, azblob.PipelineOptions{})
-	storageacc  := azblob.NewServiceURL(*endpoint, pipeline)
-
-	cubes := make([]string, 0)
-	for marker := (azblob.Marker{}); marker.NotDone(); {
-		xs, err := storageacc.ListContainersSegment(
-			ctx,
-			marker,
-			azblob.ListContainersSegmentOptions{},
-		)
-		if err != nil {
-			return nil, err
-		}
-		for _, cube := range xs.ContainerItems {
-			cubes = append(cubes, cube.Name)
-		}
-		marker = xs.NextMarker
-	}
-	return cubes, nil
-}
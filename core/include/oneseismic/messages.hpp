@@ -1,6 +1,8 @@
 #ifndef ONESEISMIC_MESSAGES_HPP
 #define ONESEISMIC_MESSAGES_HPP
 
+#include <array>
+#include <map>
 #include <stdexcept>
 #include <string>
 #include <vector>
@@ -35,10 +37,19 @@ struct not_found : public std::out_of_range {
     using std::out_of_range::out_of_range;
 };
 
+/*
+ * A volume can be stored at multiple levels of detail (a pyramid). Level 0 is
+ * the source volume, and level n > 0 is downsampled by keeping every
+ * decimation[d]'th line (or sample) of dimension d of the source, and stored
+ * under its own prefix, e.g. src/lod1. The level and decimation are optional
+ * in the manifest, and default to the source (0, and no decimation).
+ */
 struct volumedesc {
     std::string prefix; /* e.g. src/, attributes/ */
     std::string ext;    /* file-extension */
     std::vector< std::vector< int > > shapes;
+    int level;
+    std::vector< int > decimation;
 };
 
 struct attributedesc {
@@ -55,13 +66,47 @@ struct manifestdoc {
     std::vector< attributedesc >        attr;
     std::vector< std::vector< int > >   line_numbers;
     std::vector< std::string >          line_labels;
+    /*
+     * The interval and first sample of the vertical (last) axis, in
+     * milliseconds (time) or metres (depth). Manifests written before these
+     * were added get them from the line numbers of the last dimension, which
+     * are in microseconds.
+     */
+    double                              sample_interval;
+    double                              sample_start;
 };
 
+/*
+ * The sample values of the vertical axis, i.e. the time or depth of every
+ * sample in the cube.
+ */
+std::vector< double > sample_values(const manifestdoc&) noexcept (false);
+
+/*
+ * The index of the sample nearest to value (time or depth). Throws not_found
+ * if value is outside the cube, i.e. more than half a sample interval from
+ * the first or last sample.
+ */
+int sample_index(const manifestdoc&, double value) noexcept (false);
+
 /*
  * The *query messages are parsing utilities for the input messages built from
  * the graphql queries. They help build a corresponding *task which is fed to
  * the workers, and should contain all the information the workers need to do
  * their job.
+ *
+ * The tracecontext is the (opaque) trace context of the request, e.g. the W3C
+ * traceparent, which is passed as-is from the query to the tasks and the
+ * process header, so that the work done for a query can be traced across
+ * services.
+ *
+ * The prefix and level are of the volume the query is planned against, which
+ * is the source volume unless the query asks for a coarser resolution. The
+ * manifest of a query planned against a pyramid level has the line numbers
+ * and sample interval of that level.
+ *
+ * The shape is the fragment shape to read. It is optional, and when it is
+ * not set the planner picks the cheapest of the shapes of the volume.
  */
 struct basic_query {
     std::string        pid;
@@ -71,6 +116,9 @@ struct basic_query {
     std::string        storage_endpoint;
     std::vector< int > shape;
     std::string        function;
+    std::map< std::string, std::string > tracecontext;
+    std::string        prefix;
+    int                level;
 };
 
 struct basic_task {
@@ -81,7 +129,9 @@ struct basic_task {
         guid             (q.guid),
         storage_endpoint (q.storage_endpoint),
         shape            (q.shape),
-        function         (q.function)
+        function         (q.function),
+        tracecontext     (q.tracecontext),
+        prefix           (q.prefix)
     {
         this->shape_cube.reserve(q.manifest.line_numbers.size());
         for (const auto& d : q.manifest.line_numbers)
@@ -95,6 +145,8 @@ struct basic_task {
     std::vector< int > shape;
     std::vector< int > shape_cube;
     std::string        function;
+    std::map< std::string, std::string > tracecontext;
+    std::string        prefix;
 };
 
 /*
@@ -106,23 +158,67 @@ struct basic_task {
  * survey, so the shape tuple is the shape of the response *with padding*.
  *
  * The contents and order of the shape and index depend on the request type and
- * parameters.
+ * parameters. The level is the level of detail the process reads, where 0 is
+ * the source volume, and the fragment shape the shape of the fragments it
+ * reads.
+ *
+ * The index of the vertical axis is the sample values, in milliseconds (time)
+ * or metres (depth), and not the line numbers of the vertical axis. For cubes
+ * uploaded before the manifest had a sample-interval the line numbers are in
+ * microseconds, so for those cubes the vertical index is the line numbers
+ * divided by 1000.
  */
 struct process_header : Packable< process_header > {
     std::string        pid;
+    std::string        function;
+    std::map< std::string, std::string > tracecontext;
     int                ntasks;
+    int                level;
+    std::vector< int > fragment_shape;
     std::vector< int > shape;
-    std::vector< std::vector< int > > index;
+    std::vector< std::vector< double > > index;
 };
 
+/*
+ * Slices and curtains can be limited to a window, so that only the fragments
+ * that intersect the window are fetched. The window is the half-open [lower,
+ * upper) range of cartesian coordinates, and is empty when the query is not
+ * windowed.
+ *
+ * For slices, the window is in the dimensions of the slice itself, i.e. the
+ * cube dimensions without dim. For curtains, the window is a range of the
+ * vertical axis.
+ *
+ * Slices can also be decimated, by only taking every stride'th sample of the
+ * window, starting at lower. The stride is empty when the slice is not
+ * decimated, and a decimated slice is always windowed, if only to the whole
+ * slice.
+ */
 struct slice_query : public basic_query, Packable< slice_query > {
     int dim;
     int idx;
+    std::vector< int > lower;
+    std::vector< int > upper;
+    std::vector< int > stride;
 };
 
 struct curtain_query : public basic_query, Packable< curtain_query > {
     std::vector< int > dim0s;
     std::vector< int > dim1s;
+    std::vector< int > lower;
+    std::vector< int > upper;
+};
+
+/*
+ * A sub-volume (bounding box) of the cube. The query is given as inclusive
+ * [first, last] ranges of line numbers for the lateral dimensions, and of
+ * sample values (time or depth) for the vertical dimension. They are resolved
+ * to the half-open [lower, upper) ranges of cartesian (0-based) coordinates
+ * of the lines and samples inside the ranges when the query is unpacked.
+ */
+struct subvolume_query : public basic_query, Packable< subvolume_query > {
+    std::vector< int > lower;
+    std::vector< int > upper;
 };
 
 /*
@@ -131,11 +227,17 @@ struct slice_task : public basic_task, Packable< slice_task > {
     slice_task() = default;
     explicit slice_task(const slice_query& q) :
         basic_task(q),
-        dim(q.dim)
+        dim(q.dim),
+        lower(q.lower),
+        upper(q.upper),
+        stride(q.stride)
     {}
 
     int dim;
     int idx;
+    std::vector< int > lower;
+    std::vector< int > upper;
+    std::vector< int > stride;
     std::vector< std::vector< int > > ids;
 };
 
@@ -167,10 +269,22 @@ struct single {
 };
 
 struct curtain_task : public basic_task, Packable< curtain_task > {
-    using basic_task::basic_task;
+    curtain_task() = default;
+    explicit curtain_task(const curtain_query& q) :
+        basic_task(q),
+        lower(q.lower),
+        upper(q.upper)
+    {}
+
+    std::vector< int > lower;
+    std::vector< int > upper;
     std::vector< single > ids;
 };
 
+/*
+ * The coordinates of a trace are the (global) x/y position, and the position
+ * of the first sample in the curtain, i.e. relative to the top of the window.
+ */
 struct trace {
     std::vector< int > coordinates;
     std::vector< float > v;
@@ -180,6 +294,146 @@ struct curtain_traces : public MsgPackable< curtain_traces > {
     std::vector< trace > traces;
 };
 
+struct subvolume_task : public basic_task, Packable< subvolume_task > {
+    subvolume_task() = default;
+    explicit subvolume_task(const subvolume_query& q) :
+        basic_task(q),
+        lower(q.lower),
+        upper(q.upper)
+    {}
+
+    std::vector< int > lower;
+    std::vector< int > upper;
+    std::vector< std::vector< int > > ids;
+};
+
+/*
+ * The part of the sub-volume extracted from a single fragment. The offset is
+ * the position of the block in the sub-volume, and v is the samples of the
+ * block in row-major (C) order.
+ */
+struct block {
+    std::vector< int > offset;
+    std::vector< int > shape;
+    std::vector< float > v;
+};
+
+struct subvolume_blocks : public MsgPackable< subvolume_blocks > {
+    std::vector< block > blocks;
+};
+
+/*
+ * A horizon is a surface in the cube, given as the time (or depth) of every
+ * trace, on the inline/crossline grid of the survey. The horizon is sampled at
+ * the sample nearest to the surface, or the window of above and below samples
+ * around it. Traces where the horizon is not defined (null), or outside the
+ * cube, are not sampled.
+ *
+ * The dim0s, dim1s, and zs are the cartesian coordinates of the points of the
+ * horizon.
+ *
+ * The horizon-attribute function reduces the window of every point to a
+ * single value, the attribute, which is one of:
+ *   rms, mean, min, max, sum-of-magnitudes
+ * The attribute is empty for the horizon function.
+ */
+struct horizon_query : public basic_query, Packable< horizon_query > {
+    std::vector< int > dim0s;
+    std::vector< int > dim1s;
+    std::vector< int > zs;
+    int above;
+    int below;
+    std::string attribute;
+};
+
+/*
+ * The points of the horizon that need a fragment. The id is the 3-tuple
+ * fragment id, and the points the local x/y position of the trace and the
+ * (global) z of the horizon.
+ */
+struct horizon_points {
+    std::vector< int > id;
+    std::vector< std::array< int, 3 > > points;
+};
+
+struct horizon_task : public basic_task, Packable< horizon_task > {
+    horizon_task() = default;
+    explicit horizon_task(const horizon_query& q) :
+        basic_task(q),
+        above(q.above),
+        below(q.below),
+        attribute(q.attribute)
+    {}
+
+    int above;
+    int below;
+    std::string attribute;
+    std::vector< horizon_points > ids;
+};
+
+/*
+ * The horizon is output as traces, where the coordinates are the (global) x/y
+ * position of the trace, and the position of the first sample in the window.
+ */
+struct horizon_values : public MsgPackable< horizon_values > {
+    std::vector< trace > traces;
+};
+
+/*
+ * The horizon attribute is output as traces of a single value, where the
+ * coordinates are the (global) x/y position of the trace.
+ */
+struct horizon_attributes : public MsgPackable< horizon_attributes > {
+    std::vector< trace > traces;
+};
+
+/*
+ * Attributes are properties of the traces, e.g. their CDP or UTM coordinates,
+ * stored in tiles of (s0, s1) traces with one (f64) value per label for every
+ * trace, as described by the attributes in the manifest.
+ *
+ * The attribute is queried for the traces of a slice or a curtain, so that it
+ * can be matched with the amplitudes. The traces are, by dim:
+ *   0, 1: the traces of line idx of dim (a slice of dim 0 or 1)
+ *   2:    all traces (a time or depth slice)
+ *   -1:   the traces (dim0s, dim1s) of a curtain, as cartesian coordinates
+ */
+struct attribute_query : public basic_query, Packable< attribute_query > {
+    attributedesc attribute;
+    int dim;
+    int idx;
+    std::vector< int > dim0s;
+    std::vector< int > dim1s;
+};
+
+/*
+ * The ids of the attribute task are the 2-tuple tile ids, and the coordinates
+ * the (local) x/y position of the traces in the tile.
+ */
+struct attribute_task : public basic_task, Packable< attribute_task > {
+    attribute_task() = default;
+    explicit attribute_task(const attribute_query& q) :
+        basic_task(q),
+        attribute(q.attribute)
+    {}
+
+    attributedesc attribute;
+    std::vector< single > ids;
+};
+
+/*
+ * The coordinates are the (global) x/y position of the trace, and v the value
+ * of every label of the attribute.
+ */
+struct attribute_value {
+    std::vector< int > coordinates;
+    std::vector< double > v;
+};
+
+struct attribute_values : public MsgPackable< attribute_values > {
+    std::vector< attribute_value > traces;
+};
+
 }
 
 #endif //ONESEISMIC_MESSAGES_HPP
@@ -9,8 +9,27 @@
 
 namespace one {
 
+/*
+ * The number of fragments per task. A fixed size (size > 0) puts size
+ * fragments in every task, except the last.
+ *
+ * An adaptive size (size = 0) is picked for every query from the number of
+ * fragments it needs, where max is the most fragments a task can have and
+ * still finish within the target latency, and workers is the number of
+ * workers available. Queries that fit in a single task are not split, since
+ * every task comes with an overhead. Larger queries are spread evenly across
+ * the workers, in tasks of at most max fragments.
+ */
+struct task_sizing {
+    int size;
+    int max;
+    int workers;
+};
+
+int task_size(const task_sizing&, int nfragments) noexcept (false);
+
 std::vector< std::string >
-mkschedule(const char* doc, int len, int task_size) noexcept (false);
+mkschedule(const char* doc, int len, const task_sizing&) noexcept (false);
 
 }
 
@@ -18,6 +18,11 @@ public:
      *
      * Kind should be one of:
      * - slice
+     * - curtain
+     * - subvolume
+     * - horizon
+     * - horizon-attribute
+     * - attribute
      */
     static
     std::unique_ptr< proc > make(const std::string& kind)
@@ -54,7 +59,9 @@ public:
      *         proc.add(key, id, len(id))
      *
      * Chunks can be added in any order, but chunks and ids must always
-     * correspond.
+     * correspond. Throws std::out_of_range if the key is not an index into
+     * fragments(), and std::invalid_argument if the chunk is not the size of
+     * a fragment.
      */
     virtual void add(int key, const char* chunk, int len) = 0;
     virtual std::string pack() = 0;
@@ -63,10 +70,20 @@ public:
 
 protected:
     /*
-     * Set the fragment shape. This is cleared by clear() and must be set for
-     * every init(). It sets the prefix for fragment-ID generation.
+     * Set the volume prefix (e.g. src, or src/lod1 for a pyramid level) and
+     * fragment shape. This is cleared by clear() and must be set for every
+     * init(). It sets the prefix for fragment-ID generation.
      */
-    void set_fragment_shape(const std::string&) noexcept (false);
+    void set_fragment_shape(
+            const std::string& prefix,
+            const std::string& shape)
+    noexcept (false);
+    /*
+     * Set the prefix for fragment-ID generation directly, for fragments that
+     * are not in the src/ volume, e.g. attributes. This is cleared by
+     * clear().
+     */
+    void set_prefix(const std::string&) noexcept (false);
     /*
      * Register a fragment id, for url generation. Duplicates will not be
      * removed, this is effectively an accumulating ';'.join([prefix + id]...)
@@ -1,5 +1,7 @@
 #include <algorithm>
+#include <cmath>
 #include <string>
+#include <utility>
 
 #include <fmt/format.h>
 #include <nlohmann/json.hpp>
@@ -54,20 +56,40 @@ template class Packable< slice_query >;
 template class Packable< slice_task >;
 template class Packable< curtain_query >;
 template class Packable< curtain_task >;
+template class Packable< subvolume_query >;
+template class Packable< subvolume_task >;
+template class Packable< horizon_query >;
+template class Packable< horizon_task >;
+template class Packable< attribute_query >;
+template class Packable< attribute_task >;
 
 template class MsgPackable< slice_tiles >;
 template class MsgPackable< curtain_traces >;
+template class MsgPackable< subvolume_blocks >;
+template class MsgPackable< horizon_values >;
+template class MsgPackable< horizon_attributes >;
+template class MsgPackable< attribute_values >;
 
 void from_json(const nlohmann::json& doc, volumedesc& v) noexcept (false) {
     doc.at("prefix")        .get_to(v.prefix);
     doc.at("file-extension").get_to(v.ext);
     doc.at("shapes")        .get_to(v.shapes);
+
+    v.level = 0;
+    const auto level      = doc.find("level");
+    const auto decimation = doc.find("decimation");
+    if (level != doc.end())
+        level->get_to(v.level);
+    if (decimation != doc.end())
+        decimation->get_to(v.decimation);
 }
 
 void to_json(nlohmann::json& doc, const volumedesc& v) noexcept (false) {
     doc["prefix"]         = v.prefix;
     doc["file-extension"] = v.ext;
     doc["partitioning"]   = v.shapes;
+    doc["level"]          = v.level;
+    doc["decimation"]     = v.decimation;
 }
 
 void from_json(const nlohmann::json& doc, attributedesc& a) noexcept (false) {
@@ -93,13 +115,66 @@ void from_json(const nlohmann::json& doc, manifestdoc& m) noexcept (false) {
     doc.at("line-labels") .get_to(m.line_labels);
     doc.at("data")        .get_to(m.vol);
     doc.at("attributes")  .get_to(m.attr);
+
+    if (m.line_numbers.empty())
+        throw bad_document("line-numbers is empty");
+
+    const auto interval = doc.find("sample-interval");
+    const auto start    = doc.find("sample-start");
+    if (interval != doc.end() and start != doc.end()) {
+        interval->get_to(m.sample_interval);
+        start   ->get_to(m.sample_start);
+    }
+    else {
+        /*
+         * Older manifests only have the line numbers of the vertical axis,
+         * which are assumed to be regularly sampled. The line numbers are in
+         * microseconds, like in the scan, so convert them to milliseconds
+         * like upload does when it writes sample-interval.
+         */
+        const auto& samples = m.line_numbers.back();
+        const auto first  = samples.empty()    ? 0 : samples[0];
+        const auto period = samples.size() < 2 ? 1000 : samples[1] - samples[0];
+        m.sample_start    = first  / 1000.0;
+        m.sample_interval = period / 1000.0;
+    }
+
+    if (!(m.sample_interval > 0)) {
+        const auto msg = "sample-interval (= {}) must be positive";
+        throw bad_document(fmt::format(msg, m.sample_interval));
+    }
 }
 
 void to_json(nlohmann::json& doc, const manifestdoc& m) noexcept (false) {
-    doc["line-numbers"] = m.line_numbers;
-    doc["line-labels"]  = m.line_labels;
-    doc["data"]         = m.vol;
-    doc["attributes"]   = m.attr;
+    doc["line-numbers"]    = m.line_numbers;
+    doc["line-labels"]     = m.line_labels;
+    doc["data"]            = m.vol;
+    doc["attributes"]      = m.attr;
+    doc["sample-interval"] = m.sample_interval;
+    doc["sample-start"]    = m.sample_start;
+}
+
+std::vector< double > sample_values(const manifestdoc& m) noexcept (false) {
+    const auto nsamples = m.line_numbers.back().size();
+    std::vector< double > values(nsamples);
+    for (std::size_t i = 0; i < nsamples; ++i)
+        values[i] = m.sample_start + i * m.sample_interval;
+    return values;
+}
+
+int sample_index(const manifestdoc& m, double value) noexcept (false) {
+    const auto nsamples = int(m.line_numbers.back().size());
+    const auto index = std::round((value - m.sample_start) / m.sample_interval);
+    if (!(0 <= index && index < nsamples)) {
+        const auto msg = "sample (= {}) not in [{}, {}]";
+        throw not_found(fmt::format(
+            msg,
+            value,
+            m.sample_start,
+            m.sample_start + (nsamples - 1) * m.sample_interval
+        ));
+    }
+    return int(index);
 }
 
 void to_json(nlohmann::json& doc, const basic_query& query) noexcept (false) {
@@ -110,6 +185,166 @@ void to_json(nlohmann::json& doc, const basic_query& query) noexcept (false) {
     doc["storage_endpoint"] = query.storage_endpoint;
     doc["shape"]            = query.shape;
     doc["function"]         = query.function;
+    doc["tracecontext"]     = query.tracecontext;
+    doc["prefix"]           = query.prefix;
+    doc["level"]            = query.level;
+}
+
+namespace {
+
+/*
+ * The trace context is optional, and an absent trace context is the same as
+ * an empty one.
+ */
+void get_tracecontext(
+    const nlohmann::json& doc,
+    std::map< std::string, std::string >& tracecontext)
+noexcept (false) {
+    const auto itr = doc.find("tracecontext");
+    if (itr != doc.end() && !itr->is_null())
+        itr->get_to(tracecontext);
+}
+
+/*
+ * Get the optional key from doc. An absent or null key leaves out unchanged.
+ */
+template < typename T >
+void get_optional(const nlohmann::json& doc, const char* key, T& out)
+noexcept (false) {
+    const auto itr = doc.find(key);
+    if (itr != doc.end() && !itr->is_null())
+        itr->get_to(out);
+}
+
+/*
+ * Resolve the inclusive [first, last] range of line numbers, or sample
+ * values for the vertical (last) dimension, to the half-open [lower, upper)
+ * range of cartesian coordinates of dim. The range is clipped to the cube,
+ * and a range that does not include any lines or samples is not found. The
+ * name of the range is used for error messages.
+ */
+std::pair< int, int > cartesian_range(
+        const manifestdoc& m,
+        std::size_t dim,
+        const std::vector< double >& range,
+        const std::string& name)
+noexcept (false) {
+    if (range.size() != 2 or range[0] > range[1]) {
+        const auto msg = "{}: expected [first, last]";
+        throw bad_value(fmt::format(msg, name));
+    }
+
+    const auto& lines = m.line_numbers;
+    int lower, upper;
+    if (dim == lines.size() - 1) {
+        /*
+         * Samples that are within rounding error of the range are included,
+         * since sample values like 0.1 can not be represented exactly.
+         */
+        const auto eps = 1e-6;
+        const auto nsamples = int(lines[dim].size());
+        const auto first = (range[0] - m.sample_start) / m.sample_interval;
+        const auto last  = (range[1] - m.sample_start) / m.sample_interval;
+        lower = std::max(0,        int(std::ceil(first - eps)));
+        upper = std::min(nsamples, int(std::floor(last + eps)) + 1);
+    }
+    else {
+        const auto& index = lines[dim];
+        const auto fst = std::lower_bound(index.begin(), index.end(), range[0]);
+        const auto lst = std::upper_bound(index.begin(), index.end(), range[1]);
+        lower = int(std::distance(index.begin(), fst));
+        upper = int(std::distance(index.begin(), lst));
+    }
+
+    if (lower >= upper) {
+        const auto msg = "{} (= [{}, {}]) is outside the cube";
+        throw not_found(fmt::format(msg, name, range[0], range[1]));
+    }
+    return { lower, upper };
+}
+
+/*
+ * Plan the query against the coarsest level of detail in the manifest that
+ * satisfies the optional resolution in args, i.e. that is not decimated by
+ * more than resolution[d] in any dimension d, and that accept()s its
+ * decimation. Without a resolution, the query is planned against the source.
+ *
+ * The manifest of the query is reduced to the line numbers and sample interval
+ * of the level, so that the rest of the query is resolved in the (coarser)
+ * grid of the level. A level that keeps every n'th line of a dimension has
+ * the lines 0, n, 2n, ... of the source. Returns the decimation of the chosen
+ * level.
+ */
+template < typename Accept >
+std::vector< int > select_level(
+        const nlohmann::json& args,
+        basic_query& query,
+        Accept accept)
+noexcept (false) {
+    auto& m = query.manifest;
+    const auto ndims  = m.line_numbers.size();
+    const auto source = std::vector< int >(ndims, 1);
+
+    std::vector< int > resolution;
+    get_optional(args, "resolution", resolution);
+    if (resolution.empty())
+        return source;
+
+    if (resolution.size() != ndims) {
+        const auto msg = "expected {} resolutions, got {}";
+        throw bad_value(fmt::format(msg, ndims, resolution.size()));
+    }
+    for (const auto r : resolution) {
+        if (r < 1) {
+            const auto msg = "resolution (= {}) must be positive";
+            throw bad_value(fmt::format(msg, r));
+        }
+    }
+
+    const volumedesc* level = nullptr;
+    auto decimation = source;
+    long coarseness = 0;
+    for (const auto& vol : m.vol) {
+        const auto& dec = vol.decimation.empty() ? source : vol.decimation;
+        if (dec.size() != ndims) {
+            const auto msg = "level {}: expected {} decimations, got {}";
+            throw bad_document(fmt::format(msg, vol.level, ndims, dec.size()));
+        }
+
+        bool satisfies = true;
+        long size = 1;
+        for (std::size_t d = 0; d < ndims; ++d) {
+            satisfies = satisfies and 1 <= dec[d] and dec[d] <= resolution[d];
+            size *= dec[d];
+        }
+        if (not satisfies or not accept(dec))
+            continue;
+        if (level and size <= coarseness)
+            continue;
+
+        level      = &vol;
+        decimation = dec;
+        coarseness = size;
+    }
+
+    if (not level) {
+        const auto msg = "no level of detail with resolution (= {})";
+        throw not_found(fmt::format(msg, fmt::join(resolution, ", ")));
+    }
+
+    for (std::size_t d = 0; d < ndims; ++d) {
+        const auto& lines = m.line_numbers[d];
+        std::vector< int > kept;
+        for (std::size_t i = 0; i < lines.size(); i += decimation[d])
+            kept.push_back(lines[i]);
+        m.line_numbers[d] = kept;
+    }
+    m.sample_interval *= decimation.back();
+    query.prefix = level->prefix;
+    query.level  = level->level;
+    return decimation;
+}
+
 }
 
 void from_json(const nlohmann::json& doc, basic_query& query) noexcept (false) {
@@ -118,8 +353,16 @@ void from_json(const nlohmann::json& doc, basic_query& query) noexcept (false) {
     doc.at("guid")            .get_to(query.guid);
     doc.at("manifest")        .get_to(query.manifest);
     doc.at("storage_endpoint").get_to(query.storage_endpoint);
-    doc.at("shape")           .get_to(query.shape);
     doc.at("function")        .get_to(query.function);
+    get_tracecontext(doc, query.tracecontext);
+    get_optional(doc, "shape", query.shape);
+
+    /*
+     * Queries are planned against the source volume, unless they ask for a
+     * coarser resolution. See select_level().
+     */
+    query.prefix = "src";
+    query.level  = 0;
 }
 
 void to_json(nlohmann::json& doc, const basic_task& task) noexcept (false) {
@@ -130,7 +373,12 @@ void to_json(nlohmann::json& doc, const basic_task& task) noexcept (false) {
     doc["shape"]            = task.shape;
     doc["shape-cube"]       = task.shape_cube;
     doc["function"]         = task.function;
-    assert(task.shape_cube.size() == task.shape.size());
+    doc["tracecontext"]     = task.tracecontext;
+    doc["prefix"]           = task.prefix;
+    /*
+     * Attribute tasks are not read from a volume, and have no fragment shape
+     */
+    assert(task.shape.empty() or task.shape_cube.size() == task.shape.size());
 }
 
 void from_json(const nlohmann::json& doc, basic_task& task) noexcept (false) {
@@ -141,20 +389,42 @@ void from_json(const nlohmann::json& doc, basic_task& task) noexcept (false) {
     doc.at("shape")           .get_to(task.shape);
     doc.at("shape-cube")      .get_to(task.shape_cube);
     doc.at("function")        .get_to(task.function);
+    get_tracecontext(doc, task.tracecontext);
+
+    /*
+     * Tasks without a prefix read the source volume
+     */
+    get_optional(doc, "prefix", task.prefix);
+    if (task.prefix.empty())
+        task.prefix = "src";
 }
 
 void to_json(nlohmann::json& doc, const process_header& head) noexcept (false) {
-    doc["pid"]    = head.pid;
-    doc["ntasks"] = head.ntasks;
-    doc["shape"]  = head.shape;
-    doc["index"]  = head.index;
+    doc["pid"]      = head.pid;
+    doc["function"] = head.function;
+    doc["tracecontext"] = head.tracecontext;
+    doc["ntasks"]   = head.ntasks;
+    doc["level"]    = head.level;
+    doc["fragment-shape"] = head.fragment_shape;
+    doc["shape"]    = head.shape;
+    doc["index"]    = head.index;
 }
 
 void from_json(const nlohmann::json& doc, process_header& head) noexcept (false) {
-    doc.at("pid")   .get_to(head.pid);
-    doc.at("ntasks").get_to(head.ntasks);
-    doc.at("shape") .get_to(head.shape);
-    doc.at("index") .get_to(head.index);
+    doc.at("pid")     .get_to(head.pid);
+    /*
+     * The function is only used for labelling metrics, and is missing from
+     * headers written by older schedulers.
+     */
+    head.function.clear();
+    get_optional(doc, "function", head.function);
+    get_tracecontext(doc, head.tracecontext);
+    doc.at("ntasks")  .get_to(head.ntasks);
+    head.level = 0;
+    get_optional(doc, "level", head.level);
+    get_optional(doc, "fragment-shape", head.fragment_shape);
+    doc.at("shape")   .get_to(head.shape);
+    doc.at("index")   .get_to(head.index);
 }
 
 void from_json(const nlohmann::json& doc, slice_query& query) noexcept (false) {
@@ -179,11 +449,11 @@ void from_json(const nlohmann::json& doc, slice_query& query) noexcept (false) {
     }
 
     const std::string& kind = args.at("kind");
-    const int val = args.at("val");
     if (kind == "index") {
-        query.idx = val;
+        args.at("val").get_to(query.idx);
     }
     else if (kind == "lineno") {
+        const int val = args.at("val");
         const auto& index = lines[query.dim];
         const auto itr = std::find(index.begin(), index.end(), val);
         if (itr == index.end()) {
@@ -192,6 +462,88 @@ void from_json(const nlohmann::json& doc, slice_query& query) noexcept (false) {
         }
         query.idx = std::distance(index.begin(), itr);
     }
+    else if (kind == "time") {
+        /*
+         * Time (or depth) slices are always along the vertical axis, which is
+         * the last dimension.
+         */
+        if (query.dim != int(lines.size()) - 1) {
+            const auto msg = "args.dim (= {}) is not the vertical axis";
+            throw bad_value(fmt::format(msg, query.dim));
+        }
+        const double val = args.at("val");
+        query.idx = sample_index(query.manifest, val);
+    }
+    else {
+        const auto msg = "args.kind (= {}) not one of index, lineno, time";
+        throw bad_value(fmt::format(msg, kind));
+    }
+
+    /*
+     * A slice can only be read from levels of detail that have its line, and
+     * idx is the line in the grid of the level.
+     */
+    const auto idx = query.idx;
+    const auto decimation = select_level(args, query, [&](const auto& dec) {
+        return idx % dec[query.dim] == 0;
+    });
+    query.idx /= decimation[query.dim];
+
+    /*
+     * The optional stride decimates the slice, one stride for every dimension
+     * except dim, in order.
+     */
+    get_optional(args, "stride", query.stride);
+    if (not query.stride.empty()) {
+        if (query.stride.size() != lines.size() - 1) {
+            const auto msg = "expected {} strides, got {}";
+            throw bad_value(fmt::format(
+                msg,
+                lines.size() - 1,
+                query.stride.size()
+            ));
+        }
+        for (const auto stride : query.stride) {
+            if (stride < 1) {
+                const auto msg = "stride (= {}) must be positive";
+                throw bad_value(fmt::format(msg, stride));
+            }
+        }
+    }
+
+    /*
+     * The optional ranges are the window of the slice, one range for every
+     * dimension except dim, in order.
+     */
+    std::vector< std::vector< double > > ranges;
+    get_optional(args, "ranges", ranges);
+    if (ranges.empty()) {
+        /*
+         * Decimated slices are always windowed, so without a window it is
+         * the whole slice.
+         */
+        if (query.stride.empty())
+            return;
+        for (std::size_t i = 0; i < lines.size(); ++i) {
+            if (i == query.dim) continue;
+            query.lower.push_back(0);
+            query.upper.push_back(int(lines[i].size()));
+        }
+        return;
+    }
+
+    if (ranges.size() != lines.size() - 1) {
+        const auto msg = "expected {} ranges, got {}";
+        throw bad_value(fmt::format(msg, lines.size() - 1, ranges.size()));
+    }
+    for (std::size_t i = 0, j = 0; i < lines.size(); ++i) {
+        if (i == query.dim) continue;
+        const auto name  = fmt::format("ranges[{}]", j);
+        const auto range = cartesian_range(query.manifest, i, ranges[j], name);
+        query.lower.push_back(range.first);
+        query.upper.push_back(range.second);
+        ++j;
+    }
 }
 
 void from_json(const nlohmann::json& doc, curtain_query& query) noexcept (false) {
@@ -217,13 +569,34 @@ void from_json(const nlohmann::json& doc, curtain_query& query) noexcept (false)
     } catch (std::out_of_range&) {
         throw bad_value("bad coord arg; expected list-of-pairs");
     }
+
+    /*
+     * The optional samples is the window of the vertical axis
+     */
+    std::vector< double > samples;
+    get_optional(args, "samples", samples);
+    if (samples.empty())
+        return;
+
+    const auto vertical = query.manifest.line_numbers.size() - 1;
+    const auto range = cartesian_range(
+        query.manifest,
+        vertical,
+        samples,
+        "samples"
+    );
+    query.lower = { range.first };
+    query.upper = { range.second };
 }
 
 void to_json(nlohmann::json& doc, const slice_task& task) noexcept (false) {
     to_json(doc, static_cast< const basic_task& >(task));
-    doc["dim"] = task.dim;
-    doc["idx"] = task.idx;
-    doc["ids"] = task.ids;
+    doc["dim"]    = task.dim;
+    doc["idx"]    = task.idx;
+    doc["lower"]  = task.lower;
+    doc["upper"]  = task.upper;
+    doc["stride"] = task.stride;
+    doc["ids"]    = task.ids;
 }
 
 void from_json(const nlohmann::json& doc, slice_task& task) noexcept (false) {
@@ -231,6 +604,14 @@ void from_json(const nlohmann::json& doc, slice_task& task) noexcept (false) {
     doc.at("dim").get_to(task.dim);
     doc.at("idx").get_to(task.idx);
     doc.at("ids").get_to(task.ids);
+    get_optional(doc, "lower", task.lower);
+    get_optional(doc, "upper", task.upper);
+    get_optional(doc, "stride", task.stride);
+
+    if (task.lower.size() != task.upper.size())
+        throw bad_message("inconsistent window");
+    if (not task.stride.empty() and task.stride.size() != task.lower.size())
+        throw bad_message("inconsistent stride");
 
     if (task.ids.empty()) {
         /*
@@ -294,12 +675,19 @@ void from_json(const nlohmann::json& doc, single& single) noexcept (false) {
 
 void to_json(nlohmann::json& doc, const curtain_task& curtain) noexcept (false) {
     to_json(doc, static_cast< const basic_task& >(curtain));
-    doc["ids"] = curtain.ids;
+    doc["lower"] = curtain.lower;
+    doc["upper"] = curtain.upper;
+    doc["ids"]   = curtain.ids;
 }
 
 void from_json(const nlohmann::json& doc, curtain_task& curtain) noexcept (false) {
     from_json(doc, static_cast< basic_task& >(curtain));
     doc.at("ids").get_to(curtain.ids);
+    get_optional(doc, "lower", curtain.lower);
+    get_optional(doc, "upper", curtain.upper);
+
+    if (curtain.lower.size() != curtain.upper.size())
+        throw bad_message("inconsistent window");
 }
 
 void to_json(nlohmann::json& doc, const trace& trace) noexcept (false) {
@@ -320,4 +708,316 @@ void from_json(const nlohmann::json& doc, curtain_traces& traces) noexcept (fals
     doc.at("traces").get_to(traces.traces);
 }
 
+void from_json(const nlohmann::json& doc, subvolume_query& query) noexcept (false) {
+    from_json(doc, static_cast< basic_query& >(query));
+
+    if (query.function != "subvolume") {
+        const auto msg = "expected query 'subvolume', got {}";
+        throw bad_message(fmt::format(msg, query.function));
+    }
+
+    const auto& args = doc.at("args");
+    select_level(args, query, [](const auto&) { return true; });
+
+    const auto& lines = query.manifest.line_numbers;
+    std::vector< std::vector< double > > ranges;
+    args.at("ranges").get_to(ranges);
+    if (ranges.size() != lines.size()) {
+        const auto msg = "expected {} ranges, got {}";
+        throw bad_value(fmt::format(msg, lines.size(), ranges.size()));
+    }
+
+    for (std::size_t i = 0; i < ranges.size(); ++i) {
+        const auto name  = fmt::format("ranges[{}]", i);
+        const auto range = cartesian_range(query.manifest, i, ranges[i], name);
+        query.lower.push_back(range.first);
+        query.upper.push_back(range.second);
+    }
+}
+
+void to_json(nlohmann::json& doc, const subvolume_task& task) noexcept (false) {
+    to_json(doc, static_cast< const basic_task& >(task));
+    doc["lower"] = task.lower;
+    doc["upper"] = task.upper;
+    doc["ids"]   = task.ids;
+}
+
+void from_json(const nlohmann::json& doc, subvolume_task& task) noexcept (false) {
+    from_json(doc, static_cast< basic_task& >(task));
+    doc.at("lower").get_to(task.lower);
+    doc.at("upper").get_to(task.upper);
+    doc.at("ids")  .get_to(task.ids);
+
+    const auto dims = task.shape.size();
+    if (task.lower.size() != dims or task.upper.size() != dims)
+        throw bad_message("inconsistent dimensions");
+}
+
+void to_json(nlohmann::json& doc, const block& block) noexcept (false) {
+    doc["offset"] = block.offset;
+    doc["shape"]  = block.shape;
+    doc["v"]      = block.v;
+}
+
+void from_json(const nlohmann::json& doc, block& block) noexcept (false) {
+    doc.at("offset").get_to(block.offset);
+    doc.at("shape") .get_to(block.shape);
+    doc.at("v")     .get_to(block.v);
+}
+
+void to_json(nlohmann::json& doc, const subvolume_blocks& blocks) noexcept (false) {
+    doc["blocks"] = blocks.blocks;
+}
+
+void from_json(const nlohmann::json& doc, subvolume_blocks& blocks) noexcept (false) {
+    doc.at("blocks").get_to(blocks.blocks);
+}
+
+void from_json(const nlohmann::json& doc, horizon_query& query) noexcept (false) {
+    from_json(doc, static_cast< basic_query& >(query));
+
+    if (query.function != "horizon" and query.function != "horizon-attribute") {
+        const auto msg = "expected query 'horizon' or 'horizon-attribute', got {}";
+        throw bad_message(fmt::format(msg, query.function));
+    }
+
+    const auto& m = query.manifest;
+    const auto& lines = m.line_numbers;
+    const auto& args = doc.at("args");
+
+    if (query.function == "horizon-attribute") {
+        static const std::vector< std::string > attributes = {
+            "rms", "mean", "min", "max", "sum-of-magnitudes"
+        };
+        args.at("attribute").get_to(query.attribute);
+        const auto known = std::find(
+            attributes.begin(),
+            attributes.end(),
+            query.attribute
+        );
+        if (known == attributes.end()) {
+            const auto msg =
+                "args.attribute (= {}) not one of "
+                "rms, mean, min, max, sum-of-magnitudes"
+            ;
+            throw bad_value(fmt::format(msg, query.attribute));
+        }
+    }
+
+    /*
+     * The optional window is the [above, below] time (or depth) around the
+     * horizon, which is rounded to whole samples.
+     */
+    query.above = 0;
+    query.below = 0;
+    std::vector< double > window;
+    get_optional(args, "window", window);
+    if (not window.empty()) {
+        if (window.size() != 2 or !(window[0] >= 0) or !(window[1] >= 0)) {
+            throw bad_value("window: expected non-negative [above, below]");
+        }
+        query.above = int(std::round(window[0] / m.sample_interval));
+        query.below = int(std::round(window[1] / m.sample_interval));
+    }
+
+    const auto& values = args.at("values");
+    const auto n0 = lines[0].size();
+    const auto n1 = lines[1].size();
+    if (not values.is_array() or values.size() != n0) {
+        const auto msg = "values: expected {} rows";
+        throw bad_value(fmt::format(msg, n0));
+    }
+
+    const auto nsamples = int(lines.back().size());
+    for (std::size_t i = 0; i < n0; ++i) {
+        const auto& row = values[i];
+        if (not row.is_array() or row.size() != n1) {
+            const auto msg = "values[{}]: expected {} values";
+            throw bad_value(fmt::format(msg, i, n1));
+        }
+        for (std::size_t j = 0; j < n1; ++j) {
+            if (row[j].is_null())
+                continue;
+
+            const double value = row[j];
+            const auto z = std::round((value - m.sample_start) / m.sample_interval);
+            if (!(0 <= z && z < nsamples))
+                continue;
+
+            query.dim0s.push_back(int(i));
+            query.dim1s.push_back(int(j));
+            query.zs.push_back(int(z));
+        }
+    }
+}
+
+void to_json(nlohmann::json& doc, const horizon_points& points) noexcept (false) {
+    doc["id"]     = points.id;
+    doc["points"] = points.points;
+}
+
+void from_json(const nlohmann::json& doc, horizon_points& points) noexcept (false) {
+    doc.at("id")    .get_to(points.id);
+    doc.at("points").get_to(points.points);
+}
+
+void to_json(nlohmann::json& doc, const horizon_task& task) noexcept (false) {
+    to_json(doc, static_cast< const basic_task& >(task));
+    doc["above"]     = task.above;
+    doc["below"]     = task.below;
+    doc["attribute"] = task.attribute;
+    doc["ids"]       = task.ids;
+}
+
+void from_json(const nlohmann::json& doc, horizon_task& task) noexcept (false) {
+    from_json(doc, static_cast< basic_task& >(task));
+    doc.at("above").get_to(task.above);
+    doc.at("below").get_to(task.below);
+    doc.at("ids")  .get_to(task.ids);
+    get_optional(doc, "attribute", task.attribute);
+
+    if (task.above < 0 or task.below < 0)
+        throw bad_message("negative window");
+}
+
+void to_json(nlohmann::json& doc, const horizon_values& values) noexcept (false) {
+    doc["traces"] = values.traces;
+}
+
+void from_json(const nlohmann::json& doc, horizon_values& values) noexcept (false) {
+    doc.at("traces").get_to(values.traces);
+}
+
+void to_json(nlohmann::json& doc, const horizon_attributes& values) noexcept (false) {
+    doc["traces"] = values.traces;
+}
+
+void from_json(const nlohmann::json& doc, horizon_attributes& values) noexcept (false) {
+    doc.at("traces").get_to(values.traces);
+}
+
+void from_json(const nlohmann::json& doc, attribute_query& query) noexcept (false) {
+    from_json(doc, static_cast< basic_query& >(query));
+
+    if (query.function != "attribute") {
+        const auto msg = "expected query 'attribute', got {}";
+        throw bad_message(fmt::format(msg, query.function));
+    }
+
+    const auto& lines = query.manifest.line_numbers;
+    const auto& attrs = query.manifest.attr;
+    const auto& args  = doc.at("args");
+
+    const std::string& kind = args.at("kind");
+    const auto attr = std::find_if(
+        attrs.begin(),
+        attrs.end(),
+        [&kind](const auto& a) { return a.type == kind; }
+    );
+    if (attr == attrs.end()) {
+        const auto msg = "attribute (= {}) not found in cube";
+        throw not_found(fmt::format(msg, kind));
+    }
+    if (attr->layout != "tiled" or attr->ext != "f64") {
+        const auto msg = "attribute {}: unsupported layout {} ({})";
+        throw bad_document(fmt::format(msg, kind, attr->layout, attr->ext));
+    }
+    if (attr->shapes.empty() or attr->shapes.front().size() != 2) {
+        const auto msg = "attribute {}: expected 2D tile shape";
+        throw bad_document(fmt::format(msg, kind));
+    }
+    query.attribute = *attr;
+
+    /*
+     * The index of lineno in dim, which must be a lateral dimension
+     */
+    const auto indexof = [&lines](int dim, int lineno) {
+        const auto& index = lines[dim];
+        const auto itr = std::find(index.begin(), index.end(), lineno);
+        if (itr == index.end()) {
+            const auto msg = "line (= {}) not found in index";
+            throw not_found(fmt::format(msg, lineno));
+        }
+        return int(std::distance(index.begin(), itr));
+    };
+
+    const auto vertical = int(lines.size()) - 1;
+    query.idx = 0;
+    const auto coordsarg = args.find("coords");
+    if (coordsarg != args.end() and not coordsarg->is_null()) {
+        std::vector< std::vector< int > > coords;
+        coordsarg->get_to(coords);
+        query.dim = -1;
+        query.dim0s.reserve(coords.size());
+        query.dim1s.reserve(coords.size());
+        for (const auto& pair : coords) {
+            if (pair.size() != 2)
+                throw bad_value("bad coord arg; expected list-of-pairs");
+            query.dim0s.push_back(indexof(0, pair[0]));
+            query.dim1s.push_back(indexof(1, pair[1]));
+        }
+        return;
+    }
+
+    /*
+     * The lineno picks the line of a lateral dim, and is required with, and
+     * only allowed with, a lateral dim.
+     */
+    const auto given = [&args](const char* key) {
+        const auto itr = args.find(key);
+        return itr != args.end() and not itr->is_null();
+    };
+    if (given("lineno") and not given("dim"))
+        throw bad_value("args.dim required when lineno is given");
+
+    query.dim = vertical;
+    get_optional(args, "dim", query.dim);
+    if (!(0 <= query.dim && query.dim <= vertical)) {
+        const auto msg = "args.dim (= {}) not in [0, {})";
+        throw not_found(fmt::format(msg, query.dim, lines.size()));
+    }
+    if (query.dim == vertical) {
+        if (given("lineno"))
+            throw bad_value("args.lineno not allowed when dim is vertical");
+        return;
+    }
+    if (not given("lineno"))
+        throw bad_value("args.lineno required when dim is lateral");
+    query.idx = indexof(query.dim, args.at("lineno"));
+}
+
+void to_json(nlohmann::json& doc, const attribute_task& task) noexcept (false) {
+    to_json(doc, static_cast< const basic_task& >(task));
+    doc["attribute"] = task.attribute;
+    doc["ids"]       = task.ids;
+}
+
+void from_json(const nlohmann::json& doc, attribute_task& task) noexcept (false) {
+    from_json(doc, static_cast< basic_task& >(task));
+    doc.at("attribute").get_to(task.attribute);
+    doc.at("ids")      .get_to(task.ids);
+
+    const auto& shapes = task.attribute.shapes;
+    if (shapes.empty() or shapes.front().size() != 2)
+        throw bad_message("inconsistent dimensions");
+}
+
+void to_json(nlohmann::json& doc, const attribute_value& value) noexcept (false) {
+    doc["coordinates"] = value.coordinates;
+    doc["v"]           = value.v;
+}
+
+void from_json(const nlohmann::json& doc, attribute_value& value) noexcept (false) {
+    doc.at("coordinates").get_to(value.coordinates);
+    doc.at("v")          .get_to(value.v);
+}
+
+void to_json(nlohmann::json& doc, const attribute_values& values) noexcept (false) {
+    doc["traces"] = values.traces;
+}
+
+void from_json(const nlohmann::json& doc, attribute_values& values) noexcept (false) {
+    doc.at("traces").get_to(values.traces);
+}
+
 }
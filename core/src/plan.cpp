@@ -1,7 +1,10 @@
 #include <algorithm>
 #include <cassert>
 #include <iterator>
+#include <map>
 #include <string>
+#include <tuple>
+#include <utility>
 #include <vector>
 
 #include <fmt/format.h>
@@ -27,6 +30,84 @@ one::gvt< 3 > geometry(const one::basic_query& query) noexcept (false) {
     };
 }
 
+/*
+ * The line numbers of a dimension as a header index
+ */
+std::vector< double > as_index(const std::vector< int >& linenos) {
+    return std::vector< double >(linenos.begin(), linenos.end());
+}
+
+/*
+ * Check if the fragment id (along a single dimension) of fragments of size
+ * has any of the points lower, lower + stride, ... in the window [lower,
+ * upper)
+ */
+bool intersects(
+        std::size_t id,
+        std::size_t size,
+        int lower,
+        int upper,
+        int stride = 1) {
+    const auto fst = std::max(lower, int(id * size));
+    const auto lst = std::min(upper, int((id + 1) * size));
+    const auto next = lower + ((fst - lower + stride - 1) / stride) * stride;
+    return fst < lst and next < lst;
+}
+
+/*
+ * The stride of dimension i, which is 1 if the slice is not decimated
+ */
+int stride(const std::vector< int >& strides, std::size_t i) {
+    return strides.empty() ? 1 : strides[i];
+}
+
+/*
+ * Slice index [lower, upper) if the window is set, or the whole index
+ * otherwise, and take every stride'th element if decimated.
+ */
+std::vector< double > window(
+        const std::vector< double >& index,
+        const std::vector< int >& lower,
+        const std::vector< int >& upper,
+        std::size_t i,
+        const std::vector< int >& strides = {})
+noexcept (false) {
+    if (lower.empty())
+        return index;
+
+    std::vector< double > xs;
+    for (int k = lower[i]; k < upper[i]; k += stride(strides, i))
+        xs.push_back(index[k]);
+    return xs;
+}
+
+/*
+ * The fragment shapes of the volume the query is planned against
+ */
+std::vector< std::vector< int > >
+volume_shapes(const one::basic_query& query) noexcept (false) {
+    for (const auto& vol : query.manifest.vol) {
+        if (vol.prefix == query.prefix)
+            return vol.shapes;
+    }
+    return {};
+}
+
+/*
+ * The estimated cost, in bytes, of fetching nfragments (f32) fragments of
+ * shape. Every fragment costs its size, plus a fixed overhead for the request
+ * itself, so that many small fragments are not considered free even if they
+ * hold little more than the data that is needed. The overhead is roughly the
+ * bytes that can be downloaded in the time of a round-trip to storage.
+ */
+long long fetch_cost(std::size_t nfragments, const std::vector< int >& shape) {
+    const long long overhead = 64 * 1024;
+    long long bytes = sizeof(float);
+    for (const auto x : shape)
+        bytes *= x;
+    return nfragments * (overhead + bytes);
+}
+
 int task_count(int jobs, int task_size) {
     /*
      * Return the number of task-size'd tasks needed to process all jobs
@@ -93,6 +174,15 @@ struct schedule_maker {
      */
     Output build(const Input&) noexcept (false);
 
+    /*
+     * The number of fragments build() would fetch, computed from the
+     * geometry and the query without building the schedule. This is the
+     * size of the schedule for every fragment shape layout() considers, which
+     * can be very large for small fragments, so it must not allocate
+     * per-fragment.
+     */
+    std::size_t nfragments(const Input&) noexcept (false);
+
     /*
      * Make a header. This function requires deep knowledge of the shape and
      * oneseismic geometry, and must be implemented for all shape types.
@@ -119,12 +209,25 @@ struct schedule_maker {
     partition(Output&, int task_size) noexcept (false);
 
     /*
-     * Make a schedule() - calls build(), header(), and partition() in
+     * Pick the fragment shape and build() the schedule for it. Unless the
+     * query has a shape, the fragments are counted for every shape of the
+     * volume, and the cheapest one by fetch_cost() is picked. The volumes are laid
+     * out differently for different access patterns, e.g. thin slabs for
+     * slices or pencils (1x1xN) for curtains, so the best shape depends on
+     * the query. The picked shape is written back to the query, and to
+     * fragment_shape, which is the fragment shape of the process header.
+     */
+    Output layout(Input&, std::vector< int >& fragment_shape)
+    noexcept (false);
+
+    /*
+     * Make a schedule() - calls layout(), header(), and partition() in
      * sequence. The output vector should always have the header() as the
      * *last* element.
      */
     std::vector< std::string >
-    schedule(const char* doc, int len, int task_size) noexcept (false);
+    schedule(const char* doc, int len, const one::task_sizing&)
+    noexcept (false);
 };
 
 template < typename Input, typename Output >
@@ -157,20 +260,65 @@ schedule_maker< Input, Output >::partition(
     return xs;
 }
 
+template < typename Input, typename Output >
+Output schedule_maker< Input, Output >::layout(
+        Input& in,
+        std::vector< int >& fragment_shape
+) noexcept (false) {
+    if (not in.shape.empty()) {
+        fragment_shape = in.shape;
+        return this->build(in);
+    }
+
+    const auto shapes = volume_shapes(in);
+    if (shapes.empty()) {
+        const auto msg = "no fragment shapes for volume '{}'";
+        throw one::bad_document(fmt::format(msg, in.prefix));
+    }
+
+    std::vector< int > shape;
+    long long lowest = 0;
+    for (const auto& candidate : shapes) {
+        if (candidate.size() != in.manifest.line_numbers.size()) {
+            const auto msg = "fragment shape {} of volume '{}' is not {}-d";
+            throw one::bad_document(fmt::format(
+                msg,
+                fmt::join(candidate, "x"),
+                in.prefix,
+                in.manifest.line_numbers.size()
+            ));
+        }
+
+        in.shape = candidate;
+        const auto cost = fetch_cost(this->nfragments(in), candidate);
+        if (shape.empty() or cost < lowest) {
+            shape  = candidate;
+            lowest = cost;
+        }
+    }
+
+    in.shape = shape;
+    fragment_shape = shape;
+    return this->build(in);
+}
+
 template < typename Input, typename Output >
 std::vector< std::string >
 schedule_maker< Input, Output >::schedule(
         const char* doc,
         int len,
-        int task_size)
+        const one::task_sizing& sizing)
 noexcept (false) {
     Input in;
     in.unpack(doc, doc + len);
-    auto fetch = this->build(in);
+    std::vector< int > fragment_shape;
+    auto fetch = this->layout(in, fragment_shape);
+    const auto task_size = one::task_size(sizing, fetch.ids.size());
     auto sched = this->partition(fetch, task_size);
 
     const auto ntasks = int(sched.size());
-    const auto head   = this->header(in, ntasks);
+    auto head = this->header(in, ntasks);
+    head.fragment_shape = fragment_shape;
     sched.push_back(head.pack());
     return sched;
 }
@@ -188,15 +336,77 @@ schedule_maker< one::slice_query, one::slice_task >::build(
         return std::vector< int > { int(x[0]), int(x[1]), int(x[2]) };
     };
 
+    const auto dim = gvt.mkdim(query.dim);
+    const auto fs2 = gvt.squeeze(dim).fragment_shape();
+    const auto& lower = query.lower;
+    const auto& upper = query.upper;
+    const auto& strides = query.stride;
+
     task.idx = query.idx % gvt.fragment_shape()[query.dim];
-    const auto ids = gvt.slice(gvt.mkdim(query.dim), query.idx);
-    // TODO: name loop
-    for (const auto& id : ids)
+    const auto ids = gvt.slice(dim, query.idx);
+    for (const auto& id : ids) {
+        /*
+         * Windowed slices only need the fragments that intersect the window,
+         * and decimated slices only those with samples that are kept.
+         */
+        if (not lower.empty()) {
+            const auto squeezed = id.squeeze(dim);
+            bool needed = true;
+            for (std::size_t i = 0; i < 2; ++i) {
+                needed = needed and intersects(
+                    squeezed[i],
+                    fs2[i],
+                    lower[i],
+                    upper[i],
+                    stride(strides, i)
+                );
+            }
+            if (not needed)
+                continue;
+        }
         task.ids.push_back(to_vec(id));
+    }
 
     return task;
 }
 
+template <>
+std::size_t
+schedule_maker< one::slice_query, one::slice_task >::nfragments(
+    const one::slice_query& query)
+{
+    const auto gvt = geometry(query);
+    const auto dim = gvt.mkdim(query.dim);
+    const auto gvt2 = gvt.squeeze(dim);
+    const auto fs2 = gvt2.fragment_shape();
+
+    /*
+     * The fragments of the slice are the product of the fragments needed in
+     * either direction, which is all of them unless the slice is windowed.
+     */
+    std::size_t count = 1;
+    for (std::size_t i = 0; i < 2; ++i) {
+        const auto n = gvt2.fragment_count(gvt2.mkdim(i));
+        if (query.lower.empty()) {
+            count *= n;
+            continue;
+        }
+
+        std::size_t needed = 0;
+        for (std::size_t id = 0; id < n; ++id) {
+            needed += intersects(
+                id,
+                fs2[i],
+                query.lower[i],
+                query.upper[i],
+                stride(query.stride, i)
+            );
+        }
+        count *= needed;
+    }
+    return count;
+}
+
 template <>
 one::process_header
 schedule_maker< one::slice_query, one::slice_task >::header(
@@ -210,25 +420,41 @@ schedule_maker< one::slice_query, one::slice_task >::header(
     const auto fs2  = gvt2.fragment_shape();
 
     one::process_header head;
-    head.pid    = query.pid;
-    head.ntasks = ntasks;
+    head.pid      = query.pid;
+    head.function = query.function;
+    head.tracecontext = query.tracecontext;
+    head.ntasks   = ntasks;
+    head.level    = query.level;
 
     /*
      * The shape of a slice are the dimensions of the survey squeezed in that
-     * dimension.
+     * dimension, or the (decimated) window.
      */
     for (std::size_t i = 0; i < fs2.size(); ++i) {
         const auto dim = gvt2.mkdim(i);
-        head.shape.push_back(gvt2.nsamples(dim));
+        if (query.lower.empty()) {
+            head.shape.push_back(gvt2.nsamples(dim));
+            continue;
+        }
+        const auto len = query.upper[i] - query.lower[i];
+        const auto step = stride(query.stride, i);
+        head.shape.push_back((len + step - 1) / step);
     }
 
     /*
      * Build the index from the line numbers for the directions !=
-     * params.lineno
+     * params.lineno. The vertical axis is indexed by the sample values (time
+     * or depth), not the line numbers.
      */
-    for (std::size_t i = 0; i < mdims.size(); ++i) {
+    for (std::size_t i = 0, j = 0; i < mdims.size(); ++i) {
         if (i == query.dim) continue;
-        head.index.push_back(mdims[i]);
+        const auto index = i == mdims.size() - 1
+            ? one::sample_values(query.manifest)
+            : as_index(mdims[i])
+        ;
+        head.index.push_back(
+            window(index, query.lower, query.upper, j++, query.stride)
+        );
     }
     return head;
 }
@@ -259,6 +485,24 @@ noexcept (false) {
     std::transform(xs.begin(), xs.end(), xs.begin(), indexof);
 }
 
+/*
+ * The fragments [zfirst, zfirst + zfrags) of every column are needed by a
+ * curtain, which is all of them, unless the curtain is windowed.
+ */
+std::pair< int, int > curtain_zrange(
+        const one::curtain_query& query,
+        const one::gvt< 3 >& gvt)
+noexcept (true) {
+    auto zfirst = 0;
+    auto zfrags = int(gvt.fragment_count(gvt.mkdim(2)));
+    if (not query.lower.empty()) {
+        const auto zheight = int(gvt.fragment_shape()[2]);
+        zfirst = query.lower[0] / zheight;
+        zfrags = (query.upper[0] - 1) / zheight - zfirst + 1;
+    }
+    return { zfirst, zfrags };
+}
+
 template <>
 one::curtain_task
 schedule_maker< one::curtain_query, one::curtain_task >::build(
@@ -284,7 +528,9 @@ schedule_maker< one::curtain_query, one::curtain_task >::build(
     auto& ids = task.ids;
 
     auto gvt = geometry(query);
-    const auto zfrags  = gvt.fragment_count(gvt.mkdim(2));
+    const auto zrange = curtain_zrange(query, gvt);
+    const auto zfirst = zrange.first;
+    const auto zfrags = zrange.second;
 
     /*
      * Guess the number of coordinates per fragment. A reasonable assumption is
@@ -316,7 +562,8 @@ schedule_maker< one::curtain_query, one::curtain_task >::build(
             std::size_t(dim1s[i]),
             std::size_t(0),
         };
-        const auto fid = gvt.frag_id(top_point);
+        auto fid = gvt.frag_id(top_point);
+        fid[2] = zfirst;
 
         auto itr = std::lower_bound(ids.begin(), ids.end(), fid, less);
         if (itr == ids.end() or (not equal(itr->id, fid))) {
@@ -324,7 +571,7 @@ schedule_maker< one::curtain_query, one::curtain_task >::build(
             top.id.assign(fid.begin(), fid.end());
             top.coordinates.reserve(approx_coordinates_per_fragment);
             itr = ids.insert(itr, zfrags, top);
-            for (int z = 0; z < zfrags; ++z, ++itr)
+            for (int z = zfirst; z < zfirst + zfrags; ++z, ++itr)
                 itr->id[2] = z;
         }
     }
@@ -339,7 +586,8 @@ schedule_maker< one::curtain_query, one::curtain_task >::build(
             std::size_t(dim1s[i]),
             std::size_t(0),
         };
-        const auto fid = gvt.frag_id(cp);
+        auto fid = gvt.frag_id(cp);
+        fid[2] = zfirst;
         const auto lid = gvt.to_local(cp);
         auto itr = std::lower_bound(ids.begin(), ids.end(), fid, less);
         const auto end = itr + zfrags;
@@ -351,6 +599,32 @@ schedule_maker< one::curtain_query, one::curtain_task >::build(
     return task;
 }
 
+template <>
+std::size_t
+schedule_maker< one::curtain_query, one::curtain_task >::nfragments(
+    const one::curtain_query& query)
+{
+    auto dim0s = query.dim0s;
+    auto dim1s = query.dim1s;
+    to_cartesian_inplace(query.manifest.line_numbers[0], dim0s);
+    to_cartesian_inplace(query.manifest.line_numbers[1], dim1s);
+
+    /*
+     * Every column the curtain passes through is zfrags fragments
+     */
+    const auto gvt = geometry(query);
+    const auto& fs = gvt.fragment_shape();
+    std::vector< std::pair< int, int > > columns;
+    columns.reserve(dim0s.size());
+    for (std::size_t i = 0; i < dim0s.size(); ++i)
+        columns.emplace_back(dim0s[i] / int(fs[0]), dim1s[i] / int(fs[1]));
+
+    std::sort(columns.begin(), columns.end());
+    const auto last = std::unique(columns.begin(), columns.end());
+    const auto ncolumns = std::distance(columns.begin(), last);
+    return ncolumns * curtain_zrange(query, gvt).second;
+}
+
 template <>
 one::process_header
 schedule_maker< one::curtain_query, one::curtain_task >::header(
@@ -360,21 +634,401 @@ schedule_maker< one::curtain_query, one::curtain_task >::header(
     const auto& mdims = query.manifest.line_numbers;
 
     one::process_header head;
-    head.pid    = query.pid;
-    head.ntasks = ntasks;
+    head.pid      = query.pid;
+    head.function = query.function;
+    head.tracecontext = query.tracecontext;
+    head.ntasks   = ntasks;
+    head.level    = query.level;
 
+    /*
+     * Windowed curtains are clipped to the window, otherwise the traces are
+     * padded.
+     */
     const auto gvt  = geometry(query);
     const auto zpad = gvt.nsamples_padded(gvt.mkdim(gvt.ndims - 1));
+    const auto zlen = query.lower.empty()
+        ? int(zpad)
+        : query.upper[0] - query.lower[0]
+    ;
     head.shape = {
         int(query.dim0s.size()),
-        int(zpad),
+        zlen,
     };
 
-    head.index.push_back(query.dim0s);
-    head.index.push_back(query.dim1s);
-    head.index.push_back(mdims.back());
-    to_cartesian_inplace(mdims[0], head.index[0]);
-    to_cartesian_inplace(mdims[1], head.index[1]);
+    auto dim0s = query.dim0s;
+    auto dim1s = query.dim1s;
+    to_cartesian_inplace(mdims[0], dim0s);
+    to_cartesian_inplace(mdims[1], dim1s);
+    head.index.push_back(as_index(dim0s));
+    head.index.push_back(as_index(dim1s));
+    head.index.push_back(window(
+        one::sample_values(query.manifest),
+        query.lower,
+        query.upper,
+        0
+    ));
+    return head;
+}
+
+template <>
+one::subvolume_task
+schedule_maker< one::subvolume_query, one::subvolume_task >::build(
+    const one::subvolume_query& query)
+{
+    auto task = one::subvolume_task(query);
+    const auto gvt = geometry(query);
+    const auto& fs = gvt.fragment_shape();
+
+    /*
+     * The fragments that overlap the sub-volume, i.e. the fragment ids in the
+     * range [first, last] in every dimension.
+     */
+    std::vector< int > first(3), last(3);
+    for (int i = 0; i < 3; ++i) {
+        first[i] = query.lower[i] / fs[i];
+        last[i]  = (query.upper[i] - 1) / fs[i];
+    }
+
+    for (int i = first[0]; i <= last[0]; ++i)
+    for (int j = first[1]; j <= last[1]; ++j)
+    for (int k = first[2]; k <= last[2]; ++k)
+        task.ids.push_back({ i, j, k });
+
+    return task;
+}
+
+template <>
+std::size_t
+schedule_maker< one::subvolume_query, one::subvolume_task >::nfragments(
+    const one::subvolume_query& query)
+{
+    const auto& fs = geometry(query).fragment_shape();
+    std::size_t count = 1;
+    for (int i = 0; i < 3; ++i) {
+        const auto first = query.lower[i] / int(fs[i]);
+        const auto last  = (query.upper[i] - 1) / int(fs[i]);
+        count *= last - first + 1;
+    }
+    return count;
+}
+
+template <>
+one::process_header
+schedule_maker< one::subvolume_query, one::subvolume_task >::header(
+    const one::subvolume_query& query,
+    int ntasks
+) noexcept (false) {
+    const auto& mdims = query.manifest.line_numbers;
+
+    one::process_header head;
+    head.pid      = query.pid;
+    head.function = query.function;
+    head.tracecontext = query.tracecontext;
+    head.ntasks   = ntasks;
+    head.level    = query.level;
+
+    /*
+     * Blocks are clipped to the sub-volume, so the shape is not padded.
+     */
+    for (std::size_t i = 0; i < mdims.size(); ++i)
+        head.shape.push_back(query.upper[i] - query.lower[i]);
+
+    const auto samples = one::sample_values(query.manifest);
+    for (std::size_t i = 0; i < mdims.size(); ++i) {
+        const auto index = i == mdims.size() - 1
+            ? samples
+            : as_index(mdims[i]);
+        head.index.emplace_back(
+            index.begin() + query.lower[i],
+            index.begin() + query.upper[i]
+        );
+    }
+    return head;
+}
+
+template <>
+one::horizon_task
+schedule_maker< one::horizon_query, one::horizon_task >::build(
+    const one::horizon_query& query)
+{
+    auto task = one::horizon_task(query);
+    const auto gvt = geometry(query);
+    const auto zheight = int(gvt.fragment_shape()[2]);
+    const auto nsamples = int(query.manifest.line_numbers.back().size());
+
+    /*
+     * Bin the points by the fragments their window [z - above, z + below]
+     * intersects, sorted by fragment id. Windows close to a fragment boundary
+     * need more than one fragment.
+     */
+    std::map< std::vector< int >, one::horizon_points > fragments;
+    for (std::size_t i = 0; i < query.zs.size(); ++i) {
+        const auto z = query.zs[i];
+        const auto zfst = std::max(0,            z - query.above);
+        const auto zlst = std::min(nsamples - 1, z + query.below);
+        const auto cp = one::CP< 3 > {
+            std::size_t(query.dim0s[i]),
+            std::size_t(query.dim1s[i]),
+            std::size_t(zfst),
+        };
+        auto fid = gvt.frag_id(cp);
+        const auto lid = gvt.to_local(cp);
+
+        for (int k = zfst / zheight; k <= zlst / zheight; ++k) {
+            const auto id = std::vector< int > {
+                int(fid[0]),
+                int(fid[1]),
+                k,
+            };
+            auto& frag = fragments[id];
+            frag.id = id;
+            frag.points.push_back({ int(lid[0]), int(lid[1]), z });
+        }
+    }
+
+    for (auto& frag : fragments)
+        task.ids.push_back(std::move(frag.second));
+    return task;
+}
+
+template <>
+std::size_t
+schedule_maker< one::horizon_query, one::horizon_task >::nfragments(
+    const one::horizon_query& query)
+{
+    const auto gvt = geometry(query);
+    const auto& fs = gvt.fragment_shape();
+    const auto zheight = int(fs[2]);
+    const auto nsamples = int(query.manifest.line_numbers.back().size());
+
+    /*
+     * Every point needs the fragments [first, last] of its column. Sort the
+     * ranges by column and count the union of the ranges of every column.
+     */
+    struct range {
+        int dim0, dim1, first, last;
+    };
+    std::vector< range > ranges;
+    ranges.reserve(query.zs.size());
+    for (std::size_t i = 0; i < query.zs.size(); ++i) {
+        const auto z = query.zs[i];
+        const auto zfst = std::max(0,            z - query.above);
+        const auto zlst = std::min(nsamples - 1, z + query.below);
+        ranges.push_back({
+            query.dim0s[i] / int(fs[0]),
+            query.dim1s[i] / int(fs[1]),
+            zfst / zheight,
+            zlst / zheight,
+        });
+    }
+
+    std::sort(ranges.begin(), ranges.end(), [](const auto& a, const auto& b) {
+        return std::tie(a.dim0, a.dim1, a.first)
+             < std::tie(b.dim0, b.dim1, b.first);
+    });
+
+    std::size_t count = 0;
+    for (auto itr = ranges.begin(); itr != ranges.end();) {
+        const auto dim0 = itr->dim0;
+        const auto dim1 = itr->dim1;
+        auto next = itr->first;
+        for (; itr != ranges.end(); ++itr) {
+            if (itr->dim0 != dim0 or itr->dim1 != dim1) break;
+            if (itr->last < next) continue;
+            count += itr->last - std::max(next, itr->first) + 1;
+            next = itr->last + 1;
+        }
+    }
+    return count;
+}
+
+/*
+ * The window of a point can span more than one fragment of the same column,
+ * and a horizon attribute needs the whole window, so columns are never split
+ * across tasks. Tasks are filled with whole columns up to task_size
+ * fragments, or a single column if it alone is larger.
+ */
+template <>
+std::vector< std::string >
+schedule_maker< one::horizon_query, one::horizon_task >::partition(
+        one::horizon_task& output,
+        int task_size
+) noexcept (false) {
+    if (task_size < 1) {
+        const auto msg = fmt::format("task_size (= {}) < 1", task_size);
+        throw std::logic_error(msg);
+    }
+
+    const auto ids = output.ids;
+    const auto column_end = [&ids](auto fst) {
+        return std::find_if(fst, ids.end(), [fst](const auto& x) {
+            return x.id[0] != fst->id[0] or x.id[1] != fst->id[1];
+        });
+    };
+
+    /*
+     * A horizon where no points are in the cube is still a single (empty)
+     * task, so that the process completes.
+     */
+    std::vector< std::string > xs;
+    auto fst = ids.begin();
+    do {
+        auto lst = fst;
+        while (lst != ids.end()) {
+            const auto next = column_end(lst);
+            if (lst != fst and std::distance(fst, next) > task_size)
+                break;
+            lst = next;
+        }
+        output.ids.assign(fst, lst);
+        xs.push_back(output.pack());
+        fst = lst;
+    } while (fst != ids.end());
+
+    return xs;
+}
+
+template <>
+one::process_header
+schedule_maker< one::horizon_query, one::horizon_task >::header(
+    const one::horizon_query& query,
+    int ntasks
+) noexcept (false) {
+    const auto& m = query.manifest;
+    const auto& mdims = m.line_numbers;
+
+    one::process_header head;
+    head.pid      = query.pid;
+    head.function = query.function;
+    head.tracecontext = query.tracecontext;
+    head.ntasks   = ntasks;
+    head.level    = query.level;
+
+    /*
+     * The horizon is a map of the survey, with the window as the last
+     * dimension, indexed by the time (or depth) relative to the horizon.
+     * Horizon attributes reduce the window to a single value.
+     */
+    head.shape = { int(mdims[0].size()), int(mdims[1].size()) };
+    head.index.push_back(as_index(mdims[0]));
+    head.index.push_back(as_index(mdims[1]));
+    if (not query.attribute.empty())
+        return head;
+
+    head.shape.push_back(query.above + query.below + 1);
+    std::vector< double > offsets;
+    for (int k = -query.above; k <= query.below; ++k)
+        offsets.push_back(k * m.sample_interval);
+    head.index.push_back(offsets);
+    return head;
+}
+
+/*
+ * The cartesian (dim0, dim1) coordinates of the traces of the attribute query
+ */
+std::pair< std::vector< int >, std::vector< int > >
+attribute_traces(const one::attribute_query& query) noexcept (false) {
+    if (query.dim < 0)
+        return { query.dim0s, query.dim1s };
+
+    const auto n0 = int(query.manifest.line_numbers[0].size());
+    const auto n1 = int(query.manifest.line_numbers[1].size());
+    std::vector< int > dim0s, dim1s;
+    for (int i = 0; i < n0; ++i) {
+        if (query.dim == 0 and i != query.idx) continue;
+        for (int j = 0; j < n1; ++j) {
+            if (query.dim == 1 and j != query.idx) continue;
+            dim0s.push_back(i);
+            dim1s.push_back(j);
+        }
+    }
+    return { dim0s, dim1s };
+}
+
+template <>
+one::attribute_task
+schedule_maker< one::attribute_query, one::attribute_task >::build(
+    const one::attribute_query& query)
+{
+    auto task = one::attribute_task(query);
+    const auto& ts = query.attribute.shapes.front();
+    const auto traces = attribute_traces(query);
+    const auto& dim0s = traces.first;
+    const auto& dim1s = traces.second;
+
+    /*
+     * Bin the traces by the tile they are in, sorted by tile id
+     */
+    std::map< std::vector< int >, one::single > tiles;
+    for (std::size_t i = 0; i < dim0s.size(); ++i) {
+        const auto id = std::vector< int > {
+            dim0s[i] / ts[0],
+            dim1s[i] / ts[1],
+        };
+        auto& tile = tiles[id];
+        tile.id = id;
+        tile.coordinates.push_back({ dim0s[i] % ts[0], dim1s[i] % ts[1] });
+    }
+
+    for (auto& tile : tiles)
+        task.ids.push_back(std::move(tile.second));
+    return task;
+}
+
+/*
+ * Attributes are read from their own tiles, not from the fragments of a
+ * volume, so there is no fragment shape to pick, and the process has none.
+ */
+template <>
+one::attribute_task
+schedule_maker< one::attribute_query, one::attribute_task >::layout(
+    one::attribute_query& query,
+    std::vector< int >&)
+{
+    return this->build(query);
+}
+
+template <>
+one::process_header
+schedule_maker< one::attribute_query, one::attribute_task >::header(
+    const one::attribute_query& query,
+    int ntasks
+) noexcept (false) {
+    const auto& mdims = query.manifest.line_numbers;
+    const auto nlabels = int(query.attribute.labels.size());
+
+    one::process_header head;
+    head.pid      = query.pid;
+    head.function = query.function;
+    head.tracecontext = query.tracecontext;
+    head.ntasks   = ntasks;
+    head.level    = query.level;
+
+    /*
+     * The shape and index are those of the slice or curtain the traces are
+     * taken from, with the labels of the attribute as the last dimension.
+     */
+    switch (query.dim) {
+        case -1:
+            head.shape = { int(query.dim0s.size()), nlabels };
+            head.index.push_back(as_index(query.dim0s));
+            head.index.push_back(as_index(query.dim1s));
+            break;
+
+        case 0:
+        case 1: {
+            const auto& other = mdims[1 - query.dim];
+            head.shape = { int(other.size()), nlabels };
+            head.index.push_back(as_index(other));
+            break;
+        }
+
+        default:
+            head.shape = { int(mdims[0].size()), int(mdims[1].size()), nlabels };
+            head.index.push_back(as_index(mdims[0]));
+            head.index.push_back(as_index(mdims[1]));
+            break;
+    }
     return head;
 }
 
@@ -382,20 +1036,41 @@ schedule_maker< one::curtain_query, one::curtain_task >::header(
 
 namespace one {
 
+int task_size(const task_sizing& sizing, int nfragments) noexcept (false) {
+    if (sizing.size > 0)
+        return sizing.size;
+
+    if (sizing.max < 1 or sizing.workers < 1) {
+        const auto msg = "adaptive task size needs max (= {}) and workers (= {})";
+        throw std::logic_error(fmt::format(msg, sizing.max, sizing.workers));
+    }
+
+    if (nfragments <= sizing.max)
+        return std::max(nfragments, 1);
+
+    const auto spread = (nfragments + sizing.workers - 1) / sizing.workers;
+    return std::min(spread, sizing.max);
+}
+
 std::vector< std::string >
-mkschedule(const char* doc, int len, int task_size) noexcept (false) {
+mkschedule(const char* doc, int len, const task_sizing& sizing)
+noexcept (false) {
     const auto document = nlohmann::json::parse(doc, doc + len);
     /*
      * Right now, only format-version: 1 is supported, but checking the format
      * version allow for multiple document versions to be supported as storage
      * migrates between the representation. Dispatch here to different
      * query-builder routines, depending on the format version.
+     *
+     * The format-version is a property of the manifest, which is embedded in
+     * the query.
      */
-    if (document.at("format-version") != 1) {
+    const auto& version = document.at("manifest").at("format-version");
+    if (version != 1) {
         const auto msg = fmt::format(
             "unsupported format-version; expected {}, was {}",
             1,
-            int(document.at("format-version"))
+            int(version)
         );
         throw bad_document(msg);
     }
@@ -403,11 +1078,23 @@ mkschedule(const char* doc, int len, int task_size) noexcept (false) {
     const std::string function = document["function"];
     if (function == "slice") {
         auto slice = schedule_maker< slice_query, slice_task >{};
-        return slice.schedule(doc, len, task_size);
+        return slice.schedule(doc, len, sizing);
     }
     if (function == "curtain") {
         auto curtain = schedule_maker< curtain_query, curtain_task >{};
-        return curtain.schedule(doc, len, task_size);
+        return curtain.schedule(doc, len, sizing);
+    }
+    if (function == "subvolume") {
+        auto subvolume = schedule_maker< subvolume_query, subvolume_task >{};
+        return subvolume.schedule(doc, len, sizing);
+    }
+    if (function == "horizon" or function == "horizon-attribute") {
+        auto horizon = schedule_maker< horizon_query, horizon_task >{};
+        return horizon.schedule(doc, len, sizing);
+    }
+    if (function == "attribute") {
+        auto attribute = schedule_maker< attribute_query, attribute_task >{};
+        return attribute.schedule(doc, len, sizing);
     }
     throw std::logic_error("No handler for function " + function);
 }
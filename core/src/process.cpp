@@ -1,4 +1,10 @@
+#include <algorithm>
+#include <array>
+#include <cmath>
+#include <limits>
+#include <map>
 #include <numeric>
+#include <stdexcept>
 #include <string>
 #include <vector>
 
@@ -41,6 +47,36 @@ one::gvt< 3 > gvt3(const one::basic_task& task) {
     return { cs, fs };
 }
 
+/*
+ * Check that key and chunk are sane before extracting data from the chunk.
+ * Fragments are read from storage and passed along as-is, so a truncated or
+ * otherwise corrupted fragment must be rejected, or add() would read out of
+ * bounds.
+ */
+void check_fragment(int nkeys, int key, int len, std::size_t expected)
+noexcept (false) {
+    if (key < 0 or key >= nkeys) {
+        const auto msg = "fragment key {} out of range [0, {})";
+        throw std::out_of_range(fmt::format(msg, key, nkeys));
+    }
+
+    if (len < 0 or std::size_t(len) != expected) {
+        const auto msg = "fragment {}: expected {} bytes, got {}";
+        throw std::invalid_argument(fmt::format(msg, key, expected, len));
+    }
+}
+
+void check_fragment(const one::basic_task& task, int nkeys, int key, int len)
+noexcept (false) {
+    const auto samples = std::accumulate(
+        task.shape.begin(),
+        task.shape.end(),
+        std::size_t(1),
+        std::multiplies< std::size_t >()
+    );
+    check_fragment(nkeys, key, len, samples * sizeof(float));
+}
+
 class slice : public proc {
 public:
     void init(const char* msg, int len) override;
@@ -48,6 +84,13 @@ public:
     std::string pack() override;
 
 private:
+    /*
+     * Crop the tile t of fragment id (in the slice) to the window, and
+     * decimate it if the slice is strided
+     */
+    void crop(one::tile& t, const one::FID< 2 >& id);
+    int stride(std::size_t i) const noexcept (true);
+
     one::slice_task  input;
     one::slice_tiles output;
 
@@ -70,6 +113,69 @@ private:
     std::vector< int >  traceindex;
 };
 
+class subvolume : public proc {
+public:
+    void init(const char* msg, int len) override;
+    virtual void add(int, const char* chunk, int len) override;
+    std::string pack() override;
+
+private:
+    one::subvolume_task    input;
+    one::subvolume_blocks  output;
+    one::gvt< 3 >          gvt;
+};
+
+class horizon : public proc {
+public:
+    void init(const char* msg, int len) override;
+    virtual void add(int, const char* chunk, int len) override;
+    std::string pack() override;
+
+private:
+    one::horizon_task   input;
+    one::horizon_values output;
+    one::gvt< 3 >       gvt;
+    std::vector< int >  traceindex;
+};
+
+/*
+ * The horizon attribute is computed from the window of every point, which can
+ * be spread over multiple fragments, so the samples are accumulated in add()
+ * and reduced in pack().
+ */
+class horizon_attribute : public proc {
+public:
+    void init(const char* msg, int len) override;
+    virtual void add(int, const char* chunk, int len) override;
+    std::string pack() override;
+
+private:
+    struct accumulator {
+        int    n      = 0;
+        double sum    = 0;
+        double sumsq  = 0;
+        double sumabs = 0;
+        float  min    = std::numeric_limits< float >::max();
+        float  max    = std::numeric_limits< float >::lowest();
+    };
+
+    one::horizon_task  input;
+    one::gvt< 3 >      gvt;
+    std::map< std::array< int, 2 >, accumulator > windows;
+};
+
+class attribute : public proc {
+public:
+    void init(const char* msg, int len) override;
+    virtual void add(int, const char* chunk, int len) override;
+    std::string pack() override;
+
+private:
+    one::attribute_task   input;
+    one::attribute_values output;
+    std::vector< int >    traceindex;
+};
+
 }
 
 std::unique_ptr< proc > proc::make(const std::string& kind) noexcept (false) {
@@ -77,12 +183,27 @@ std::unique_ptr< proc > proc::make(const std::string& kind) noexcept (false) {
         return std::make_unique< slice >();
     if (kind == "curtain")
         return std::make_unique< curtain >();
+    if (kind == "subvolume")
+        return std::make_unique< subvolume >();
+    if (kind == "horizon")
+        return std::make_unique< horizon >();
+    if (kind == "horizon-attribute")
+        return std::make_unique< horizon_attribute >();
+    if (kind == "attribute")
+        return std::make_unique< attribute >();
     else
         return nullptr;
 }
 
-void proc::set_fragment_shape(const std::string& shape) noexcept (false) {
-    this->prefix = "src/" + shape + "/";
+void proc::set_fragment_shape(
+        const std::string& prefix,
+        const std::string& shape)
+noexcept (false) {
+    this->set_prefix(prefix + "/" + shape);
+}
+
+void proc::set_prefix(const std::string& prefix) noexcept (false) {
+    this->prefix = prefix + "/";
 }
 
 void proc::add_fragment(const std::string& id) noexcept (false) {
@@ -111,7 +232,10 @@ void slice::init(const char* msg, int len) {
     const auto& fragment_shape = g3.fragment_shape();
     const auto& cube_shape     = g3.cube_shape();
 
-    this->set_fragment_shape(fmt::format("{}", fmt::join(fragment_shape, "-")));
+    this->set_fragment_shape(
+        this->input.prefix,
+        fmt::format("{}", fmt::join(fragment_shape, "-"))
+    );
     this->dim = g3.mkdim(this->input.dim);
     this->idx = this->input.idx;
     this->layout = fragment_shape.slice_stride(this->dim);
@@ -122,12 +246,20 @@ void slice::init(const char* msg, int len) {
 
     const auto& cs = this->gvt.cube_shape();
     this->output.shape.assign(cs.begin(), cs.end());
+    if (not this->input.lower.empty()) {
+        for (std::size_t i = 0; i < this->output.shape.size(); ++i) {
+            const auto len  = this->input.upper[i] - this->input.lower[i];
+            const auto step = this->stride(i);
+            this->output.shape[i] = (len + step - 1) / step;
+        }
+    }
 
     for (const auto& id : this->input.ids)
         this->add_fragment(fmt::format("{}.f32", fmt::join(id, "-")));
 }
 
 void slice::add(int key, const char* chunk, int len) {
+    check_fragment(this->input, int(this->input.ids.size()), key, len);
     auto& t = this->output.tiles[key];
     const auto squeezed_id = id3(this->input.ids[key]).squeeze(this->dim);
     const auto tile_layout = this->gvt.injection_stride(squeezed_id);
@@ -145,6 +277,56 @@ void slice::add(int key, const char* chunk, int len) {
         dst += this->layout.substride * sizeof(float);
         src += this->layout.superstride * sizeof(float);
     }
+
+    if (not this->input.lower.empty())
+        this->crop(t, squeezed_id);
+}
+
+int slice::stride(std::size_t i) const noexcept (true) {
+    return this->input.stride.empty() ? 1 : this->input.stride[i];
+}
+
+void slice::crop(one::tile& t, const one::FID< 2 >& id) {
+    /*
+     * The tile holds the fragment slice in row-major order. Keep only the
+     * part inside the window, and only every stride'th sample (counted from
+     * lower), and lay it out relative to the (decimated) window.
+     */
+    const auto& lower = this->input.lower;
+    const auto& upper = this->input.upper;
+    const auto& fs = this->gvt.fragment_shape();
+
+    int origin[2], fst[2], lst[2], step[2], n[2];
+    for (int i = 0; i < 2; ++i) {
+        origin[i] = int(id[i] * fs[i]);
+        step[i] = this->stride(i);
+        fst[i] = std::max(lower[i], origin[i]);
+        fst[i] = lower[i] + ((fst[i] - lower[i] + step[i] - 1) / step[i]) * step[i];
+        lst[i] = std::min(upper[i], origin[i] + int(fs[i]));
+        n[i] = std::max(0, (lst[i] - fst[i] + step[i] - 1) / step[i]);
+    }
+    const auto rows  = n[0];
+    const auto cols  = n[1];
+    const auto width = this->output.shape[1];
+
+    std::vector< float > v;
+    v.reserve(rows * cols);
+    for (int r = 0; r < rows; ++r) {
+        const auto row = fst[0] + r * step[0];
+        const auto src = t.v.begin() + (row - origin[0]) * fs[1];
+        for (int c = 0; c < cols; ++c) {
+            const auto col = fst[1] + c * step[1];
+            v.push_back(*(src + (col - origin[1])));
+        }
+    }
+
+    t.iterations   = rows;
+    t.chunk_size   = cols;
+    t.initial_skip = ((fst[0] - lower[0]) / step[0]) * width
+                   + ((fst[1] - lower[1]) / step[1]);
+    t.superstride  = width;
+    t.substride    = cols;
+    t.v = std::move(v);
 }
 
 std::string slice::pack() {
@@ -156,6 +338,7 @@ void curtain::init(const char* msg, int len) {
     this->input.unpack(msg, msg + len);
     this->gvt = gvt3(this->input);
     this->set_fragment_shape(
+        this->input.prefix,
         fmt::format("{}", fmt::join(this->gvt.fragment_shape(), "-"))
     );
 
@@ -199,6 +382,7 @@ void curtain::init(const char* msg, int len) {
 }
 
 void curtain::add(int key, const char* chunk, int len) {
+    check_fragment(this->input, int(this->input.ids.size()), key, len);
     const auto& id = this->input.ids[key];
     assert(
            this->traceindex[key] + int(id.coordinates.size())
@@ -208,7 +392,22 @@ void curtain::add(int key, const char* chunk, int len) {
     const auto* fchunk = reinterpret_cast< const float* >(chunk);
     auto out = this->output.traces.begin() + this->traceindex[key];
     const auto fid = id3(id.id);
-    const auto zheight = this->gvt.fragment_shape()[2];
+    const auto zheight = int(this->gvt.fragment_shape()[2]);
+
+    /*
+     * Extract the samples [zfst, zlst) of the fragment, which is all of them
+     * unless the curtain is windowed, in which case z is relative to the top
+     * of the window.
+     */
+    const auto z0 = int(fid[2]) * zheight;
+    auto zfst = 0;
+    auto zlst = zheight;
+    auto ztop = 0;
+    if (not this->input.lower.empty()) {
+        ztop = this->input.lower[0];
+        zfst = std::max(0,       this->input.lower[0] - z0);
+        zlst = std::min(zheight, this->input.upper[0] - z0);
+    }
 
     for (const auto& coord : id.coordinates) {
         const auto fp = one::FP< 3 > {
@@ -218,8 +417,9 @@ void curtain::add(int key, const char* chunk, int len) {
         };
         const auto global = this->gvt.to_global(fid, fp);
         out->coordinates.assign(global.begin(), global.end());
+        out->coordinates[2] = z0 + zfst - ztop;
         const auto off = this->gvt.fragment_shape().to_offset(fp);
-        out->v.assign(fchunk + off, fchunk + off + zheight);
+        out->v.assign(fchunk + off + zfst, fchunk + off + std::max(zfst, zlst));
         ++out;
     }
 }
@@ -228,4 +428,300 @@ std::string curtain::pack() {
     return this->output.pack();
 }
 
+void subvolume::init(const char* msg, int len) {
+    this->clear();
+    this->input.unpack(msg, msg + len);
+    this->gvt = gvt3(this->input);
+    this->set_fragment_shape(
+        this->input.prefix,
+        fmt::format("{}", fmt::join(this->gvt.fragment_shape(), "-"))
+    );
+
+    for (const auto& id : this->input.ids)
+        this->add_fragment(fmt::format("{}.f32", fmt::join(id, "-")));
+
+    this->output.blocks.resize(this->input.ids.size());
+}
+
+void subvolume::add(int key, const char* chunk, int len) {
+    check_fragment(this->input, int(this->input.ids.size()), key, len);
+    const auto& lower = this->input.lower;
+    const auto& upper = this->input.upper;
+    const auto& fs  = this->gvt.fragment_shape();
+    const auto  fid = id3(this->input.ids[key]);
+
+    /*
+     * The intersection [fst, lst) of the fragment and the sub-volume, in
+     * global (cartesian) coordinates
+     */
+    const auto origin = this->gvt.to_global(fid, one::FP< 3 >{ 0, 0, 0 });
+    int fst[3], lst[3];
+    for (int i = 0; i < 3; ++i) {
+        fst[i] = std::max(lower[i], int(origin[i]));
+        lst[i] = std::min(upper[i], int(origin[i] + fs[i]));
+    }
+
+    auto& block = this->output.blocks[key];
+    block.offset.clear();
+    block.shape.clear();
+    for (int i = 0; i < 3; ++i) {
+        block.offset.push_back(fst[i] - lower[i]);
+        block.shape.push_back(std::max(0, lst[i] - fst[i]));
+    }
+    block.v.clear();
+    block.v.reserve(block.shape[0] * block.shape[1] * block.shape[2]);
+
+    /*
+     * Fragments are row-major with the vertical axis fastest, so every
+     * (i, j) pair is a contiguous run of samples.
+     */
+    const auto* fchunk = reinterpret_cast< const float* >(chunk);
+    for (int i = fst[0]; i < lst[0]; ++i)
+    for (int j = fst[1]; j < lst[1]; ++j) {
+        const auto fp = one::FP< 3 > {
+            std::size_t(i      - origin[0]),
+            std::size_t(j      - origin[1]),
+            std::size_t(fst[2] - origin[2]),
+        };
+        const auto* src = fchunk + fs.to_offset(fp);
+        block.v.insert(block.v.end(), src, src + (lst[2] - fst[2]));
+    }
+}
+
+std::string subvolume::pack() {
+    return this->output.pack();
+}
+
+void horizon::init(const char* msg, int len) {
+    this->clear();
+    this->input.unpack(msg, msg + len);
+    this->gvt = gvt3(this->input);
+    this->set_fragment_shape(
+        this->input.prefix,
+        fmt::format("{}", fmt::join(this->gvt.fragment_shape(), "-"))
+    );
+
+    const auto& ids = this->input.ids;
+    for (const auto& frag : ids)
+        this->add_fragment(fmt::format("{}.f32", fmt::join(frag.id, "-")));
+
+    /*
+     * The traceindex [k] is the position of the first trace of add(k) in the
+     * output, like for curtains.
+     */
+    this->traceindex.resize(ids.size() + 1);
+    this->traceindex[0] = 0;
+    std::transform(
+        ids.begin(),
+        ids.end(),
+        this->traceindex.begin() + 1,
+        [](const auto& x) { return x.points.size(); }
+    );
+    std::partial_sum(
+        this->traceindex.begin(),
+        this->traceindex.end(),
+        this->traceindex.begin()
+    );
+
+    this->output.traces.resize(this->traceindex.back());
+}
+
+void horizon::add(int key, const char* chunk, int len) {
+    check_fragment(this->input, int(this->input.ids.size()), key, len);
+    const auto& frag = this->input.ids[key];
+    const auto fid = id3(frag.id);
+    const auto& fs = this->gvt.fragment_shape();
+    const auto zheight = int(fs[2]);
+    const auto z0 = int(fid[2]) * zheight;
+    const auto nsamples = int(this->gvt.cube_shape()[2]);
+
+    const auto* fchunk = reinterpret_cast< const float* >(chunk);
+    auto out = this->output.traces.begin() + this->traceindex[key];
+    for (const auto& point : frag.points) {
+        /*
+         * The part of the window [z - above, z + below] that is in this
+         * fragment and inside the cube, and its position in the window.
+         */
+        const auto top  = point[2] - this->input.above;
+        const auto zfst = std::max(top, z0);
+        const auto zlst = std::min({
+            point[2] + this->input.below + 1,
+            z0 + zheight,
+            nsamples,
+        });
+
+        const auto fp = one::FP< 3 > {
+            std::size_t(point[0]),
+            std::size_t(point[1]),
+            std::size_t(0),
+        };
+        const auto global = this->gvt.to_global(fid, fp);
+        out->coordinates = {
+            int(global[0]),
+            int(global[1]),
+            zfst - top,
+        };
+        const auto off = fs.to_offset(fp);
+        out->v.assign(
+            fchunk + off + (zfst - z0),
+            fchunk + off + std::max(zfst, zlst) - z0
+        );
+        ++out;
+    }
+}
+
+std::string horizon::pack() {
+    return this->output.pack();
+}
+
+void horizon_attribute::init(const char* msg, int len) {
+    this->clear();
+    this->windows.clear();
+    this->input.unpack(msg, msg + len);
+    this->gvt = gvt3(this->input);
+    this->set_fragment_shape(
+        this->input.prefix,
+        fmt::format("{}", fmt::join(this->gvt.fragment_shape(), "-"))
+    );
+
+    for (const auto& frag : this->input.ids)
+        this->add_fragment(fmt::format("{}.f32", fmt::join(frag.id, "-")));
+}
+
+void horizon_attribute::add(int key, const char* chunk, int len) {
+    check_fragment(this->input, int(this->input.ids.size()), key, len);
+    const auto& frag = this->input.ids[key];
+    const auto fid = id3(frag.id);
+    const auto& fs = this->gvt.fragment_shape();
+    const auto zheight = int(fs[2]);
+    const auto z0 = int(fid[2]) * zheight;
+    const auto nsamples = int(this->gvt.cube_shape()[2]);
+
+    const auto* fchunk = reinterpret_cast< const float* >(chunk);
+    for (const auto& point : frag.points) {
+        const auto zfst = std::max(point[2] - this->input.above, z0);
+        const auto zlst = std::min({
+            point[2] + this->input.below + 1,
+            z0 + zheight,
+            nsamples,
+        });
+
+        const auto fp = one::FP< 3 > {
+            std::size_t(point[0]),
+            std::size_t(point[1]),
+            std::size_t(0),
+        };
+        const auto global = this->gvt.to_global(fid, fp);
+        auto& acc = this->windows[{ int(global[0]), int(global[1]) }];
+
+        const auto* trace = fchunk + fs.to_offset(fp);
+        for (int z = zfst; z < zlst; ++z) {
+            const auto x = trace[z - z0];
+            acc.n      += 1;
+            acc.sum    += x;
+            acc.sumsq  += double(x) * x;
+            acc.sumabs += std::abs(x);
+            acc.min     = std::min(acc.min, x);
+            acc.max     = std::max(acc.max, x);
+        }
+    }
+}
+
+std::string horizon_attribute::pack() {
+    const auto& attribute = this->input.attribute;
+    const auto reduce = [&attribute](const accumulator& acc) -> float {
+        if (attribute == "rms")  return std::sqrt(acc.sumsq / acc.n);
+        if (attribute == "mean") return acc.sum / acc.n;
+        if (attribute == "min")  return acc.min;
+        if (attribute == "max")  return acc.max;
+        if (attribute == "sum-of-magnitudes") return acc.sumabs;
+        const auto msg = "unknown horizon attribute {}";
+        throw std::invalid_argument(fmt::format(msg, attribute));
+    };
+
+    one::horizon_attributes output;
+    output.traces.reserve(this->windows.size());
+    for (const auto& window : this->windows) {
+        if (window.second.n == 0)
+            continue;
+        one::trace t;
+        t.coordinates = { window.first[0], window.first[1] };
+        t.v = { reduce(window.second) };
+        output.traces.push_back(std::move(t));
+    }
+    return output.pack();
+}
+
+void attribute::init(const char* msg, int len) {
+    this->clear();
+    this->input.unpack(msg, msg + len);
+
+    const auto& attr = this->input.attribute;
+    this->set_prefix(fmt::format(
+        "{}/{}",
+        attr.prefix,
+        fmt::join(attr.shapes.front(), "-")
+    ));
+
+    const auto& ids = this->input.ids;
+    for (const auto& single : ids) {
+        this->add_fragment(
+            fmt::format("{}.{}", fmt::join(single.id, "-"), attr.ext)
+        );
+    }
+
+    /*
+     * The traceindex [k] is the position of the first trace of add(k) in the
+     * output, like for curtains.
+     */
+    this->traceindex.resize(ids.size() + 1);
+    this->traceindex[0] = 0;
+    std::transform(
+        ids.begin(),
+        ids.end(),
+        this->traceindex.begin() + 1,
+        [](const auto& x) { return x.coordinates.size(); }
+    );
+    std::partial_sum(
+        this->traceindex.begin(),
+        this->traceindex.end(),
+        this->traceindex.begin()
+    );
+
+    this->output.traces.resize(this->traceindex.back());
+}
+
+void attribute::add(int key, const char* chunk, int len) {
+    const auto& attr = this->input.attribute;
+    const auto& ts = attr.shapes.front();
+    const auto nlabels = attr.labels.size();
+    check_fragment(
+        int(this->input.ids.size()),
+        key,
+        len,
+        std::size_t(ts[0]) * ts[1] * nlabels * sizeof(double)
+    );
+
+    /*
+     * Tiles are row-major, with the values of every label of a trace
+     * contiguous.
+     */
+    const auto* dchunk = reinterpret_cast< const double* >(chunk);
+    const auto& id = this->input.ids[key];
+    auto out = this->output.traces.begin() + this->traceindex[key];
+    for (const auto& coord : id.coordinates) {
+        out->coordinates = {
+            id.id[0] * ts[0] + coord[0],
+            id.id[1] * ts[1] + coord[1],
+        };
+        const auto off = (coord[0] * ts[1] + coord[1]) * nlabels;
+        out->v.assign(dchunk + off, dchunk + off + nlabels);
+        ++out;
+    }
+}
+
+std::string attribute::pack() {
+    return this->output.pack();
+}
+
 }
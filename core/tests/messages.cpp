@@ -18,6 +18,7 @@ bool operator == (const one::basic_task& lhs, const one::basic_task& rhs) {
         && lhs.storage_endpoint == rhs.storage_endpoint
         && lhs.shape            == rhs.shape
         && lhs.function         == rhs.function
+        && lhs.tracecontext     == rhs.tracecontext
     ;
 }
 
@@ -173,6 +174,7 @@ TEST_CASE("slice-task can round trip packing") {
     task.shape = { 64, 64, 64 };
     task.shape_cube = { 512, 512, 512 };
     task.function = "slice";
+    task.tracecontext = { { "traceparent", "00-trace-span-01" } };
     task.dim = 1;
     task.idx = 2;
     task.ids = {
@@ -187,3 +189,611 @@ TEST_CASE("slice-task can round trip packing") {
 
     CHECK(task == unpacked);
 }
+
+TEST_CASE("trace context is optional and carried from query to task") {
+    const auto doc = std::string(R"({
+        "pid": "some-pid",
+        "token": "on-behalf-of-token",
+        "guid": "object-id",
+        "storage_endpoint": "https://storage.com",
+        "manifest": {
+            "data": [],
+            "attributes": [],
+            "line-numbers": [[10], [11], [12]],
+            "line-labels": ["dim-0", "dim-1", "dim-2"]
+        },
+        "shape": [64, 64, 64],
+        "function": "slice",
+        "args": { "kind": "index", "dim": 0, "val": 0 })");
+    const auto tracecontext = std::string(R"(,
+        "tracecontext": { "traceparent": "00-trace-span-01" }
+    })");
+
+    SECTION("an absent trace context is empty") {
+        const auto msg = doc + "}";
+        one::slice_query query;
+        query.unpack(msg.data(), msg.data() + msg.size());
+        CHECK(query.tracecontext.empty());
+    }
+
+    SECTION("the trace context is copied to the task") {
+        const auto msg = doc + tracecontext;
+        one::slice_query query;
+        query.unpack(msg.data(), msg.data() + msg.size());
+        CHECK(query.tracecontext.at("traceparent") == "00-trace-span-01");
+
+        const auto task = one::slice_task(query);
+        CHECK(task.tracecontext == query.tracecontext);
+    }
+}
+
+namespace {
+
+std::string time_slice_query(const std::string& samples, double time) {
+    return fmt::format(R"({{
+        "pid": "some-pid",
+        "token": "on-behalf-of-token",
+        "guid": "object-id",
+        "storage_endpoint": "https://storage.com",
+        "manifest": {{
+            "data": [],
+            "attributes": [],
+            "line-numbers": [[1, 2], [10, 11], [0, 4000, 8000, 12000]],
+            "line-labels": ["inline", "crossline", "time"]
+            {}
+        }},
+        "shape": [64, 64, 64],
+        "function": "slice",
+        "args": {{ "kind": "time", "dim": 2, "val": {} }}
+    }})", samples, time);
+}
+
+}
+
+TEST_CASE("time-slice query picks the nearest sample") {
+    const auto samples = R"(,
+        "sample-interval": 0.5,
+        "sample-start": 100.0
+    )";
+
+    const auto cases = std::vector< std::pair< double, int > > {
+        { 100.0,  0 },
+        { 100.2,  0 },
+        { 100.3,  1 },
+        { 101.5,  3 },
+        { 101.7,  3 },
+    };
+
+    for (const auto& c : cases) {
+        const auto doc = time_slice_query(samples, c.first);
+        one::slice_query query;
+        query.unpack(doc.data(), doc.data() + doc.size());
+        INFO("time = " << c.first);
+        CHECK(query.idx == c.second);
+    }
+
+    const auto doc = time_slice_query(samples, 100.0);
+    one::slice_query query;
+    query.unpack(doc.data(), doc.data() + doc.size());
+    CHECK_THAT(
+        one::sample_values(query.manifest),
+        Equals(std::vector< double > { 100.0, 100.5, 101.0, 101.5 })
+    );
+}
+
+TEST_CASE("time-slice query outside the cube fails") {
+    const auto samples = R"(,
+        "sample-interval": 4.0,
+        "sample-start": 0.0
+    )";
+
+    for (const auto time : { -2.5, 14.5, 100.0 }) {
+        const auto doc = time_slice_query(samples, time);
+        one::slice_query query;
+        INFO("time = " << time);
+        CHECK_THROWS_AS(
+            query.unpack(doc.data(), doc.data() + doc.size()),
+            one::not_found
+        );
+    }
+}
+
+TEST_CASE("sample interval defaults to the vertical line numbers in ms") {
+    const auto doc = time_slice_query("", 8.0);
+    one::slice_query query;
+    query.unpack(doc.data(), doc.data() + doc.size());
+    CHECK(query.manifest.sample_start    == 0);
+    CHECK(query.manifest.sample_interval == 4.0);
+    CHECK(query.idx == 2);
+    CHECK_THAT(
+        one::sample_values(query.manifest),
+        Equals(std::vector< double > { 0.0, 4.0, 8.0, 12.0 })
+    );
+}
+
+TEST_CASE("sub-volume ranges are resolved to cartesian coordinates") {
+    const auto query = [](const std::string& ranges) {
+        const auto doc = fmt::format(R"({{
+            "pid": "some-pid",
+            "token": "on-behalf-of-token",
+            "guid": "object-id",
+            "storage_endpoint": "https://storage.com",
+            "manifest": {{
+                "data": [],
+                "attributes": [],
+                "line-numbers": [[1, 3, 5, 7], [10, 11, 12], [0, 4, 8, 12]],
+                "line-labels": ["inline", "crossline", "time"],
+                "sample-interval": 4.0,
+                "sample-start": 0.0
+            }},
+            "shape": [64, 64, 64],
+            "function": "subvolume",
+            "args": {{ "ranges": {} }}
+        }})", ranges);
+        one::subvolume_query q;
+        q.unpack(doc.data(), doc.data() + doc.size());
+        return q;
+    };
+
+    SECTION("ranges are inclusive") {
+        const auto q = query("[[3, 5], [10, 12], [4, 8]]");
+        CHECK_THAT(q.lower, Equals(std::vector< int >{ 1, 0, 1 }));
+        CHECK_THAT(q.upper, Equals(std::vector< int >{ 3, 3, 3 }));
+    }
+
+    SECTION("ranges are clipped to the cube") {
+        const auto q = query("[[2, 100], [0, 10], [-10, 5]]");
+        CHECK_THAT(q.lower, Equals(std::vector< int >{ 1, 0, 0 }));
+        CHECK_THAT(q.upper, Equals(std::vector< int >{ 4, 1, 2 }));
+    }
+
+    SECTION("empty ranges fail") {
+        CHECK_THROWS_AS(
+            query("[[4, 4], [10, 12], [0, 12]]"),
+            one::not_found
+        );
+        CHECK_THROWS_AS(
+            query("[[1, 7], [10, 12], [13, 15]]"),
+            one::not_found
+        );
+    }
+
+    SECTION("malformed ranges fail") {
+        CHECK_THROWS_AS(query("[[1, 7], [10, 12]]"), one::bad_value);
+        CHECK_THROWS_AS(query("[[7, 1], [10, 12], [0, 4]]"), one::bad_value);
+        CHECK_THROWS_AS(query("[[1], [10, 12], [0, 4]]"), one::bad_value);
+    }
+}
+
+TEST_CASE("slice windows are resolved to cartesian coordinates") {
+    const auto query = [](const std::string& args) {
+        const auto doc = fmt::format(R"({{
+            "pid": "some-pid",
+            "token": "on-behalf-of-token",
+            "guid": "object-id",
+            "storage_endpoint": "https://storage.com",
+            "manifest": {{
+                "data": [],
+                "attributes": [],
+                "line-numbers": [[1, 3, 5, 7], [10, 11, 12], [0, 4, 8, 12]],
+                "line-labels": ["inline", "crossline", "time"],
+                "sample-interval": 4.0,
+                "sample-start": 0.0
+            }},
+            "shape": [64, 64, 64],
+            "function": "slice",
+            "args": {}
+        }})", args);
+        one::slice_query q;
+        q.unpack(doc.data(), doc.data() + doc.size());
+        return q;
+    };
+
+    SECTION("slices are not windowed by default") {
+        const auto q = query(R"({ "kind": "lineno", "dim": 0, "val": 3 })");
+        CHECK(q.lower.empty());
+        CHECK(q.upper.empty());
+    }
+
+    SECTION("the window is in the dimensions of the slice") {
+        const auto q = query(R"({
+            "kind": "lineno",
+            "dim": 1,
+            "val": 11,
+            "ranges": [[3, 7], [4, 6]]
+        })");
+        CHECK_THAT(q.lower, Equals(std::vector< int >{ 1, 1 }));
+        CHECK_THAT(q.upper, Equals(std::vector< int >{ 4, 2 }));
+
+        const auto task = one::slice_task(q);
+        CHECK_THAT(task.lower, Equals(q.lower));
+        CHECK_THAT(task.upper, Equals(q.upper));
+    }
+
+    SECTION("a window outside the cube fails") {
+        CHECK_THROWS_AS(
+            query(R"({
+                "kind": "index",
+                "dim": 2,
+                "val": 0,
+                "ranges": [[8, 9], [10, 12]]
+            })"),
+            one::not_found
+        );
+    }
+
+    SECTION("a window with the wrong number of ranges fails") {
+        CHECK_THROWS_AS(
+            query(R"({
+                "kind": "index",
+                "dim": 2,
+                "val": 0,
+                "ranges": [[1, 7]]
+            })"),
+            one::bad_value
+        );
+    }
+}
+
+TEST_CASE("attribute queries are resolved to the traces of a slice or curtain") {
+    const auto query = [](const std::string& args) {
+        const auto doc = fmt::format(R"({{
+            "pid": "some-pid",
+            "token": "on-behalf-of-token",
+            "guid": "object-id",
+            "storage_endpoint": "https://storage.com",
+            "manifest": {{
+                "data": [],
+                "attributes": [
+                    {{
+                        "prefix": "attributes/cdp",
+                        "file-extension": "f64",
+                        "type": "cdp",
+                        "layout": "tiled",
+                        "labels": ["cdpx", "cdpy"],
+                        "shapes": [[2, 2]]
+                    }}
+                ],
+                "line-numbers": [[1, 3, 5, 7], [10, 11, 12], [0, 4, 8, 12]],
+                "line-labels": ["inline", "crossline", "time"],
+                "sample-interval": 4.0,
+                "sample-start": 0.0
+            }},
+            "shape": [64, 64, 64],
+            "function": "attribute",
+            "args": {}
+        }})", args);
+        one::attribute_query q;
+        q.unpack(doc.data(), doc.data() + doc.size());
+        return q;
+    };
+
+    SECTION("all traces by default") {
+        const auto q = query(R"({ "kind": "cdp" })");
+        CHECK(q.dim == 2);
+        CHECK(q.attribute.prefix == "attributes/cdp");
+        CHECK_THAT(q.attribute.labels, Equals(std::vector< std::string > {
+            "cdpx", "cdpy"
+        }));
+    }
+
+    SECTION("lines are resolved to cartesian coordinates") {
+        const auto q = query(R"({ "kind": "cdp", "dim": 1, "lineno": 12 })");
+        CHECK(q.dim == 1);
+        CHECK(q.idx == 2);
+    }
+
+    SECTION("coords are resolved to cartesian coordinates") {
+        const auto q = query(R"({
+            "kind": "cdp",
+            "coords": [[3, 10], [7, 12]]
+        })");
+        CHECK(q.dim == -1);
+        CHECK_THAT(q.dim0s, Equals(std::vector< int >{ 1, 3 }));
+        CHECK_THAT(q.dim1s, Equals(std::vector< int >{ 0, 2 }));
+    }
+
+    SECTION("unknown attributes and lines fail") {
+        CHECK_THROWS_AS(query(R"({ "kind": "utm" })"), one::not_found);
+        CHECK_THROWS_AS(
+            query(R"({ "kind": "cdp", "dim": 0, "lineno": 2 })"),
+            one::not_found
+        );
+        CHECK_THROWS_AS(
+            query(R"({ "kind": "cdp", "coords": [[3, 13]] })"),
+            one::not_found
+        );
+        CHECK_THROWS_AS(
+            query(R"({ "kind": "cdp", "coords": [[3]] })"),
+            one::bad_value
+        );
+    }
+    SECTION("lineno is required with, and only with, a lateral dim") {
+        CHECK_THROWS_AS(
+            query(R"({ "kind": "cdp", "dim": 0 })"),
+            one::bad_value
+        );
+        CHECK_THROWS_AS(
+            query(R"({ "kind": "cdp", "lineno": 3 })"),
+            one::bad_value
+        );
+        CHECK_THROWS_AS(
+            query(R"({ "kind": "cdp", "dim": 2, "lineno": 4 })"),
+            one::bad_value
+        );
+    }
+}
+
+TEST_CASE("horizon values are resolved to the nearest sample") {
+    const auto query = [](const std::string& args) {
+        const auto doc = fmt::format(R"({{
+            "pid": "some-pid",
+            "token": "on-behalf-of-token",
+            "guid": "object-id",
+            "storage_endpoint": "https://storage.com",
+            "manifest": {{
+                "data": [],
+                "attributes": [],
+                "line-numbers": [[1, 3], [10, 11, 12], [0, 4, 8, 12]],
+                "line-labels": ["inline", "crossline", "time"],
+                "sample-interval": 4.0,
+                "sample-start": 0.0
+            }},
+            "shape": [64, 64, 64],
+            "function": "horizon",
+            "args": {}
+        }})", args);
+        one::horizon_query q;
+        q.unpack(doc.data(), doc.data() + doc.size());
+        return q;
+    };
+
+    SECTION("undefined points and points outside the cube are skipped") {
+        const auto q = query(R"({
+            "values": [[1.9, null, 12], [100, 5, -3]]
+        })");
+        CHECK_THAT(q.dim0s, Equals(std::vector< int >{ 0, 0, 1 }));
+        CHECK_THAT(q.dim1s, Equals(std::vector< int >{ 0, 2, 1 }));
+        CHECK_THAT(q.zs,    Equals(std::vector< int >{ 0, 3, 1 }));
+        CHECK(q.above == 0);
+        CHECK(q.below == 0);
+    }
+
+    SECTION("the window is rounded to samples") {
+        const auto q = query(R"({
+            "values": [[0, 0, 0], [0, 0, 0]],
+            "window": [4, 9]
+        })");
+        CHECK(q.above == 1);
+        CHECK(q.below == 2);
+    }
+
+    SECTION("malformed horizons fail") {
+        CHECK_THROWS_AS(query(R"({ "values": [[0, 0, 0]] })"), one::bad_value);
+        CHECK_THROWS_AS(
+            query(R"({ "values": [[0, 0, 0], [0, 0]] })"),
+            one::bad_value
+        );
+        CHECK_THROWS_AS(
+            query(R"({ "values": [[0, 0, 0], [0, 0, 0]], "window": [-4, 0] })"),
+            one::bad_value
+        );
+    }
+}
+
+TEST_CASE("horizon attributes must be known") {
+    const auto query = [](const std::string& attribute) {
+        const auto doc = fmt::format(R"({{
+            "pid": "some-pid",
+            "token": "on-behalf-of-token",
+            "guid": "object-id",
+            "storage_endpoint": "https://storage.com",
+            "manifest": {{
+                "data": [],
+                "attributes": [],
+                "line-numbers": [[1], [10], [0, 4, 8, 12]],
+                "line-labels": ["inline", "crossline", "time"],
+                "sample-interval": 4.0,
+                "sample-start": 0.0
+            }},
+            "shape": [64, 64, 64],
+            "function": "horizon-attribute",
+            "args": {{ "values": [[4]], "window": [4, 4], "attribute": "{}" }}
+        }})", attribute);
+        one::horizon_query q;
+        q.unpack(doc.data(), doc.data() + doc.size());
+        return q;
+    };
+
+    CHECK(query("rms").attribute == "rms");
+    CHECK(one::horizon_task(query("sum-of-magnitudes")).attribute
+        == "sum-of-magnitudes");
+    CHECK_THROWS_AS(query("median"), one::bad_value);
+}
+
+TEST_CASE("decimated slices are windowed to the whole slice") {
+    const auto query = [](const std::string& args) {
+        const auto doc = fmt::format(R"({{
+            "pid": "some-pid",
+            "token": "on-behalf-of-token",
+            "guid": "object-id",
+            "storage_endpoint": "https://storage.com",
+            "manifest": {{
+                "data": [],
+                "attributes": [],
+                "line-numbers": [[1, 3, 5, 7], [10, 11, 12], [0, 4, 8, 12]],
+                "line-labels": ["inline", "crossline", "time"],
+                "sample-interval": 4.0,
+                "sample-start": 0.0
+            }},
+            "shape": [64, 64, 64],
+            "function": "slice",
+            "args": {}
+        }})", args);
+        one::slice_query q;
+        q.unpack(doc.data(), doc.data() + doc.size());
+        return q;
+    };
+
+    SECTION("without ranges") {
+        const auto q = query(R"({
+            "kind": "index",
+            "dim": 1,
+            "val": 0,
+            "stride": [2, 3]
+        })");
+        CHECK_THAT(q.lower,  Equals(std::vector< int >{ 0, 0 }));
+        CHECK_THAT(q.upper,  Equals(std::vector< int >{ 4, 4 }));
+        CHECK_THAT(q.stride, Equals(std::vector< int >{ 2, 3 }));
+        CHECK_THAT(one::slice_task(q).stride, Equals(q.stride));
+    }
+
+    SECTION("with ranges") {
+        const auto q = query(R"({
+            "kind": "index",
+            "dim": 2,
+            "val": 0,
+            "ranges": [[3, 7], [10, 11]],
+            "stride": [2, 1]
+        })");
+        CHECK_THAT(q.lower, Equals(std::vector< int >{ 1, 0 }));
+        CHECK_THAT(q.upper, Equals(std::vector< int >{ 4, 2 }));
+    }
+
+    SECTION("bad strides fail") {
+        CHECK_THROWS_AS(
+            query(R"({ "kind": "index", "dim": 0, "val": 0, "stride": [0, 1] })"),
+            one::bad_value
+        );
+        CHECK_THROWS_AS(
+            query(R"({ "kind": "index", "dim": 0, "val": 0, "stride": [2] })"),
+            one::bad_value
+        );
+    }
+}
+
+TEST_CASE("queries are planned against the coarsest level of the resolution") {
+    const auto query = [](const std::string& function, const std::string& args) {
+        const auto doc = fmt::format(R"({{
+            "pid": "some-pid",
+            "token": "on-behalf-of-token",
+            "guid": "object-id",
+            "storage_endpoint": "https://storage.com",
+            "manifest": {{
+                "data": [
+                    {{
+                        "file-extension": "f32",
+                        "shapes": [[64, 64, 64]],
+                        "prefix": "src"
+                    }},
+                    {{
+                        "file-extension": "f32",
+                        "shapes": [[64, 64, 64]],
+                        "prefix": "src/lod1",
+                        "level": 1,
+                        "decimation": [2, 2, 2]
+                    }},
+                    {{
+                        "file-extension": "f32",
+                        "shapes": [[64, 64, 64]],
+                        "prefix": "src/lod2",
+                        "level": 2,
+                        "decimation": [4, 4, 4]
+                    }}
+                ],
+                "attributes": [],
+                "line-numbers": [[1, 3, 5, 7, 9], [10, 11, 12, 13], [0, 4, 8, 12]],
+                "line-labels": ["inline", "crossline", "time"],
+                "sample-interval": 4.0,
+                "sample-start": 0.0
+            }},
+            "shape": [64, 64, 64],
+            "function": "{}",
+            "args": {}
+        }})", function, args);
+        return doc;
+    };
+
+    SECTION("without a resolution, the source is read") {
+        const auto doc = query("slice", R"({
+            "kind": "lineno", "dim": 0, "val": 5
+        })");
+        one::slice_query q;
+        q.unpack(doc.data(), doc.data() + doc.size());
+        CHECK(q.level == 0);
+        CHECK(q.prefix == "src");
+        CHECK(q.idx == 2);
+    }
+
+    SECTION("the coarsest level that is fine enough is picked") {
+        const auto doc = query("subvolume", R"({
+            "ranges": [[1, 9], [10, 13], [0, 12]],
+            "resolution": [3, 2, 8]
+        })");
+        one::subvolume_query q;
+        q.unpack(doc.data(), doc.data() + doc.size());
+        CHECK(q.level == 1);
+        CHECK(q.prefix == "src/lod1");
+
+        const auto& lines = q.manifest.line_numbers;
+        CHECK_THAT(lines[0], Equals(std::vector< int >{ 1, 5, 9 }));
+        CHECK_THAT(lines[1], Equals(std::vector< int >{ 10, 12 }));
+        CHECK_THAT(lines[2], Equals(std::vector< int >{ 0, 8 }));
+        CHECK(q.manifest.sample_interval == 8.0);
+        CHECK_THAT(q.upper, Equals(std::vector< int >{ 3, 2, 2 }));
+
+        const auto task = one::subvolume_task(q);
+        CHECK(task.prefix == "src/lod1");
+        CHECK_THAT(task.shape_cube, Equals(std::vector< int >{ 3, 2, 2 }));
+    }
+
+    SECTION("slices are read from levels that have the line") {
+        const auto doc = query("slice", R"({
+            "kind": "lineno", "dim": 0, "val": 3, "resolution": [4, 4, 4]
+        })");
+        one::slice_query q;
+        q.unpack(doc.data(), doc.data() + doc.size());
+        CHECK(q.level == 0);
+        CHECK(q.idx == 1);
+
+        const auto coarse = query("slice", R"({
+            "kind": "lineno", "dim": 0, "val": 9, "resolution": [4, 4, 4]
+        })");
+        q.unpack(coarse.data(), coarse.data() + coarse.size());
+        CHECK(q.level == 2);
+        CHECK(q.idx == 1);
+    }
+
+    SECTION("malformed resolutions fail") {
+        const auto wrongsize = query("slice", R"({
+            "kind": "index", "dim": 0, "val": 0, "resolution": [2, 2]
+        })");
+        const auto negative = query("slice", R"({
+            "kind": "index", "dim": 0, "val": 0, "resolution": [2, 0, 2]
+        })");
+        one::slice_query q;
+        CHECK_THROWS_AS(
+            q.unpack(wrongsize.data(), wrongsize.data() + wrongsize.size()),
+            one::bad_value
+        );
+        CHECK_THROWS_AS(
+            q.unpack(negative.data(), negative.data() + negative.size()),
+            one::bad_value
+        );
+    }
+}
+
+TEST_CASE("process headers without function can be unpacked") {
+    const auto doc = std::string(R"({
+        "pid": "pid",
+        "ntasks": 1,
+        "shape": [2, 2],
+        "index": [[0, 1], [0, 1]]
+    })");
+
+    one::process_header head;
+    head.unpack(doc.data(), doc.data() + doc.size());
+    CHECK(head.pid == "pid");
+    CHECK(head.function == "");
+    CHECK(head.ntasks == 1);
+}
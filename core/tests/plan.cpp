@@ -0,0 +1,376 @@
+#include <string>
+#include <vector>
+
+#include <catch/catch.hpp>
+#include <nlohmann/json.hpp>
+
+#include <oneseismic/messages.hpp>
+#include <oneseismic/plan.hpp>
+
+using namespace Catch::Matchers;
+
+namespace {
+
+/*
+ * A manifest for a cube with linenos, 4ms apart, in fragments of shapes
+ */
+nlohmann::json manifest(
+        const std::vector< std::vector< int > >& linenos,
+        const std::vector< std::vector< int > >& shapes = { { 64, 64, 64 } }) {
+    return {
+        { "format-version", 1 },
+        { "data", {
+            {
+                { "file-extension", "f32" },
+                { "shapes",         shapes },
+                { "prefix",         "src" },
+                { "resolution",     "source" },
+            },
+        }},
+        { "attributes",      nlohmann::json::array() },
+        { "line-numbers",    linenos },
+        { "line-labels",     { "inline", "crossline", "time" } },
+        { "sample-interval", 4.0 },
+        { "sample-start",    0.0 },
+    };
+}
+
+/*
+ * The line numbers 0, 1, ..., n-1 of every dimension
+ */
+std::vector< std::vector< int > > survey(int n) {
+    std::vector< int > linenos;
+    for (int i = 0; i < n; ++i)
+        linenos.push_back(i);
+    return { linenos, linenos, linenos };
+}
+
+struct plan {
+    one::process_header header;
+    std::vector< nlohmann::json > tasks;
+};
+
+/*
+ * Schedule the query of function and args against the manifest, in tasks of
+ * (up to) 10 fragments
+ */
+plan mkplan(
+        const nlohmann::json& manifest,
+        const std::string& function,
+        const nlohmann::json& args) {
+    const nlohmann::json query = {
+        { "pid",              "some-pid" },
+        { "token",            "some-token" },
+        { "guid",             "some-guid" },
+        { "storage_endpoint", "https://storage.com" },
+        { "manifest",         manifest },
+        { "function",         function },
+        { "args",             args },
+    };
+    const auto doc = query.dump();
+    const auto sched = one::mkschedule(
+        doc.data(),
+        int(doc.size()),
+        one::task_sizing { 10, 0, 0 }
+    );
+
+    plan p;
+    const auto& head = sched.back();
+    p.header.unpack(head.data(), head.data() + head.size());
+    for (auto itr = sched.begin(); itr != sched.end() - 1; ++itr)
+        p.tasks.push_back(nlohmann::json::parse(*itr));
+    return p;
+}
+
+}
+
+TEST_CASE("time slices are indexed by the sample values") {
+    auto m = manifest({ { 1, 2 }, { 10, 11 }, { 0, 4 } });
+    m["sample-interval"] = 0.5;
+    m["sample-start"]    = 100.0;
+
+    const auto time = mkplan(m, "slice", {
+        { "kind", "time" },
+        { "dim",  2 },
+        { "val",  100.4 },
+    });
+    CHECK_THAT(time.header.index, Equals(std::vector< std::vector< double > > {
+        { 1, 2 },
+        { 10, 11 },
+    }));
+
+    const auto lineno = mkplan(m, "slice", {
+        { "kind", "lineno" },
+        { "dim",  0 },
+        { "val",  1 },
+    });
+    CHECK_THAT(lineno.header.index, Equals(std::vector< std::vector< double > > {
+        { 10, 11 },
+        { 100, 100.5 },
+    }));
+
+    CHECK_THROWS_AS(
+        mkplan(m, "slice", { { "kind", "time" }, { "dim", 2 }, { "val", 200 } }),
+        one::not_found
+    );
+}
+
+TEST_CASE("old manifests are indexed by the line numbers in milliseconds") {
+    /*
+     * Manifests written before sample-interval was added have the vertical
+     * line numbers in microseconds
+     */
+    auto m = manifest({ { 1, 2 }, { 10, 11 }, { 2000, 6000, 10000 } });
+    m.erase("sample-interval");
+    m.erase("sample-start");
+
+    const auto lineno = mkplan(m, "slice", {
+        { "kind", "lineno" },
+        { "dim",  0 },
+        { "val",  1 },
+    });
+    CHECK_THAT(lineno.header.index, Equals(std::vector< std::vector< double > > {
+        { 10, 11 },
+        { 2, 6, 10 },
+    }));
+
+    const auto time = mkplan(m, "slice", {
+        { "kind", "time" },
+        { "dim",  2 },
+        { "val",  6 },
+    });
+    CHECK_THAT(time.header.index, Equals(std::vector< std::vector< double > > {
+        { 1, 2 },
+        { 10, 11 },
+    }));
+
+    CHECK_THROWS_AS(
+        mkplan(m, "slice", { { "kind", "time" }, { "dim", 2 }, { "val", 6000 } }),
+        one::not_found
+    );
+}
+
+TEST_CASE("sub-volume header has the shape and index of the box") {
+    const auto m = manifest({ { 1, 2, 3 }, { 10, 11 }, { 0, 4, 8 } });
+    const auto p = mkplan(m, "subvolume", {
+        { "ranges", { { 2, 3 }, { 0, 100 }, { 3, 5 } } },
+    });
+
+    CHECK_THAT(p.header.shape, Equals(std::vector< int > { 2, 2, 1 }));
+    CHECK_THAT(p.header.index, Equals(std::vector< std::vector< double > > {
+        { 2, 3 },
+        { 10, 11 },
+        { 4 },
+    }));
+    CHECK(p.header.ntasks == 1);
+}
+
+TEST_CASE("windowed slices only fetch the intersecting fragments") {
+    const auto p = mkplan(manifest(survey(200)), "slice", {
+        { "kind",   "index" },
+        { "dim",    0 },
+        { "val",    0 },
+        { "ranges", { { 10, 12 }, { 400, 404 } } },
+    });
+
+    CHECK_THAT(p.header.shape, Equals(std::vector< int > { 3, 2 }));
+    CHECK_THAT(p.header.index, Equals(std::vector< std::vector< double > > {
+        { 10, 11, 12 },
+        { 400, 404 },
+    }));
+    REQUIRE(p.tasks.size() == 1);
+    const auto ids = p.tasks[0]["ids"].get< std::vector< std::vector< int > > >();
+    CHECK_THAT(ids, Equals(std::vector< std::vector< int > > { { 0, 0, 1 } }));
+}
+
+TEST_CASE("windowed curtains only fetch the fragments of the window") {
+    const auto p = mkplan(manifest(survey(200)), "curtain", {
+        { "coords",  { { 0, 0 }, { 1, 1 } } },
+        { "samples", { 8, 12 } },
+    });
+
+    CHECK_THAT(p.header.shape, Equals(std::vector< int > { 2, 2 }));
+    CHECK_THAT(p.header.index[2], Equals(std::vector< double > { 8, 12 }));
+    REQUIRE(p.tasks.size() == 1);
+    REQUIRE(p.tasks[0]["ids"].size() == 1);
+    const auto id = p.tasks[0]["ids"][0]["id"].get< std::vector< int > >();
+    CHECK_THAT(id, Equals(std::vector< int > { 0, 0, 0 }));
+}
+
+TEST_CASE("attribute header matches the traces of the query") {
+    auto m = manifest({ { 1, 2, 3 }, { 10, 11 }, { 0, 4, 8 } });
+    m["attributes"].push_back({
+        { "prefix",         "attributes/cdp" },
+        { "file-extension", "f64" },
+        { "type",           "cdp" },
+        { "layout",         "tiled" },
+        { "labels",         { "cdpx", "cdpy" } },
+        { "shapes",         { { 2, 2 } } },
+    });
+
+    SECTION("every trace") {
+        /*
+         * The 3x2 traces are in two 2x2 tiles, which fit in a single task
+         */
+        const auto p = mkplan(m, "attribute", { { "kind", "cdp" } });
+        CHECK_THAT(p.header.shape, Equals(std::vector< int > { 3, 2, 2 }));
+        CHECK_THAT(p.header.index, Equals(std::vector< std::vector< double > > {
+            { 1, 2, 3 },
+            { 10, 11 },
+        }));
+        CHECK(p.header.ntasks == 1);
+        CHECK(p.header.fragment_shape.empty());
+    }
+
+    SECTION("a line") {
+        const auto p = mkplan(m, "attribute", {
+            { "kind",   "cdp" },
+            { "dim",    0 },
+            { "lineno", 3 },
+        });
+        CHECK_THAT(p.header.shape, Equals(std::vector< int > { 2, 2 }));
+        CHECK_THAT(p.header.index, Equals(std::vector< std::vector< double > > {
+            { 10, 11 },
+        }));
+    }
+
+    SECTION("a list of traces") {
+        const auto p = mkplan(m, "attribute", {
+            { "kind",   "cdp" },
+            { "coords", { { 2, 11 }, { 3, 10 } } },
+        });
+        CHECK_THAT(p.header.shape, Equals(std::vector< int > { 2, 2 }));
+        CHECK_THAT(p.header.index, Equals(std::vector< std::vector< double > > {
+            { 1, 2 },
+            { 1, 0 },
+        }));
+    }
+
+    SECTION("a missing attribute") {
+        CHECK_THROWS_AS(
+            mkplan(m, "attribute", { { "kind", "utm" } }),
+            one::not_found
+        );
+    }
+}
+
+TEST_CASE("horizon header is a map with the window") {
+    const auto m = manifest({ { 1, 2 }, { 10, 11 }, { 0, 4, 8 } });
+    const auto p = mkplan(m, "horizon", {
+        { "values", { { 4.0, nullptr }, { 4.0, 4.0 } } },
+        { "window", { 4, 4 } },
+    });
+
+    CHECK_THAT(p.header.shape, Equals(std::vector< int > { 2, 2, 3 }));
+    CHECK_THAT(p.header.index, Equals(std::vector< std::vector< double > > {
+        { 1, 2 },
+        { 10, 11 },
+        { -4, 0, 4 },
+    }));
+    CHECK(p.header.ntasks == 1);
+}
+
+TEST_CASE("horizon attribute tasks have whole columns") {
+    /*
+     * With 2 samples per fragment, the window of every point needs the 3
+     * fragments in its column, which must not be split across tasks.
+     */
+    const auto m = manifest(
+        { { 1, 2, 3 }, { 10, 11 }, { 0, 4, 8, 12, 16, 20 } },
+        { { 1, 1, 2 } }
+    );
+    const auto p = mkplan(m, "horizon-attribute", {
+        { "values",    { { 8, 8 }, { 8, 8 }, { 8, 8 } } },
+        { "window",    { 8, 8 } },
+        { "attribute", "rms" },
+    });
+
+    CHECK_THAT(p.header.shape, Equals(std::vector< int > { 3, 2 }));
+    REQUIRE(p.tasks.size() == 2);
+    for (const auto& task : p.tasks)
+        CHECK(task["ids"].size() == 9);
+}
+
+TEST_CASE("decimated slices only fetch the fragments with kept samples") {
+    const auto p = mkplan(manifest(survey(200)), "slice", {
+        { "kind",   "index" },
+        { "dim",    2 },
+        { "val",    0 },
+        { "stride", { 100, 150 } },
+    });
+
+    CHECK_THAT(p.header.shape, Equals(std::vector< int > { 2, 2 }));
+    CHECK_THAT(p.header.index, Equals(std::vector< std::vector< double > > {
+        { 0, 100 },
+        { 0, 150 },
+    }));
+
+    /*
+     * Of the 4x4 fragments of the slice, only those with inline 0 or 100, and
+     * crossline 0 or 150 are needed.
+     */
+    REQUIRE(p.tasks.size() == 1);
+    const auto ids = p.tasks[0]["ids"].get< std::vector< std::vector< int > > >();
+    CHECK_THAT(ids, Equals(std::vector< std::vector< int > > {
+        { 0, 0, 0 },
+        { 0, 2, 0 },
+        { 1, 0, 0 },
+        { 1, 2, 0 },
+    }));
+}
+
+TEST_CASE("coarse slices are read from the pyramid") {
+    auto m = manifest({ { 1, 2, 3 }, { 10, 11, 12 }, { 0, 4, 8 } });
+    m["data"].push_back({
+        { "file-extension", "f32" },
+        { "shapes",         { { 64, 64, 64 } } },
+        { "prefix",         "src/lod1" },
+        { "resolution",     "lod1" },
+        { "level",          1 },
+        { "decimation",     { 2, 2, 2 } },
+    });
+
+    const auto p = mkplan(m, "slice", {
+        { "kind",       "lineno" },
+        { "dim",        0 },
+        { "val",        3 },
+        { "resolution", { 2, 2, 2 } },
+    });
+
+    CHECK(p.header.level == 1);
+    CHECK_THAT(p.header.shape, Equals(std::vector< int > { 2, 2 }));
+    CHECK_THAT(p.header.index, Equals(std::vector< std::vector< double > > {
+        { 10, 12 },
+        { 0, 8 },
+    }));
+    REQUIRE(p.tasks.size() == 1);
+    CHECK(p.tasks[0]["prefix"] == "src/lod1");
+}
+
+TEST_CASE("the planner picks the cheapest fragment shape") {
+    const auto m = manifest(survey(200), { { 64, 64, 64 }, { 1, 1, 200 } });
+
+    /*
+     * A time slice needs all 200x200 pencils, but only 16 cubes
+     */
+    const auto slice = mkplan(m, "slice", {
+        { "kind", "index" },
+        { "dim",  2 },
+        { "val",  10 },
+    });
+    CHECK_THAT(
+        slice.header.fragment_shape,
+        Equals(std::vector< int > { 64, 64, 64 })
+    );
+
+    /*
+     * A short curtain needs a handful of pencils, but whole cubes
+     */
+    const auto curtain = mkplan(m, "curtain", {
+        { "coords", { { 0, 0 }, { 1, 1 }, { 2, 2 } } },
+    });
+    CHECK_THAT(
+        curtain.header.fragment_shape,
+        Equals(std::vector< int > { 1, 1, 200 })
+    );
+}
@@ -1,3 +1,5 @@
+#include <cmath>
+
 #include <catch/catch.hpp>
 
 #include <oneseismic/geometry.hpp>
@@ -54,6 +56,15 @@ TEST_CASE("slice.fragments generates the right IDs from a task") {
         ;
         CHECK(slice->fragments() == expected);
     }
+    SECTION("In the volume of the level of detail") {
+        input.prefix = "src/lod1";
+        input.ids = {
+            { 0, 1, 2 },
+        };
+        const auto msg = input.pack();
+        slice->init(msg.data(), msg.size());
+        CHECK(slice->fragments() == "src/lod1/64-64-64/0-1-2.f32");
+    }
 }
 
 /*
@@ -154,6 +165,153 @@ TEST_CASE("slice.add is not sensitive to order") {
     CHECK_THAT(unpacked.tiles.at(1).v, Equals(expected[1]));
 }
 
+TEST_CASE("slice.add rejects malformed fragments") {
+    auto input = default_slice_task();
+    input.ids = {
+        { 0, 0, 0 },
+    };
+    input.shape      = { 2, 2, 2 };
+    input.shape_cube = { 2, 2, 2 };
+
+    const auto msg = input.pack();
+    auto slice = one::proc::make("slice");
+    slice->init(msg.data(), msg.size());
+
+    const auto chunk = std::vector< float >(2 * 2 * 2);
+    const auto* ptr  = reinterpret_cast< const char* >(chunk.data());
+    const auto  len  = int(chunk.size() * sizeof(float));
+
+    SECTION("when the key is out of range") {
+        CHECK_THROWS_AS(slice->add( 1, ptr, len), std::out_of_range);
+        CHECK_THROWS_AS(slice->add(-1, ptr, len), std::out_of_range);
+    }
+
+    SECTION("when the fragment is truncated") {
+        CHECK_THROWS_AS(slice->add(0, ptr, len - 1), std::invalid_argument);
+        CHECK_THROWS_AS(slice->add(0, ptr, 0),       std::invalid_argument);
+    }
+}
+
+/*
+ * A fragment of a 5x5x5 cube in 3x3x3 fragments where every sample is its own
+ * global offset
+ */
+std::vector< float > offset_fragment(const std::vector< int >& id) {
+    std::vector< float > chunk;
+    for (int i = 0; i < 3; ++i)
+    for (int j = 0; j < 3; ++j)
+    for (int k = 0; k < 3; ++k) {
+        const auto x = id[0] * 3 + i;
+        const auto y = id[1] * 3 + j;
+        const auto z = id[2] * 3 + k;
+        chunk.push_back(x * 25 + y * 5 + z);
+    }
+    return chunk;
+}
+
+TEST_CASE("Windowed slices are cropped to the window") {
+    auto input = default_slice_task();
+    input.dim = 0;
+    input.idx = 1;
+    input.shape      = { 3, 3, 3 };
+    input.shape_cube = { 5, 5, 5 };
+    input.lower = { 1, 2 };
+    input.upper = { 4, 4 };
+    input.ids = {
+        { 0, 0, 0 },
+        { 0, 1, 0 },
+        { 0, 0, 1 },
+        { 0, 1, 1 },
+    };
+
+    const auto msg = input.pack();
+    auto slice = one::proc::make("slice");
+    slice->init(msg.data(), msg.size());
+    for (int key = 0; key < int(input.ids.size()); ++key) {
+        const auto chunk = offset_fragment(input.ids[key]);
+        slice->add(key,
+            reinterpret_cast< const char* >(chunk.data()),
+            int(chunk.size() * sizeof(float))
+        );
+    }
+
+    const auto output = unpack< one::slice_tiles >(slice->pack());
+    CHECK_THAT(output.shape, Equals(std::vector< int >{ 3, 2 }));
+
+    std::vector< float > result(3 * 2, -1);
+    for (const auto& tile : output.tiles) {
+        auto dst = tile.initial_skip;
+        auto src = 0;
+        for (int i = 0; i < tile.iterations; ++i) {
+            std::copy_n(
+                tile.v.begin() + src,
+                tile.chunk_size,
+                result.begin() + dst
+            );
+            src += tile.substride;
+            dst += tile.superstride;
+        }
+    }
+
+    std::vector< float > expected;
+    for (int y = 1; y < 4; ++y)
+    for (int z = 2; z < 4; ++z)
+        expected.push_back(1 * 25 + y * 5 + z);
+    CHECK_THAT(result, Equals(expected));
+}
+
+TEST_CASE("Decimated slices keep every stride'th sample of the window") {
+    auto input = default_slice_task();
+    input.dim = 0;
+    input.idx = 1;
+    input.shape      = { 3, 3, 3 };
+    input.shape_cube = { 5, 5, 5 };
+    input.lower  = { 1, 0 };
+    input.upper  = { 5, 5 };
+    input.stride = { 2, 3 };
+    input.ids = {
+        { 0, 0, 0 },
+        { 0, 1, 0 },
+        { 0, 0, 1 },
+        { 0, 1, 1 },
+    };
+
+    const auto msg = input.pack();
+    auto slice = one::proc::make("slice");
+    slice->init(msg.data(), msg.size());
+    for (int key = 0; key < int(input.ids.size()); ++key) {
+        const auto chunk = offset_fragment(input.ids[key]);
+        slice->add(key,
+            reinterpret_cast< const char* >(chunk.data()),
+            int(chunk.size() * sizeof(float))
+        );
+    }
+
+    const auto output = unpack< one::slice_tiles >(slice->pack());
+    CHECK_THAT(output.shape, Equals(std::vector< int >{ 2, 2 }));
+
+    std::vector< float > result(2 * 2, -1);
+    for (const auto& tile : output.tiles) {
+        auto dst = tile.initial_skip;
+        auto src = 0;
+        for (int i = 0; i < tile.iterations; ++i) {
+            std::copy_n(
+                tile.v.begin() + src,
+                tile.chunk_size,
+                result.begin() + dst
+            );
+            src += tile.substride;
+            dst += tile.superstride;
+        }
+    }
+
+    std::vector< float > expected;
+    for (int y = 1; y < 5; y += 2)
+    for (int z = 0; z < 5; z += 3)
+        expected.push_back(1 * 25 + y * 5 + z);
+    CHECK_THAT(result, Equals(expected));
+}
+
 one::curtain_task default_curtain_task() {
     one::curtain_task input;
     input.pid   = "some-pid";
@@ -295,8 +453,300 @@ TEST_CASE("Curtains extracted from chunks matches hand-extracted curtain") {
     }
 }
 
+TEST_CASE("Windowed curtains are cropped to the window") {
+    auto input = default_curtain_task();
+    input.shape      = { 3, 3, 3 };
+    input.shape_cube = { 5, 5, 5 };
+    input.lower = { 2 };
+    input.upper = { 4 };
+    input.ids = {
+        one::single { { 0, 0, 0 }, { { 1, 1 } } },
+        one::single { { 0, 0, 1 }, { { 1, 1 } } },
+    };
+
+    const auto msg = input.pack();
+    auto curtain = one::proc::make("curtain");
+    curtain->init(msg.data(), msg.size());
+    for (int key = 0; key < int(input.ids.size()); ++key) {
+        const auto chunk = offset_fragment(input.ids[key].id);
+        curtain->add(key,
+            reinterpret_cast< const char* >(chunk.data()),
+            int(chunk.size() * sizeof(float))
+        );
+    }
+
+    const auto output = unpack< one::curtain_traces >(curtain->pack());
+    REQUIRE(output.traces.size() == 2);
+    const auto& top    = output.traces[0];
+    const auto& bottom = output.traces[1];
+    CHECK_THAT(top.coordinates,    Equals(std::vector< int >{ 1, 1, 0 }));
+    CHECK_THAT(top.v,              Equals(std::vector< float >{ 32 }));
+    CHECK_THAT(bottom.coordinates, Equals(std::vector< int >{ 1, 1, 1 }));
+    CHECK_THAT(bottom.v,           Equals(std::vector< float >{ 33 }));
+}
+
+TEST_CASE("curtain.add rejects truncated fragments") {
+    auto input = default_curtain_task();
+    input.shape      = { 2, 2, 2 };
+    input.shape_cube = { 2, 2, 2 };
+    input.ids = {
+        one::single {
+            { 0, 0, 0 },
+            { { 0, 0 } },
+        },
+    };
+
+    const auto msg = input.pack();
+    auto curtain = one::proc::make("curtain");
+    curtain->init(msg.data(), msg.size());
+
+    const auto chunk = std::vector< float >(2);
+    const auto* ptr  = reinterpret_cast< const char* >(chunk.data());
+    const auto  len  = int(chunk.size() * sizeof(float));
+    CHECK_THROWS_AS(curtain->add(0, ptr, len), std::invalid_argument);
+    CHECK_THROWS_AS(curtain->add(1, ptr, len), std::out_of_range);
+}
+
+TEST_CASE("Sub-volume assembled from blocks matches the cube") {
+    /*
+     * A 5x5x5 cube in 3x3x3 fragments where every sample is its own global
+     * offset, so the expected sub-volume is easy to compute.
+     */
+    one::subvolume_task input;
+    input.pid   = "some-pid";
+    input.token = "some-token";
+    input.guid  = "some-guid";
+    input.storage_endpoint = "some-endpoint";
+    input.function   = "subvolume";
+    input.shape      = { 3, 3, 3 };
+    input.shape_cube = { 5, 5, 5 };
+    input.lower = { 1, 2, 1 };
+    input.upper = { 4, 5, 3 };
+    for (int i = 0; i < 2; ++i)
+    for (int j = 0; j < 2; ++j)
+        input.ids.push_back({ i, j, 0 });
+
+    const auto msg = input.pack();
+    auto subvolume = one::proc::make("subvolume");
+    subvolume->init(msg.data(), msg.size());
+    CHECK_THAT(subvolume->fragments(), Contains("src/3-3-3/1-1-0.f32"));
+
+    for (int key = 0; key < int(input.ids.size()); ++key) {
+        const auto& id = input.ids[key];
+        std::vector< float > chunk;
+        for (int i = 0; i < 3; ++i)
+        for (int j = 0; j < 3; ++j)
+        for (int k = 0; k < 3; ++k) {
+            const auto x = id[0] * 3 + i;
+            const auto y = id[1] * 3 + j;
+            const auto z = id[2] * 3 + k;
+            chunk.push_back(x * 25 + y * 5 + z);
+        }
+        subvolume->add(key,
+            reinterpret_cast< const char* >(chunk.data()),
+            int(chunk.size() * sizeof(float))
+        );
+    }
+
+    const auto output = unpack< one::subvolume_blocks >(subvolume->pack());
+    REQUIRE(output.blocks.size() == 4);
+
+    const int shape[] = { 3, 3, 2 };
+    std::vector< float > result(3 * 3 * 2, -1);
+    for (const auto& block : output.blocks) {
+        const auto& o = block.offset;
+        const auto& s = block.shape;
+        REQUIRE(int(block.v.size()) == s[0] * s[1] * s[2]);
+        auto v = block.v.begin();
+        for (int i = 0; i < s[0]; ++i)
+        for (int j = 0; j < s[1]; ++j)
+        for (int k = 0; k < s[2]; ++k) {
+            const auto x = o[0] + i;
+            const auto y = o[1] + j;
+            const auto z = o[2] + k;
+            result[x * shape[1] * shape[2] + y * shape[2] + z] = *v++;
+        }
+    }
+
+    std::vector< float > expected;
+    for (int x = 1; x < 4; ++x)
+    for (int y = 2; y < 5; ++y)
+    for (int z = 1; z < 3; ++z)
+        expected.push_back(x * 25 + y * 5 + z);
+    CHECK_THAT(result, Equals(expected));
+}
+
+TEST_CASE("Horizons are sampled in a window across fragments") {
+    one::horizon_task input;
+    input.pid   = "some-pid";
+    input.token = "some-token";
+    input.guid  = "some-guid";
+    input.storage_endpoint = "some-endpoint";
+    input.function   = "horizon";
+    input.shape      = { 3, 3, 3 };
+    input.shape_cube = { 5, 5, 5 };
+    input.above = 1;
+    input.below = 1;
+    input.ids = {
+        one::horizon_points { { 0, 0, 0 }, { { 1, 1, 2 } } },
+        one::horizon_points { { 0, 0, 1 }, { { 1, 1, 2 } } },
+        one::horizon_points { { 1, 1, 1 }, { { 0, 1, 4 } } },
+    };
+
+    const auto msg = input.pack();
+    auto horizon = one::proc::make("horizon");
+    horizon->init(msg.data(), msg.size());
+    CHECK_THAT(horizon->fragments(), Contains("src/3-3-3/1-1-1.f32"));
+    for (int key = 0; key < int(input.ids.size()); ++key) {
+        const auto chunk = offset_fragment(input.ids[key].id);
+        horizon->add(key,
+            reinterpret_cast< const char* >(chunk.data()),
+            int(chunk.size() * sizeof(float))
+        );
+    }
+
+    /*
+     * The window of the first point is split across two fragments, and the
+     * window of the last point is clipped to the bottom of the cube.
+     */
+    const auto output = unpack< one::horizon_values >(horizon->pack());
+    REQUIRE(output.traces.size() == 3);
+    CHECK_THAT(output.traces[0].coordinates, Equals(std::vector< int >{ 1, 1, 0 }));
+    CHECK_THAT(output.traces[0].v, Equals(std::vector< float >{ 31, 32 }));
+    CHECK_THAT(output.traces[1].coordinates, Equals(std::vector< int >{ 1, 1, 2 }));
+    CHECK_THAT(output.traces[1].v, Equals(std::vector< float >{ 33 }));
+    CHECK_THAT(output.traces[2].coordinates, Equals(std::vector< int >{ 3, 4, 0 }));
+    CHECK_THAT(output.traces[2].v, Equals(std::vector< float >{ 98, 99 }));
+}
+
+TEST_CASE("Horizon attributes are computed from the whole window") {
+    one::horizon_task input;
+    input.pid   = "some-pid";
+    input.token = "some-token";
+    input.guid  = "some-guid";
+    input.storage_endpoint = "some-endpoint";
+    input.function   = "horizon-attribute";
+    input.shape      = { 3, 3, 3 };
+    input.shape_cube = { 5, 5, 5 };
+    input.above = 1;
+    input.below = 1;
+    input.ids = {
+        one::horizon_points { { 0, 0, 0 }, { { 1, 1, 2 } } },
+        one::horizon_points { { 0, 0, 1 }, { { 1, 1, 2 } } },
+        one::horizon_points { { 1, 1, 1 }, { { 0, 1, 4 } } },
+    };
+
+    /*
+     * The window of (1, 1) is { 31, 32, 33 } across two fragments, and the
+     * window of (3, 4) is { 98, 99 }, clipped to the bottom of the cube.
+     */
+    const auto rms0 = float(std::sqrt((31.0 * 31 + 32 * 32 + 33 * 33) / 3));
+    const auto rms1 = float(std::sqrt((98.0 * 98 + 99 * 99) / 2));
+    const std::vector< std::pair< std::string, std::vector< float > > > cases {
+        { "mean",              { 32,  98.5 } },
+        { "min",               { 31,  98   } },
+        { "max",               { 33,  99   } },
+        { "sum-of-magnitudes", { 96,  197  } },
+        { "rms",               { rms0, rms1 } },
+    };
+
+    for (const auto& c : cases) {
+        input.attribute = c.first;
+        const auto msg = input.pack();
+        auto horizon = one::proc::make("horizon-attribute");
+        horizon->init(msg.data(), msg.size());
+        for (int key = 0; key < int(input.ids.size()); ++key) {
+            const auto chunk = offset_fragment(input.ids[key].id);
+            horizon->add(key,
+                reinterpret_cast< const char* >(chunk.data()),
+                int(chunk.size() * sizeof(float))
+            );
+        }
+
+        INFO("attribute is " << c.first);
+        const auto output = unpack< one::horizon_attributes >(horizon->pack());
+        REQUIRE(output.traces.size() == 2);
+        CHECK_THAT(output.traces[0].coordinates, Equals(std::vector< int >{ 1, 1 }));
+        CHECK_THAT(output.traces[1].coordinates, Equals(std::vector< int >{ 3, 4 }));
+        CHECK(output.traces[0].v.at(0) == Catch::Detail::Approx(c.second[0]));
+        CHECK(output.traces[1].v.at(0) == Catch::Detail::Approx(c.second[1]));
+    }
+}
+
+TEST_CASE("Attributes are extracted from tiles") {
+    /*
+     * A 3x3 survey in 2x2 tiles of (x, y), where the attribute of a trace is
+     * (10 * i, j)
+     */
+    one::attribute_task input;
+    input.pid   = "some-pid";
+    input.token = "some-token";
+    input.guid  = "some-guid";
+    input.storage_endpoint = "some-endpoint";
+    input.function   = "attribute";
+    input.shape      = { 64, 64, 64 };
+    input.shape_cube = { 3, 3, 64 };
+    input.attribute.prefix = "attributes/cdp";
+    input.attribute.ext    = "f64";
+    input.attribute.type   = "cdp";
+    input.attribute.layout = "tiled";
+    input.attribute.labels = { "cdpx", "cdpy" };
+    input.attribute.shapes = { { 2, 2 } };
+    input.ids = {
+        one::single { { 0, 1 }, { { 1, 0 } } },
+        one::single { { 1, 0 }, { { 0, 0 }, { 0, 1 } } },
+    };
+
+    const auto msg = input.pack();
+    auto attribute = one::proc::make("attribute");
+    attribute->init(msg.data(), msg.size());
+    const auto expected =
+        "attributes/cdp/2-2/0-1.f64" ";"
+        "attributes/cdp/2-2/1-0.f64"
+    ;
+    CHECK(attribute->fragments() == expected);
+
+    for (int key = 0; key < int(input.ids.size()); ++key) {
+        const auto& id = input.ids[key].id;
+        std::vector< double > tile;
+        for (int i = 0; i < 2; ++i)
+        for (int j = 0; j < 2; ++j) {
+            tile.push_back(10 * (id[0] * 2 + i));
+            tile.push_back(id[1] * 2 + j);
+        }
+        attribute->add(key,
+            reinterpret_cast< const char* >(tile.data()),
+            int(tile.size() * sizeof(double))
+        );
+    }
+
+    const auto output = unpack< one::attribute_values >(attribute->pack());
+    REQUIRE(output.traces.size() == 3);
+    CHECK_THAT(output.traces[0].coordinates, Equals(std::vector< int >{ 1, 2 }));
+    CHECK_THAT(output.traces[0].v, Equals(std::vector< double >{ 10, 2 }));
+    CHECK_THAT(output.traces[1].coordinates, Equals(std::vector< int >{ 2, 0 }));
+    CHECK_THAT(output.traces[1].v, Equals(std::vector< double >{ 20, 0 }));
+    CHECK_THAT(output.traces[2].coordinates, Equals(std::vector< int >{ 2, 1 }));
+    CHECK_THAT(output.traces[2].v, Equals(std::vector< double >{ 20, 1 }));
+
+    SECTION("truncated tiles are rejected") {
+        std::vector< double > tile(7);
+        CHECK_THROWS_AS(
+            attribute->add(0,
+                reinterpret_cast< const char* >(tile.data()),
+                int(tile.size() * sizeof(double))
+            ),
+            std::invalid_argument
+        );
+    }
+}
+
 TEST_CASE("All process kinds can be constructed") {
     CHECK( one::proc::make("slice"));
     CHECK( one::proc::make("curtain"));
+    CHECK( one::proc::make("subvolume"));
+    CHECK( one::proc::make("horizon"));
+    CHECK( one::proc::make("horizon-attribute"));
+    CHECK( one::proc::make("attribute"));
     CHECK(!one::proc::make("unknown"));
 }
@@ -82,7 +82,8 @@ class assembler_slice(assembler):
         return result.reshape((dims0, dims1))
 
     def xarray(self, unpacked):
-        index = unpacked[0]['index']
+        header = unpacked[0]
+        index = header['index']
         a = self.numpy(unpacked)
         # TODO: add units for time/depth
         return xarray.DataArray(
@@ -90,6 +91,7 @@ class assembler_slice(assembler):
             dims   = self.dims,
             name   = self.name,
             coords = index,
+            attrs  = { 'level': header.get('level', 0) },
         )
 
 class assembler_curtain(assembler):
@@ -147,6 +149,236 @@ class assembler_curtain(assembler):
 
         return da
 
+class assembler_coordinates(assembler_curtain):
+    """Assembler for curtains by world coordinates
+
+    The curtain is assembled from the traces in the index, and every point of
+    the curtain is the weighted sum of the traces given by the header.
+    """
+    kind = 'curtain-by-coordinates'
+
+    def numpy(self, unpacked):
+        header = unpacked[0]
+        traces = super().numpy(unpacked)
+
+        xs = np.zeros((len(header['traces']), traces.shape[1]), dtype = np.single)
+        for point, (ts, ws) in enumerate(zip(header['traces'], header['weights'])):
+            for trace, weight in zip(ts, ws):
+                xs[point] += weight * traces[trace]
+        return xs
+
+    def xarray(self, unpacked):
+        header = unpacked[0]
+        a = self.numpy(unpacked)
+        positions = header['positions']
+        return xarray.DataArray(
+            data = a,
+            name = 'curtain',
+            dims = ['point', 'z'],
+            coords = {
+                'x': ('point', [x for x, _ in positions]),
+                'y': ('point', [y for _, y in positions]),
+                'z': header['index'][2],
+            }
+        )
+
+class assembler_subvolume(assembler):
+    kind = 'subvolume'
+
+    def numpy(self, unpacked):
+        header = unpacked[0]
+        xs = np.zeros(shape = header['shape'], dtype = np.single)
+
+        for bundle in unpacked[1]:
+            for block in bundle['blocks']:
+                (x, y, z), shape = block['offset'], block['shape']
+                v = np.asarray(block['v'], dtype = np.single).reshape(shape)
+                dx, dy, dz = shape
+                xs[x:x+dx, y:y+dy, z:z+dz] = v
+
+        return xs
+
+    def xarray(self, unpacked):
+        header = unpacked[0]
+        index = header['index']
+        a = self.numpy(unpacked)
+        # TODO: derive labels from query, header, or manifest
+        return xarray.DataArray(
+            data   = a,
+            dims   = ['inline', 'crossline', 'time'],
+            name   = 'subvolume',
+            coords = index,
+            attrs  = { 'level': header.get('level', 0) },
+        )
+
+class assembler_horizon(assembler):
+    """Assembler for horizons
+
+    The horizon is a map of the survey, with the window around the horizon as
+    the last dimension. Traces where the horizon is not defined, or the parts
+    of the window outside the cube, are nan.
+    """
+    kind = 'horizon'
+
+    def numpy(self, unpacked):
+        header = unpacked[0]
+        xs = np.full(header['shape'], np.nan, dtype = np.single)
+
+        for bundle in unpacked[1]:
+            for trace in bundle['traces']:
+                x, y, z = trace['coordinates']
+                v = trace['v']
+                xs[x, y, z:z+len(v)] = v
+
+        return xs
+
+    def xarray(self, unpacked):
+        index = unpacked[0]['index']
+        a = self.numpy(unpacked)
+        return xarray.DataArray(
+            data   = a,
+            dims   = ['inline', 'crossline', 'offset'],
+            name   = 'horizon',
+            coords = index,
+        )
+
+class assembler_horizon_attribute(assembler):
+    """Assembler for horizon attributes
+
+    The horizon attribute is a map of the survey. Traces where the horizon is
+    not defined are nan.
+    """
+    kind = 'horizon-attribute'
+
+    def __init__(self, sourcecube, attribute):
+        super().__init__(sourcecube)
+        self.attribute = attribute
+
+    def numpy(self, unpacked):
+        header = unpacked[0]
+        xs = np.full(header['shape'], np.nan, dtype = np.single)
+
+        for bundle in unpacked[1]:
+            for trace in bundle['traces']:
+                x, y = trace['coordinates']
+                xs[x, y] = trace['v'][0]
+
+        return xs
+
+    def xarray(self, unpacked):
+        index = unpacked[0]['index']
+        a = self.numpy(unpacked)
+        return xarray.DataArray(
+            data   = a,
+            dims   = ['inline', 'crossline'],
+            name   = self.attribute,
+            coords = index,
+        )
+
+class assembler_attribute(assembler):
+    """Assembler for attributes
+
+    The attribute is assembled to the traces of the slice or curtain it was
+    queried for, with the labels of the attribute as the last dimension.
+    """
+    kind = 'attribute'
+
+    def __init__(self, sourcecube, attribute, dim = None):
+        super().__init__(sourcecube)
+        self.attribute = attribute
+        self.dim = dim
+
+    def numpy(self, unpacked):
+        header = unpacked[0]
+        shape = header['shape']
+        index = header['index']
+        xs = np.zeros(shape = shape, dtype = np.double)
+
+        if len(shape) == 3:
+            def position(x, y): return (x, y)
+        elif len(index) == 2:
+            xyindex = {
+                (x, y): i for i, (x, y) in enumerate(zip(index[0], index[1]))
+            }
+            def position(x, y): return xyindex[(x, y)]
+        else:
+            dim = self.dim
+            def position(x, y): return y if dim == 0 else x
+
+        for bundle in unpacked[1]:
+            for trace in bundle['traces']:
+                x, y = trace['coordinates']
+                xs[position(x, y)] = trace['v']
+
+        return xs
+
+    def xarray(self, unpacked):
+        header = unpacked[0]
+        index = header['index']
+        a = self.numpy(unpacked)
+        ijk = self.sourcecube.ijk
+
+        if len(header['shape']) == 3:
+            dims = ['inline', 'crossline', 'label']
+            coords = { 'inline': index[0], 'crossline': index[1] }
+        elif len(index) == 2:
+            dims = ['xy', 'label']
+            coords = {
+                'x': ('xy', [ijk[0][x] for x in index[0]]),
+                'y': ('xy', [ijk[1][y] for y in index[1]]),
+            }
+        else:
+            label = ['crossline', 'inline'][self.dim]
+            dims = [label, 'label']
+            coords = { label: index[0] }
+
+        return xarray.DataArray(
+            data   = a,
+            dims   = dims,
+            name   = self.attribute,
+            coords = coords,
+        )
+
+def horizonargs(values, window):
+    """Render the values and optional window arguments of a horizon query
+
+    The values are as large as the survey, so they are passed as the $values
+    variable, and not written into the query text. The variable definition
+    and variables are returned together with the arguments.
+    """
+    values = np.asarray(values, dtype = np.double)
+    rows = [
+        [None if np.isnan(x) else float(x) for x in row]
+        for row in values
+    ]
+    arguments = 'values: $values'
+    if window is not None:
+        above, below = window
+        arguments += f', window: {[float(above), float(below)]}'
+    return arguments, '($values: [[Float]!]!)', { 'values': rows }
+
+def window(ranges):
+    """Render the optional ranges argument of a slice query
+    """
+    if ranges is None:
+        return ''
+    ranges = [[float(first), float(last)] for first, last in ranges]
+    return f', ranges: {ranges}'
+
+def decimate(stride):
+    """Render the optional stride argument of a slice query
+    """
+    if stride is None:
+        return ''
+    return f', stride: {[int(x) for x in stride]}'
+
+def lod(resolution):
+    """Render the optional resolution argument of a slice or sub-volume query
+    """
+    if resolution is None:
+        return ''
+    return f', resolution: {[int(x) for x in resolution]}'
+
 class cube:
     """ Cube handle
 
@@ -201,7 +433,7 @@ class cube:
         self._ijk = res['cube']['linenumbers']
         return self._ijk
 
-    def slice(self, dim, lineno):
+    def slice(self, dim, lineno, ranges = None, stride = None, resolution = None):
         """ Fetch a slice
 
         Parameters
@@ -213,6 +445,19 @@ class cube:
             The line number we would like to fetch. This corresponds to the
             axis labels given in the dim<n> members. In order to fetch the nth
             surface allong the mth dimension use lineno = dim<m>[n].
+        ranges : list of (first, last), optional
+            Only fetch the window of the slice given by the inclusive range of
+            every dimension except dim, as line numbers for inline and
+            crossline, and time (or depth) for the vertical axis.
+        stride : list of int, optional
+            Only fetch every stride'th sample of every dimension except dim,
+            starting at the first sample of the window.
+        resolution : list of int, optional
+            The coarsest acceptable resolution, as the number of lines (or
+            samples) of the cube per line (or sample) of the slice, for every
+            dimension. The slice is read from the coarsest pre-computed level
+            of detail within the resolution, and the level is in the level
+            attribute of the result.
 
         Returns
         -------
@@ -223,7 +468,7 @@ class cube:
         query = f'''
         query {{
             cube(id: "{self.guid}") {{
-                sliceByLineno(dim: {dim}, lineno: {lineno}) {{
+                sliceByLineno(dim: {dim}, lineno: {lineno}{window(ranges)}{decimate(stride)}{lod(resolution)}) {{
                     url
                     key
                 }}
@@ -242,12 +487,62 @@ class cube:
         proc.assembler = assembler_slice(self, dimlabels = labels, name = name)
         return proc
 
-    def curtain(self, intersections):
+    def timeslice(self, time, ranges = None, stride = None, resolution = None):
+        """ Fetch a time (or depth) slice
+
+        Parameters
+        ----------
+
+        time : float
+            The time in milliseconds (or depth) of the slice. The slice is
+            taken at the sample nearest to time.
+        ranges : list of (first, last), optional
+            Only fetch the window of the slice given by the inclusive inline
+            and crossline ranges.
+        stride : list of int, optional
+            Only fetch every stride'th inline and crossline, starting at the
+            first line of the window.
+        resolution : list of int, optional
+            The coarsest acceptable resolution, see slice()
+
+        Returns
+        -------
+
+        slice : numpy.ndarray
+        """
+
+        query = f'''
+        query {{
+            cube(id: "{self.guid}") {{
+                sliceByTime(time: {time}{window(ranges)}{decimate(stride)}{lod(resolution)}) {{
+                    url
+                    key
+                }}
+            }}
+        }}
+        '''
+
+        proc = gschedule(
+            self.gclient,
+            self.session.base_url,
+            query,
+        )
+        labels = ['inline', 'crossline']
+        name = f'time {time}'
+        proc.assembler = assembler_slice(self, dimlabels = labels, name = name)
+        return proc
+
+    def curtain(self, intersections, samples = None):
         """Fetch a curtain
 
         Parameters
         ----------
 
+        intersections : list of (inline, crossline)
+            The traces of the curtain
+        samples : (first, last), optional
+            Only fetch the inclusive range of time (or depth) of the traces
+
         Returns
         -------
         curtain : numpy.ndarray
@@ -258,10 +553,14 @@ class cube:
         # list-of-list-of-ints. Simple enough for this demo, but this should be
         # significantly different with a new gql (the python library) version
         # and more a more sophisticated schema.
+        samplewindow = ''
+        if samples is not None:
+            first, last = samples
+            samplewindow = f', samples: {[float(first), float(last)]}'
         query = f'''
         query {{
             cube(id: "{self.guid}") {{
-                curtain(coords: {intersections}) {{
+                curtain(coords: {intersections}{samplewindow}) {{
                     url
                     key
                 }}
@@ -276,6 +575,304 @@ class cube:
         proc.assembler = assembler_curtain(self)
         return proc
 
+    def curtain_by_coordinates(
+        self,
+        points,
+        interpolation = 'nearest',
+        samples = None,
+    ):
+        """Fetch a curtain through points in world coordinates
+
+        Parameters
+        ----------
+
+        points : list of (x, y)
+            The points of the curtain, in the world (UTM or CDP) coordinates
+            of the survey
+        interpolation : { 'nearest', 'linear' }
+            Use the trace nearest to every point, or interpolate (bilinear)
+            from the surrounding traces
+        samples : (first, last), optional
+            Only fetch the inclusive range of time (or depth) of the traces
+
+        Returns
+        -------
+        curtain : numpy.ndarray
+
+        Notes
+        -----
+        The positions of the traces actually used, which for nearest is not
+        quite the points, are the x and y coordinates of the xarray.
+        """
+        points = [[float(x), float(y)] for x, y in points]
+        samplewindow = ''
+        if samples is not None:
+            first, last = samples
+            samplewindow = f', samples: {[float(first), float(last)]}'
+        query = f'''
+        query {{
+            cube(id: "{self.guid}") {{
+                curtainByCoordinates(
+                    points: {points},
+                    interpolation: "{interpolation}"{samplewindow}
+                ) {{
+                    url
+                    key
+                }}
+            }}
+        }}
+        '''
+        proc = gschedule(
+            self.gclient,
+            self.session.base_url,
+            query,
+        )
+        proc.assembler = assembler_coordinates(self)
+        return proc
+
+    def curtain_along_polyline(self, vertices, spacing = None, samples = None):
+        """Fetch a curtain along a polyline
+
+        Parameters
+        ----------
+
+        vertices : list of (inline, crossline)
+            The vertices of the polyline, as line numbers
+        spacing : float, optional
+            The distance, in traces, between the traces of the curtain, at
+            least 1. By default every trace the polyline crosses is in the
+            curtain
+        samples : (first, last), optional
+            Only fetch the inclusive range of time (or depth) of the traces
+
+        Returns
+        -------
+        curtain : numpy.ndarray
+
+        Notes
+        -----
+        The traces are densified along the polyline by the server, and a
+        trace is only in the curtain once, even if the polyline crosses
+        itself. Polylines that are longer than the survey has traces are
+        rejected.
+        """
+        vertices = [[int(i), int(j)] for i, j in vertices]
+        arguments = f'vertices: {vertices}'
+        if spacing is not None:
+            arguments += f', spacing: {float(spacing)}'
+        if samples is not None:
+            first, last = samples
+            arguments += f', samples: {[float(first), float(last)]}'
+        query = f'''
+        query {{
+            cube(id: "{self.guid}") {{
+                curtainAlongPolyline({arguments}) {{
+                    url
+                    key
+                }}
+            }}
+        }}
+        '''
+        proc = gschedule(
+            self.gclient,
+            self.session.base_url,
+            query,
+        )
+        proc.assembler = assembler_curtain(self)
+        return proc
+
+    def horizon(self, values, window = None):
+        """Fetch the amplitudes along a horizon
+
+        Parameters
+        ----------
+
+        values : array_like of float
+            The time (or depth) of the horizon at every trace, as an inline by
+            crossline grid. Traces where the horizon is nan are not sampled.
+        window : (above, below), optional
+            Sample the window of time (or depth) around the horizon. By
+            default only the sample nearest the horizon is fetched.
+
+        Returns
+        -------
+        horizon : numpy.ndarray
+            The amplitudes of shape (inlines, crosslines, window)
+        """
+        arguments, definitions, variables = horizonargs(values, window)
+
+        query = f'''
+        query{definitions} {{
+            cube(id: "{self.guid}") {{
+                horizon({arguments}) {{
+                    url
+                    key
+                }}
+            }}
+        }}
+        '''
+        proc = gschedule(
+            self.gclient,
+            self.session.base_url,
+            query,
+            variables,
+        )
+        proc.assembler = assembler_horizon(self)
+        return proc
+
+    def horizon_attribute(self, values, attribute, window = None):
+        """Compute an attribute along a horizon
+
+        Parameters
+        ----------
+
+        values : array_like of float
+            The time (or depth) of the horizon at every trace, as an inline by
+            crossline grid. Traces where the horizon is nan are not sampled.
+        attribute : { 'rms', 'mean', 'min', 'max', 'sum-of-magnitudes' }
+            The attribute of the window around every point of the horizon
+        window : (above, below), optional
+            The window of time (or depth) around the horizon. By default only
+            the sample nearest the horizon is used.
+
+        Returns
+        -------
+        attribute : numpy.ndarray
+            The attribute of shape (inlines, crosslines)
+        """
+        arguments, definitions, variables = horizonargs(values, window)
+        arguments += f', attribute: "{attribute}"'
+
+        query = f'''
+        query{definitions} {{
+            cube(id: "{self.guid}") {{
+                horizonAttribute({arguments}) {{
+                    url
+                    key
+                }}
+            }}
+        }}
+        '''
+        proc = gschedule(
+            self.gclient,
+            self.session.base_url,
+            query,
+            variables,
+        )
+        proc.assembler = assembler_horizon_attribute(self, attribute)
+        return proc
+
+    @property
+    def attributes(self):
+        """The attributes of the cube
+
+        Returns
+        -------
+        attributes : list of dict
+            The type, labels, and layout of every attribute of the cube
+        """
+        query = f'''
+        {{
+            cube(id: "{self.guid}") {{
+                attributes {{
+                    type
+                    labels
+                    layout
+                }}
+            }}
+        }}
+        '''
+        res = self.gclient.execute(gql.gql(query))
+        return res['cube']['attributes']
+
+    def attribute(self, kind, dim = None, lineno = None, intersections = None):
+        """Fetch an attribute
+
+        Fetch the attribute, e.g. cdp or utm coordinates, of the traces of a
+        slice or curtain.
+
+        Parameters
+        ----------
+
+        kind : str
+            The type of the attribute, as listed by attributes
+        dim : int, optional
+            With lineno, the attribute of the traces of an inline (0) or
+            crossline (1)
+        lineno : int, optional
+        intersections : list of (inline, crossline), optional
+            The attribute of the traces of a curtain
+
+        Returns
+        -------
+        attribute : numpy.ndarray
+            The attribute, with the labels as the last dimension. By default
+            it is the attribute of all traces, i.e. of a time slice.
+        """
+        if intersections is not None and dim is not None:
+            raise ValueError('intersections and dim are exclusive')
+
+        arguments = f'kind: "{kind}"'
+        if dim is not None:
+            arguments += f', dim: {int(dim)}, lineno: {int(lineno)}'
+        if intersections is not None:
+            coords = [[int(i), int(j)] for i, j in intersections]
+            arguments += f', coords: {coords}'
+
+        query = f'''
+        query {{
+            cube(id: "{self.guid}") {{
+                attribute({arguments}) {{
+                    url
+                    key
+                }}
+            }}
+        }}
+        '''
+        proc = gschedule(
+            self.gclient,
+            self.session.base_url,
+            query,
+        )
+        proc.assembler = assembler_attribute(self, attribute = kind, dim = dim)
+        return proc
+
+    def subvolume(self, ranges, resolution = None):
+        """Fetch a sub-volume
+
+        Parameters
+        ----------
+
+        ranges : list of (first, last)
+            The inclusive range of every dimension, as line numbers for inline
+            and crossline, and time (or depth) for the vertical axis. Ranges
+            that reach outside the cube are clipped.
+        resolution : list of int, optional
+            The coarsest acceptable resolution, see slice()
+
+        Returns
+        -------
+        subvolume : numpy.ndarray
+        """
+        ranges = [[float(first), float(last)] for first, last in ranges]
+        query = f'''
+        query {{
+            cube(id: "{self.guid}") {{
+                subvolume(ranges: {ranges}{lod(resolution)}) {{
+                    url
+                    key
+                }}
+            }}
+        }}
+        '''
+        proc = gschedule(
+            self.gclient,
+            self.session.base_url,
+            query,
+        )
+        proc.assembler = assembler_subvolume(self)
+        return proc
+
 class process:
     """
 
@@ -423,14 +1020,15 @@ class process:
         """
         return self.withcompression(kind = 'gz')
 
-def gschedule(client, base_url, query):
+def gschedule(client, base_url, query, variables = None):
     """Schedule a job with GraphQL
 
     This is the graphql version of schedule(), which eventually will become
-    schedule().
+    schedule(). The variables are the values of the variables of the query,
+    if any.
     """
     q = gql.gql(query)
-    res = client.execute(q)
+    res = client.execute(q, variable_values = variables)
 
     for promise in res['cube'].values():
         url = promise['url']
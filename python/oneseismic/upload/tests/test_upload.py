@@ -7,6 +7,7 @@ from pathlib import Path
 from ...internal import localfs
 from ... import scan
 from .. import upload
+from ..upload import tiles
 
 # output generated by the scan program for the small.sgy file
 small_manifest = '''
@@ -212,3 +213,41 @@ def test_upload_scrambled_traces(tmp_path):
             from_scramble = f.read()
             from_orig     = g.read()
         assert from_scramble == from_orig
+
+def test_tiles_are_padded():
+    a = np.arange(3 * 5 * 2, dtype = np.float64).reshape(3, 5, 2)
+    split = dict(tiles(a, (2, 2)))
+    assert sorted(split.keys()) == [
+        (0, 0), (0, 1), (0, 2),
+        (1, 0), (1, 1), (1, 2),
+    ]
+    assert split[(0, 0)].shape == (2, 2, 2)
+    np.testing.assert_array_equal(split[(0, 1)], a[0:2, 2:4])
+    np.testing.assert_array_equal(split[(1, 2)][0, 0], a[2, 4])
+    np.testing.assert_array_equal(split[(1, 2)][1], 0)
+    np.testing.assert_array_equal(split[(1, 2)][0, 1], 0)
+
+def test_upload_writes_cdp_attribute(tmp_path):
+    filesys = localfs(tmp_path)
+    fragment_shape = (4, 4, 4)
+    meta = json.loads(small_manifest)
+    with open(source, 'rb') as src:
+        upload(meta, fragment_shape, src, filesys)
+
+    guid = meta['guid']
+    with open(tmp_path / Path(f'{guid}/manifest.json')) as f:
+        manifest = json.load(f)
+    assert manifest['attributes'] == [{
+        'file-extension': 'f64',
+        'type': 'cdp',
+        'layout': 'tiled',
+        'labels': ['cdpx', 'cdpy'],
+        'shapes': [[4, 4]],
+        'prefix': 'attributes/cdp',
+    }]
+
+    root = tmp_path / Path(f'{guid}/attributes/cdp/4-4')
+    uploaded = sorted([p.name for p in root.iterdir()])
+    assert uploaded == ['0-0.f64', '0-1.f64', '1-0.f64', '1-1.f64']
+    tile = np.fromfile(root / '0-0.f64', dtype = '<f8')
+    assert tile.size == 4 * 4 * 2
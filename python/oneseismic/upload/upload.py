@@ -176,6 +176,52 @@ class fileset:
 
         self.limits.update(limits)
 
+def cdp(header):
+    """World (CDP) coordinates of a trace
+
+    Parameters
+    ----------
+    header : segyio.Field
+
+    Returns
+    -------
+    x, y : float
+        The CDP coordinates, with the coordinate scalar applied
+    """
+    x = header[segyio.su.cdpx]
+    y = header[segyio.su.cdpy]
+    scalar = header[segyio.su.scalco]
+    if scalar > 0:
+        return x * scalar, y * scalar
+    if scalar < 0:
+        return x / -scalar, y / -scalar
+    return x, y
+
+def tiles(a, shape):
+    """Split a grid into tiles
+
+    Split the (inline, crossline, ...) grid of values into tiles of shape,
+    zero-padded at the edges. This is the layout of the tiled attributes.
+
+    Parameters
+    ----------
+    a : array_like
+    shape : tuple of int
+
+    Yields
+    ------
+    ident : (int, int)
+        The (i, j) tile ID
+    tile : np.array
+    """
+    a = np.asarray(a)
+    for i in range(0, a.shape[0], shape[0]):
+        for j in range(0, a.shape[1], shape[1]):
+            tile = np.zeros(tuple(shape) + a.shape[2:], dtype = a.dtype)
+            src = a[i:i + shape[0], j:j + shape[1]]
+            tile[:src.shape[0], :src.shape[1]] = src
+            yield (i // shape[0], j // shape[1]), tile
+
 def upload(manifest, fragment_shape, src, filesys):
     """Upload volume to oneseismic
 
@@ -216,6 +262,14 @@ def upload(manifest, fragment_shape, src, filesys):
     trace = np.array(1, dtype = dtype)
     fmt = manifest['format']
 
+    # The world coordinates of every trace are stored as a tiled attribute,
+    # in tiles of the lateral fragment shape. Traces that are not in the
+    # input are left at zero.
+    index1 = {k: i for i, k in enumerate(key1s)}
+    index2 = {k: i for i, k in enumerate(key2s)}
+    coordinates = np.zeros((len(key1s), len(key2s), 2), dtype = '<f8')
+    tileshape = fragment_shape[:2]
+
     files = fileset(key1s, key2s, key3s, fragment_shape)
     files.setlimits(manifest['key1-last-trace'])
     shapeident = '-'.join(map(str, fragment_shape))
@@ -235,6 +289,7 @@ def upload(manifest, fragment_shape, src, filesys):
         key1 = header[word1]
         key2 = header[word2]
         files.put(key1, key2, data)
+        coordinates[index1[key1], index2[key2]] = cdp(header)
         for ident, fragment in files.commit(key1):
             ident = '-'.join(map(str, ident))
             name = f'{prefix}/{ident}.f32'
@@ -242,6 +297,15 @@ def upload(manifest, fragment_shape, src, filesys):
             with filesys.open(name, mode = 'wb') as f:
                 f.write(fragment)
 
+    cdpprefix = 'attributes/cdp'
+    tileident = '-'.join(map(str, tileshape))
+    for ident, tile in tiles(coordinates, tileshape):
+        ident = '-'.join(map(str, ident))
+        name = f'{cdpprefix}/{tileident}/{ident}.f64'
+        print('uploading', name)
+        with filesys.open(name, mode = 'wb') as f:
+            f.write(tile.tobytes())
+
     manifest = {
         'format-version': 1,
         'guid': guid,
@@ -255,6 +319,14 @@ def upload(manifest, fragment_shape, src, filesys):
             },
         ],
         'attributes': [
+            {
+                'file-extension': 'f64',
+                'type': 'cdp',
+                'layout': 'tiled',
+                'labels': ['cdpx', 'cdpy'],
+                'shapes': [list(tileshape)],
+                'prefix': cdpprefix,
+            },
         ],
         'line-numbers': [
             key1s,
@@ -262,6 +334,10 @@ def upload(manifest, fragment_shape, src, filesys):
             key3s,
         ],
         'line-labels': ['inline', 'crossline', 'depth'],
+        # The sample interval and first sample of the vertical axis in
+        # milliseconds (or metres), while the scan is in microseconds
+        'sample-interval': manifest['sampleinterval'] / 1000,
+        'sample-start': key3s[0] / 1000,
     }
 
     with filesys.open('manifest.json', mode = 'wb') as f: